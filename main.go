@@ -1,11 +1,19 @@
 package main
 
 import (
-	"log"
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/joho/godotenv"
 
 	"github.com/YuarenArt/tg-users-database/pkg/db"
 	"github.com/YuarenArt/tg-users-database/pkg/handler"
+	"github.com/YuarenArt/tg-users-database/pkg/logger"
 	"github.com/YuarenArt/tg-users-database/pkg/scheduler"
+	"github.com/YuarenArt/tg-users-database/pkg/tracing"
 )
 
 // @title user Database API
@@ -23,10 +31,30 @@ import (
 // @BasePath /
 // @schemes https
 func main() {
+	// Load .env before building the logger so LOG_FORMAT and LOG_LEVEL can be set there
+	_ = godotenv.Load()
+	log, err := logger.FromEnv()
+	if err != nil {
+		log.Error("Invalid logging configuration", "error", err)
+		os.Exit(1)
+	}
+	slog.SetDefault(log)
+
+	// Tracing stays off unless an OTLP endpoint is configured
+	exporter, err := tracing.ExporterFromEnv(log)
+	if err != nil {
+		log.Error("Invalid tracing configuration", "error", err)
+		os.Exit(1)
+	}
+	if exporter != nil {
+		tracing.SetExporter(exporter)
+	}
+
 	// Initialize the database connection
-	database, err := db.NewDatabase("users.db")
+	database, err := db.NewDatabase("users.db", log)
 	if err != nil {
-		log.Fatalf("Failed to connect to the database: %v", err)
+		log.Error("Failed to connect to the database", "error", err)
+		os.Exit(1)
 	}
 	scheduler := scheduler.NewScheduler(database)
 	scheduler.Start()
@@ -35,8 +63,30 @@ func main() {
 	keyFile := "key.pem"
 
 	// Initialize the handler with the database
-	handler := handler.NewHandler(database)
+	handler := handler.NewHandler(database, scheduler, log)
+
+	// A co-located client can skip TCP and TLS by talking over a Unix socket
+	if socket := os.Getenv("LISTEN_SOCKET"); socket != "" {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err := handler.ServeUnix(ctx, socket)
+
+		// In-flight requests are done, so nothing uses the database any more
+		scheduler.Stop()
+		if closeErr := database.Close(); closeErr != nil {
+			log.Error("Failed to close the database", "error", closeErr)
+		}
+		if err != nil {
+			log.Error("Failed to serve on the Unix socket", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := handler.Router.RunTLS(":8082", certFile, keyFile); err != nil {
-		log.Fatalf("Failed to start the server: %v", err)
+		log.Error("Failed to start the server", "error", err)
+		scheduler.Stop()
+		database.Close()
+		os.Exit(1)
 	}
 }
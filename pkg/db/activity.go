@@ -0,0 +1,63 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const touchUserSQL = "UPDATE users SET last_active = $1 WHERE username = $2 AND deleted_at IS NULL"
+
+// TouchUser sets the last activity of the user to now.
+// A missing or deleted user is reported as ErrUserNotFound.
+func (db *Database) TouchUser(ctx context.Context, username string) error {
+	ctx, span := db.startSpan(ctx, "TouchUser", "UPDATE")
+	defer span.End()
+
+	result, err := db.DB.ExecContext(ctx, db.rebind(touchUserSQL), FormatTime(time.Now()), username)
+	if err != nil {
+		return fmt.Errorf("failed to execute touch statement: %w", err)
+	}
+	return checkUserAffected(result, username)
+}
+
+// touchUser sets the last activity of the user to now within tx after a change to their subscription.
+// Changes made by the scheduler are not the user's doing and leave it alone.
+func (db *Database) touchUser(ctx context.Context, tx *sql.Tx, username string, now time.Time) error {
+	if changeSource(ctx, "") == SourceScheduler {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, db.rebind(touchUserSQL), FormatTime(now), username); err != nil {
+		return fmt.Errorf("failed to update last activity: %w", err)
+	}
+	return nil
+}
+
+// InactiveUsers returns the users not active since the given time, including those never seen active,
+// ordered by username
+func (db *Database) InactiveUsers(ctx context.Context, since time.Time) ([]User, error) {
+	ctx, span := db.startSpan(ctx, "InactiveUsers", "SELECT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Retrieving inactive users", "since", FormatTime(since))
+	return db.users(ctx, db.dialect.inactiveUsersSQL, FormatTime(since))
+}
+
+// ErrInvalidTimeRange is returned when the start of a time range is after its end
+var ErrInvalidTimeRange = errors.New("invalid time range")
+
+// UsersCreatedBetween returns the users registered from from to to, both included, oldest first.
+// Users created before registration times were recorded are never returned.
+func (db *Database) UsersCreatedBetween(ctx context.Context, from, to time.Time) ([]User, error) {
+	ctx, span := db.startSpan(ctx, "UsersCreatedBetween", "SELECT")
+	defer span.End()
+
+	if from.After(to) {
+		return nil, fmt.Errorf("%w: %s is after %s", ErrInvalidTimeRange, FormatTime(from), FormatTime(to))
+	}
+
+	db.log.DebugContext(ctx, "Retrieving users created between", "from", FormatTime(from), "to", FormatTime(to))
+	return db.users(ctx, db.dialect.usersCreatedSQL, FormatTime(from), FormatTime(to))
+}
@@ -0,0 +1,216 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLastActive(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	if err := db.CreateUser(ctx, &User{Username: "testuser", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+	user, err := db.User(ctx, "testuser")
+	if err != nil || user.LastActive == nil {
+		t.Fatalf("Expected last_active on a new user: %v, got: %v", err, user)
+	}
+
+	// Move the activity into the past so that every update visibly advances it
+	past := time.Now().Add(-48 * time.Hour).UTC().Truncate(time.Second)
+	setLastActive := func() {
+		if _, err := db.DB.ExecContext(ctx, db.rebind("UPDATE users SET last_active = $1 WHERE username = $2"), FormatTime(past), "testuser"); err != nil {
+			t.Fatalf("Failed to set last_active: %v", err)
+		}
+	}
+	lastActive := func() time.Time {
+		user, err := db.User(ctx, "testuser")
+		if err != nil || user.LastActive == nil {
+			t.Fatalf("Expected last_active: %v, got: %v", err, user)
+		}
+		return *user.LastActive
+	}
+
+	setLastActive()
+	if err := db.UpdateUserTraffic(ctx, "testuser", 100); err != nil {
+		t.Fatalf("Failed to update traffic: %v", err)
+	}
+	if got := lastActive(); !got.After(past) {
+		t.Fatalf("Expected last_active after %v on traffic update, got: %v", past, got)
+	}
+
+	setLastActive()
+	chatID := int64(54321)
+	if err := db.UpdateUser(ctx, "testuser", UserPatch{ChatID: &chatID}); err != nil {
+		t.Fatalf("Failed to patch chat_id: %v", err)
+	}
+	if got := lastActive(); !got.Equal(past) {
+		t.Fatalf("Expected last_active unchanged by a chat_id patch: %v, got: %v", past, got)
+	}
+	traffic := 200.0
+	if err := db.UpdateUser(ctx, "testuser", UserPatch{Traffic: &traffic}); err != nil {
+		t.Fatalf("Failed to patch traffic: %v", err)
+	}
+	if got := lastActive(); !got.After(past) {
+		t.Fatalf("Expected last_active after %v on traffic patch, got: %v", past, got)
+	}
+
+	setLastActive()
+	if err := db.ResetUserTraffic(ctx, "testuser"); err != nil {
+		t.Fatalf("Failed to reset traffic: %v", err)
+	}
+	if got := lastActive(); !got.Equal(past) {
+		t.Fatalf("Expected last_active unchanged by a reset: %v, got: %v", past, got)
+	}
+
+	if err := db.ExtendSubscription(ctx, "testuser", 24*time.Hour); err != nil {
+		t.Fatalf("Failed to extend subscription: %v", err)
+	}
+	if got := lastActive(); !got.After(past) {
+		t.Fatalf("Expected last_active after %v on subscription change, got: %v", past, got)
+	}
+
+	setLastActive()
+	if err := db.CancelSubscription(WithChangeSource(ctx, SourceScheduler), "testuser"); err != nil {
+		t.Fatalf("Failed to cancel subscription: %v", err)
+	}
+	if got := lastActive(); !got.Equal(past) {
+		t.Fatalf("Expected last_active unchanged by the scheduler: %v, got: %v", past, got)
+	}
+
+	if err := db.TouchUser(ctx, "testuser"); err != nil {
+		t.Fatalf("Failed to touch user: %v", err)
+	}
+	if got := lastActive(); !got.After(past) {
+		t.Fatalf("Expected last_active after %v on touch, got: %v", past, got)
+	}
+
+	if err := db.TouchUser(ctx, "nonexistentuser"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected error: %v, got: %v", ErrUserNotFound, err)
+	}
+}
+
+func TestInactiveUsers(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			now := time.Now()
+			lastActive := map[string]*time.Time{
+				"recent":  timePtr(now.Add(-24 * time.Hour)),
+				"dormant": timePtr(now.AddDate(0, 0, -40)),
+				"never":   nil,
+				"deleted": timePtr(now.AddDate(0, 0, -40)),
+			}
+			for username, at := range lastActive {
+				if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+					t.Fatalf("Failed to create initial user: %v", err)
+				}
+				var value any
+				if at != nil {
+					value = FormatTime(*at)
+				}
+				if _, err := db.DB.ExecContext(ctx, db.rebind("UPDATE users SET last_active = $1 WHERE username = $2"), value, username); err != nil {
+					t.Fatalf("Failed to set last_active: %v", err)
+				}
+			}
+			if err := db.DeleteUser(ctx, "deleted"); err != nil {
+				t.Fatalf("Failed to delete user: %v", err)
+			}
+
+			users, err := db.InactiveUsers(ctx, now.AddDate(0, 0, -30))
+			if err != nil {
+				t.Fatalf("Failed to get inactive users: %v", err)
+			}
+			if len(users) != 2 || users[0].Username != "dormant" || users[1].Username != "never" {
+				t.Fatalf("Expected inactive users: [dormant never], got: %v", users)
+			}
+
+			users, err = db.InactiveUsers(ctx, now.AddDate(0, 0, -60))
+			if err != nil || len(users) != 1 || users[0].Username != "never" {
+				t.Fatalf("Expected inactive users: [never]: %v, got: %v", err, users)
+			}
+		})
+	}
+}
+
+func TestUsersCreatedBetween(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			// Registration is recorded on creation
+			before := time.Now().Add(-time.Second)
+			if err := db.CreateUser(ctx, &User{Username: "fresh_user", ChatID: 12345}); err != nil {
+				t.Fatalf("Failed to create initial user: %v", err)
+			}
+			user, err := db.User(ctx, "fresh_user")
+			if err != nil {
+				t.Fatalf("Failed to retrieve user: %v", err)
+			}
+			if user.CreatedAt == nil || user.CreatedAt.Before(before) {
+				t.Fatalf("Expected created_at after %v, got: %v", before, user.CreatedAt)
+			}
+
+			start := time.Date(2024, time.March, 1, 0, 0, 0, 0, time.UTC)
+			createdAt := map[string]*time.Time{
+				"february":    timePtr(start.AddDate(0, 0, -1)),
+				"march_first": timePtr(start),
+				"march_mid":   timePtr(start.AddDate(0, 0, 14)),
+				"april":       timePtr(start.AddDate(0, 1, 0)),
+				"unknown":     nil,
+				"deleted":     timePtr(start.AddDate(0, 0, 10)),
+			}
+			for username, at := range createdAt {
+				if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+					t.Fatalf("Failed to create initial user: %v", err)
+				}
+				var value any
+				if at != nil {
+					value = FormatTime(*at)
+				}
+				if _, err := db.DB.ExecContext(ctx, db.rebind("UPDATE users SET created_at = $1 WHERE username = $2"), value, username); err != nil {
+					t.Fatalf("Failed to set created_at: %v", err)
+				}
+			}
+			if err := db.DeleteUser(ctx, "deleted"); err != nil {
+				t.Fatalf("Failed to delete user: %v", err)
+			}
+
+			// Both ends are included
+			users, err := db.UsersCreatedBetween(ctx, start, start.AddDate(0, 1, 0).Add(-time.Second))
+			if err != nil {
+				t.Fatalf("Failed to get users created in March: %v", err)
+			}
+			if len(users) != 2 || users[0].Username != "march_first" || users[1].Username != "march_mid" {
+				t.Fatalf("Expected users created in March: [march_first march_mid], got: %v", users)
+			}
+
+			users, err = db.UsersCreatedBetween(ctx, start, start)
+			if err != nil || len(users) != 1 || users[0].Username != "march_first" {
+				t.Fatalf("Expected users created at the start of March: [march_first]: %v, got: %v", err, users)
+			}
+
+			if _, err := db.UsersCreatedBetween(ctx, start, start.Add(-time.Second)); !errors.Is(err, ErrInvalidTimeRange) {
+				t.Fatalf("Expected ErrInvalidTimeRange, got: %v", err)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
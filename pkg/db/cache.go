@@ -0,0 +1,157 @@
+package db
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultExistsCacheTTL is how long an existence check is cached when USER_EXISTS_CACHE_TTL is not set
+const defaultExistsCacheTTL = 30 * time.Second
+
+// existsCache is a least recently used cache of IsUserExists results.
+// A nil cache is disabled: lookups always miss and writes do nothing.
+type existsCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	now     func() time.Time
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type existsCacheEntry struct {
+	username string
+	exists   bool
+	expires  time.Time
+}
+
+// newExistsCache returns a cache holding up to size usernames for ttl each, or nil when size is not positive
+func newExistsCache(size int, ttl time.Duration) *existsCache {
+	if size <= 0 {
+		return nil
+	}
+	return &existsCache{
+		size:    size,
+		ttl:     ttl,
+		now:     time.Now,
+		order:   list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+// existsCacheFromEnv returns the cache configured by USER_EXISTS_CACHE_SIZE and USER_EXISTS_CACHE_TTL.
+// The cache is off unless USER_EXISTS_CACHE_SIZE is set.
+func existsCacheFromEnv() (*existsCache, error) {
+	size := 0
+	if value := os.Getenv("USER_EXISTS_CACHE_SIZE"); value != "" {
+		var err error
+		size, err = strconv.Atoi(value)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid USER_EXISTS_CACHE_SIZE %q: must be a non-negative integer", value)
+		}
+	}
+
+	ttl := defaultExistsCacheTTL
+	if value := os.Getenv("USER_EXISTS_CACHE_TTL"); value != "" {
+		var err error
+		ttl, err = time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return nil, fmt.Errorf("invalid USER_EXISTS_CACHE_TTL %q: must be a positive duration", value)
+		}
+	}
+
+	return newExistsCache(size, ttl), nil
+}
+
+// get returns the cached existence of username and whether there was an unexpired entry
+func (c *existsCache) get(username string) (exists, ok bool) {
+	if c == nil {
+		return false, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[username]
+	if !ok {
+		return false, false
+	}
+	entry := element.Value.(*existsCacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(element)
+		return false, false
+	}
+	c.order.MoveToFront(element)
+	return entry.exists, true
+}
+
+// load returns the cached existence of username, calling check and caching its result on a miss
+func (c *existsCache) load(username string, check func() (bool, error)) (bool, error) {
+	if exists, ok := c.get(username); ok {
+		return exists, nil
+	}
+	exists, err := check()
+	if err != nil {
+		return false, err
+	}
+	c.set(username, exists)
+	return exists, nil
+}
+
+// set caches the existence of username, evicting the least recently used entry when full
+func (c *existsCache) set(username string, exists bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := c.now().Add(c.ttl)
+	if element, ok := c.entries[username]; ok {
+		entry := element.Value.(*existsCacheEntry)
+		entry.exists, entry.expires = exists, expires
+		c.order.MoveToFront(element)
+		return
+	}
+
+	c.entries[username] = c.order.PushFront(&existsCacheEntry{username: username, exists: exists, expires: expires})
+	if c.order.Len() > c.size {
+		c.remove(c.order.Back())
+	}
+}
+
+// invalidate drops the cached existence of the usernames
+func (c *existsCache) invalidate(usernames ...string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, username := range usernames {
+		if element, ok := c.entries[username]; ok {
+			c.remove(element)
+		}
+	}
+}
+
+// clear drops every cached entry
+func (c *existsCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	clear(c.entries)
+}
+
+// remove drops element, the caller holds the lock
+func (c *existsCache) remove(element *list.Element) {
+	c.order.Remove(element)
+	delete(c.entries, element.Value.(*existsCacheEntry).username)
+}
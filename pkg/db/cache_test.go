@@ -0,0 +1,185 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExistsCacheFromEnv(t *testing.T) {
+	testCases := []struct {
+		name     string
+		size     string
+		ttl      string
+		wantSize int
+		wantTTL  time.Duration
+		wantErr  bool
+	}{
+		{name: "Disabled"},
+		{name: "Default TTL", size: "100", wantSize: 100, wantTTL: defaultExistsCacheTTL},
+		{name: "Custom TTL", size: "10", ttl: "5m", wantSize: 10, wantTTL: 5 * time.Minute},
+		{name: "Zero size", size: "0", ttl: "5m"},
+		{name: "Negative size", size: "-1", wantErr: true},
+		{name: "Invalid size", size: "many", wantErr: true},
+		{name: "Invalid TTL", size: "10", ttl: "soon", wantErr: true},
+		{name: "Zero TTL", size: "10", ttl: "0s", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("USER_EXISTS_CACHE_SIZE", tc.size)
+			t.Setenv("USER_EXISTS_CACHE_TTL", tc.ttl)
+			cache, err := existsCacheFromEnv()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if tc.wantSize == 0 {
+				if cache != nil {
+					t.Fatalf("Expected cache to be disabled, got: %+v", cache)
+				}
+				return
+			}
+			if cache == nil || cache.size != tc.wantSize || cache.ttl != tc.wantTTL {
+				t.Fatalf("Expected cache of %d entries for %v, got: %+v", tc.wantSize, tc.wantTTL, cache)
+			}
+		})
+	}
+}
+
+func TestExistsCache(t *testing.T) {
+	calls := 0
+	check := func(exists bool) func() (bool, error) {
+		return func() (bool, error) {
+			calls++
+			return exists, nil
+		}
+	}
+	load := func(t *testing.T, c *existsCache, username string, exists bool) {
+		t.Helper()
+		got, err := c.load(username, check(exists))
+		if err != nil {
+			t.Fatalf("Failed to load %s: %v", username, err)
+		}
+		if got != exists {
+			t.Fatalf("Expected %s to exist: %v, got: %v", username, exists, got)
+		}
+	}
+
+	t.Run("Hits", func(t *testing.T) {
+		calls = 0
+		c := newExistsCache(10, time.Minute)
+		load(t, c, "cached_user", true)
+		load(t, c, "cached_user", true)
+		load(t, c, "missing_user", false)
+		load(t, c, "missing_user", false)
+		if calls != 2 {
+			t.Fatalf("Expected 2 checks, got: %d", calls)
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		calls = 0
+		now := time.Now()
+		c := newExistsCache(10, time.Minute)
+		c.now = func() time.Time { return now }
+		load(t, c, "cached_user", true)
+		now = now.Add(time.Minute)
+		load(t, c, "cached_user", true)
+		if calls != 2 {
+			t.Fatalf("Expected expired entry to be checked again, got %d checks", calls)
+		}
+	})
+
+	t.Run("Eviction", func(t *testing.T) {
+		calls = 0
+		c := newExistsCache(2, time.Minute)
+		load(t, c, "user_one", true)
+		load(t, c, "user_two", true)
+		load(t, c, "user_one", true) // user_two is now the least recently used
+		load(t, c, "user_three", true)
+		if calls != 3 {
+			t.Fatalf("Expected 3 checks, got: %d", calls)
+		}
+		if _, ok := c.get("user_two"); ok {
+			t.Fatalf("Expected user_two to be evicted")
+		}
+		if _, ok := c.get("user_one"); !ok {
+			t.Fatalf("Expected user_one to stay cached")
+		}
+	})
+
+	t.Run("Invalidate", func(t *testing.T) {
+		calls = 0
+		c := newExistsCache(10, time.Minute)
+		load(t, c, "cached_user", true)
+		c.invalidate("cached_user")
+		load(t, c, "cached_user", false)
+		c.clear()
+		load(t, c, "cached_user", true)
+		if calls != 3 {
+			t.Fatalf("Expected 3 checks, got: %d", calls)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		calls = 0
+		var c *existsCache
+		load(t, c, "cached_user", true)
+		load(t, c, "cached_user", true)
+		c.invalidate("cached_user")
+		c.clear()
+		if calls != 2 {
+			t.Fatalf("Expected every lookup to be checked, got %d checks", calls)
+		}
+	})
+}
+
+func TestIsUserExistsCached(t *testing.T) {
+	t.Setenv("USER_EXISTS_CACHE_SIZE", "10")
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	exists := func(username string) bool {
+		t.Helper()
+		exists, err := db.IsUserExists(ctx, username)
+		if err != nil {
+			t.Fatalf("Failed to check if user exists: %v", err)
+		}
+		return exists
+	}
+
+	// A cached miss is dropped once the user is created
+	if exists("cached_user") {
+		t.Fatalf("Expected cached_user not to exist yet")
+	}
+	if err := db.CreateUser(ctx, &User{Username: "cached_user"}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	if !exists("cached_user") {
+		t.Fatalf("Expected cached_user to exist after creation")
+	}
+
+	// Changes made behind the database's back are not seen while the entry is cached
+	if _, err := db.DB.Exec("UPDATE users SET deleted_at = ? WHERE username = ?", FormatTime(time.Now()), "cached_user"); err != nil {
+		t.Fatalf("Failed to delete user directly: %v", err)
+	}
+	if !exists("cached_user") {
+		t.Fatalf("Expected cached_user to be served from the cache")
+	}
+	if _, err := db.DB.Exec("UPDATE users SET deleted_at = NULL WHERE username = ?", "cached_user"); err != nil {
+		t.Fatalf("Failed to restore user directly: %v", err)
+	}
+
+	// Deleting through the database invalidates the entry
+	if err := db.DeleteUser(ctx, "cached_user"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+	if exists("cached_user") {
+		t.Fatalf("Expected cached_user not to exist after deletion")
+	}
+}
@@ -5,98 +5,343 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"math"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
-
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
 )
 
 type User struct {
 	Username     string       `json:"username"`
 	Subscription Subscription `json:"subscription"`
-	Traffic      float64      `json:"traffic"`
-	ChatID       int64        `json:"chat_id"`
+	// Traffic is in MB and derived from TrafficBytes, which is what is stored.
+	// Writes use TrafficBytes when it is set and Traffic otherwise.
+	Traffic      float64    `json:"traffic"`
+	TrafficBytes int64      `json:"traffic_bytes"`
+	ChatID       int64      `json:"chat_id"`
+	DeletedAt    *time.Time `json:"deleted_at,omitempty"`
+	// LastActive is when traffic was last reported for the user or their subscription last changed
+	LastActive *time.Time `json:"last_active,omitempty"`
+	// CreatedAt is when the user was registered, unknown for users created before it was recorded
+	CreatedAt *time.Time `json:"created_at,omitempty"`
 }
 
 type Subscription struct {
-	ID                 int64     `json:"id"`
-	SubscriptionStatus string    `json:"subscription_status"` // active, inactive
-	Duration           string    `json:"duration"`            // month, year, forever
-	StartSubscription  time.Time `json:"start_subscription"`
-	EndSubscription    time.Time `json:"end_subscription"`
+	ID                 int64              `json:"id"`
+	SubscriptionStatus SubscriptionStatus `json:"subscription_status" binding:"omitempty,oneof=active inactive"` // active, inactive
+	Duration           string             `json:"duration" binding:"omitempty,subscription_duration"`            // month, year, forever
+	StartSubscription  time.Time          `json:"start_subscription"`
+	EndSubscription    time.Time          `json:"end_subscription"`
+	// AutoRenew rolls the subscription forward by its duration when it expires instead of marking it inactive
+	AutoRenew bool `json:"auto_renew"`
+}
+
+// SubscriptionStatus is the state of a subscription
+type SubscriptionStatus string
+
+const (
+	StatusActive   SubscriptionStatus = "active"
+	StatusInactive SubscriptionStatus = "inactive"
+)
+
+// nullableStatus returns the status read from a nullable column, taking NULL left by old rows as inactive
+func nullableStatus(status sql.NullString) SubscriptionStatus {
+	if !status.Valid {
+		return StatusInactive
+	}
+	return SubscriptionStatus(status.String)
+}
+
+// ErrInvalidSubscriptionStatus is returned when a subscription status is not one of the allowed values.
+var ErrInvalidSubscriptionStatus = errors.New("invalid subscription status")
+
+// Validate reports an error wrapping ErrInvalidSubscriptionStatus if s is not an allowed status.
+func (s SubscriptionStatus) Validate() error {
+	switch s {
+	case StatusActive, StatusInactive:
+		return nil
+	default:
+		return fmt.Errorf("%w %q: must be %q or %q", ErrInvalidSubscriptionStatus, string(s), StatusActive, StatusInactive)
+	}
+}
+
+// IsForever reports whether the subscription has the "forever" duration and so never ends.
+// Its end time is zero and must not be compared against.
+func (s Subscription) IsForever() bool {
+	return strings.EqualFold(strings.TrimSpace(s.Duration), DurationForever)
+}
+
+// RemainingDays returns how many days are left on the subscription at now, counting a started day as a whole one.
+// It is 0 once the subscription has ended and -1 for forever subscriptions.
+func (s Subscription) RemainingDays(now time.Time) int {
+	if s.IsForever() {
+		return -1
+	}
+	remaining := s.EndSubscription.Sub(now)
+	if remaining <= 0 {
+		return 0
+	}
+	return int((remaining + day - 1) / day)
+}
+
+// IsExpired reports whether the subscription period has ended by now, whatever its status.
+// Forever subscriptions never expire.
+func (s Subscription) IsExpired(now time.Time) bool {
+	return !s.IsForever() && !s.EndSubscription.After(now)
+}
+
+// IsActive reports whether the subscription is in use at now: it is marked active, has started and has not expired.
+func (s Subscription) IsActive(now time.Time) bool {
+	return s.SubscriptionStatus == StatusActive && !s.StartSubscription.After(now) && !s.IsExpired(now)
+}
+
+// ErrInvalidSubscriptionDates is returned when the start and end of a subscription do not form a valid period.
+var ErrInvalidSubscriptionDates = errors.New("invalid subscription dates")
+
+// validateDates reports an error wrapping ErrInvalidSubscriptionDates if the subscription ends before it starts
+// or is active without a start or an end. Forever subscriptions have no end and only need a start when active.
+func (s Subscription) validateDates() error {
+	forever := s.IsForever()
+
+	if s.SubscriptionStatus == StatusActive {
+		if s.StartSubscription.IsZero() {
+			return fmt.Errorf("%w: active subscription needs start_subscription", ErrInvalidSubscriptionDates)
+		}
+		if !forever && s.EndSubscription.IsZero() {
+			return fmt.Errorf("%w: active subscription needs end_subscription", ErrInvalidSubscriptionDates)
+		}
+	}
+
+	if !forever && !s.StartSubscription.IsZero() && !s.EndSubscription.IsZero() && !s.EndSubscription.After(s.StartSubscription) {
+		return fmt.Errorf("%w: end_subscription %s is not after start_subscription %s",
+			ErrInvalidSubscriptionDates, FormatTime(s.EndSubscription), FormatTime(s.StartSubscription))
+	}
+	return nil
+}
+
+// ErrUserNotFound is returned when the requested user does not exist or has been deleted.
+var ErrUserNotFound = errors.New("user not found")
+
+// userNotFoundError reports a missing user by name and matches ErrUserNotFound.
+// When err is set, e.g. to sql.ErrNoRows, it matches that error as well.
+type userNotFoundError struct {
+	username string
+	err      error
+}
+
+func (e *userNotFoundError) Error() string {
+	return fmt.Sprintf("user %s not found", e.username)
+}
+
+func (e *userNotFoundError) Is(target error) bool {
+	return target == ErrUserNotFound
+}
+
+func (e *userNotFoundError) Unwrap() error {
+	return e.err
+}
+
+// ErrUserExists is returned when creating a user whose username is already taken.
+var ErrUserExists = errors.New("user already exists")
+
+// userExistsError reports a taken username and matches ErrUserExists.
+type userExistsError struct {
+	username string
+	err      error
+}
+
+func (e *userExistsError) Error() string {
+	return fmt.Sprintf("user %s already exists", e.username)
+}
+
+func (e *userExistsError) Is(target error) bool {
+	return target == ErrUserExists
+}
+
+func (e *userExistsError) Unwrap() error {
+	return e.err
+}
+
+// pqUniqueViolation is the Postgres error code for unique constraint violations
+const pqUniqueViolation = "23505"
+
+// isUniqueViolation reports whether err was caused by a unique constraint on Postgres or SQLite.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == pqUniqueViolation
+	}
+	return strings.Contains(err.Error(), "UNIQUE constraint failed")
 }
 
 type Database struct {
-	DB *sql.DB
-	mu sync.Mutex
+	DB      *sql.DB
+	driver  string
+	dialect dialect
+	log     *slog.Logger
+
+	// replica serves user lookups, existence and status checks and the username list when DB_REPLICA_URL is set
+	replica *sql.DB
+
+	// maxTraffic is the largest traffic value in MB accepted on writes, set by MAX_TRAFFIC_MB
+	maxTraffic float64
+
+	// trafficQuota is the traffic in MB users are charged against, set by TRAFFIC_QUOTA_MB, see ChargeTraffic
+	trafficQuota float64
+
+	// defaults is the subscription given to users created without one, set by DEFAULT_SUBSCRIPTION_DURATION and DEFAULT_TRIAL
+	defaults subscriptionDefaults
+
+	// existsCache caches IsUserExists results when USER_EXISTS_CACHE_SIZE is set, nil otherwise
+	existsCache *existsCache
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 // SQL Queries
 const (
-	createTableUsers = `
-    CREATE TABLE IF NOT EXISTS users (
-        username TEXT PRIMARY KEY,
-        subscription_id SERIAL NOT NULL,
-        traffic REAL DEFAULT 0,
-        chat_id BIGINT,
-        FOREIGN KEY (subscription_id) REFERENCES subscriptions(id) ON DELETE CASCADE
-    );`
-
-	createTableSubscriptions = `
-    CREATE TABLE IF NOT EXISTS subscriptions (
-        id SERIAL PRIMARY KEY,
-        subscription_status TEXT DEFAULT 'inactive',
-        duration TEXT NOT NULL DEFAULT 'month',
-        start_subscription TIMESTAMP NOT NULL,
-        end_subscription TIMESTAMP NOT NULL
-    );`
-
-	selectUserSQL = `
-    		SELECT  users.username, users.traffic, users.chat_id, 
+	selectUsersSQL = `
+    		SELECT  users.username, users.traffic_bytes, users.chat_id, users.deleted_at, users.last_active, users.created_at,
            			subscriptions.id, subscriptions.subscription_status, 
-          			subscriptions.duration, subscriptions.start_subscription, subscriptions.end_subscription
+          			subscriptions.duration, subscriptions.start_subscription, subscriptions.end_subscription, subscriptions.auto_renew
     		FROM users 
-    		JOIN subscriptions ON users.subscription_id = subscriptions.id 
+    		JOIN subscriptions ON users.subscription_id = subscriptions.id`
+	selectUserWithDeletedSQL = selectUsersSQL + ` 
     		WHERE users.username = $1`
+	selectUserSQL = selectUserWithDeletedSQL + ` AND users.deleted_at IS NULL`
+
+	listUsersSQL = selectUsersSQL + ` 
+    		WHERE users.deleted_at IS NULL 
+    		ORDER BY users.username 
+    		LIMIT $1 OFFSET $2`
+
+	listUsersAfterSQL = selectUsersSQL + ` 
+    		WHERE users.deleted_at IS NULL AND users.username > $1 
+    		ORDER BY users.username 
+    		LIMIT $2`
+
+	activeSubscriptionsSQL = selectUsersSQL + ` 
+    		WHERE users.deleted_at IS NULL AND subscriptions.subscription_status = 'active' 
+    		ORDER BY users.username`
+
+	totalTrafficSQL    = "SELECT COALESCE(SUM(traffic_bytes), 0) FROM users WHERE deleted_at IS NULL"
+	topTrafficUsersSQL = selectUsersSQL + ` 
+    		WHERE users.deleted_at IS NULL 
+    		ORDER BY users.traffic_bytes DESC, users.username 
+    		LIMIT $1`
+	usersOverTrafficSQL = selectUsersSQL + ` 
+    		WHERE users.deleted_at IS NULL AND users.traffic_bytes > $1 
+    		ORDER BY users.traffic_bytes DESC, users.username`
+
+	// Durations are compared ignoring case and surrounding spaces, with the two spellings of a one-unit plan
+	usersByDurationSQL = selectUsersSQL + ` 
+    		WHERE users.deleted_at IS NULL AND LOWER(TRIM(subscriptions.duration)) IN ($1, $2) 
+    		ORDER BY users.username`
+
+	statusCountsSQL = `
+    		SELECT subscriptions.subscription_status, COUNT(*) 
+    		FROM users 
+    		JOIN subscriptions ON users.subscription_id = subscriptions.id 
+    		WHERE users.deleted_at IS NULL 
+    		GROUP BY subscriptions.subscription_status`
 
 	updateUserSubscriptionSQL = `
     		UPDATE subscriptions 
         	SET subscription_status = $1, duration = $2, start_subscription = $3, end_subscription = $4
-        	WHERE id = (SELECT subscription_id FROM users WHERE username = $5)`
+        	WHERE id = (SELECT subscription_id FROM users WHERE username = $5 AND deleted_at IS NULL)`
+
+	cancelSubscriptionSQL = `
+    		UPDATE subscriptions 
+        	SET subscription_status = 'inactive', end_subscription = $1
+        	WHERE id = (SELECT subscription_id FROM users WHERE username = $2 AND deleted_at IS NULL)`
 
 	userSubscriptionStatusSQL = `
 			SELECT subscriptions.subscription_status 
 			FROM users 
 			JOIN subscriptions ON users.subscription_id = subscriptions.id 
-			WHERE users.username = $1`
+			WHERE users.username = $1 AND users.deleted_at IS NULL`
+
+	userSubscriptionSQL = `
+			SELECT subscriptions.id, subscriptions.subscription_status, subscriptions.duration,
+			       subscriptions.start_subscription, subscriptions.end_subscription, subscriptions.auto_renew
+			FROM users 
+			JOIN subscriptions ON users.subscription_id = subscriptions.id 
+			WHERE users.username = $1 AND users.deleted_at IS NULL`
 
 	deleteSubscriptionIfUnusedSQL = `
             DELETE FROM subscriptions 
             WHERE id = $1 AND NOT EXISTS (SELECT 1 FROM users WHERE subscription_id = $1)`
-	unusedSubscriptionsSQL = `
-            SELECT id FROM subscriptions 
+	deleteUnusedSubscriptionsSQL = `
+            DELETE FROM subscriptions 
             WHERE NOT EXISTS (SELECT 1 FROM users WHERE users.subscription_id = subscriptions.id)`
 
-	insertUserSQL        = "INSERT INTO users (username, subscription_id, chat_id) VALUES ($1, $2, $3)"
-	deleteUserSQL        = "DELETE FROM users WHERE username = $1"
-	userExistsSQL        = "SELECT EXISTS(SELECT 1 FROM users WHERE username = $1)"
-	addSubscription      = "INSERT INTO subscriptions (subscription_status, duration, start_subscription, end_subscription) VALUES ($1, $2, $3, $4) RETURNING id"
+	// Users go first, their subscriptions are referenced by them
+	truncateUsersSQL         = "DELETE FROM users"
+	truncateSubscriptionsSQL = "DELETE FROM subscriptions"
+
+	insertUserSQL        = "INSERT INTO users (username, subscription_id, chat_id, traffic_bytes, last_active, created_at) VALUES ($1, $2, $3, $4, $5, $5)"
+	softDeleteUserSQL    = "UPDATE users SET deleted_at = $1 WHERE username = $2 AND deleted_at IS NULL"
+	hardDeleteUserSQL    = "DELETE FROM users WHERE username = $1 RETURNING subscription_id"
+	userExistsSQL        = "SELECT EXISTS(SELECT 1 FROM users WHERE username = $1 AND deleted_at IS NULL)"
+	addSubscription      = "INSERT INTO subscriptions (subscription_status, duration, start_subscription, end_subscription, auto_renew) VALUES ($1, $2, $3, $4, $5) RETURNING id"
 	subscriptionId       = "SELECT subscription_id FROM users WHERE username = $1"
-	updateUserTrafficSQL = "UPDATE users SET traffic = $1 WHERE username = $2"
-	allUsername          = "SELECT username FROM users"
+	updateUserTrafficSQL = "UPDATE users SET traffic_bytes = $1, last_active = $3 WHERE username = $2 AND deleted_at IS NULL"
+	resetUserTrafficSQL  = "UPDATE users SET traffic_bytes = 0 WHERE username = $1 AND deleted_at IS NULL"
+	allUsername          = "SELECT username FROM users WHERE deleted_at IS NULL"
+
+	usernamesByStatusSQL = `
+			SELECT users.username 
+			FROM users 
+			JOIN subscriptions ON users.subscription_id = subscriptions.id 
+			WHERE subscriptions.subscription_status = $1 AND users.deleted_at IS NULL`
+
+	upsertUserSQL = insertUserSQL + `
+    		ON CONFLICT (username) DO UPDATE
+    		SET subscription_id = excluded.subscription_id, chat_id = excluded.chat_id,
+    		    traffic_bytes = excluded.traffic_bytes, last_active = excluded.last_active, deleted_at = NULL`
+
+	// Deleted users are left alone, so no row is returned for them
+	upsertUserTrafficSQL = insertUserSQL + `
+    		ON CONFLICT (username) DO UPDATE
+    		SET traffic_bytes = excluded.traffic_bytes, last_active = excluded.last_active
+    		WHERE users.deleted_at IS NULL
+    		RETURNING subscription_id`
 )
 
 const timeFormat = time.RFC3339
 
+// legacyTimeFormats are also accepted when reading timestamps,
+// as rows written by older versions or edited by hand may use them
+var legacyTimeFormats = []string{time.RFC3339Nano, "2006-01-02 15:04:05"}
+
 func FormatTime(t time.Time) string {
 	return t.Format(timeFormat)
 }
 
+// parseTime parses a timestamp read from column, falling back to legacyTimeFormats with a warning.
+// Timestamps without a zone are taken as UTC.
+func (db *Database) parseTime(ctx context.Context, column, value string) (time.Time, error) {
+	t, err := time.Parse(timeFormat, value)
+	if err == nil {
+		return t, nil
+	}
+
+	for _, layout := range legacyTimeFormats {
+		if legacy, legacyErr := time.Parse(layout, value); legacyErr == nil {
+			db.log.WarnContext(ctx, "Timestamp not in RFC3339 format", "column", column, "value", value)
+			return legacy, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("failed to parse %s: %w", column, err)
+}
+
 var dbInitMu sync.Mutex
 
 /*
@@ -105,16 +350,134 @@ var (
 	pgOnce     sync.Once
 )
 */
-// NewDatabase initializes and returns a new Database instance
-func NewDatabase(dataSourceName string) (*Database, error) {
+// NewDatabase initializes and returns a new Database instance using the driver selected by DB_DRIVER
+// ("postgres" by default, or "sqlite"). For SQLite, dataSourceName is the database file.
+// If logger is nil, slog.Default() is used.
+func NewDatabase(dataSourceName string, logger *slog.Logger) (*Database, error) {
+	driver := os.Getenv("DB_DRIVER")
+	if driver == "" {
+		driver = DriverPostgres
+	}
+	return NewDatabaseWithDriver(driver, dataSourceName, logger)
+}
+
+// NewDatabaseWithDriver initializes and returns a new Database instance using the given driver.
+// Postgres connection settings are read from the environment and dataSourceName is ignored,
+// SQLite opens dataSourceName, which may be ":memory:".
+// If logger is nil, slog.Default() is used.
+func NewDatabaseWithDriver(driver, dataSourceName string, logger *slog.Logger) (*Database, error) {
+	return newDatabase(driver, dataSourceName, defaultRetryPolicy, logger)
+}
+
+// NewDatabaseWithRetry works like NewDatabase but waits for the database to come up,
+// making up to attempts connection attempts. The wait starts at backoff and doubles after every attempt.
+// Only connection failures are retried, authentication errors are returned immediately.
+func NewDatabaseWithRetry(dataSourceName string, attempts int, backoff time.Duration, logger *slog.Logger) (*Database, error) {
+	driver := os.Getenv("DB_DRIVER")
+	if driver == "" {
+		driver = DriverPostgres
+	}
+	return newDatabase(driver, dataSourceName, retryPolicy{attempts: attempts, backoff: backoff}, logger)
+}
+
+func newDatabase(driver, dataSourceName string, retry retryPolicy, logger *slog.Logger) (*Database, error) {
 	dbInitMu.Lock()
 	defer dbInitMu.Unlock()
 
-	log.Println("Opening database connection...")
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	dialect, ok := dialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+
+	maxTraffic, err := maxTrafficFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	trafficQuota, err := trafficQuotaFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	defaults, err := subscriptionDefaultsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	existsCache, err := existsCacheFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Opening database connection...", "driver", driver)
+
+	var db *sql.DB
+	var password string
+	switch driver {
+	case DriverSQLite:
+		db, err = openSQLite(dataSourceName)
+	default:
+		db, password, err = openPostgres(retry, logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	replica, err := openReplica(driver)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Create a new Database instance
+	newDB := &Database{
+		DB:           db,
+		driver:       driver,
+		dialect:      dialect,
+		log:          logger,
+		replica:      replica,
+		maxTraffic:   maxTraffic,
+		trafficQuota: trafficQuota,
+		defaults:     defaults,
+		existsCache:  existsCache,
+	}
+
+	// Bring the schema up to date
+	err = newDB.migrate(context.Background())
+	if err != nil {
+		return nil, redactError(fmt.Errorf("failed to migrate database: %w", err), password)
+	}
+
+	// Catch schemas changed by hand since the migrations ran
+	err = newDB.VerifySchema(context.Background())
+	if err != nil {
+		return nil, redactError(err, password)
+	}
+
+	// Clean up unused subscriptions
+	// A growing count points at subscriptions leaking while the service runs
+	removed, err := newDB.CleanupUnusedSubscriptions(context.Background())
+	if err != nil {
+		return nil, redactError(fmt.Errorf("failed to clean up unused subscriptions: %w", err), password)
+	}
+	logger.Info("Unused subscriptions cleaned up", "count", removed)
+
+	logger.Info("Database connection established successfully.")
+
+	return newDB, nil
+}
 
+// openPostgres creates the users database if needed and connects to it.
+// It also returns the password so callers can redact it from errors.
+func openPostgres(retry retryPolicy, logger *slog.Logger) (*sql.DB, string, error) {
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		logger.Error("Error loading .env file", "error", err)
+		os.Exit(1)
 	}
 
 	user := os.Getenv("DB_USER")
@@ -128,18 +491,23 @@ func NewDatabase(dataSourceName string) (*Database, error) {
 		user, password, host, port, sslmode,
 	)
 
-	log.Println("defaultConnStr: ", defaultConnStr)
+	logger.Info("Connecting to default database", "conn_str", redactConnStr(defaultConnStr))
 
 	defaultDB, err := sql.Open("postgres", defaultConnStr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open default database: %w", err)
+		return nil, password, redactError(fmt.Errorf("failed to open default database: %w", err), password)
 	}
 	defer defaultDB.Close()
 
+	// The server may still be starting, e.g. right after a deploy
+	if err := pingWithRetry(context.Background(), defaultDB, retry, logger); err != nil {
+		return nil, password, redactError(fmt.Errorf("failed to connect to the default database: %w", err), password)
+	}
+
 	// Create the new database
 	_, err = defaultDB.Exec("CREATE DATABASE users")
 	if err != nil && err.Error() != "pq: database \"users\" already exists" {
-		log.Printf("failed to create database: %s", err.Error())
+		logger.Warn("failed to create database", "error", redactError(err, password))
 	}
 
 	// Connect to the newly created database
@@ -149,289 +517,1336 @@ func NewDatabase(dataSourceName string) (*Database, error) {
 	)
 	db, err := sql.Open("postgres", ConnStr)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to the new database: %w", err)
+		return nil, password, redactError(fmt.Errorf("failed to connect to the new database: %w", err), password)
+	}
+
+	if err := configurePool(db); err != nil {
+		db.Close()
+		return nil, password, err
 	}
 
-	db.SetMaxOpenConns(25)
-	db.SetMaxIdleConns(25)
-	db.SetConnMaxLifetime(time.Hour)
+	return db, password, nil
+}
+
+// openSQLite opens the SQLite database file with foreign keys enforced.
+// SQLite allows a single writer and every connection to ":memory:" is a separate database,
+// so the pool is limited to one connection.
+func openSQLite(dataSourceName string) (*sql.DB, error) {
+	if dataSourceName == "" {
+		return nil, errors.New("sqlite requires a database file")
+	}
 
-	// Initialize subscriptions table
-	_, err = db.Exec(createTableSubscriptions)
+	separator := "?"
+	if strings.Contains(dataSourceName, "?") {
+		separator = "&"
+	}
+	db, err := sql.Open("sqlite3", dataSourceName+separator+"_foreign_keys=on&_busy_timeout=5000")
 	if err != nil {
-		return nil, fmt.Errorf("failed to create subscriptions table: %w", err)
+		return nil, fmt.Errorf("failed to open sqlite database: %w", err)
 	}
 
-	// Initialize users table
-	_, err = db.Exec(createTableUsers)
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+	db.SetConnMaxLifetime(0)
+
+	return db, nil
+}
+
+// CleanupUnusedSubscriptions deletes the subscriptions no user refers to and returns how many were removed
+func (db *Database) CleanupUnusedSubscriptions(ctx context.Context) (int, error) {
+	ctx, span := db.startSpan(ctx, "CleanupUnusedSubscriptions", "DELETE")
+	defer span.End()
+
+	result, err := db.DB.ExecContext(ctx, db.rebind(deleteUnusedSubscriptionsSQL))
 	if err != nil {
-		return nil, fmt.Errorf("failed to create users table: %w", err)
+		return 0, fmt.Errorf("failed to delete unused subscriptions: %w", err)
 	}
 
-	// Create a new Database instance
-	newDB := &Database{
-		DB: db,
+	removed, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get affected rows: %w", err)
 	}
+	return int(removed), nil
+}
 
-	// Clean up unused subscriptions
-	err = newDB.cleanupUnusedSubscriptions(context.Background())
+// defaultSubscription is the inactive subscription given to users created by a traffic report
+func defaultSubscription(now time.Time) Subscription {
+	return Subscription{
+		SubscriptionStatus: StatusInactive,
+		Duration:           "month",
+		StartSubscription:  now,
+	}
+}
+
+// addSubscription inserts the subscription into the subscriptions table within tx and returns its ID
+func (db *Database) addSubscription(ctx context.Context, tx *sql.Tx, subscription Subscription) (int64, error) {
+	stmt, err := tx.PrepareContext(ctx, db.rebind(addSubscription))
 	if err != nil {
-		return nil, fmt.Errorf("failed to clean up unused subscriptions: %w", err)
+		return 0, fmt.Errorf("failed to prepare subscription insert statement: %w", err)
 	}
+	defer stmt.Close()
 
-	log.Println("Database connection established successfully.")
+	startSubscription := FormatTime(subscription.StartSubscription)
+	endSubscription := FormatTime(subscription.EndSubscription)
 
-	return newDB, nil
+	var subscriptionID int64
+	err = stmt.QueryRowContext(ctx, subscription.SubscriptionStatus, subscription.Duration, startSubscription, endSubscription, subscription.AutoRenew).
+		Scan(&subscriptionID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to execute subscription insert statement: %w", err)
+	}
+	return subscriptionID, nil
+}
+
+// CreateUser adds a new user to the database.
+// The user's subscription is stored when its status is set, otherwise the user starts with an inactive monthly one,
+// or the default set by DEFAULT_SUBSCRIPTION_DURATION and DEFAULT_TRIAL.
+// The subscription and the user are inserted in one transaction, so a failed user insert leaves no subscription behind.
+func (db *Database) CreateUser(ctx context.Context, user *User) error {
+	ctx, span := db.startSpan(ctx, "CreateUser", "INSERT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Preparing to insert user", "username", user.Username)
+
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		return db.insertUser(ctx, tx, user, time.Now())
+	})
+	db.existsCache.invalidate(user.Username)
+	if err != nil {
+		return err
+	}
+
+	db.log.DebugContext(ctx, "User created successfully", "username", user.Username)
+	return nil
 }
 
-// cleanupUnusedSubscriptions deletes all unused subscriptions
-func (db *Database) cleanupUnusedSubscriptions(ctx context.Context) error {
-	rows, err := db.DB.QueryContext(ctx, unusedSubscriptionsSQL)
+// UpsertUser creates the user like CreateUser or, if the username is already taken, replaces that user:
+// chat_id and traffic are taken from user, the subscription is replaced like on creation
+// and a soft-deleted user is restored. It reports whether the user was created.
+func (db *Database) UpsertUser(ctx context.Context, user *User) (bool, error) {
+	ctx, span := db.startSpan(ctx, "UpsertUser", "INSERT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Preparing to upsert user", "username", user.Username)
+
+	traffic, err := db.userTrafficBytes(user)
 	if err != nil {
-		return fmt.Errorf("failed to execute unused subscriptions query: %w", err)
+		return false, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var subscriptionID int64
-		if err := rows.Scan(&subscriptionID); err != nil {
-			return fmt.Errorf("failed to scan row: %w", err)
+	var created bool
+	err = db.withTx(ctx, func(tx *sql.Tx) error {
+		var oldSubscriptionID int64
+		err := tx.QueryRowContext(ctx, db.rebind(subscriptionId), user.Username).Scan(&oldSubscriptionID)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to get subscription ID: %w", err)
+		}
+		created = errors.Is(err, sql.ErrNoRows)
+		if created {
+			if err := validateUsername(user.Username); err != nil {
+				return err
+			}
 		}
 
-		stmt, err := db.DB.PrepareContext(ctx, deleteSubscriptionIfUnusedSQL)
+		now := time.Now()
+		subscriptionID, err := db.addUserSubscription(ctx, tx, user, now)
 		if err != nil {
-			return fmt.Errorf("failed to prepare delete subscription statement: %w", err)
+			return err
 		}
-		defer stmt.Close()
 
-		_, err = stmt.ExecContext(ctx, subscriptionID)
+		_, err = tx.ExecContext(ctx, db.rebind(upsertUserSQL), user.Username, subscriptionID, user.ChatID, traffic, FormatTime(now))
 		if err != nil {
-			return fmt.Errorf("failed to execute delete subscription statement: %w", err)
+			return fmt.Errorf("failed to execute upsert statement: %w", err)
+		}
+
+		// The replaced subscription is no longer referenced
+		if !created {
+			if _, err := tx.ExecContext(ctx, db.rebind(deleteSubscriptionIfUnusedSQL), oldSubscriptionID); err != nil {
+				return fmt.Errorf("failed to delete replaced subscription: %w", err)
+			}
 		}
+		return nil
+	})
+	db.existsCache.invalidate(user.Username)
+	if err != nil {
+		return false, err
 	}
 
-	if err := rows.Err(); err != nil {
-		return fmt.Errorf("row iteration error: %w", err)
+	db.log.DebugContext(ctx, "User upserted successfully", "username", user.Username, "created", created)
+	return created, nil
+}
+
+// CreateUsers adds all users in one transaction, so either every user is created or none is.
+// Each user is stored like CreateUser stores it. Errors name the position of the failing user.
+func (db *Database) CreateUsers(ctx context.Context, users []User) error {
+	ctx, span := db.startSpan(ctx, "CreateUsers", "INSERT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Preparing to insert users", "count", len(users))
+
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		now := time.Now()
+		for i := range users {
+			if err := db.insertUser(ctx, tx, &users[i], now); err != nil {
+				return fmt.Errorf("user %d (%s): %w", i+1, users[i].Username, err)
+			}
+		}
+		return nil
+	})
+	for i := range users {
+		db.existsCache.invalidate(users[i].Username)
+	}
+	if err != nil {
+		return err
 	}
 
+	db.log.DebugContext(ctx, "Users created successfully", "count", len(users))
 	return nil
 }
 
-// addSubscription inserts a new empty subscription into the subscriptions table
-func (db *Database) addSubscription(ctx context.Context) (int64, error) {
-	stmt, err := db.DB.PrepareContext(ctx, addSubscription)
+// addUserSubscription validates the subscription of a new user and inserts it within tx.
+// The user's subscription is used when its status is set, otherwise the default one
+// configured by DEFAULT_SUBSCRIPTION_DURATION and DEFAULT_TRIAL.
+func (db *Database) addUserSubscription(ctx context.Context, tx *sql.Tx, user *User, now time.Time) (int64, error) {
+	subscription, err := db.defaults.subscription(now)
 	if err != nil {
-		return 0, fmt.Errorf("failed to prepare subscription insert statement: %w", err)
+		return 0, err
+	}
+	if status := user.Subscription.SubscriptionStatus; status != "" {
+		if err := status.Validate(); err != nil {
+			return 0, err
+		}
+		subscription = user.Subscription
+		if err := subscription.applyDuration(now); err != nil {
+			return 0, fmt.Errorf("failed to apply subscription duration: %w", err)
+		}
+		if err := subscription.validateDates(); err != nil {
+			return 0, err
+		}
 	}
-	defer stmt.Close()
-
-	startSubscription := FormatTime(time.Now())
-	endSubscription := FormatTime(time.Time{})
-	duration := "month"
-	suscriptionStatus := "inactive"
 
-	var subscriptionID int64
-	err = stmt.QueryRowContext(ctx, suscriptionStatus, duration, startSubscription, endSubscription).Scan(&subscriptionID)
+	subscriptionID, err := db.addSubscription(ctx, tx, subscription)
 	if err != nil {
-		return 0, fmt.Errorf("failed to execute subscription insert statement: %w", err)
+		return 0, fmt.Errorf("failed to add subscription: %w", err)
 	}
 	return subscriptionID, nil
 }
 
-// CreateUser adds a new user to the database
-func (db *Database) CreateUser(ctx context.Context, user *User) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-
-	log.Printf("Preparing to insert user: %s", user.Username)
-
-	if strings.TrimSpace(user.Username) == "" {
-		return errors.New("unsupported username")
+// insertUser validates the user and inserts it with its subscription within tx
+func (db *Database) insertUser(ctx context.Context, tx *sql.Tx, user *User, now time.Time) error {
+	if err := validateUsername(user.Username); err != nil {
+		return err
+	}
+	traffic, err := db.userTrafficBytes(user)
+	if err != nil {
+		return err
 	}
 
-	subscriptionID, err := db.addSubscription(ctx)
+	subscriptionID, err := db.addUserSubscription(ctx, tx, user, now)
 	if err != nil {
-		return fmt.Errorf("failed to add subscription: %w", err)
+		return err
 	}
 
-	stmt, err := db.DB.PrepareContext(ctx, insertUserSQL)
+	stmt, err := tx.PrepareContext(ctx, db.rebind(insertUserSQL))
 	if err != nil {
 		return fmt.Errorf("failed to prepare insert statement: %w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.ExecContext(ctx, user.Username, subscriptionID, user.ChatID)
+	_, err = stmt.ExecContext(ctx, user.Username, subscriptionID, user.ChatID, traffic, FormatTime(now))
 	if err != nil {
+		if isUniqueViolation(err) {
+			return &userExistsError{username: user.Username, err: err}
+		}
 		return fmt.Errorf("failed to execute insert statement: %w", err)
 	}
-
-	log.Printf("User %s created successfully.", user.Username)
 	return nil
 }
 
-// User retrieves a user by Telegram username
+// User retrieves a user by Telegram username.
+// A missing or deleted user is reported as ErrUserNotFound.
 func (db *Database) User(ctx context.Context, username string) (*User, error) {
+	ctx, span := db.startSpan(ctx, "User", "SELECT")
+	defer span.End()
 
-	log.Printf("Retrieving user: %s", username)
-	var usr User
-	var sub Subscription
+	return db.user(ctx, selectUserSQL, username)
+}
+
+// UserIncludingDeleted retrieves a user by Telegram username, including soft-deleted users.
+// A missing user is reported as ErrUserNotFound.
+func (db *Database) UserIncludingDeleted(ctx context.Context, username string) (*User, error) {
+	ctx, span := db.startSpan(ctx, "UserIncludingDeleted", "SELECT")
+	defer span.End()
+
+	return db.user(ctx, selectUserWithDeletedSQL, username)
+}
+
+func (db *Database) user(ctx context.Context, query, username string) (*User, error) {
+
+	db.log.DebugContext(ctx, "Retrieving user", "username", username)
+
+	var usr *User
+	err := db.read(ctx, func(q queryer) error {
+		var err error
+		usr, err = db.scanUser(ctx, q.QueryRowContext(ctx, db.rebind(query), username))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		db.log.DebugContext(ctx, "User not found", "username", username)
+		return nil, &userNotFoundError{username: username, err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	db.log.DebugContext(ctx, "User retrieved", "username", username)
+	return usr, nil
+}
+
+// users runs a query selecting the columns of selectUsersSQL and returns the users found
+func (db *Database) users(ctx context.Context, query string, args ...any) ([]User, error) {
+	rows, err := db.DB.QueryContext(ctx, db.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute query: %w", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		usr, err := db.scanUser(ctx, rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *usr)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("row iteration error: %w", err)
+	}
+
+	return users, nil
+}
 
-	row := db.DB.QueryRowContext(ctx, selectUserSQL, username)
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...any) error
+}
 
+// scanUser reads a user with its subscription from a row selected by selectUsersSQL.
+// sql.ErrNoRows is returned as is.
+func (db *Database) scanUser(ctx context.Context, row rowScanner) (*User, error) {
+	var usr User
+	var sub Subscription
 	var startSubscription, endSubscription string
+	var status, deletedAt, lastActive, createdAt sql.NullString
 
 	err := row.Scan(
 		&usr.Username,
-		&usr.Traffic,
+		&usr.TrafficBytes,
 		&usr.ChatID,
+		&deletedAt,
+		&lastActive,
+		&createdAt,
 		&sub.ID,
-		&sub.SubscriptionStatus,
+		&status,
 		&sub.Duration,
 		&startSubscription,
 		&endSubscription,
+		&sub.AutoRenew,
 	)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			log.Printf("User %s not found.", username)
 			return nil, err
 		}
 		return nil, fmt.Errorf("failed to scan row: %w", err)
 	}
+	usr.Traffic = MBFromBytes(usr.TrafficBytes)
 
-	sub.StartSubscription, err = time.Parse(timeFormat, startSubscription)
+	sub.SubscriptionStatus = nullableStatus(status)
+
+	sub.StartSubscription, err = db.parseTime(ctx, "start_subscription", startSubscription)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse start_subscription: %w", err)
+		return nil, err
 	}
 
-	sub.EndSubscription, err = time.Parse(timeFormat, endSubscription)
+	sub.EndSubscription, err = db.parseTime(ctx, "end_subscription", endSubscription)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse end_subscription: %w", err)
+		return nil, err
+	}
+
+	if deletedAt.Valid {
+		t, err := db.parseTime(ctx, "deleted_at", deletedAt.String)
+		if err != nil {
+			return nil, err
+		}
+		usr.DeletedAt = &t
+	}
+
+	if lastActive.Valid {
+		t, err := db.parseTime(ctx, "last_active", lastActive.String)
+		if err != nil {
+			return nil, err
+		}
+		usr.LastActive = &t
+	}
+
+	if createdAt.Valid {
+		t, err := db.parseTime(ctx, "created_at", createdAt.String)
+		if err != nil {
+			return nil, err
+		}
+		usr.CreatedAt = &t
 	}
 
 	usr.Subscription = sub
-	log.Printf("User retrieved: %s", username)
 	return &usr, nil
 }
 
-// UpdateUserSubscription updates a user's subscription status
+// UpdateUserSubscription updates a user's subscription status.
+// The change is recorded in the subscription history in the same transaction.
 func (db *Database) UpdateUserSubscription(ctx context.Context, username string, newSubscription Subscription) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	ctx, span := db.startSpan(ctx, "UpdateUserSubscription", "UPDATE")
+	defer span.End()
 
-	log.Printf("Updating user: %s", username)
+	db.log.DebugContext(ctx, "Updating user", "username", username)
 
-	exists, err := db.IsUserExists(ctx, username)
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		return db.updateSubscription(ctx, tx, username, newSubscription)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to check if user exists: %w", err)
+		return err
 	}
-	if !exists {
-		return fmt.Errorf("user %s not found", username)
+
+	db.log.DebugContext(ctx, "User updated successfully", "username", username)
+	return nil
+}
+
+// updateSubscription validates the subscription, stores it as the user's subscription
+// and records the change in the subscription history within tx
+func (db *Database) updateSubscription(ctx context.Context, tx *sql.Tx, username string, newSubscription Subscription) error {
+	if err := newSubscription.SubscriptionStatus.Validate(); err != nil {
+		return err
 	}
 
-	stmt, err := db.DB.PrepareContext(ctx, updateUserSubscriptionSQL)
-	if err != nil {
-		return fmt.Errorf("failed to prepare update statement: %w", err)
+	// Derive the end date when only the duration is given
+	now := time.Now()
+	if err := newSubscription.applyDuration(now); err != nil {
+		return fmt.Errorf("failed to apply subscription duration: %w", err)
+	}
+	if err := newSubscription.validateDates(); err != nil {
+		return err
+	}
+
+	oldStatus, err := db.currentStatus(ctx, tx, username)
+	if err != nil {
+		return err
 	}
-	defer stmt.Close()
 
 	startSubscription := FormatTime(newSubscription.StartSubscription)
 	endSubscription := FormatTime(newSubscription.EndSubscription)
 
-	_, err = stmt.ExecContext(ctx, newSubscription.SubscriptionStatus, newSubscription.Duration, startSubscription, endSubscription, username)
+	result, err := tx.ExecContext(ctx, db.rebind(updateUserSubscriptionSQL),
+		newSubscription.SubscriptionStatus, newSubscription.Duration, startSubscription, endSubscription, username)
 	if err != nil {
 		return fmt.Errorf("failed to execute update statement: %w", err)
 	}
+	if err := checkUserAffected(result, username); err != nil {
+		return err
+	}
+
+	err = db.recordSubscriptionChange(ctx, tx, SubscriptionChange{
+		Username:  username,
+		OldStatus: oldStatus,
+		NewStatus: newSubscription.SubscriptionStatus,
+		ChangedAt: now.UTC(),
+		Source:    changeSource(ctx, SourceUpdate),
+	})
+	if err != nil {
+		return err
+	}
+
+	return db.touchUser(ctx, tx, username, now)
+}
 
-	log.Printf("User %s updated successfully.", username)
+// checkUserAffected returns a userNotFoundError if the statement changed no row
+func checkUserAffected(result sql.Result, username string) error {
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if affected == 0 {
+		return &userNotFoundError{username: username}
+	}
 	return nil
 }
 
-// DeleteUser removes a user from the database
+// UserPatch lists the user fields to change. Nil fields are left as they are.
+// Traffic is in MB.
+type UserPatch struct {
+	ChatID       *int64        `json:"chat_id,omitempty"`
+	Traffic      *float64      `json:"traffic,omitempty"`
+	Subscription *Subscription `json:"subscription,omitempty"`
+}
+
+// ErrEmptyPatch is returned when a UserPatch has no fields set.
+var ErrEmptyPatch = errors.New("no fields to update")
+
+// UpdateUser applies the fields set in patch to the user in one transaction.
+// The users table is only written when chat_id or traffic is set and the subscription only when it is set,
+// in which case it is replaced like UpdateUserSubscription does.
+func (db *Database) UpdateUser(ctx context.Context, username string, patch UserPatch) error {
+	ctx, span := db.startSpan(ctx, "UpdateUser", "UPDATE")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Patching user", "username", username)
+
+	if patch.ChatID == nil && patch.Traffic == nil && patch.Subscription == nil {
+		return ErrEmptyPatch
+	}
+
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		if patch.ChatID != nil || patch.Traffic != nil {
+			var sets []string
+			var args []any
+			if patch.ChatID != nil {
+				args = append(args, *patch.ChatID)
+				sets = append(sets, fmt.Sprintf("chat_id = $%d", len(args)))
+			}
+			if patch.Traffic != nil {
+				if err := db.validateTraffic(*patch.Traffic); err != nil {
+					return err
+				}
+				args = append(args, BytesFromMB(*patch.Traffic))
+				sets = append(sets, fmt.Sprintf("traffic_bytes = $%d", len(args)))
+				// A traffic report is user activity, like UpdateUserTraffic
+				args = append(args, FormatTime(time.Now()))
+				sets = append(sets, fmt.Sprintf("last_active = $%d", len(args)))
+			}
+			args = append(args, username)
+			query := fmt.Sprintf("UPDATE users SET %s WHERE username = $%d AND deleted_at IS NULL", strings.Join(sets, ", "), len(args))
+
+			result, err := tx.ExecContext(ctx, db.rebind(query), args...)
+			if err != nil {
+				return fmt.Errorf("failed to execute update statement: %w", err)
+			}
+			if err := checkUserAffected(result, username); err != nil {
+				return err
+			}
+		}
+
+		if patch.Subscription != nil {
+			return db.updateSubscription(ctx, tx, username, *patch.Subscription)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	db.log.DebugContext(ctx, "User patched successfully", "username", username)
+	return nil
+}
+
+// ExtendSubscription activates the user's subscription and extends it by d.
+// The start is reset to now for inactive subscriptions and the new end is max(current end, now) + d.
+// The change is recorded in the subscription history in the same transaction.
+func (db *Database) ExtendSubscription(ctx context.Context, username string, d time.Duration) error {
+	ctx, span := db.startSpan(ctx, "ExtendSubscription", "UPDATE")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Extending subscription", "username", username, "duration", d)
+
+	if d <= 0 {
+		return fmt.Errorf("invalid extension duration: %s", d)
+	}
+
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		return db.extendSubscription(ctx, tx, username, d, time.Now())
+	})
+	if err != nil {
+		return err
+	}
+
+	db.log.DebugContext(ctx, "Subscription extended successfully", "username", username)
+	return nil
+}
+
+// ExtendSubscriptionsBulk extends the subscriptions of the given users by d in one transaction,
+// like ExtendSubscription does for a single user, and returns how many were extended.
+// Unknown and repeated usernames are skipped. With no usernames every active subscription is extended.
+func (db *Database) ExtendSubscriptionsBulk(ctx context.Context, usernames []string, d time.Duration) (int, error) {
+	ctx, span := db.startSpan(ctx, "ExtendSubscriptionsBulk", "UPDATE")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Extending subscriptions", "count", len(usernames), "duration", d)
+
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid extension duration: %s", d)
+	}
+
+	extended := 0
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		if len(usernames) == 0 {
+			var err error
+			usernames, err = db.usernames(ctx, tx, usernamesByStatusSQL, StatusActive)
+			if err != nil {
+				return fmt.Errorf("failed to get active users: %w", err)
+			}
+		}
+
+		now := time.Now()
+		seen := map[string]bool{}
+		for _, username := range usernames {
+			// A username listed twice is extended once
+			if seen[username] {
+				continue
+			}
+			seen[username] = true
+
+			err := db.extendSubscription(ctx, tx, username, d, now)
+			if errors.Is(err, ErrUserNotFound) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to extend subscription of %s: %w", username, err)
+			}
+			extended++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	db.log.DebugContext(ctx, "Subscriptions extended successfully", "count", extended)
+	return extended, nil
+}
+
+// extendSubscription activates the user's subscription and extends it by d within tx, recording the change
+func (db *Database) extendSubscription(ctx context.Context, tx *sql.Tx, username string, d time.Duration, now time.Time) error {
+	oldStatus, err := db.currentStatus(ctx, tx, username)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, db.rebind(db.dialect.extendSubscriptionSQL), FormatTime(now), d.Seconds(), username)
+	if err != nil {
+		return fmt.Errorf("failed to execute extend statement: %w", err)
+	}
+	if err := checkUserAffected(result, username); err != nil {
+		return err
+	}
+
+	err = db.recordSubscriptionChange(ctx, tx, SubscriptionChange{
+		Username:  username,
+		OldStatus: oldStatus,
+		NewStatus: StatusActive,
+		ChangedAt: now.UTC(),
+		Source:    changeSource(ctx, SourceExtend),
+	})
+	if err != nil {
+		return err
+	}
+
+	return db.touchUser(ctx, tx, username, now)
+}
+
+// ActivateSubscription marks the user's subscription active from now for the given duration,
+// such as "1 month" or "forever", computing its end from the duration.
+func (db *Database) ActivateSubscription(ctx context.Context, username, duration string) error {
+	ctx, span := db.startSpan(ctx, "ActivateSubscription", "UPDATE")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Activating subscription", "username", username, "duration", duration)
+
+	if _, _, err := ParseDuration(duration); err != nil {
+		return err
+	}
+
+	// Without start and end both are derived from the duration
+	ctx = WithChangeSource(ctx, changeSource(ctx, SourceActivate))
+	subscription := Subscription{SubscriptionStatus: StatusActive, Duration: duration}
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		return db.updateSubscription(ctx, tx, username, subscription)
+	})
+	if err != nil {
+		return err
+	}
+
+	db.log.DebugContext(ctx, "Subscription activated successfully", "username", username)
+	return nil
+}
+
+// CancelSubscription ends the user's subscription now and marks it inactive.
+// Cancelling a subscription that is already inactive leaves it unchanged.
+func (db *Database) CancelSubscription(ctx context.Context, username string) error {
+	ctx, span := db.startSpan(ctx, "CancelSubscription", "UPDATE")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Cancelling subscription", "username", username)
+
+	var alreadyInactive bool
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		oldStatus, err := db.currentStatus(ctx, tx, username)
+		if err != nil {
+			return err
+		}
+		if oldStatus == StatusInactive {
+			alreadyInactive = true
+			return nil
+		}
+
+		now := time.Now()
+		result, err := tx.ExecContext(ctx, db.rebind(cancelSubscriptionSQL), FormatTime(now), username)
+		if err != nil {
+			return fmt.Errorf("failed to execute cancel statement: %w", err)
+		}
+		if err := checkUserAffected(result, username); err != nil {
+			return err
+		}
+
+		err = db.recordSubscriptionChange(ctx, tx, SubscriptionChange{
+			Username:  username,
+			OldStatus: oldStatus,
+			NewStatus: StatusInactive,
+			ChangedAt: now.UTC(),
+			Source:    changeSource(ctx, SourceCancel),
+		})
+		if err != nil {
+			return err
+		}
+		return db.touchUser(ctx, tx, username, now)
+	})
+	if err != nil {
+		return err
+	}
+
+	if alreadyInactive {
+		db.log.DebugContext(ctx, "Subscription already inactive", "username", username)
+		return nil
+	}
+	db.log.DebugContext(ctx, "Subscription cancelled successfully", "username", username)
+	return nil
+}
+
+// DeleteUser soft-deletes a user by setting deleted_at.
+// The user and their subscription are kept until PurgeDeletedUsers removes them.
 func (db *Database) DeleteUser(ctx context.Context, username string) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	ctx, span := db.startSpan(ctx, "DeleteUser", "UPDATE")
+	defer span.End()
 
-	log.Printf("Preparing to delete user: %s", username)
+	db.log.DebugContext(ctx, "Preparing to delete user", "username", username)
 
-	stmt, err := db.DB.PrepareContext(ctx, deleteUserSQL)
+	stmt, err := db.DB.PrepareContext(ctx, db.rebind(softDeleteUserSQL))
 	if err != nil {
 		return fmt.Errorf("failed to prepare delete statement: %w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.ExecContext(ctx, username)
+	result, err := stmt.ExecContext(ctx, FormatTime(time.Now()), username)
+	db.existsCache.invalidate(username)
 	if err != nil {
 		return fmt.Errorf("failed to execute delete statement: %w", err)
 	}
 
-	log.Printf("User %s and their subscription deleted successfully.", username)
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if affected == 0 {
+		return &userNotFoundError{username: username}
+	}
+
+	db.log.DebugContext(ctx, "User deleted successfully", "username", username)
+	return nil
+}
+
+// DeleteUsers permanently removes the users with the given usernames together with their subscriptions
+// in one transaction and returns how many users were removed. Unknown usernames are ignored.
+// Unlike DeleteUser the users are not kept for PurgeDeletedUsers, so soft-deleted users are removed as well.
+func (db *Database) DeleteUsers(ctx context.Context, usernames []string) (int, error) {
+	ctx, span := db.startSpan(ctx, "DeleteUsers", "DELETE")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Preparing to delete users", "count", len(usernames))
+
+	var subscriptionIDs []int64
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		for _, username := range usernames {
+			var subscriptionID int64
+			err := tx.QueryRowContext(ctx, db.rebind(hardDeleteUserSQL), username).Scan(&subscriptionID)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				return fmt.Errorf("failed to delete user %s: %w", username, err)
+			}
+			subscriptionIDs = append(subscriptionIDs, subscriptionID)
+		}
+
+		for _, subscriptionID := range subscriptionIDs {
+			if _, err := tx.ExecContext(ctx, db.rebind(deleteSubscriptionIfUnusedSQL), subscriptionID); err != nil {
+				return fmt.Errorf("failed to delete subscription %d: %w", subscriptionID, err)
+			}
+		}
+		return nil
+	})
+	db.existsCache.invalidate(usernames...)
+	if err != nil {
+		return 0, err
+	}
+
+	db.log.DebugContext(ctx, "Users deleted successfully", "count", len(subscriptionIDs))
+	return len(subscriptionIDs), nil
+}
+
+// PurgeDeletedUsers permanently removes users soft-deleted before olderThan
+// together with their subscriptions and returns how many users were removed.
+func (db *Database) PurgeDeletedUsers(ctx context.Context, olderThan time.Time) (int64, error) {
+	ctx, span := db.startSpan(ctx, "PurgeDeletedUsers", "DELETE")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Purging deleted users", "older_than", FormatTime(olderThan))
+
+	result, err := db.DB.ExecContext(ctx, db.rebind(db.dialect.purgeDeletedUsersSQL), FormatTime(olderThan))
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge deleted users: %w", err)
+	}
+
+	purged, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+
+	if _, err := db.CleanupUnusedSubscriptions(ctx); err != nil {
+		return purged, fmt.Errorf("failed to clean up unused subscriptions: %w", err)
+	}
+
+	db.log.InfoContext(ctx, "Deleted users purged", "count", purged)
+	return purged, nil
+}
+
+// TruncateUsers permanently removes every user, including soft-deleted ones, and every subscription
+// in one transaction. It is meant for resetting test and development databases.
+func (db *Database) TruncateUsers(ctx context.Context) error {
+	ctx, span := db.startSpan(ctx, "TruncateUsers", "DELETE")
+	defer span.End()
+
+	db.log.WarnContext(ctx, "Removing all users and subscriptions")
+
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, truncateUsersSQL); err != nil {
+			return fmt.Errorf("failed to delete users: %w", err)
+		}
+		if _, err := tx.ExecContext(ctx, truncateSubscriptionsSQL); err != nil {
+			return fmt.Errorf("failed to delete subscriptions: %w", err)
+		}
+		return nil
+	})
+	db.existsCache.clear()
+	if err != nil {
+		return err
+	}
+
+	db.log.InfoContext(ctx, "All users removed")
 	return nil
 }
 
 // IsUserExists checks if a user exists in the database
 func (db *Database) IsUserExists(ctx context.Context, username string) (bool, error) {
-
-	log.Printf("Checking if user exists: %s", username)
-	var exists bool
-	err := db.DB.QueryRowContext(ctx, userExistsSQL, username).Scan(&exists)
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return false, fmt.Errorf("failed to check if user exists: %w", err)
+	ctx, span := db.startSpan(ctx, "IsUserExists", "SELECT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Checking if user exists", "username", username)
+	exists, err := db.existsCache.load(username, func() (bool, error) {
+		var exists bool
+		err := db.read(ctx, func(q queryer) error {
+			return q.QueryRowContext(ctx, db.rebind(userExistsSQL), username).Scan(&exists)
+		})
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return false, fmt.Errorf("failed to check if user exists: %w", err)
+		}
+		return exists, nil
+	})
+	if err != nil {
+		return false, err
 	}
 
-	log.Printf("User: %s, exists: %v", username, exists)
+	db.log.DebugContext(ctx, "User existence checked", "username", username, "exists", exists)
 	return exists, nil
 }
 
-// SubscriptionStatus returns the user's subscription status
+// SubscriptionStatus returns the user's subscription status.
+// A missing or deleted user is reported as ErrUserNotFound.
 func (db *Database) SubscriptionStatus(ctx context.Context, username string) (string, error) {
+	ctx, span := db.startSpan(ctx, "SubscriptionStatus", "SELECT")
+	defer span.End()
 
-	log.Printf("Checking subscription status: %s", username)
+	db.log.DebugContext(ctx, "Checking subscription status", "username", username)
 
-	var subscriptionStatus string
-	err := db.DB.QueryRowContext(ctx, userSubscriptionStatusSQL, username).Scan(&subscriptionStatus)
+	var status sql.NullString
+	err := db.read(ctx, func(q queryer) error {
+		return q.QueryRowContext(ctx, db.rebind(userSubscriptionStatusSQL), username).Scan(&status)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", &userNotFoundError{username: username}
+	}
 	if err != nil {
 		return "", fmt.Errorf("failed to check subscription status: %w", err)
 	}
-	log.Printf("User: %s, status: %v", username, subscriptionStatus)
+	subscriptionStatus := string(nullableStatus(status))
+	db.log.DebugContext(ctx, "Subscription status checked", "username", username, "status", subscriptionStatus)
 	return subscriptionStatus, nil
 }
 
-// UpdateUserTraffic changes the user's traffic value
+// GetSubscription returns the user's subscription without reading the rest of the user.
+// A missing or deleted user is reported as ErrUserNotFound.
+func (db *Database) GetSubscription(ctx context.Context, username string) (*Subscription, error) {
+	ctx, span := db.startSpan(ctx, "GetSubscription", "SELECT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Fetching subscription", "username", username)
+
+	var sub Subscription
+	var status sql.NullString
+	var startSubscription, endSubscription string
+	err := db.read(ctx, func(q queryer) error {
+		return q.QueryRowContext(ctx, db.rebind(userSubscriptionSQL), username).
+			Scan(&sub.ID, &status, &sub.Duration, &startSubscription, &endSubscription, &sub.AutoRenew)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &userNotFoundError{username: username}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch subscription: %w", err)
+	}
+
+	sub.SubscriptionStatus = nullableStatus(status)
+	if sub.StartSubscription, err = db.parseTime(ctx, "start_subscription", startSubscription); err != nil {
+		return nil, err
+	}
+	if sub.EndSubscription, err = db.parseTime(ctx, "end_subscription", endSubscription); err != nil {
+		return nil, err
+	}
+
+	db.log.DebugContext(ctx, "Subscription fetched successfully", "username", username)
+	return &sub, nil
+}
+
+// SubscriptionStatuses returns the subscription statuses of the given users in a single query.
+// Unknown and deleted users are left out of the result.
+func (db *Database) SubscriptionStatuses(ctx context.Context, usernames []string) (map[string]SubscriptionStatus, error) {
+	ctx, span := db.startSpan(ctx, "SubscriptionStatuses", "SELECT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Checking subscription statuses", "count", len(usernames))
+
+	var statuses map[string]SubscriptionStatus
+	err := db.read(ctx, func(q queryer) error {
+		rows, err := q.QueryContext(ctx, db.rebind(db.dialect.subscriptionStatusesSQL), db.dialect.listArg(usernames))
+		if err != nil {
+			return fmt.Errorf("failed to execute query: %w", err)
+		}
+		defer rows.Close()
+
+		statuses = make(map[string]SubscriptionStatus, len(usernames))
+		for rows.Next() {
+			var username string
+			var status sql.NullString
+			if err := rows.Scan(&username, &status); err != nil {
+				return fmt.Errorf("failed to scan row: %w", err)
+			}
+			statuses[username] = nullableStatus(status)
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("row iteration error: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	db.log.DebugContext(ctx, "Subscription statuses checked", "count", len(usernames), "found", len(statuses))
+	return statuses, nil
+}
+
+// UpdateUserTraffic changes the user's traffic value.
+// Traffic outside 0 to MAX_TRAFFIC_MB is rejected with ErrInvalidTraffic
+// and a missing or deleted user is reported as ErrUserNotFound.
 func (db *Database) UpdateUserTraffic(ctx context.Context, username string, traffic float64) error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	ctx, span := db.startSpan(ctx, "UpdateUserTraffic", "UPDATE")
+	defer span.End()
 
-	log.Printf("Updating traffic for user: %s", username)
+	db.log.DebugContext(ctx, "Updating traffic", "username", username)
 
-	stmt, err := db.DB.PrepareContext(ctx, updateUserTrafficSQL)
+	if err := db.validateTraffic(traffic); err != nil {
+		return err
+	}
+	return db.updateUserTraffic(ctx, username, BytesFromMB(traffic))
+}
+
+// UpdateUserTrafficBytes is UpdateUserTraffic for traffic in bytes, which is stored exactly
+func (db *Database) UpdateUserTrafficBytes(ctx context.Context, username string, traffic int64) error {
+	ctx, span := db.startSpan(ctx, "UpdateUserTrafficBytes", "UPDATE")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Updating traffic", "username", username, "unit", "bytes")
+
+	if err := db.validateTrafficBytes(traffic); err != nil {
+		return err
+	}
+	return db.updateUserTraffic(ctx, username, traffic)
+}
+
+// updateUserTraffic sets the validated traffic of the user in bytes
+func (db *Database) updateUserTraffic(ctx context.Context, username string, traffic int64) error {
+	stmt, err := db.DB.PrepareContext(ctx, db.rebind(updateUserTrafficSQL))
 	if err != nil {
 		return fmt.Errorf("failed to prepare update statement: %w", err)
 	}
 	defer stmt.Close()
 
-	_, err = stmt.ExecContext(ctx, traffic, username)
+	result, err := stmt.ExecContext(ctx, traffic, username, FormatTime(time.Now()))
 	if err != nil {
 		return fmt.Errorf("failed to execute update statement: %w", err)
 	}
+	if err := checkUserAffected(result, username); err != nil {
+		return err
+	}
 
-	log.Printf("Traffic for user %s updated successfully.", username)
+	db.log.DebugContext(ctx, "Traffic updated successfully", "username", username)
 	return nil
 }
 
-// ResetUserTraffic resets the traffic for a user
+// UpsertUserTraffic sets the traffic of a user like UpdateUserTraffic, but creates a missing user
+// with a default inactive subscription instead of failing. It reports whether the user was created.
+// A report racing with the registration of the user is applied to the registered user.
+// Deleted users are not restored and are reported as ErrUserNotFound.
+func (db *Database) UpsertUserTraffic(ctx context.Context, username string, traffic float64) (bool, error) {
+	ctx, span := db.startSpan(ctx, "UpsertUserTraffic", "INSERT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Upserting traffic", "username", username)
+
+	if err := db.validateTraffic(traffic); err != nil {
+		return false, err
+	}
+	return db.upsertUserTraffic(ctx, username, BytesFromMB(traffic))
+}
+
+// UpsertUserTrafficBytes is UpsertUserTraffic for traffic in bytes, which is stored exactly
+func (db *Database) UpsertUserTrafficBytes(ctx context.Context, username string, traffic int64) (bool, error) {
+	ctx, span := db.startSpan(ctx, "UpsertUserTrafficBytes", "INSERT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Upserting traffic", "username", username, "unit", "bytes")
+
+	if err := db.validateTrafficBytes(traffic); err != nil {
+		return false, err
+	}
+	return db.upsertUserTraffic(ctx, username, traffic)
+}
+
+// upsertUserTraffic sets the validated traffic of the user in bytes, creating a missing user
+func (db *Database) upsertUserTraffic(ctx context.Context, username string, traffic int64) (bool, error) {
+	var updated, created bool
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		// Most reports are for existing users and need no subscription
+		now := time.Now()
+		result, err := tx.ExecContext(ctx, db.rebind(updateUserTrafficSQL), traffic, username, FormatTime(now))
+		if err != nil {
+			return fmt.Errorf("failed to execute update statement: %w", err)
+		}
+		err = checkUserAffected(result, username)
+		if err == nil {
+			updated = true
+			return nil
+		}
+		if !errors.Is(err, ErrUserNotFound) {
+			return err
+		}
+		if err := validateUsername(username); err != nil {
+			return err
+		}
+
+		subscriptionID, err := db.addSubscription(ctx, tx, defaultSubscription(now))
+		if err != nil {
+			return fmt.Errorf("failed to add subscription: %w", err)
+		}
+
+		var userSubscriptionID int64
+		err = tx.QueryRowContext(ctx, db.rebind(upsertUserTrafficSQL), username, subscriptionID, 0, traffic, FormatTime(now)).Scan(&userSubscriptionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return &userNotFoundError{username: username}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to execute upsert statement: %w", err)
+		}
+
+		// The user was registered concurrently and kept its own subscription
+		created = userSubscriptionID == subscriptionID
+		if !created {
+			if _, err := tx.ExecContext(ctx, db.rebind(deleteSubscriptionIfUnusedSQL), subscriptionID); err != nil {
+				return fmt.Errorf("failed to delete unused subscription: %w", err)
+			}
+		}
+		return nil
+	})
+	if !updated {
+		db.existsCache.invalidate(username)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if updated {
+		db.log.DebugContext(ctx, "Traffic updated successfully", "username", username)
+		return false, nil
+	}
+	db.log.DebugContext(ctx, "Traffic upserted successfully", "username", username, "created", created)
+	return created, nil
+}
+
+// ResetUserTraffic resets the traffic for a user.
+// Unlike a traffic report it leaves last_active alone, so resets do not count as activity.
+// A missing or deleted user is reported as ErrUserNotFound.
 func (db *Database) ResetUserTraffic(ctx context.Context, username string) error {
-	return db.UpdateUserTraffic(ctx, username, 0)
+	ctx, span := db.startSpan(ctx, "ResetUserTraffic", "UPDATE")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Resetting traffic", "username", username)
+
+	result, err := db.DB.ExecContext(ctx, db.rebind(resetUserTrafficSQL), username)
+	if err != nil {
+		return fmt.Errorf("failed to execute reset statement: %w", err)
+	}
+	if err := checkUserAffected(result, username); err != nil {
+		return err
+	}
+
+	db.log.DebugContext(ctx, "Traffic reset successfully", "username", username)
+	return nil
+}
+
+// ListUsers returns a page of at most limit users with their subscriptions, ordered by username,
+// skipping the first offset users
+func (db *Database) ListUsers(ctx context.Context, offset, limit int) ([]User, error) {
+	ctx, span := db.startSpan(ctx, "ListUsers", "SELECT")
+	defer span.End()
+
+	if offset < 0 || limit <= 0 {
+		return nil, fmt.Errorf("invalid page: offset %d, limit %d", offset, limit)
+	}
+
+	db.log.DebugContext(ctx, "Listing users", "offset", offset, "limit", limit)
+	return db.users(ctx, listUsersSQL, limit, offset)
+}
+
+// ListUsersAfter returns at most limit users whose username sorts after afterUsername, ordered by username.
+// An empty afterUsername starts from the beginning. Unlike ListUsers, pages stay stable while users are
+// created or deleted in between, so passing the last username of a page returns every user exactly once.
+func (db *Database) ListUsersAfter(ctx context.Context, afterUsername string, limit int) ([]User, error) {
+	ctx, span := db.startSpan(ctx, "ListUsersAfter", "SELECT")
+	defer span.End()
+
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid page limit: %d", limit)
+	}
+
+	db.log.DebugContext(ctx, "Listing users", "after", afterUsername, "limit", limit)
+	return db.users(ctx, listUsersAfterSQL, afterUsername, limit)
+}
+
+// SubscriptionInfo is an active subscription with the time left on it
+type SubscriptionInfo struct {
+	Username        string    `json:"username" example:"john_doe"`
+	Duration        string    `json:"duration" example:"month"`
+	EndSubscription time.Time `json:"end_subscription"`
+	// RemainingDays counts a started day as a whole one and is -1 for forever subscriptions
+	RemainingDays int `json:"remaining_days" example:"12"`
+}
+
+// ActiveSubscriptions returns the active subscriptions that have not ended yet, ordered by username.
+// Subscriptions still marked active after their end are left out until the scheduler deactivates them.
+func (db *Database) ActiveSubscriptions(ctx context.Context) ([]SubscriptionInfo, error) {
+	ctx, span := db.startSpan(ctx, "ActiveSubscriptions", "SELECT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Listing active subscriptions")
+
+	users, err := db.users(ctx, activeSubscriptionsSQL)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	subscriptions := []SubscriptionInfo{}
+	for _, user := range users {
+		sub := user.Subscription
+		if sub.IsExpired(now) {
+			continue
+		}
+		subscriptions = append(subscriptions, SubscriptionInfo{
+			Username:        user.Username,
+			Duration:        sub.Duration,
+			EndSubscription: sub.EndSubscription,
+			RemainingDays:   sub.RemainingDays(now),
+		})
+	}
+	return subscriptions, nil
+}
+
+// TotalTraffic returns the sum of the traffic of all users
+func (db *Database) TotalTraffic(ctx context.Context) (float64, error) {
+	ctx, span := db.startSpan(ctx, "TotalTraffic", "SELECT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Summing traffic")
+
+	// Summing whole bytes keeps the total exact however many users there are
+	var total int64
+	if err := db.DB.QueryRowContext(ctx, db.rebind(totalTrafficSQL)).Scan(&total); err != nil {
+		return 0, fmt.Errorf("failed to sum traffic: %w", err)
+	}
+	return MBFromBytes(total), nil
+}
+
+// SubscriptionStatusCounts returns the number of users with each subscription status.
+// Every status is present, with 0 when no user has it.
+func (db *Database) SubscriptionStatusCounts(ctx context.Context) (map[string]int, error) {
+	ctx, span := db.startSpan(ctx, "SubscriptionStatusCounts", "SELECT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Counting users by subscription status")
+
+	counts := map[string]int{string(StatusActive): 0, string(StatusInactive): 0}
+	rows, err := db.DB.QueryContext(ctx, db.rebind(statusCountsSQL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to count subscription statuses: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var status sql.NullString
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, fmt.Errorf("failed to scan subscription status count: %w", err)
+		}
+		// NULL statuses of old rows are counted as inactive
+		counts[string(nullableStatus(status))] += count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate subscription status counts: %w", err)
+	}
+	return counts, nil
+}
+
+// TopTrafficUsers returns the n users with the most traffic, highest first
+func (db *Database) TopTrafficUsers(ctx context.Context, n int) ([]User, error) {
+	ctx, span := db.startSpan(ctx, "TopTrafficUsers", "SELECT")
+	defer span.End()
+
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid number of users: %d", n)
+	}
+
+	db.log.DebugContext(ctx, "Retrieving top traffic users", "n", n)
+	return db.users(ctx, topTrafficUsersSQL, n)
+}
+
+// UsersOverTraffic returns the users whose traffic exceeds thresholdMB, the highest first
+func (db *Database) UsersOverTraffic(ctx context.Context, thresholdMB float64) ([]User, error) {
+	ctx, span := db.startSpan(ctx, "UsersOverTraffic", "SELECT")
+	defer span.End()
+
+	if thresholdMB < 0 || math.IsNaN(thresholdMB) {
+		return nil, fmt.Errorf("invalid traffic threshold: %v", thresholdMB)
+	}
+
+	db.log.DebugContext(ctx, "Retrieving users over traffic", "threshold_mb", thresholdMB)
+	// Traffic above the threshold is above the whole bytes it contains
+	threshold := BytesFromMB(math.Floor(thresholdMB*BytesPerMB) / BytesPerMB)
+	return db.users(ctx, usersOverTrafficSQL, threshold)
+}
+
+// UsersByDuration returns the users whose subscription is on the duration plan, ordered by username.
+// The duration is normalized before matching, so "Year" and "1 year" both find users on "year".
+func (db *Database) UsersByDuration(ctx context.Context, duration string) ([]User, error) {
+	ctx, span := db.startSpan(ctx, "UsersByDuration", "SELECT")
+	defer span.End()
+
+	if _, _, err := ParseDuration(duration); err != nil {
+		return nil, err
+	}
+
+	normalized, alternative := durationSpellings(duration)
+	db.log.DebugContext(ctx, "Retrieving users by duration", "duration", normalized)
+	return db.users(ctx, usersByDurationSQL, normalized, alternative)
 }
 
 // AllUsername return all username
 func (db *Database) AllUsername(ctx context.Context) ([]string, error) {
-	rows, err := db.DB.QueryContext(ctx, allUsername)
+	ctx, span := db.startSpan(ctx, "AllUsername", "SELECT")
+	defer span.End()
+
+	var usernames []string
+	err := db.read(ctx, func(q queryer) error {
+		var err error
+		usernames, err = db.usernames(ctx, q, allUsername)
+		return err
+	})
+	return usernames, err
+}
+
+// UsernamesByStatus returns the usernames of users whose subscription has the given status
+func (db *Database) UsernamesByStatus(ctx context.Context, status SubscriptionStatus) ([]string, error) {
+	ctx, span := db.startSpan(ctx, "UsernamesByStatus", "SELECT")
+	defer span.End()
+
+	if err := status.Validate(); err != nil {
+		return nil, err
+	}
+	return db.usernames(ctx, db.DB, usernamesByStatusSQL, status)
+}
+
+// SearchUsernames returns up to limit usernames starting with prefix, ignoring case, in alphabetical order.
+// The LIKE wildcards % and _ in prefix are matched literally.
+func (db *Database) SearchUsernames(ctx context.Context, prefix string, limit int) ([]string, error) {
+	ctx, span := db.startSpan(ctx, "SearchUsernames", "SELECT")
+	defer span.End()
+
+	if limit <= 0 {
+		return nil, fmt.Errorf("invalid search limit: %d", limit)
+	}
+
+	db.log.DebugContext(ctx, "Searching usernames", "prefix", prefix, "limit", limit)
+	return db.usernames(ctx, db.DB, db.dialect.searchUsernamesSQL, escapeLikePattern(prefix), limit)
+}
+
+// likeEscaper escapes the LIKE wildcards and the escape character itself
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLikePattern makes s match literally in a LIKE pattern using '\' as the escape character
+func escapeLikePattern(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+// queryer is implemented by *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// usernames returns the usernames selected by query through q
+func (db *Database) usernames(ctx context.Context, q queryer, query string, args ...any) ([]string, error) {
+	rows, err := q.QueryContext(ctx, db.rebind(query), args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute query: %w", err)
 	}
 	defer rows.Close()
 
-	var usernames []string
+	usernames := []string{}
 	for rows.Next() {
 		var username string
 		if err := rows.Scan(&username); err != nil {
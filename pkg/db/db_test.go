@@ -1,12 +1,23 @@
 package db
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 var (
@@ -15,15 +26,29 @@ var (
 )
 
 func setupTestDB() (*Database, error) {
-	db, err := NewDatabase(dataSourceName)
+	return setupTestDBWithDriver(DriverSQLite)
+}
+
+func setupTestDBWithDriver(driver string) (*Database, error) {
+	db, err := NewDatabaseWithDriver(driver, dataSourceName, nil)
 	if err != nil {
 		return nil, err
 	}
 	return db, nil
 }
 
+// testDrivers returns the drivers to run the driver matrix against.
+// Postgres needs a running server configured through the usual DB_* variables and is enabled by TEST_POSTGRES=true.
+func testDrivers() []string {
+	drivers := []string{DriverSQLite}
+	if os.Getenv("TEST_POSTGRES") == "true" {
+		drivers = append(drivers, DriverPostgres)
+	}
+	return drivers
+}
+
 func teardownTestDB(db *Database) {
-	db.DB.Close()
+	db.Close()
 }
 
 // Test functions
@@ -63,7 +88,7 @@ func TestCreateUser(t *testing.T) {
 				},
 			},
 			wantErr:    true,
-			errMessage: "unsupported username",
+			errMessage: "invalid username \"\": must be 5 to 32 letters, digits or underscores",
 		},
 		{
 			name: "DuplicateUser",
@@ -78,7 +103,7 @@ func TestCreateUser(t *testing.T) {
 				},
 			},
 			wantErr:    true,
-			errMessage: "failed to execute insert statement: UNIQUE constraint failed: users.username",
+			errMessage: "user testuser already exists",
 		},
 	}
 
@@ -456,6 +481,9 @@ func TestSubscriptionStatus(t *testing.T) {
 			if (err != nil) != tc.wantErr {
 				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
 			}
+			if tc.wantErr && !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Expected error: %v, got: %v", ErrUserNotFound, err)
+			}
 			if status != tc.wantStatus {
 				t.Fatalf("Expected status: %s, got: %s", tc.wantStatus, status)
 			}
@@ -503,7 +531,7 @@ func TestUpdateUserTraffic(t *testing.T) {
 			},
 			username: "nonexistentuser",
 			traffic:  100.0,
-			wantErr:  false, // No error expected for non-existent user
+			wantErr:  true, // A missing user is reported as ErrUserNotFound
 		},
 	}
 
@@ -526,6 +554,9 @@ func TestUpdateUserTraffic(t *testing.T) {
 			if (err != nil) != tc.wantErr {
 				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
 			}
+			if tc.wantErr && !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Expected ErrUserNotFound, got: %v", err)
+			}
 
 			if !tc.wantErr {
 				user, err := db.User(ctx, tc.username)
@@ -584,7 +615,7 @@ func TestResetUserTraffic(t *testing.T) {
 				},
 			},
 			username: "nonexistentuser",
-			wantErr:  false, // No error expected for non-existent user
+			wantErr:  true, // A missing user is reported as ErrUserNotFound
 		},
 	}
 
@@ -607,6 +638,9 @@ func TestResetUserTraffic(t *testing.T) {
 			if (err != nil) != tc.wantErr {
 				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
 			}
+			if tc.wantErr && !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Expected ErrUserNotFound, got: %v", err)
+			}
 
 			if !tc.wantErr {
 				user, err := db.User(ctx, tc.username)
@@ -693,6 +727,10 @@ func TestAllUsername(t *testing.T) {
 			if len(usernames) != len(tc.wantUsernames) {
 				t.Fatalf("Expected usernames length: %d, got: %d", len(tc.wantUsernames), len(usernames))
 			}
+			// An empty result must encode as [] rather than null
+			if encoded, _ := json.Marshal(usernames); len(tc.wantUsernames) == 0 && string(encoded) != "[]" {
+				t.Fatalf("Expected usernames to encode as [], got: %s", encoded)
+			}
 			for _, username := range tc.wantUsernames {
 				if !contains(usernames, username) {
 					t.Fatalf("Expected username: %s, not found in usernames", username)
@@ -710,3 +748,2024 @@ func contains(slice []string, item string) bool {
 	}
 	return false
 }
+
+func TestRedactConnStr(t *testing.T) {
+	type testCase struct {
+		name     string
+		connStr  string
+		password string
+		want     string
+	}
+
+	testCases := []testCase{
+		{
+			name:     "PlainPassword",
+			connStr:  "user=admin password=s3cr3t dbname=users host=localhost port=5432 sslmode=disable",
+			password: "s3cr3t",
+			want:     "user=admin password=***** dbname=users host=localhost port=5432 sslmode=disable",
+		},
+		{
+			name:     "QuotedPassword",
+			connStr:  "user=admin password='my s3cr3t' dbname=users",
+			password: "my s3cr3t",
+			want:     "user=admin password=***** dbname=users",
+		},
+		{
+			name:     "EmptyPassword",
+			connStr:  "user=admin password= dbname=users",
+			password: "",
+			want:     "user=admin password=***** dbname=users",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := redactConnStr(tc.connStr)
+			if got != tc.want {
+				t.Fatalf("Expected: %s, got: %s", tc.want, got)
+			}
+			if tc.password != "" && strings.Contains(got, tc.password) {
+				t.Fatalf("Redacted string still contains the password: %s", got)
+			}
+		})
+	}
+}
+
+func TestRedactError(t *testing.T) {
+	password := "s3cr3t"
+	cause := errors.New("dial failed for password=s3cr3t")
+	err := redactError(fmt.Errorf("failed to open default database: %w", cause), password)
+
+	if strings.Contains(err.Error(), password) {
+		t.Fatalf("Error message still contains the password: %s", err.Error())
+	}
+	if !errors.Is(err, cause) {
+		t.Fatalf("Expected redacted error to wrap the original error")
+	}
+	if redactError(nil, password) != nil {
+		t.Fatalf("Expected nil error to stay nil")
+	}
+}
+
+func TestSoftDeleteUser(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	user := User{Username: "deleteduser", ChatID: 12345}
+	if err := db.CreateUser(ctx, &user); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	if err := db.DeleteUser(ctx, user.Username); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+
+	if _, err := db.User(ctx, user.Username); err == nil {
+		t.Fatalf("Expected soft-deleted user to be hidden")
+	}
+
+	exists, err := db.IsUserExists(ctx, user.Username)
+	if err != nil {
+		t.Fatalf("Failed to check if user exists: %v", err)
+	}
+	if exists {
+		t.Fatalf("Expected soft-deleted user to not exist")
+	}
+
+	usernames, err := db.AllUsername(ctx)
+	if err != nil {
+		t.Fatalf("Failed to get usernames: %v", err)
+	}
+	if contains(usernames, user.Username) {
+		t.Fatalf("Expected soft-deleted user to be excluded from usernames")
+	}
+
+	deleted, err := db.UserIncludingDeleted(ctx, user.Username)
+	if err != nil {
+		t.Fatalf("Failed to retrieve soft-deleted user: %v", err)
+	}
+	if deleted.DeletedAt == nil {
+		t.Fatalf("Expected deleted_at to be set")
+	}
+
+	if err := db.DeleteUser(ctx, user.Username); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected ErrUserNotFound on second delete, got: %v", err)
+	}
+
+	purged, err := db.PurgeDeletedUsers(ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to purge deleted users: %v", err)
+	}
+	if purged != 0 {
+		t.Fatalf("Expected recently deleted user to be kept, purged: %d", purged)
+	}
+
+	purged, err = db.PurgeDeletedUsers(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to purge deleted users: %v", err)
+	}
+	if purged != 1 {
+		t.Fatalf("Expected 1 purged user, got: %d", purged)
+	}
+
+	if _, err := db.UserIncludingDeleted(ctx, user.Username); err == nil {
+		t.Fatalf("Expected purged user to be gone")
+	}
+}
+
+func TestExtendSubscription(t *testing.T) {
+	now := time.Now()
+
+	type testCase struct {
+		name         string
+		username     string
+		subscription Subscription
+		extendBy     time.Duration
+		wantStart    time.Time
+		wantEnd      time.Time
+		wantErr      error
+	}
+
+	testCases := []testCase{
+		{
+			name:     "ActiveSubscription",
+			username: "activeuser",
+			subscription: Subscription{
+				SubscriptionStatus: "active",
+				Duration:           "month",
+				StartSubscription:  now.AddDate(0, 0, -20),
+				EndSubscription:    now.AddDate(0, 0, 10),
+			},
+			extendBy:  30 * 24 * time.Hour,
+			wantStart: now.AddDate(0, 0, -20),
+			wantEnd:   now.AddDate(0, 0, 40),
+		},
+		{
+			name:     "ExpiredSubscription",
+			username: "expireduser",
+			subscription: Subscription{
+				SubscriptionStatus: "inactive",
+				Duration:           "month",
+				StartSubscription:  now.AddDate(0, -2, 0),
+				EndSubscription:    now.AddDate(0, 0, -5),
+			},
+			extendBy:  30 * 24 * time.Hour,
+			wantStart: now,
+			wantEnd:   now.AddDate(0, 0, 30),
+		},
+		{
+			name:     "UserDoesNotExist",
+			username: "nonexistentuser",
+			extendBy: time.Hour,
+			wantErr:  ErrUserNotFound,
+		},
+	}
+
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.wantErr == nil {
+				if err := db.CreateUser(ctx, &User{Username: tc.username, ChatID: 12345}); err != nil {
+					t.Fatalf("Failed to create initial user: %v", err)
+				}
+				if err := db.UpdateUserSubscription(ctx, tc.username, tc.subscription); err != nil {
+					t.Fatalf("Failed to set initial subscription: %v", err)
+				}
+			}
+
+			err := db.ExtendSubscription(ctx, tc.username, tc.extendBy)
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+
+			user, err := db.User(ctx, tc.username)
+			if err != nil {
+				t.Fatalf("Failed to retrieve user: %v", err)
+			}
+			sub := user.Subscription
+			if sub.SubscriptionStatus != "active" {
+				t.Fatalf("Expected status: active, got: %s", sub.SubscriptionStatus)
+			}
+			assertTimeClose(t, "start_subscription", tc.wantStart, sub.StartSubscription)
+			assertTimeClose(t, "end_subscription", tc.wantEnd, sub.EndSubscription)
+		})
+	}
+}
+
+// assertTimeClose fails if got differs from want by more than the stored precision allows
+func assertTimeClose(t *testing.T, field string, want, got time.Time) {
+	t.Helper()
+	if diff := got.Sub(want); diff > 2*time.Second || diff < -2*time.Second {
+		t.Fatalf("Expected %s: %v, got: %v", field, want, got)
+	}
+}
+
+func TestSubscriptionIsActive(t *testing.T) {
+	now := time.Now()
+
+	testCases := []struct {
+		name         string
+		subscription Subscription
+		wantActive   bool
+		wantExpired  bool
+	}{
+		{
+			name:         "Active",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: now.AddDate(0, 0, -1), EndSubscription: now.AddDate(0, 1, 0)},
+			wantActive:   true,
+		},
+		{
+			name:         "Expired",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: now.AddDate(0, -1, -1), EndSubscription: now.AddDate(0, 0, -1)},
+			wantExpired:  true,
+		},
+		{
+			name:         "EndsNow",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: now.AddDate(0, -1, 0), EndSubscription: now},
+			wantExpired:  true,
+		},
+		{
+			name:         "FutureDated",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: now.AddDate(0, 0, 1), EndSubscription: now.AddDate(0, 1, 1)},
+		},
+		{
+			name:         "Inactive",
+			subscription: Subscription{SubscriptionStatus: StatusInactive, Duration: "month", StartSubscription: now.AddDate(0, 0, -1), EndSubscription: now.AddDate(0, 1, 0)},
+		},
+		{
+			name:         "InactiveExpired",
+			subscription: Subscription{SubscriptionStatus: StatusInactive, Duration: "month"},
+			wantExpired:  true,
+		},
+		{
+			name:         "Forever",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: DurationForever, StartSubscription: now.AddDate(-1, 0, 0)},
+			wantActive:   true,
+		},
+		{
+			name:         "ForeverCancelled",
+			subscription: Subscription{SubscriptionStatus: StatusInactive, Duration: DurationForever, StartSubscription: now.AddDate(-1, 0, 0), EndSubscription: now.AddDate(0, 0, -1)},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.subscription.IsActive(now); got != tc.wantActive {
+				t.Fatalf("Expected active: %v, got: %v", tc.wantActive, got)
+			}
+			if got := tc.subscription.IsExpired(now); got != tc.wantExpired {
+				t.Fatalf("Expected expired: %v, got: %v", tc.wantExpired, got)
+			}
+		})
+	}
+}
+
+func TestSubscriptionStatusValidation(t *testing.T) {
+	type testCase struct {
+		name    string
+		status  SubscriptionStatus
+		wantErr bool
+	}
+
+	testCases := []testCase{
+		{name: "Active", status: StatusActive},
+		{name: "Inactive", status: StatusInactive},
+		{name: "Typo", status: "actve", wantErr: true},
+		{name: "WrongCase", status: "Active", wantErr: true},
+		{name: "Empty", status: "", wantErr: true},
+	}
+
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	if err := db.CreateUser(ctx, &User{Username: "statususer", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := db.UpdateUserSubscription(ctx, "statususer", Subscription{
+				SubscriptionStatus: tc.status,
+				Duration:           "month",
+				StartSubscription:  time.Now(),
+				EndSubscription:    time.Now().AddDate(0, 1, 0),
+			})
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if tc.wantErr && !errors.Is(err, ErrInvalidSubscriptionStatus) {
+				t.Fatalf("Expected ErrInvalidSubscriptionStatus, got: %v", err)
+			}
+		})
+	}
+
+	err = db.CreateUser(ctx, &User{
+		Username:     "typouser",
+		Subscription: Subscription{SubscriptionStatus: "actve"},
+	})
+	if !errors.Is(err, ErrInvalidSubscriptionStatus) {
+		t.Fatalf("Expected ErrInvalidSubscriptionStatus on create, got: %v", err)
+	}
+}
+
+func TestCreateDuplicateUser(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	if err := db.CreateUser(ctx, &User{Username: "testuser", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	err = db.CreateUser(ctx, &User{Username: "testuser", ChatID: 67890})
+	if !errors.Is(err, ErrUserExists) {
+		t.Fatalf("Expected ErrUserExists, got: %v", err)
+	}
+	if strings.Contains(err.Error(), "UNIQUE") {
+		t.Fatalf("Expected error without the raw SQL message, got: %s", err.Error())
+	}
+}
+
+func TestCreateDuplicateUserRollsBackSubscription(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			username := "rollbackuser_" + driver
+			if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+				t.Fatalf("Failed to create initial user: %v", err)
+			}
+
+			countSubscriptions := func() int {
+				var count int
+				if err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM subscriptions").Scan(&count); err != nil {
+					t.Fatalf("Failed to count subscriptions: %v", err)
+				}
+				return count
+			}
+			before := countSubscriptions()
+
+			err = db.CreateUser(ctx, &User{Username: username, ChatID: 67890})
+			if !errors.Is(err, ErrUserExists) {
+				t.Fatalf("Expected ErrUserExists, got: %v", err)
+			}
+
+			if after := countSubscriptions(); after != before {
+				t.Fatalf("Expected subscriptions: %d, got: %d", before, after)
+			}
+		})
+	}
+}
+
+func TestUsernamesByStatus(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	statuses := map[string]SubscriptionStatus{
+		"activeuser1":  StatusActive,
+		"activeuser2":  StatusActive,
+		"inactiveuser": StatusInactive,
+	}
+	for username, status := range statuses {
+		if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+		err := db.UpdateUserSubscription(ctx, username, Subscription{
+			SubscriptionStatus: status,
+			Duration:           "month",
+			StartSubscription:  time.Now(),
+			EndSubscription:    time.Now().AddDate(0, 1, 0),
+		})
+		if err != nil {
+			t.Fatalf("Failed to set initial subscription: %v", err)
+		}
+	}
+
+	type testCase struct {
+		name          string
+		status        SubscriptionStatus
+		wantUsernames []string
+		wantErr       bool
+	}
+
+	testCases := []testCase{
+		{name: "Active", status: StatusActive, wantUsernames: []string{"activeuser1", "activeuser2"}},
+		{name: "Inactive", status: StatusInactive, wantUsernames: []string{"inactiveuser"}},
+		{name: "InvalidStatus", status: "expired", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			usernames, err := db.UsernamesByStatus(ctx, tc.status)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if len(usernames) != len(tc.wantUsernames) {
+				t.Fatalf("Expected usernames: %v, got: %v", tc.wantUsernames, usernames)
+			}
+			for _, username := range tc.wantUsernames {
+				if !contains(usernames, username) {
+					t.Fatalf("Expected username: %s, not found in usernames", username)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchUsernames(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			for _, username := range []string{"alice", "alfred", "alina", "bobby", "Bobbie", "xx_yy", "xxyzz"} {
+				if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+					t.Fatalf("Failed to create initial user: %v", err)
+				}
+			}
+
+			type testCase struct {
+				name          string
+				prefix        string
+				limit         int
+				wantUsernames []string
+				anyOrder      bool // mixed case names sort differently depending on the collation
+				wantErr       bool
+			}
+
+			testCases := []testCase{
+				{name: "Prefix", prefix: "ali", limit: 10, wantUsernames: []string{"alice", "alina"}},
+				{name: "Ordered", prefix: "al", limit: 10, wantUsernames: []string{"alfred", "alice", "alina"}},
+				{name: "Limit", prefix: "al", limit: 2, wantUsernames: []string{"alfred", "alice"}},
+				{name: "IgnoresCase", prefix: "BOB", limit: 10, wantUsernames: []string{"Bobbie", "bobby"}, anyOrder: true},
+				{name: "UnderscoreLiteral", prefix: "xx_", limit: 10, wantUsernames: []string{"xx_yy"}},
+				{name: "PercentLiteral", prefix: "xx%", limit: 10},
+				{name: "PercentOnly", prefix: "%", limit: 10},
+				{name: "NoMatch", prefix: "zed", limit: 10},
+				{name: "InvalidLimit", prefix: "al", limit: 0, wantErr: true},
+			}
+
+			for _, tc := range testCases {
+				t.Run(tc.name, func(t *testing.T) {
+					usernames, err := db.SearchUsernames(ctx, tc.prefix, tc.limit)
+					if (err != nil) != tc.wantErr {
+						t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+					}
+					if tc.anyOrder {
+						sort.Strings(usernames)
+					}
+					if fmt.Sprint(usernames) != fmt.Sprint(tc.wantUsernames) {
+						t.Fatalf("Expected usernames: %v, got: %v", tc.wantUsernames, usernames)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestIndexesCreated(t *testing.T) {
+	indexQueries := map[string]string{
+		DriverPostgres: "SELECT EXISTS(SELECT 1 FROM pg_indexes WHERE indexname = $1)",
+		DriverSQLite:   "SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'index' AND name = $1)",
+	}
+
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			for _, index := range []string{"idx_subscriptions_end", "idx_users_chat_id"} {
+				var exists bool
+				err := db.DB.QueryRowContext(ctx, indexQueries[driver], index).Scan(&exists)
+				if err != nil {
+					t.Fatalf("Failed to look up index %s: %v", index, err)
+				}
+				if !exists {
+					t.Fatalf("Expected index %s to exist", index)
+				}
+			}
+		})
+	}
+}
+
+func TestCoreCRUDDrivers(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			username := "cruduser_" + driver
+			if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+
+			exists, err := db.IsUserExists(ctx, username)
+			if err != nil || !exists {
+				t.Fatalf("Expected user to exist, got: %v, %v", exists, err)
+			}
+
+			subscription := Subscription{
+				SubscriptionStatus: StatusActive,
+				Duration:           "month",
+				StartSubscription:  time.Now(),
+				EndSubscription:    time.Now().AddDate(0, 1, 0),
+			}
+			if err := db.UpdateUserSubscription(ctx, username, subscription); err != nil {
+				t.Fatalf("Failed to update subscription: %v", err)
+			}
+			if err := db.ExtendSubscription(ctx, username, 24*time.Hour); err != nil {
+				t.Fatalf("Failed to extend subscription: %v", err)
+			}
+			if err := db.UpdateUserTraffic(ctx, username, 42.5); err != nil {
+				t.Fatalf("Failed to update traffic: %v", err)
+			}
+
+			user, err := db.User(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to retrieve user: %v", err)
+			}
+			if user.ChatID != 12345 || user.Traffic != 42.5 || user.Subscription.SubscriptionStatus != StatusActive {
+				t.Fatalf("Unexpected user: %+v", user)
+			}
+			assertTimeClose(t, "end_subscription", subscription.EndSubscription.Add(24*time.Hour), user.Subscription.EndSubscription)
+
+			status, err := db.SubscriptionStatus(ctx, username)
+			if err != nil || status != string(StatusActive) {
+				t.Fatalf("Expected status active, got: %s, %v", status, err)
+			}
+
+			usernames, err := db.AllUsername(ctx)
+			if err != nil || !contains(usernames, username) {
+				t.Fatalf("Expected %s in usernames, got: %v, %v", username, usernames, err)
+			}
+
+			if err := db.DeleteUser(ctx, username); err != nil {
+				t.Fatalf("Failed to delete user: %v", err)
+			}
+			if _, err := db.PurgeDeletedUsers(ctx, time.Now().Add(time.Hour)); err != nil {
+				t.Fatalf("Failed to purge deleted users: %v", err)
+			}
+			if _, err := db.UserIncludingDeleted(ctx, username); err == nil {
+				t.Fatalf("Expected purged user to be gone")
+			}
+		})
+	}
+}
+
+// BenchmarkConcurrentWrites measures traffic updates from concurrent writers to different users.
+// "Serialized" reproduces the process-wide write lock the database used to take,
+// "Concurrent" leaves concurrency to the connection pool.
+// SQLite has a single connection, run with TEST_POSTGRES=true to see the difference.
+func BenchmarkConcurrentWrites(b *testing.B) {
+	const users = 32
+
+	for _, driver := range testDrivers() {
+		db, err := NewDatabaseWithDriver(driver, dataSourceName, slog.New(slog.NewTextHandler(io.Discard, nil)))
+		if err != nil {
+			b.Fatalf("Failed to setup test database: %v", err)
+		}
+
+		usernames := make([]string, users)
+		for i := range usernames {
+			usernames[i] = fmt.Sprintf("bench_%s_%d", driver, i)
+			if err := db.CreateUser(ctx, &User{Username: usernames[i]}); err != nil {
+				b.Fatalf("Failed to create user: %v", err)
+			}
+		}
+
+		run := func(b *testing.B, lock func() func()) {
+			var next atomic.Int64
+			b.RunParallel(func(pb *testing.PB) {
+				username := usernames[next.Add(1)%users]
+				for pb.Next() {
+					unlock := lock()
+					err := db.UpdateUserTraffic(ctx, username, 1)
+					unlock()
+					if err != nil {
+						b.Errorf("Failed to update traffic: %v", err)
+						return
+					}
+				}
+			})
+		}
+
+		var mu sync.Mutex
+		b.Run(driver+"/Serialized", func(b *testing.B) {
+			run(b, func() func() { mu.Lock(); return mu.Unlock })
+		})
+		b.Run(driver+"/Concurrent", func(b *testing.B) {
+			run(b, func() func() { return func() {} })
+		})
+
+		teardownTestDB(db)
+	}
+}
+
+func TestTrafficAggregation(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	total, err := db.TotalTraffic(ctx)
+	if err != nil || total != 0 {
+		t.Fatalf("Expected total traffic 0 on an empty table, got: %v, %v", total, err)
+	}
+	top, err := db.TopTrafficUsers(ctx, 10)
+	if err != nil || len(top) != 0 {
+		t.Fatalf("Expected no top users on an empty table, got: %v, %v", top, err)
+	}
+
+	traffic := map[string]float64{"light": 1.5, "medium": 20, "heavy": 300, "idle_user": 0, "deleted": 1000}
+	for username, value := range traffic {
+		if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+		if err := db.UpdateUserTraffic(ctx, username, value); err != nil {
+			t.Fatalf("Failed to set traffic: %v", err)
+		}
+	}
+	if err := db.DeleteUser(ctx, "deleted"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+
+	total, err = db.TotalTraffic(ctx)
+	if err != nil || total != 321.5 {
+		t.Fatalf("Expected total traffic 321.5, got: %v, %v", total, err)
+	}
+
+	top, err = db.TopTrafficUsers(ctx, 2)
+	if err != nil {
+		t.Fatalf("Failed to get top traffic users: %v", err)
+	}
+	if len(top) != 2 || top[0].Username != "heavy" || top[1].Username != "medium" {
+		t.Fatalf("Expected top users: [heavy medium], got: %v", top)
+	}
+	if top[0].Traffic != 300 || top[0].Subscription.ID == 0 {
+		t.Fatalf("Expected heavy user with traffic and subscription, got: %+v", top[0])
+	}
+
+	if _, err := db.TopTrafficUsers(ctx, 0); err == nil {
+		t.Fatalf("Expected error for n = 0")
+	}
+}
+
+func TestSubscriptionStatusCounts(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	// Statuses nobody has are still reported
+	counts, err := db.SubscriptionStatusCounts(ctx)
+	if err != nil {
+		t.Fatalf("Failed to count subscription statuses: %v", err)
+	}
+	if want := map[string]int{"active": 0, "inactive": 0}; !reflect.DeepEqual(counts, want) {
+		t.Fatalf("Expected counts: %v, got: %v", want, counts)
+	}
+
+	now := time.Now()
+	active := Subscription{SubscriptionStatus: StatusActive, Duration: "1 month", StartSubscription: now, EndSubscription: now.AddDate(0, 1, 0)}
+	statuses := map[string]Subscription{
+		"active_one":    active,
+		"active_two":    active,
+		"active_three":  active,
+		"inactive_one":  {},
+		"inactive_two":  {},
+		"legacy_status": {},
+		"deleted":       active,
+	}
+	for username, subscription := range statuses {
+		if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345, Subscription: subscription}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+	if err := db.DeleteUser(ctx, "deleted"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+	// Rows from older versions may have no status, which counts as inactive
+	_, err = db.DB.ExecContext(ctx, db.rebind(`
+		UPDATE subscriptions SET subscription_status = NULL
+		WHERE id = (SELECT subscription_id FROM users WHERE username = $1)`), "legacy_status")
+	if err != nil {
+		t.Fatalf("Failed to clear subscription status: %v", err)
+	}
+
+	counts, err = db.SubscriptionStatusCounts(ctx)
+	if err != nil {
+		t.Fatalf("Failed to count subscription statuses: %v", err)
+	}
+	if want := map[string]int{"active": 3, "inactive": 3}; !reflect.DeepEqual(counts, want) {
+		t.Fatalf("Expected counts: %v, got: %v", want, counts)
+	}
+}
+
+func TestUsersOverTraffic(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	traffic := map[string]float64{"below_limit": 99.5, "at_limit": 100, "above_limit": 100.5, "far_above": 2000, "deleted": 5000}
+	for username, value := range traffic {
+		if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+		if err := db.UpdateUserTraffic(ctx, username, value); err != nil {
+			t.Fatalf("Failed to set traffic: %v", err)
+		}
+	}
+	if err := db.DeleteUser(ctx, "deleted"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+
+	users, err := db.UsersOverTraffic(ctx, 100)
+	if err != nil {
+		t.Fatalf("Failed to get users over traffic: %v", err)
+	}
+	if len(users) != 2 || users[0].Username != "far_above" || users[1].Username != "above_limit" {
+		t.Fatalf("Expected users over traffic: [far above], got: %v", users)
+	}
+
+	users, err = db.UsersOverTraffic(ctx, 5000)
+	if err != nil || users == nil || len(users) != 0 {
+		t.Fatalf("Expected an empty list: %v, got: %v", err, users)
+	}
+
+	if _, err := db.UsersOverTraffic(ctx, -1); err == nil {
+		t.Fatalf("Expected error for a negative threshold")
+	}
+}
+
+func TestUsersByDuration(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	durations := map[string]string{
+		"monthly_a": "month",
+		"monthly_b": "1 month",
+		"quarterly": "3 months",
+		"yearly_a":  "Year",
+		"yearly_b":  "1 year",
+		"lifetime":  "forever",
+		"deleted":   "year",
+	}
+	for username, duration := range durations {
+		user := &User{Username: username, ChatID: 12345, Subscription: Subscription{SubscriptionStatus: StatusInactive, Duration: duration}}
+		if err := db.CreateUser(ctx, user); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+	if err := db.DeleteUser(ctx, "deleted"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+
+	testCases := []struct {
+		duration string
+		want     []string
+	}{
+		{duration: "year", want: []string{"yearly_a", "yearly_b"}},
+		{duration: " 1  YEAR ", want: []string{"yearly_a", "yearly_b"}},
+		{duration: "month", want: []string{"monthly_a", "monthly_b"}},
+		{duration: "3 months", want: []string{"quarterly"}},
+		{duration: "forever", want: []string{"lifetime"}},
+		{duration: "7d", want: []string{}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.duration, func(t *testing.T) {
+			users, err := db.UsersByDuration(ctx, tc.duration)
+			if err != nil {
+				t.Fatalf("Failed to get users by duration: %v", err)
+			}
+			usernames := []string{}
+			for _, user := range users {
+				usernames = append(usernames, user.Username)
+			}
+			if !reflect.DeepEqual(usernames, tc.want) {
+				t.Fatalf("Expected users: %v, got: %v", tc.want, usernames)
+			}
+		})
+	}
+
+	if _, err := db.UsersByDuration(ctx, "someday"); err == nil {
+		t.Fatalf("Expected error for an invalid duration")
+	}
+}
+
+func TestListUsers(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	for _, username := range []string{"carol", "alice", "david", "bobby", "erina"} {
+		if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	type testCase struct {
+		name          string
+		offset        int
+		limit         int
+		wantUsernames []string
+		wantErr       bool
+	}
+
+	testCases := []testCase{
+		{name: "FirstPage", offset: 0, limit: 2, wantUsernames: []string{"alice", "bobby"}},
+		{name: "SecondPage", offset: 2, limit: 2, wantUsernames: []string{"carol", "david"}},
+		{name: "LastPage", offset: 4, limit: 2, wantUsernames: []string{"erina"}},
+		{name: "PastEnd", offset: 10, limit: 2, wantUsernames: []string{}},
+		{name: "InvalidLimit", offset: 0, limit: 0, wantErr: true},
+		{name: "InvalidOffset", offset: -1, limit: 2, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			users, err := db.ListUsers(ctx, tc.offset, tc.limit)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			usernames := []string{}
+			for _, user := range users {
+				usernames = append(usernames, user.Username)
+			}
+			if fmt.Sprint(usernames) != fmt.Sprint(tc.wantUsernames) {
+				t.Fatalf("Expected usernames: %v, got: %v", tc.wantUsernames, usernames)
+			}
+		})
+	}
+}
+
+func TestCreateUsers(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	err = db.CreateUsers(ctx, []User{{Username: "first", Traffic: 3}, {Username: "second"}})
+	if err != nil {
+		t.Fatalf("Failed to create users: %v", err)
+	}
+	user, err := db.User(ctx, "first")
+	if err != nil || user.Traffic != 3 {
+		t.Fatalf("Expected first user with traffic 3, got: %+v, %v", user, err)
+	}
+
+	// The duplicate rolls back the whole batch
+	err = db.CreateUsers(ctx, []User{{Username: "third"}, {Username: "first"}})
+	if !errors.Is(err, ErrUserExists) {
+		t.Fatalf("Expected ErrUserExists, got: %v", err)
+	}
+	if !strings.Contains(err.Error(), "user 2 (first)") {
+		t.Fatalf("Expected error naming the failing user, got: %v", err)
+	}
+	exists, err := db.IsUserExists(ctx, "third")
+	if err != nil || exists {
+		t.Fatalf("Expected third user to be rolled back, got: %v, %v", exists, err)
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	chatID := int64(67890)
+	traffic := 42.5
+	subscription := Subscription{
+		SubscriptionStatus: StatusActive,
+		Duration:           "1 month",
+		StartSubscription:  time.Now(),
+		EndSubscription:    time.Now().AddDate(0, 1, 0),
+	}
+
+	type testCase struct {
+		name        string
+		username    string
+		patch       UserPatch
+		wantChatID  int64
+		wantTraffic float64
+		wantStatus  SubscriptionStatus
+		wantErr     error
+	}
+
+	testCases := []testCase{
+		{name: "ChatIDOnly", username: "patchuser", patch: UserPatch{ChatID: &chatID}, wantChatID: 67890, wantTraffic: 10, wantStatus: StatusInactive},
+		{name: "TrafficOnly", username: "patchuser", patch: UserPatch{Traffic: &traffic}, wantChatID: 12345, wantTraffic: 42.5, wantStatus: StatusInactive},
+		{name: "SubscriptionOnly", username: "patchuser", patch: UserPatch{Subscription: &subscription}, wantChatID: 12345, wantTraffic: 10, wantStatus: StatusActive},
+		{name: "All", username: "patchuser", patch: UserPatch{ChatID: &chatID, Traffic: &traffic, Subscription: &subscription}, wantChatID: 67890, wantTraffic: 42.5, wantStatus: StatusActive},
+		{name: "Empty", username: "patchuser", patch: UserPatch{}, wantErr: ErrEmptyPatch},
+		{name: "NotFound", username: "nonexistentuser", patch: UserPatch{ChatID: &chatID}, wantErr: ErrUserNotFound},
+		{name: "SubscriptionNotFound", username: "nonexistentuser", patch: UserPatch{Subscription: &subscription}, wantErr: ErrUserNotFound},
+		{name: "InvalidStatusRollsBack", username: "patchuser", patch: UserPatch{ChatID: &chatID, Subscription: &Subscription{SubscriptionStatus: "actve"}}, wantErr: ErrInvalidSubscriptionStatus},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			db, err := setupTestDB()
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			if err := db.CreateUser(ctx, &User{Username: "patchuser", ChatID: 12345, Traffic: 10}); err != nil {
+				t.Fatalf("Failed to create initial user: %v", err)
+			}
+
+			err = db.UpdateUser(ctx, tc.username, tc.patch)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+				}
+				// Nothing of a failed patch is kept
+				user, err := db.User(ctx, "patchuser")
+				if err != nil || user.ChatID != 12345 {
+					t.Fatalf("Expected user to be unchanged, got: %+v, %v", user, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to patch user: %v", err)
+			}
+
+			user, err := db.User(ctx, tc.username)
+			if err != nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+			if user.ChatID != tc.wantChatID || user.Traffic != tc.wantTraffic || user.Subscription.SubscriptionStatus != tc.wantStatus {
+				t.Fatalf("Expected chat_id %d, traffic %v, status %s, got: %+v", tc.wantChatID, tc.wantTraffic, tc.wantStatus, user)
+			}
+		})
+	}
+}
+
+func TestListUsersAfter(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	want := map[string]bool{}
+	for i := 0; i < 25; i++ {
+		username := fmt.Sprintf("user%02d", i*2)
+		if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+		want[username] = true
+	}
+
+	// Insert users between the pages, before and after the cursor, like a concurrent writer would
+	seen := map[string]int{}
+	after := ""
+	for page := 0; ; page++ {
+		users, err := db.ListUsersAfter(ctx, after, 4)
+		if err != nil {
+			t.Fatalf("Failed to list users: %v", err)
+		}
+		for _, user := range users {
+			seen[user.Username]++
+		}
+		if len(users) < 4 {
+			break
+		}
+		after = users[len(users)-1].Username
+
+		for _, username := range []string{fmt.Sprintf("user%02d", page*8+1), fmt.Sprintf("new%02d", page), fmt.Sprintf("zed%02d", page)} {
+			if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+				t.Fatalf("Failed to create concurrent user: %v", err)
+			}
+		}
+	}
+
+	for username := range want {
+		if seen[username] != 1 {
+			t.Fatalf("Expected %s to be returned once, got: %d", username, seen[username])
+		}
+	}
+	// Users created past the cursor are picked up by a later page
+	if seen["zed00"] != 1 {
+		t.Fatalf("Expected zed00 created after the cursor to be returned once, got: %d", seen["zed00"])
+	}
+	for username, count := range seen {
+		if count != 1 {
+			t.Fatalf("Expected %s to be returned once, got: %d", username, count)
+		}
+	}
+
+	if _, err := db.ListUsersAfter(ctx, "", 0); err == nil {
+		t.Fatalf("Expected error for limit 0")
+	}
+}
+
+func TestSubscriptionDates(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	start := time.Now().Truncate(time.Second)
+	testCases := []struct {
+		name         string
+		subscription Subscription
+		wantErr      bool
+	}{
+		{
+			name:         "ReversedDates",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: start, EndSubscription: start.AddDate(0, -1, 0)},
+			wantErr:      true,
+		},
+		{
+			name:         "EndEqualsStart",
+			subscription: Subscription{SubscriptionStatus: StatusInactive, Duration: "month", StartSubscription: start, EndSubscription: start},
+			wantErr:      true,
+		},
+		{
+			name:         "ActiveWithZeroEnd",
+			subscription: Subscription{SubscriptionStatus: StatusActive, StartSubscription: start},
+			wantErr:      true,
+		},
+		{
+			name:         "ActiveWithZeroStart",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", EndSubscription: start.AddDate(0, 1, 0)},
+			wantErr:      true,
+		},
+		{
+			name:         "ActiveForever",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: DurationForever, StartSubscription: start},
+		},
+		{
+			name:         "InactiveWithZeroEnd",
+			subscription: Subscription{SubscriptionStatus: StatusInactive, Duration: "month", StartSubscription: start},
+		},
+		{
+			name:         "Valid",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: start, EndSubscription: start.AddDate(0, 1, 0)},
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			username := fmt.Sprintf("datesuser%d", i)
+			err := db.CreateUser(ctx, &User{Username: username, Subscription: tc.subscription})
+			if tc.wantErr != errors.Is(err, ErrInvalidSubscriptionDates) {
+				t.Fatalf("Expected ErrInvalidSubscriptionDates: %v, got: %v", tc.wantErr, err)
+			}
+
+			// Updating an existing user is validated the same way
+			if tc.wantErr {
+				if err := db.CreateUser(ctx, &User{Username: username}); err != nil {
+					t.Fatalf("Failed to create user: %v", err)
+				}
+			}
+			err = db.UpdateUserSubscription(ctx, username, tc.subscription)
+			if tc.wantErr != errors.Is(err, ErrInvalidSubscriptionDates) {
+				t.Fatalf("Expected ErrInvalidSubscriptionDates on update: %v, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSubscriptionHistory(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			username := "historyuser_" + driver
+			if err := db.CreateUser(ctx, &User{Username: username}); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+
+			start := time.Now().Truncate(time.Second)
+			active := Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: start, EndSubscription: start.AddDate(0, 1, 0)}
+			if err := db.UpdateUserSubscription(ctx, username, active); err != nil {
+				t.Fatalf("Failed to update subscription: %v", err)
+			}
+			if err := db.ExtendSubscription(WithChangeSource(ctx, "support"), username, 24*time.Hour); err != nil {
+				t.Fatalf("Failed to extend subscription: %v", err)
+			}
+			if err := db.UpdateUser(ctx, username, UserPatch{Subscription: &Subscription{SubscriptionStatus: StatusInactive, Duration: "month", StartSubscription: start}}); err != nil {
+				t.Fatalf("Failed to patch user: %v", err)
+			}
+
+			// Rejected changes leave no entry
+			reversed := Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: start, EndSubscription: start.AddDate(0, -1, 0)}
+			if err := db.UpdateUserSubscription(ctx, username, reversed); !errors.Is(err, ErrInvalidSubscriptionDates) {
+				t.Fatalf("Expected ErrInvalidSubscriptionDates, got: %v", err)
+			}
+			if err := db.ExtendSubscription(ctx, "nosuchuser", time.Hour); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Expected ErrUserNotFound, got: %v", err)
+			}
+
+			history, err := db.SubscriptionHistory(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to get subscription history: %v", err)
+			}
+
+			want := []SubscriptionChange{
+				{Username: username, OldStatus: StatusActive, NewStatus: StatusInactive, Source: SourceUpdate},
+				{Username: username, OldStatus: StatusActive, NewStatus: StatusActive, Source: "support"},
+				{Username: username, OldStatus: StatusInactive, NewStatus: StatusActive, Source: SourceUpdate},
+			}
+			if len(history) != len(want) {
+				t.Fatalf("Expected history: %v, got: %v", want, history)
+			}
+			for i, change := range history {
+				if change.ChangedAt.IsZero() {
+					t.Fatalf("Expected changed_at to be set, got: %v", change)
+				}
+				change.ChangedAt = time.Time{}
+				if change != want[i] {
+					t.Fatalf("Expected change %d: %v, got: %v", i, want[i], change)
+				}
+			}
+
+			quiet := "quietuser_" + driver
+			if err := db.CreateUser(ctx, &User{Username: quiet}); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+			empty, err := db.SubscriptionHistory(ctx, quiet)
+			if err != nil || empty == nil || len(empty) != 0 {
+				t.Fatalf("Expected an empty history: %v, got: %v", err, empty)
+			}
+
+			if _, err := db.SubscriptionHistory(ctx, "nosuchuser"); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Expected ErrUserNotFound, got: %v", err)
+			}
+			if err := db.DeleteUser(ctx, quiet); err != nil {
+				t.Fatalf("Failed to delete user: %v", err)
+			}
+			if _, err := db.SubscriptionHistory(ctx, quiet); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Expected ErrUserNotFound for a deleted user, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtendSubscriptionsBulk(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			prefix := "promo_" + driver + "_"
+			start := time.Now().Truncate(time.Second)
+			end := start.AddDate(0, 0, 10)
+			active := Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: start, EndSubscription: end}
+			for _, user := range []User{
+				{Username: prefix + "a", Subscription: active},
+				{Username: prefix + "b", Subscription: active},
+				{Username: prefix + "inactive"},
+			} {
+				if err := db.CreateUser(ctx, &user); err != nil {
+					t.Fatalf("Failed to create user: %v", err)
+				}
+			}
+			endOf := func(username string) time.Time {
+				user, err := db.User(ctx, username)
+				if err != nil {
+					t.Fatalf("Failed to get user: %v", err)
+				}
+				return user.Subscription.EndSubscription
+			}
+
+			// A specific list, skipping unknown and repeated names
+			extended, err := db.ExtendSubscriptionsBulk(ctx, []string{prefix + "a", prefix + "a", "nosuchuser", prefix + "inactive"}, 7*24*time.Hour)
+			if err != nil || extended != 2 {
+				t.Fatalf("Expected 2 extended subscriptions: %v, got: %d", err, extended)
+			}
+			if got := endOf(prefix + "a"); !got.Equal(end.AddDate(0, 0, 7)) {
+				t.Fatalf("Expected end: %v, got: %v", end.AddDate(0, 0, 7), got)
+			}
+			if got := endOf(prefix + "b"); !got.Equal(end) {
+				t.Fatalf("Expected unlisted user to keep end: %v, got: %v", end, got)
+			}
+
+			// All active users, which now includes the previously inactive one
+			extended, err = db.ExtendSubscriptionsBulk(ctx, nil, 24*time.Hour)
+			if err != nil || extended != 3 {
+				t.Fatalf("Expected 3 extended subscriptions: %v, got: %d", err, extended)
+			}
+			if got := endOf(prefix + "b"); !got.Equal(end.AddDate(0, 0, 1)) {
+				t.Fatalf("Expected end: %v, got: %v", end.AddDate(0, 0, 1), got)
+			}
+
+			history, err := db.SubscriptionHistory(ctx, prefix+"a")
+			if err != nil || len(history) != 2 || history[0].Source != SourceExtend {
+				t.Fatalf("Expected 2 extend entries: %v, got: %v", err, history)
+			}
+
+			if _, err := db.ExtendSubscriptionsBulk(ctx, nil, 0); err == nil {
+				t.Fatalf("Expected error for a zero duration")
+			}
+		})
+	}
+}
+
+func TestCancelSubscription(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			username := "canceluser_" + driver
+			start := time.Now().Add(-time.Hour).Truncate(time.Second)
+			user := &User{Username: username, Subscription: Subscription{
+				SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: start, EndSubscription: start.AddDate(0, 1, 0),
+			}}
+			if err := db.CreateUser(ctx, user); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+
+			before := time.Now().Truncate(time.Second)
+			if err := db.CancelSubscription(ctx, username); err != nil {
+				t.Fatalf("Failed to cancel subscription: %v", err)
+			}
+			cancelled, err := db.User(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+			sub := cancelled.Subscription
+			if sub.SubscriptionStatus != StatusInactive || sub.EndSubscription.Before(before) || sub.EndSubscription.After(time.Now()) {
+				t.Fatalf("Expected an inactive subscription ending now, got: %+v", sub)
+			}
+			if !sub.StartSubscription.Equal(start) || sub.Duration != "month" {
+				t.Fatalf("Expected start and duration to be kept, got: %+v", sub)
+			}
+
+			// Cancelling again changes nothing and records no history
+			if err := db.CancelSubscription(ctx, username); err != nil {
+				t.Fatalf("Failed to cancel cancelled subscription: %v", err)
+			}
+			again, err := db.User(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+			if !again.Subscription.EndSubscription.Equal(sub.EndSubscription) {
+				t.Fatalf("Expected end: %v, got: %v", sub.EndSubscription, again.Subscription.EndSubscription)
+			}
+
+			history, err := db.SubscriptionHistory(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to get subscription history: %v", err)
+			}
+			if len(history) != 1 || history[0].OldStatus != StatusActive || history[0].NewStatus != StatusInactive || history[0].Source != SourceCancel {
+				t.Fatalf("Expected a single cancel entry, got: %v", history)
+			}
+
+			if err := db.CancelSubscription(ctx, "nosuchuser"); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Expected ErrUserNotFound, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestDeleteUsers(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			prefix := "bulkdelete_" + driver + "_"
+			for _, name := range []string{"a", "b", "c", "soft"} {
+				if err := db.CreateUser(ctx, &User{Username: prefix + name}); err != nil {
+					t.Fatalf("Failed to create user: %v", err)
+				}
+			}
+			if err := db.DeleteUser(ctx, prefix+"soft"); err != nil {
+				t.Fatalf("Failed to soft-delete user: %v", err)
+			}
+
+			countSubscriptions := func() int {
+				var count int
+				if err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM subscriptions").Scan(&count); err != nil {
+					t.Fatalf("Failed to count subscriptions: %v", err)
+				}
+				return count
+			}
+			before := countSubscriptions()
+
+			// Unknown and repeated usernames are skipped
+			deleted, err := db.DeleteUsers(ctx, []string{prefix + "a", prefix + "missing", prefix + "b", prefix + "a", prefix + "soft"})
+			if err != nil {
+				t.Fatalf("Failed to delete users: %v", err)
+			}
+			if deleted != 3 {
+				t.Fatalf("Expected deleted: 3, got: %d", deleted)
+			}
+			if after := countSubscriptions(); after != before-3 {
+				t.Fatalf("Expected subscriptions: %d, got: %d", before-3, after)
+			}
+
+			for _, name := range []string{"a", "b", "soft"} {
+				user, err := db.UserIncludingDeleted(ctx, prefix+name)
+				if user != nil || !errors.Is(err, ErrUserNotFound) {
+					t.Fatalf("Expected user %s to be removed: %v, got: %v", name, err, user)
+				}
+			}
+			if exists, err := db.IsUserExists(ctx, prefix+"c"); err != nil || !exists {
+				t.Fatalf("Expected user c to be kept: %v, got: %v", err, exists)
+			}
+
+			deleted, err = db.DeleteUsers(ctx, nil)
+			if err != nil || deleted != 0 {
+				t.Fatalf("Expected nothing to be deleted: %v, got: %d", err, deleted)
+			}
+		})
+	}
+}
+
+func TestUpsertUser(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			username := "upsertuser_" + driver
+			start := time.Now().Truncate(time.Second)
+			created, err := db.UpsertUser(ctx, &User{
+				Username: username,
+				ChatID:   111,
+				Traffic:  50,
+				Subscription: Subscription{
+					SubscriptionStatus: StatusActive,
+					Duration:           "month",
+					StartSubscription:  start,
+					EndSubscription:    start.AddDate(0, 1, 0),
+				},
+			})
+			if err != nil || !created {
+				t.Fatalf("Expected the user to be created: %v, got: %v", err, created)
+			}
+			first, err := db.User(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to retrieve user: %v", err)
+			}
+
+			countSubscriptions := func() int {
+				var count int
+				if err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM subscriptions").Scan(&count); err != nil {
+					t.Fatalf("Failed to count subscriptions: %v", err)
+				}
+				return count
+			}
+			before := countSubscriptions()
+
+			// The username is reused after a ban by another chat
+			if err := db.DeleteUser(ctx, username); err != nil {
+				t.Fatalf("Failed to delete user: %v", err)
+			}
+			created, err = db.UpsertUser(ctx, &User{Username: username, ChatID: 222})
+			if err != nil || created {
+				t.Fatalf("Expected the user to be replaced: %v, got created: %v", err, created)
+			}
+
+			second, err := db.User(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to retrieve restored user: %v", err)
+			}
+			if second.ChatID != 222 || second.Traffic != 0 || second.DeletedAt != nil {
+				t.Fatalf("Expected chat_id 222, no traffic and no deleted_at, got: %+v", second)
+			}
+			if second.Subscription.SubscriptionStatus != StatusInactive || second.Subscription.ID == first.Subscription.ID {
+				t.Fatalf("Expected a new inactive subscription, got: %+v", second.Subscription)
+			}
+			if after := countSubscriptions(); after != before {
+				t.Fatalf("Expected the replaced subscription to be removed, subscriptions: %d, got: %d", before, after)
+			}
+		})
+	}
+}
+
+func TestUpsertUserTraffic(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			countSubscriptions := func() int {
+				var count int
+				if err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM subscriptions").Scan(&count); err != nil {
+					t.Fatalf("Failed to count subscriptions: %v", err)
+				}
+				return count
+			}
+
+			// The strict update keeps rejecting unknown users
+			username := "earlyreport_" + driver
+			if err := db.UpdateUserTraffic(ctx, username, 10); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Expected ErrUserNotFound, got: %v", err)
+			}
+
+			created, err := db.UpsertUserTraffic(ctx, username, 10)
+			if err != nil || !created {
+				t.Fatalf("Expected the user to be created: %v, got: %v", err, created)
+			}
+			user, err := db.User(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to retrieve user: %v", err)
+			}
+			if user.Traffic != 10 || user.Subscription.SubscriptionStatus != StatusInactive || user.Subscription.ID == 0 {
+				t.Fatalf("Expected traffic 10 and an inactive subscription, got: %+v", user)
+			}
+
+			before := countSubscriptions()
+			created, err = db.UpsertUserTraffic(ctx, username, 25)
+			if err != nil || created {
+				t.Fatalf("Expected the traffic to be updated: %v, got created: %v", err, created)
+			}
+			user, err = db.User(ctx, username)
+			if err != nil || user.Traffic != 25 {
+				t.Fatalf("Expected traffic 25: %v, got: %+v", err, user)
+			}
+			if after := countSubscriptions(); after != before {
+				t.Fatalf("Expected no new subscription, subscriptions: %d, got: %d", before, after)
+			}
+
+			// Deleted users stay deleted
+			if err := db.DeleteUser(ctx, username); err != nil {
+				t.Fatalf("Failed to delete user: %v", err)
+			}
+			if _, err := db.UpsertUserTraffic(ctx, username, 30); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Expected ErrUserNotFound, got: %v", err)
+			}
+			if after := countSubscriptions(); after != before {
+				t.Fatalf("Expected no new subscription, subscriptions: %d, got: %d", before, after)
+			}
+
+			if _, err := db.UpsertUserTraffic(ctx, "newuser_"+driver, -1); !errors.Is(err, ErrInvalidTraffic) {
+				t.Fatalf("Expected ErrInvalidTraffic, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestActiveSubscriptions(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	subscriptions, err := db.ActiveSubscriptions(ctx)
+	if err != nil || subscriptions == nil || len(subscriptions) != 0 {
+		t.Fatalf("Expected no active subscriptions: %v, got: %v", err, subscriptions)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	users := []User{
+		{Username: "active", Subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: now, EndSubscription: now.Add(10*day + time.Hour)}},
+		{Username: "forever", Subscription: Subscription{SubscriptionStatus: StatusActive, Duration: DurationForever, StartSubscription: now}},
+		{Username: "inactive", Subscription: Subscription{SubscriptionStatus: StatusInactive, Duration: "month", StartSubscription: now}},
+		{Username: "expired", Subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: now.AddDate(0, -2, 0), EndSubscription: now.AddDate(0, -1, 0)}},
+		{Username: "deleted", Subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: now, EndSubscription: now.AddDate(0, 1, 0)}},
+	}
+	for i := range users {
+		if err := db.CreateUser(ctx, &users[i]); err != nil {
+			t.Fatalf("Failed to create user %s: %v", users[i].Username, err)
+		}
+	}
+	if err := db.DeleteUser(ctx, "deleted"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+
+	subscriptions, err = db.ActiveSubscriptions(ctx)
+	if err != nil {
+		t.Fatalf("Failed to list active subscriptions: %v", err)
+	}
+	if len(subscriptions) != 2 || subscriptions[0].Username != "active" || subscriptions[1].Username != "forever" {
+		t.Fatalf("Expected active and forever, got: %+v", subscriptions)
+	}
+	if got := subscriptions[0]; got.RemainingDays != 11 || !got.EndSubscription.Equal(now.Add(10*day+time.Hour)) {
+		t.Fatalf("Expected 11 remaining days until %v, got: %+v", now.Add(10*day+time.Hour), got)
+	}
+	if got := subscriptions[1].RemainingDays; got != -1 {
+		t.Fatalf("Expected -1 remaining days for forever, got: %d", got)
+	}
+}
+
+func TestSubscriptionStatuses(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			now := time.Now()
+			users := []User{
+				{Username: "paid_user", Subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: now, EndSubscription: now.AddDate(0, 1, 0)}},
+				{Username: "free_user"},
+				{Username: "deleted", Subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: now, EndSubscription: now.AddDate(0, 1, 0)}},
+			}
+			for i := range users {
+				if err := db.CreateUser(ctx, &users[i]); err != nil {
+					t.Fatalf("Failed to create user %s: %v", users[i].Username, err)
+				}
+			}
+			if err := db.DeleteUser(ctx, "deleted"); err != nil {
+				t.Fatalf("Failed to delete user: %v", err)
+			}
+
+			statuses, err := db.SubscriptionStatuses(ctx, []string{"paid_user", "free_user", "deleted", "missing", "paid_user"})
+			if err != nil {
+				t.Fatalf("Failed to get subscription statuses: %v", err)
+			}
+			want := map[string]SubscriptionStatus{"paid_user": StatusActive, "free_user": StatusInactive}
+			if !reflect.DeepEqual(statuses, want) {
+				t.Fatalf("Expected statuses: %v, got: %v", want, statuses)
+			}
+
+			statuses, err = db.SubscriptionStatuses(ctx, []string{})
+			if err != nil || len(statuses) != 0 {
+				t.Fatalf("Expected no statuses: %v, got: %v", err, statuses)
+			}
+		})
+	}
+}
+
+func TestGetSubscription(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			prefix := "getsubscription_" + driver + "_"
+			now := time.Now()
+			for _, user := range []User{
+				{Username: prefix + "paid", Subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "1 month", StartSubscription: now, EndSubscription: now.AddDate(0, 1, 0)}},
+				{Username: prefix + "free"},
+				{Username: prefix + "deleted"},
+			} {
+				if err := db.CreateUser(ctx, &user); err != nil {
+					t.Fatalf("Failed to create user %s: %v", user.Username, err)
+				}
+			}
+			if err := db.DeleteUser(ctx, prefix+"deleted"); err != nil {
+				t.Fatalf("Failed to delete user: %v", err)
+			}
+
+			for _, name := range []string{"paid", "free"} {
+				user, err := db.User(ctx, prefix+name)
+				if err != nil {
+					t.Fatalf("Failed to get user: %v", err)
+				}
+				subscription, err := db.GetSubscription(ctx, prefix+name)
+				if err != nil {
+					t.Fatalf("Failed to get subscription: %v", err)
+				}
+				if !reflect.DeepEqual(*subscription, user.Subscription) {
+					t.Fatalf("Expected subscription: %+v, got: %+v", user.Subscription, *subscription)
+				}
+			}
+
+			for _, name := range []string{"deleted", "missing"} {
+				subscription, err := db.GetSubscription(ctx, prefix+name)
+				if !errors.Is(err, ErrUserNotFound) {
+					t.Fatalf("Expected ErrUserNotFound for %s: %v, got: %v", name, subscription, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLegacyTimestamps(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	if err := db.CreateUser(ctx, &User{Username: "legacy", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	// Written by an older version and by hand
+	_, err = db.DB.ExecContext(ctx, db.rebind(`
+		UPDATE subscriptions SET start_subscription = $1, end_subscription = $2
+		WHERE id = (SELECT subscription_id FROM users WHERE username = $3)`),
+		"2024-01-02 03:04:05", "2024-02-02T03:04:05.123456789Z", "legacy")
+	if err != nil {
+		t.Fatalf("Failed to write legacy timestamps: %v", err)
+	}
+
+	user, err := db.User(ctx, "legacy")
+	if err != nil {
+		t.Fatalf("Expected legacy timestamps to parse, got: %v", err)
+	}
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); !user.Subscription.StartSubscription.Equal(want) {
+		t.Fatalf("Expected start_subscription: %v, got: %v", want, user.Subscription.StartSubscription)
+	}
+	if want := time.Date(2024, 2, 2, 3, 4, 5, 123456789, time.UTC); !user.Subscription.EndSubscription.Equal(want) {
+		t.Fatalf("Expected end_subscription: %v, got: %v", want, user.Subscription.EndSubscription)
+	}
+
+	// Drivers may hand timestamps over as text as well, so the layouts are checked directly too
+	for _, value := range []string{"2024-01-02T03:04:05Z", "2024-01-02T03:04:05.000Z", "2024-01-02 03:04:05"} {
+		got, err := db.parseTime(ctx, "start_subscription", value)
+		if want := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC); err != nil || !got.Equal(want) {
+			t.Fatalf("Expected %s to parse as %v: %v, got: %v", value, want, err, got)
+		}
+	}
+	if _, err := db.parseTime(ctx, "start_subscription", "02/01/2024"); err == nil {
+		t.Fatalf("Expected error for an unknown timestamp format")
+	}
+}
+
+func TestCleanupUnusedSubscriptions(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	for _, username := range []string{"kept_user", "orphan1", "orphan2"} {
+		if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+	// Deleting the users directly leaves their subscriptions behind
+	if _, err := db.DB.ExecContext(ctx, "DELETE FROM users WHERE username IN ('orphan1', 'orphan2')"); err != nil {
+		t.Fatalf("Failed to delete users: %v", err)
+	}
+
+	removed, err := db.CleanupUnusedSubscriptions(ctx)
+	if err != nil || removed != 2 {
+		t.Fatalf("Expected 2 subscriptions removed: %v, got: %d", err, removed)
+	}
+
+	var remaining int
+	if err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM subscriptions").Scan(&remaining); err != nil {
+		t.Fatalf("Failed to count subscriptions: %v", err)
+	}
+	if remaining != 1 {
+		t.Fatalf("Expected the subscription of the remaining user to be kept, got: %d subscriptions", remaining)
+	}
+	if _, err := db.User(ctx, "kept_user"); err != nil {
+		t.Fatalf("Expected remaining user to be readable: %v", err)
+	}
+
+	removed, err = db.CleanupUnusedSubscriptions(ctx)
+	if err != nil || removed != 0 {
+		t.Fatalf("Expected nothing left to remove: %v, got: %d", err, removed)
+	}
+}
+
+func TestCleanupUnusedSubscriptionsAtStartup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	db, err := NewDatabaseWithDriver(DriverSQLite, path, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	for _, username := range []string{"kept_user", "orphan1", "orphan2", "orphan3"} {
+		if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+	if _, err := db.DB.ExecContext(ctx, "DELETE FROM users WHERE username LIKE 'orphan%'"); err != nil {
+		t.Fatalf("Failed to delete users: %v", err)
+	}
+	db.Close()
+
+	var logs bytes.Buffer
+	db, err = NewDatabaseWithDriver(DriverSQLite, path, slog.New(slog.NewTextHandler(&logs, nil)))
+	if err != nil {
+		t.Fatalf("Failed to reopen test database: %v", err)
+	}
+	defer db.Close()
+
+	if !strings.Contains(logs.String(), `msg="Unused subscriptions cleaned up" count=3`) {
+		t.Fatalf("Expected 3 unused subscriptions to be logged, got: %s", logs.String())
+	}
+}
+
+func TestOperationLogLevel(t *testing.T) {
+	testCases := []struct {
+		name      string
+		level     slog.Level
+		wantLines bool
+	}{
+		{name: "Info", level: slog.LevelInfo, wantLines: false},
+		{name: "Debug", level: slog.LevelDebug, wantLines: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			db, err := NewDatabaseWithDriver(DriverSQLite, dataSourceName, slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{Level: tc.level})))
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			// Only the per-operation lines are checked, opening the database logs at info
+			logs.Reset()
+			if err := db.CreateUser(ctx, &User{Username: "logged_user", ChatID: 12345}); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+			if _, err := db.IsUserExists(ctx, "logged_user"); err != nil {
+				t.Fatalf("Failed to check user: %v", err)
+			}
+			if err := db.UpdateUserTraffic(ctx, "logged_user", 10); err != nil {
+				t.Fatalf("Failed to update traffic: %v", err)
+			}
+			if err := db.DeleteUser(ctx, "logged_user"); err != nil {
+				t.Fatalf("Failed to delete user: %v", err)
+			}
+
+			out := logs.String()
+			for _, line := range []string{"Preparing to insert user", "Checking if user exists", "Updating traffic", "Preparing to delete user"} {
+				if strings.Contains(out, line) != tc.wantLines {
+					t.Fatalf("Expected %q logged: %v, got: %s", line, tc.wantLines, out)
+				}
+			}
+			if !tc.wantLines && strings.Contains(out, "logged_user") {
+				t.Fatalf("Expected no username at info level, got: %s", out)
+			}
+		})
+	}
+}
+
+func TestCleanupManyUnusedSubscriptions(t *testing.T) {
+	const orphans = 1000
+
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			if err := db.CreateUser(ctx, &User{Username: "kept_user", ChatID: 12345}); err != nil {
+				t.Fatalf("Failed to create initial user: %v", err)
+			}
+			tx, err := db.DB.BeginTx(ctx, nil)
+			if err != nil {
+				t.Fatalf("Failed to begin transaction: %v", err)
+			}
+			for i := 0; i < orphans; i++ {
+				if _, err := db.addSubscription(ctx, tx, defaultSubscription(time.Now())); err != nil {
+					t.Fatalf("Failed to add subscription: %v", err)
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				t.Fatalf("Failed to commit transaction: %v", err)
+			}
+
+			removed, err := db.CleanupUnusedSubscriptions(ctx)
+			if err != nil || removed != orphans {
+				t.Fatalf("Expected %d subscriptions removed: %v, got: %d", orphans, err, removed)
+			}
+
+			var remaining int
+			if err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM subscriptions").Scan(&remaining); err != nil {
+				t.Fatalf("Failed to count subscriptions: %v", err)
+			}
+			if remaining != 1 {
+				t.Fatalf("Expected only the used subscription to be kept, got: %d subscriptions", remaining)
+			}
+		})
+	}
+}
+
+// The cleanup once prepared a statement per row while the query was still open, holding on to connections until it returned
+func TestCleanupUnusedSubscriptionsReleasesConnections(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+	db.DB.SetMaxOpenConns(1)
+
+	for i := 0; i < 3; i++ {
+		tx, err := db.DB.BeginTx(ctx, nil)
+		if err != nil {
+			t.Fatalf("Failed to begin transaction: %v", err)
+		}
+		for j := 0; j < 200; j++ {
+			if _, err := db.addSubscription(ctx, tx, defaultSubscription(time.Now())); err != nil {
+				t.Fatalf("Failed to add subscription: %v", err)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatalf("Failed to commit transaction: %v", err)
+		}
+
+		// With a single connection a leaked one makes the cleanup or the query after it wait for the timeout
+		timeoutCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		removed, err := db.CleanupUnusedSubscriptions(timeoutCtx)
+		if err != nil || removed != 200 {
+			cancel()
+			t.Fatalf("Expected 200 subscriptions removed: %v, got: %d", err, removed)
+		}
+		if _, err := db.AllUsername(timeoutCtx); err != nil {
+			cancel()
+			t.Fatalf("Expected the connection to be free after the cleanup: %v", err)
+		}
+		cancel()
+	}
+
+	if inUse := db.DB.Stats().InUse; inUse != 0 {
+		t.Fatalf("Expected no connection in use after the cleanup, got: %d", inUse)
+	}
+}
+
+func TestActivateSubscription(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			username := "activateuser_" + driver
+			if err := db.CreateUser(ctx, &User{Username: username}); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+
+			before := time.Now().Truncate(time.Second)
+			if err := db.ActivateSubscription(ctx, username, "3 months"); err != nil {
+				t.Fatalf("Failed to activate subscription: %v", err)
+			}
+			activated, err := db.User(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+			sub := activated.Subscription
+			if sub.SubscriptionStatus != StatusActive || sub.Duration != "3 months" || sub.StartSubscription.Before(before) {
+				t.Fatalf("Expected an active 3 months subscription starting now, got: %+v", sub)
+			}
+			if got := sub.EndSubscription.Sub(sub.StartSubscription); got != 90*day {
+				t.Fatalf("Expected the subscription to last %v, got: %v", 90*day, got)
+			}
+
+			history, err := db.SubscriptionHistory(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to get subscription history: %v", err)
+			}
+			if len(history) != 1 || history[0].NewStatus != StatusActive || history[0].Source != SourceActivate {
+				t.Fatalf("Expected a single activate entry, got: %v", history)
+			}
+
+			if err := db.ActivateSubscription(ctx, username, "soon"); err == nil {
+				t.Fatalf("Expected error for an invalid duration")
+			}
+			if err := db.ActivateSubscription(ctx, "nosuchuser", "1 month"); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Expected ErrUserNotFound, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestNullSubscriptionStatus(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	if err := db.CreateUser(ctx, &User{Username: "legacy", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+	// Left by old versions, the column allows NULL
+	_, err = db.DB.ExecContext(ctx, db.rebind(`
+		UPDATE subscriptions SET subscription_status = NULL
+		WHERE id = (SELECT subscription_id FROM users WHERE username = $1)`), "legacy")
+	if err != nil {
+		t.Fatalf("Failed to clear subscription status: %v", err)
+	}
+
+	status, err := db.SubscriptionStatus(ctx, "legacy")
+	if err != nil || status != string(StatusInactive) {
+		t.Fatalf("Expected status: %s, got: %q, %v", StatusInactive, status, err)
+	}
+
+	user, err := db.User(ctx, "legacy")
+	if err != nil || user.Subscription.SubscriptionStatus != StatusInactive {
+		t.Fatalf("Expected user with status: %s: %v, got: %v", StatusInactive, err, user)
+	}
+
+	statuses, err := db.SubscriptionStatuses(ctx, []string{"legacy"})
+	if err != nil || statuses["legacy"] != StatusInactive {
+		t.Fatalf("Expected statuses: map[legacy:%s]: %v, got: %v", StatusInactive, err, statuses)
+	}
+
+	// Changes record the old status as inactive
+	if err := db.ExtendSubscription(ctx, "legacy", day); err != nil {
+		t.Fatalf("Failed to extend subscription: %v", err)
+	}
+	history, err := db.SubscriptionHistory(ctx, "legacy")
+	if err != nil || len(history) != 1 || history[0].OldStatus != StatusInactive {
+		t.Fatalf("Expected a change from %s: %v, got: %v", StatusInactive, err, history)
+	}
+}
+
+func TestTruncateUsers(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			prefix := "truncate_" + driver + "_"
+			for _, name := range []string{"a", "b", "soft"} {
+				if err := db.CreateUser(ctx, &User{Username: prefix + name}); err != nil {
+					t.Fatalf("Failed to create user: %v", err)
+				}
+			}
+			if err := db.DeleteUser(ctx, prefix+"soft"); err != nil {
+				t.Fatalf("Failed to soft-delete user: %v", err)
+			}
+
+			if err := db.TruncateUsers(ctx); err != nil {
+				t.Fatalf("Failed to truncate users: %v", err)
+			}
+
+			for _, table := range []string{"users", "subscriptions"} {
+				var count int
+				if err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&count); err != nil {
+					t.Fatalf("Failed to count %s: %v", table, err)
+				}
+				if count != 0 {
+					t.Fatalf("Expected no rows in %s, got: %d", table, count)
+				}
+			}
+
+			// The tables stay usable
+			if err := db.CreateUser(ctx, &User{Username: prefix + "a"}); err != nil {
+				t.Fatalf("Failed to create user after truncating: %v", err)
+			}
+		})
+	}
+}
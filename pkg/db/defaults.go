@@ -0,0 +1,59 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultSubscriptionDuration is the duration of new users' subscriptions when DEFAULT_SUBSCRIPTION_DURATION is not set
+const defaultSubscriptionDuration = "month"
+
+// subscriptionDefaults describes the subscription given to users created without one
+type subscriptionDefaults struct {
+	// duration is the subscription duration, such as "month" or "7d"
+	duration string
+	// trial starts the subscription active for duration instead of inactive
+	trial bool
+}
+
+// subscriptionDefaultsFromEnv reads the defaults for new users from DEFAULT_SUBSCRIPTION_DURATION and DEFAULT_TRIAL
+func subscriptionDefaultsFromEnv() (subscriptionDefaults, error) {
+	defaults := subscriptionDefaults{duration: defaultSubscriptionDuration}
+
+	if value := os.Getenv("DEFAULT_SUBSCRIPTION_DURATION"); value != "" {
+		if _, _, err := ParseDuration(value); err != nil {
+			return defaults, fmt.Errorf("invalid DEFAULT_SUBSCRIPTION_DURATION: %w", err)
+		}
+		defaults.duration = value
+	}
+
+	if value := os.Getenv("DEFAULT_TRIAL"); value != "" {
+		trial, err := strconv.ParseBool(value)
+		if err != nil {
+			return defaults, fmt.Errorf("invalid DEFAULT_TRIAL %q: must be true or false", value)
+		}
+		defaults.trial = trial
+	}
+
+	return defaults, nil
+}
+
+// subscription returns the subscription of a user created at now without one:
+// an active trial ending after the default duration, or an inactive subscription.
+func (d subscriptionDefaults) subscription(now time.Time) (Subscription, error) {
+	duration := d.duration
+	if duration == "" {
+		duration = defaultSubscriptionDuration
+	}
+	if !d.trial {
+		return Subscription{SubscriptionStatus: StatusInactive, Duration: duration, StartSubscription: now}, nil
+	}
+
+	subscription := Subscription{SubscriptionStatus: StatusActive, Duration: duration, StartSubscription: now}
+	if err := subscription.applyDuration(now); err != nil {
+		return Subscription{}, fmt.Errorf("failed to apply default subscription duration: %w", err)
+	}
+	return subscription, nil
+}
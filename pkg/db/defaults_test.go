@@ -0,0 +1,87 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDefaultSubscription(t *testing.T) {
+	testCases := []struct {
+		name         string
+		duration     string
+		trial        string
+		wantStatus   SubscriptionStatus
+		wantDuration string
+		wantLength   time.Duration
+	}{
+		{name: "Unset", wantStatus: StatusInactive, wantDuration: "month"},
+		{name: "TrialOff", duration: "year", trial: "false", wantStatus: StatusInactive, wantDuration: "year"},
+		{name: "TrialOn", duration: "7d", trial: "true", wantStatus: StatusActive, wantDuration: "7d", wantLength: 7 * 24 * time.Hour},
+		{name: "TrialOnDefaultDuration", trial: "true", wantStatus: StatusActive, wantDuration: "month", wantLength: 30 * 24 * time.Hour},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("DEFAULT_SUBSCRIPTION_DURATION", tc.duration)
+			t.Setenv("DEFAULT_TRIAL", tc.trial)
+			db, err := setupTestDB()
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			if err := db.CreateUser(ctx, &User{Username: "newcomer", ChatID: 12345}); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+			user, err := db.User(ctx, "newcomer")
+			if err != nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+
+			sub := user.Subscription
+			if sub.SubscriptionStatus != tc.wantStatus || sub.Duration != tc.wantDuration {
+				t.Fatalf("Expected subscription: %s %s, got: %s %s", tc.wantStatus, tc.wantDuration, sub.SubscriptionStatus, sub.Duration)
+			}
+			if tc.wantLength == 0 {
+				if !sub.EndSubscription.IsZero() {
+					t.Fatalf("Expected no end, got: %v", sub.EndSubscription)
+				}
+				return
+			}
+			if length := sub.EndSubscription.Sub(sub.StartSubscription); length != tc.wantLength {
+				t.Fatalf("Expected trial length: %v, got: %v", tc.wantLength, length)
+			}
+
+			// A subscription given by the caller is kept as is
+			given := Subscription{SubscriptionStatus: StatusInactive, Duration: "year"}
+			if err := db.CreateUser(ctx, &User{Username: "subscriber", Subscription: given}); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+			user, err = db.User(ctx, "subscriber")
+			if err != nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+			if user.Subscription.SubscriptionStatus != StatusInactive || user.Subscription.Duration != "year" {
+				t.Fatalf("Expected subscription: inactive year, got: %+v", user.Subscription)
+			}
+		})
+	}
+}
+
+func TestSubscriptionDefaultsFromEnvInvalid(t *testing.T) {
+	for name, env := range map[string][2]string{
+		"Duration": {"fortnight", ""},
+		"Trial":    {"", "maybe"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv("DEFAULT_SUBSCRIPTION_DURATION", env[0])
+			t.Setenv("DEFAULT_TRIAL", env[1])
+			if _, err := subscriptionDefaultsFromEnv(); err == nil {
+				t.Fatalf("Expected an error")
+			}
+			if _, err := setupTestDB(); err == nil {
+				t.Fatalf("Expected opening the database to fail")
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Supported database drivers
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+)
+
+// dialect holds the queries whose SQL differs between the supported drivers
+type dialect struct {
+	extendSubscriptionSQL string
+	purgeDeletedUsersSQL  string
+	searchUsernamesSQL    string
+	inactiveUsersSQL      string
+	usersCreatedSQL       string
+	// subscriptionStatusesSQL selects username and status of the users named in the list bound by listArg
+	subscriptionStatusesSQL string
+	// listArg turns a list of strings into a single query argument
+	listArg func(values []string) any
+	// tableColumnsSQL lists the table and column names of the schema in use
+	tableColumnsSQL string
+}
+
+var dialects = map[string]dialect{
+	DriverPostgres: {
+		extendSubscriptionSQL: `
+    		UPDATE subscriptions 
+        	SET subscription_status = 'active',
+        	    start_subscription = CASE WHEN subscription_status = 'active' THEN start_subscription ELSE $1 END,
+        	    end_subscription = GREATEST(end_subscription, $1) + make_interval(secs => $2)
+        	WHERE id = (SELECT subscription_id FROM users WHERE username = $3 AND deleted_at IS NULL)`,
+		purgeDeletedUsersSQL: "DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at < $1",
+		inactiveUsersSQL: selectUsersSQL + `
+			WHERE users.deleted_at IS NULL AND (users.last_active IS NULL OR users.last_active < $1)
+			ORDER BY users.username`,
+		usersCreatedSQL: selectUsersSQL + `
+			WHERE users.deleted_at IS NULL AND users.created_at >= $1 AND users.created_at <= $2
+			ORDER BY users.created_at, users.username`,
+		subscriptionStatusesSQL: `
+			SELECT users.username, subscriptions.subscription_status
+			FROM users
+			JOIN subscriptions ON users.subscription_id = subscriptions.id
+			WHERE users.username = ANY($1) AND users.deleted_at IS NULL`,
+		listArg: func(values []string) any { return pq.Array(values) },
+		searchUsernamesSQL: `
+			SELECT username FROM users
+			WHERE deleted_at IS NULL AND username ILIKE $1 || '%' ESCAPE '\'
+			ORDER BY username LIMIT $2`,
+		tableColumnsSQL: `
+			SELECT table_name, column_name FROM information_schema.columns
+			WHERE table_schema = current_schema()`,
+	},
+	// SQLite stores timestamps as text, so they are compared and shifted through julianday
+	DriverSQLite: {
+		extendSubscriptionSQL: `
+    		UPDATE subscriptions 
+        	SET subscription_status = 'active',
+        	    start_subscription = CASE WHEN subscription_status = 'active' THEN start_subscription ELSE $1 END,
+        	    end_subscription = strftime('%Y-%m-%dT%H:%M:%SZ', max(julianday(end_subscription), julianday($1)) + $2 / 86400.0)
+        	WHERE id = (SELECT subscription_id FROM users WHERE username = $3 AND deleted_at IS NULL)`,
+		purgeDeletedUsersSQL: "DELETE FROM users WHERE deleted_at IS NOT NULL AND julianday(deleted_at) < julianday($1)",
+		inactiveUsersSQL: selectUsersSQL + `
+			WHERE users.deleted_at IS NULL AND (users.last_active IS NULL OR julianday(users.last_active) < julianday($1))
+			ORDER BY users.username`,
+		usersCreatedSQL: selectUsersSQL + `
+			WHERE users.deleted_at IS NULL AND julianday(users.created_at) BETWEEN julianday($1) AND julianday($2)
+			ORDER BY julianday(users.created_at), users.username`,
+		// SQLite has no arrays, the list is bound as a JSON array
+		subscriptionStatusesSQL: `
+			SELECT users.username, subscriptions.subscription_status
+			FROM users
+			JOIN subscriptions ON users.subscription_id = subscriptions.id
+			WHERE users.username IN (SELECT value FROM json_each($1)) AND users.deleted_at IS NULL`,
+		listArg: func(values []string) any {
+			// Marshalling strings cannot fail
+			encoded, _ := json.Marshal(values)
+			return string(encoded)
+		},
+		// LIKE is case-insensitive for ASCII in SQLite
+		searchUsernamesSQL: `
+			SELECT username FROM users
+			WHERE deleted_at IS NULL AND username LIKE $1 || '%' ESCAPE '\'
+			ORDER BY username LIMIT $2`,
+		// SQLite has no information_schema, its tables are listed in sqlite_master
+		tableColumnsSQL: `
+			SELECT m.name, p.name FROM sqlite_master AS m
+			JOIN pragma_table_info(m.name) AS p
+			WHERE m.type = 'table'`,
+	},
+}
+
+// placeholderStyle returns the bind variable prefix used by the driver
+func placeholderStyle(driver string) byte {
+	if driver == DriverSQLite {
+		return '?'
+	}
+	return '$'
+}
+
+// rebind rewrites the Postgres style $N placeholders of a query into the style of the driver.
+// SQLite gets numbered ?N placeholders, which bind by position like $N does in Postgres,
+// so a query may reuse or reorder its arguments on either backend.
+// Quoted literals and identifiers are copied unchanged.
+func rebind(driver, query string) string {
+	style := placeholderStyle(driver)
+	if style == '$' {
+		return query
+	}
+
+	var b strings.Builder
+	b.Grow(len(query))
+
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '$' && i+1 < len(query) && query[i+1] >= '0' && query[i+1] <= '9':
+			c = style
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// rebind rewrites the placeholders of a query for the database driver
+func (db *Database) rebind(query string) string {
+	return rebind(db.driver, query)
+}
@@ -0,0 +1,81 @@
+package db
+
+import "testing"
+
+func TestRebind(t *testing.T) {
+	type testCase struct {
+		name   string
+		driver string
+		query  string
+		want   string
+	}
+
+	testCases := []testCase{
+		{
+			name:   "PostgresUnchanged",
+			driver: DriverPostgres,
+			query:  "SELECT id FROM users WHERE username = $1 AND chat_id = $2",
+			want:   "SELECT id FROM users WHERE username = $1 AND chat_id = $2",
+		},
+		{
+			name:   "SQLiteNumbered",
+			driver: DriverSQLite,
+			query:  "SELECT id FROM users WHERE username = $1 AND chat_id = $2",
+			want:   "SELECT id FROM users WHERE username = ?1 AND chat_id = ?2",
+		},
+		{
+			name:   "SQLiteRepeated",
+			driver: DriverSQLite,
+			query:  "UPDATE subscriptions SET start_subscription = $1, end_subscription = $1 WHERE id = $10",
+			want:   "UPDATE subscriptions SET start_subscription = ?1, end_subscription = ?1 WHERE id = ?10",
+		},
+		{
+			name:   "SQLiteLiteralsKept",
+			driver: DriverSQLite,
+			query:  `SELECT '$1', "$2", $3 FROM users`,
+			want:   `SELECT '$1', "$2", ?3 FROM users`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := rebind(tc.driver, tc.query); got != tc.want {
+				t.Fatalf("Expected query: %s, got: %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestPlaceholderTranslation(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			// Arguments are reordered and reused to make sure they bind by position
+			var got string
+			query := db.rebind("SELECT CAST($2 AS TEXT) || CAST($1 AS TEXT) || CAST($2 AS TEXT)")
+			if err := db.DB.QueryRowContext(ctx, query, "a", "b").Scan(&got); err != nil {
+				t.Fatalf("Failed to run query: %v", err)
+			}
+			if got != "bab" {
+				t.Fatalf("Expected result: bab, got: %s", got)
+			}
+
+			username := "placeholder_" + driver
+			if err := db.CreateUser(ctx, &User{Username: username, ChatID: 42}); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+			user, err := db.User(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+			if user.ChatID != 42 {
+				t.Fatalf("Expected chat id: 42, got: %d", user.ChatID)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	day   = 24 * time.Hour
+	week  = 7 * day
+	month = 30 * day
+	year  = 365 * day
+
+	// DurationForever is the subscription duration that never ends
+	DurationForever = "forever"
+)
+
+// durationUnits maps the unit names accepted by ParseDuration to their length
+var durationUnits = map[string]time.Duration{
+	"d":      day,
+	"day":    day,
+	"days":   day,
+	"w":      week,
+	"week":   week,
+	"weeks":  week,
+	"month":  month,
+	"months": month,
+	"year":   year,
+	"years":  year,
+}
+
+// ParseDuration converts a subscription duration such as "1 month", "3 months", "year", "7d" or "forever"
+// into a time.Duration. A month is 30 days and a year is 365 days.
+// The returned bool reports a "forever" duration, in which case the time.Duration is zero.
+// Go duration strings like "12h" are accepted as well.
+func ParseDuration(s string) (time.Duration, bool, error) {
+	normalized := strings.ToLower(strings.TrimSpace(s))
+	if normalized == DurationForever {
+		return 0, true, nil
+	}
+
+	// A bare unit ("month", "year") means one of it
+	if unit, ok := durationUnits[normalized]; ok {
+		return unit, false, nil
+	}
+
+	// Split the leading count from the unit: "3 months", "3months", "7d"
+	i := 0
+	for i < len(normalized) && normalized[i] >= '0' && normalized[i] <= '9' {
+		i++
+	}
+	if i > 0 {
+		if unit, ok := durationUnits[strings.TrimSpace(normalized[i:])]; ok {
+			n, err := strconv.Atoi(normalized[:i])
+			if err != nil || n <= 0 {
+				return 0, false, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(n) * unit, false, nil
+		}
+	}
+
+	d, err := time.ParseDuration(normalized)
+	if err != nil || d <= 0 {
+		return 0, false, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, false, nil
+}
+
+// durationSpellings returns the duration in lower case with single spaces and the other way of writing it,
+// "1 month" for "month" and the reverse, or the normalized duration twice when there is none
+func durationSpellings(duration string) (string, string) {
+	normalized := strings.ToLower(strings.Join(strings.Fields(duration), " "))
+	if _, ok := durationUnits[normalized]; ok && len(normalized) > 1 {
+		return normalized, "1 " + normalized
+	}
+	if unit, ok := strings.CutPrefix(normalized, "1 "); ok {
+		if _, ok := durationUnits[unit]; ok && len(unit) > 1 {
+			return normalized, unit
+		}
+	}
+	return normalized, normalized
+}
+
+// applyDuration fills in the end of an active subscription from its duration when only the duration is given.
+// The start defaults to now. Forever subscriptions keep a zero end.
+// Inactive subscriptions are left untouched since a zero end is how they are stored.
+func (s *Subscription) applyDuration(now time.Time) error {
+	if s.SubscriptionStatus != StatusActive || !s.EndSubscription.IsZero() || strings.TrimSpace(s.Duration) == "" {
+		return nil
+	}
+
+	d, forever, err := ParseDuration(s.Duration)
+	if err != nil {
+		return err
+	}
+	if s.StartSubscription.IsZero() {
+		s.StartSubscription = now
+	}
+	if !forever {
+		s.EndSubscription = s.StartSubscription.Add(d)
+	}
+	return nil
+}
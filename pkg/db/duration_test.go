@@ -0,0 +1,116 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	type testCase struct {
+		name        string
+		input       string
+		want        time.Duration
+		wantForever bool
+		wantErr     bool
+	}
+
+	testCases := []testCase{
+		{name: "OneMonth", input: "1 month", want: 30 * 24 * time.Hour},
+		{name: "ThreeMonths", input: "3 months", want: 90 * 24 * time.Hour},
+		{name: "TwoMonthsNoSpace", input: "2months", want: 60 * 24 * time.Hour},
+		{name: "BareMonth", input: "month", want: 30 * 24 * time.Hour},
+		{name: "OneYear", input: "1 year", want: 365 * 24 * time.Hour},
+		{name: "BareYear", input: "Year", want: 365 * 24 * time.Hour},
+		{name: "Days", input: "7d", want: 7 * 24 * time.Hour},
+		{name: "Weeks", input: "2 weeks", want: 14 * 24 * time.Hour},
+		{name: "GoDuration", input: "12h", want: 12 * time.Hour},
+		{name: "Forever", input: "forever", wantForever: true},
+		{name: "ForeverPadded", input: "  FOREVER ", wantForever: true},
+		{name: "Empty", input: "", wantErr: true},
+		{name: "Zero", input: "0 months", wantErr: true},
+		{name: "Negative", input: "-1h", wantErr: true},
+		{name: "UnknownUnit", input: "3 fortnights", wantErr: true},
+		{name: "Garbage", input: "soon", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, forever, err := ParseDuration(tc.input)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Fatalf("Expected duration: %v, got: %v", tc.want, got)
+			}
+			if forever != tc.wantForever {
+				t.Fatalf("Expected forever: %v, got: %v", tc.wantForever, forever)
+			}
+		})
+	}
+}
+
+func TestApplyDuration(t *testing.T) {
+	now := time.Now()
+
+	type testCase struct {
+		name         string
+		subscription Subscription
+		wantStart    time.Time
+		wantEnd      time.Time
+		wantErr      bool
+	}
+
+	testCases := []testCase{
+		{
+			name:         "DurationOnly",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "1 month"},
+			wantStart:    now,
+			wantEnd:      now.Add(30 * 24 * time.Hour),
+		},
+		{
+			name:         "DurationWithStart",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "7d", StartSubscription: now.Add(-24 * time.Hour)},
+			wantStart:    now.Add(-24 * time.Hour),
+			wantEnd:      now.Add(6 * 24 * time.Hour),
+		},
+		{
+			name:         "ExplicitEndKept",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "1 year", StartSubscription: now, EndSubscription: now.Add(time.Hour)},
+			wantStart:    now,
+			wantEnd:      now.Add(time.Hour),
+		},
+		{
+			name:         "Forever",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "forever"},
+			wantStart:    now,
+		},
+		{
+			name:         "InvalidDuration",
+			subscription: Subscription{SubscriptionStatus: StatusActive, Duration: "soon"},
+			wantErr:      true,
+		},
+		{
+			name:         "InactiveUntouched",
+			subscription: Subscription{SubscriptionStatus: StatusInactive, Duration: "1 month"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sub := tc.subscription
+			err := sub.applyDuration(now)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if !sub.StartSubscription.Equal(tc.wantStart) {
+				t.Fatalf("Expected start_subscription: %v, got: %v", tc.wantStart, sub.StartSubscription)
+			}
+			if !sub.EndSubscription.Equal(tc.wantEnd) {
+				t.Fatalf("Expected end_subscription: %v, got: %v", tc.wantEnd, sub.EndSubscription)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	insertSubscriptionChangeSQL = `
+            INSERT INTO subscription_history (username, old_status, new_status, changed_at, source)
+            VALUES ($1, $2, $3, $4, $5)`
+
+	// Joined from users so a user without changes gets one row of NULLs and a missing user none
+	subscriptionHistorySQL = `
+            SELECT subscription_history.old_status, subscription_history.new_status,
+                   subscription_history.changed_at, subscription_history.source
+            FROM users
+            LEFT JOIN subscription_history ON subscription_history.username = users.username
+            WHERE users.username = $1 AND users.deleted_at IS NULL
+            ORDER BY subscription_history.changed_at DESC, subscription_history.id DESC`
+)
+
+// Sources of subscription changes recorded when the context names none, see WithChangeSource
+const (
+	SourceUpdate   = "update"
+	SourceExtend   = "extend"
+	SourceCancel   = "cancel"
+	SourceActivate = "activate"
+	SourceTransfer = "transfer"
+	// SourceScheduler marks the changes of the subscription check, which do not count as user activity
+	SourceScheduler = "scheduler"
+)
+
+// SubscriptionChange is an entry of a user's subscription history
+type SubscriptionChange struct {
+	Username  string             `json:"username" example:"john_doe"`
+	OldStatus SubscriptionStatus `json:"old_status" example:"inactive"`
+	NewStatus SubscriptionStatus `json:"new_status" example:"active"`
+	ChangedAt time.Time          `json:"changed_at"`
+	Source    string             `json:"source" example:"extend"`
+}
+
+type changeSourceKey struct{}
+
+// WithChangeSource returns a copy of ctx that records subscription changes made with it as coming from source,
+// for example "scheduler", instead of the name of the operation.
+func WithChangeSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, changeSourceKey{}, source)
+}
+
+// changeSource returns the source stored in ctx, or fallback if there is none
+func changeSource(ctx context.Context, fallback string) string {
+	if source, ok := ctx.Value(changeSourceKey{}).(string); ok && source != "" {
+		return source
+	}
+	return fallback
+}
+
+// currentStatus returns the status of the user's subscription within tx
+func (db *Database) currentStatus(ctx context.Context, tx *sql.Tx, username string) (SubscriptionStatus, error) {
+	var status sql.NullString
+	err := tx.QueryRowContext(ctx, db.rebind(userSubscriptionStatusSQL), username).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", &userNotFoundError{username: username}
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get subscription status: %w", err)
+	}
+	return nullableStatus(status), nil
+}
+
+// recordSubscriptionChange adds an entry to the user's subscription history within tx
+func (db *Database) recordSubscriptionChange(ctx context.Context, tx *sql.Tx, change SubscriptionChange) error {
+	_, err := tx.ExecContext(ctx, db.rebind(insertSubscriptionChangeSQL),
+		change.Username, change.OldStatus, change.NewStatus, FormatTime(change.ChangedAt), change.Source)
+	if err != nil {
+		return fmt.Errorf("failed to record subscription change: %w", err)
+	}
+	return nil
+}
+
+// SubscriptionHistory returns the changes of the user's subscription, the most recent first.
+// A missing or deleted user is reported as ErrUserNotFound.
+func (db *Database) SubscriptionHistory(ctx context.Context, username string) ([]SubscriptionChange, error) {
+	ctx, span := db.startSpan(ctx, "SubscriptionHistory", "SELECT")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Fetching subscription history", "username", username)
+
+	rows, err := db.DB.QueryContext(ctx, db.rebind(subscriptionHistorySQL), username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query subscription history: %w", err)
+	}
+	defer rows.Close()
+
+	found := false
+	history := []SubscriptionChange{}
+	for rows.Next() {
+		found = true
+		var oldStatus, newStatus, changedAt, source sql.NullString
+		if err := rows.Scan(&oldStatus, &newStatus, &changedAt, &source); err != nil {
+			return nil, fmt.Errorf("failed to scan subscription change: %w", err)
+		}
+		if !changedAt.Valid {
+			// The user has no changes
+			continue
+		}
+		change := SubscriptionChange{
+			Username:  username,
+			OldStatus: SubscriptionStatus(oldStatus.String),
+			NewStatus: SubscriptionStatus(newStatus.String),
+			Source:    source.String,
+		}
+		if change.ChangedAt, err = db.parseTime(ctx, "changed_at", changedAt.String); err != nil {
+			return nil, err
+		}
+		history = append(history, change)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to iterate subscription history: %w", err)
+	}
+	if !found {
+		return nil, &userNotFoundError{username: username}
+	}
+	return history, nil
+}
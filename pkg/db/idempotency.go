@@ -0,0 +1,73 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	selectIdempotentResponseSQL = `
+            SELECT status_code, response FROM idempotency_keys
+            WHERE key = $1 AND created_at > $2`
+
+	// An expired key is taken over by the new response, a live one keeps the first
+	saveIdempotentResponseSQL = `
+            INSERT INTO idempotency_keys (key, status_code, response, created_at) VALUES ($1, $2, $3, $4)
+            ON CONFLICT (key) DO UPDATE
+            SET status_code = excluded.status_code, response = excluded.response, created_at = excluded.created_at
+            WHERE idempotency_keys.created_at <= $5`
+
+	purgeIdempotencyKeysSQL = "DELETE FROM idempotency_keys WHERE created_at <= $1"
+)
+
+// IdempotentResponse is a response stored under an Idempotency-Key
+type IdempotentResponse struct {
+	StatusCode int
+	Body       []byte
+}
+
+// IdempotentResponse returns the response stored under key within the last ttl, or nil if there is none
+func (db *Database) IdempotentResponse(ctx context.Context, key string, ttl time.Duration) (*IdempotentResponse, error) {
+	ctx, span := db.startSpan(ctx, "IdempotentResponse", "SELECT")
+	defer span.End()
+
+	since := time.Now().UTC().Add(-ttl)
+
+	var response IdempotentResponse
+	var body string
+	err := db.DB.QueryRowContext(ctx, db.rebind(selectIdempotentResponseSQL), key, FormatTime(since)).
+		Scan(&response.StatusCode, &body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get idempotent response: %w", err)
+	}
+
+	response.Body = []byte(body)
+	return &response, nil
+}
+
+// SaveIdempotentResponse stores the response under key for ttl and drops the keys that have expired.
+// A key that is still live keeps the response stored first.
+func (db *Database) SaveIdempotentResponse(ctx context.Context, key string, response IdempotentResponse, ttl time.Duration) error {
+	ctx, span := db.startSpan(ctx, "SaveIdempotentResponse", "INSERT")
+	defer span.End()
+
+	now := time.Now().UTC()
+	expired := FormatTime(now.Add(-ttl))
+
+	if _, err := db.DB.ExecContext(ctx, db.rebind(purgeIdempotencyKeysSQL), expired); err != nil {
+		return fmt.Errorf("failed to purge idempotency keys: %w", err)
+	}
+
+	_, err := db.DB.ExecContext(ctx, db.rebind(saveIdempotentResponseSQL),
+		key, response.StatusCode, string(response.Body), FormatTime(now), expired)
+	if err != nil {
+		return fmt.Errorf("failed to save idempotent response: %w", err)
+	}
+	return nil
+}
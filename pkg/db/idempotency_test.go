@@ -0,0 +1,59 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdempotentResponse(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			if _, err := db.DB.ExecContext(ctx, "DELETE FROM idempotency_keys"); err != nil {
+				t.Fatalf("Failed to clear idempotency keys: %v", err)
+			}
+
+			response, err := db.IdempotentResponse(ctx, "key", time.Hour)
+			if err != nil || response != nil {
+				t.Fatalf("Expected no response for an unknown key: %v, got: %v", err, response)
+			}
+
+			first := IdempotentResponse{StatusCode: 201, Body: []byte(`{"username":"first"}`)}
+			if err := db.SaveIdempotentResponse(ctx, "key", first, time.Hour); err != nil {
+				t.Fatalf("Failed to save response: %v", err)
+			}
+
+			// A live key keeps the first response
+			second := IdempotentResponse{StatusCode: 201, Body: []byte(`{"username":"second"}`)}
+			if err := db.SaveIdempotentResponse(ctx, "key", second, time.Hour); err != nil {
+				t.Fatalf("Failed to save response: %v", err)
+			}
+			response, err = db.IdempotentResponse(ctx, "key", time.Hour)
+			if err != nil || response == nil || string(response.Body) != string(first.Body) || response.StatusCode != first.StatusCode {
+				t.Fatalf("Expected the first response: %v, got: %v", err, response)
+			}
+
+			// Once the TTL has passed the key is forgotten and can be reused
+			expired := FormatTime(time.Now().UTC().Add(-2 * time.Hour))
+			if _, err := db.DB.ExecContext(ctx, db.rebind("UPDATE idempotency_keys SET created_at = $1"), expired); err != nil {
+				t.Fatalf("Failed to age idempotency key: %v", err)
+			}
+			response, err = db.IdempotentResponse(ctx, "key", time.Hour)
+			if err != nil || response != nil {
+				t.Fatalf("Expected no response for an expired key: %v, got: %v", err, response)
+			}
+			if err := db.SaveIdempotentResponse(ctx, "key", second, time.Hour); err != nil {
+				t.Fatalf("Failed to save response: %v", err)
+			}
+			response, err = db.IdempotentResponse(ctx, "key", time.Hour)
+			if err != nil || response == nil || string(response.Body) != string(second.Body) {
+				t.Fatalf("Expected the second response: %v, got: %v", err, response)
+			}
+		})
+	}
+}
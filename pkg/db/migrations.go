@@ -0,0 +1,178 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+const (
+	createSchemaMigrationsSQL = `
+    CREATE TABLE IF NOT EXISTS schema_migrations (
+        version INTEGER PRIMARY KEY,
+        applied_at TIMESTAMP NOT NULL
+    );`
+
+	schemaVersionSQL    = "SELECT COALESCE(MAX(version), 0) FROM schema_migrations"
+	insertMigrationSQL  = "INSERT INTO schema_migrations (version, applied_at) VALUES ($1, $2)"
+	migrationFilePrefix = "migrations"
+)
+
+// migration is a versioned schema change loaded from migrations/<driver>/<version>_<name>.sql
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// loadMigrations returns the embedded migrations of the driver ordered by version
+func loadMigrations(driver string) ([]migration, error) {
+	dir := path.Join(migrationFilePrefix, driver)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	migrations := make([]migration, 0, len(entries))
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %q", entry.Name())
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", entry.Name(), err)
+		}
+		migrations = append(migrations, migration{version: version, name: name, sql: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].version == migrations[i-1].version {
+			return nil, fmt.Errorf("duplicate migration version %d", migrations[i].version)
+		}
+	}
+	return migrations, nil
+}
+
+// migrate applies the pending migrations, each in its own transaction
+func (db *Database) migrate(ctx context.Context) error {
+	if _, err := db.DB.ExecContext(ctx, db.rebind(createSchemaMigrationsSQL)); err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	migrations, err := loadMigrations(db.driver)
+	if err != nil {
+		return err
+	}
+
+	current, err := db.SchemaVersion(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+
+		db.log.InfoContext(ctx, "Applying migration", "version", m.version, "name", m.name)
+		if err := db.applyMigration(ctx, m); err != nil {
+			return fmt.Errorf("failed to apply migration %s: %w", m.name, err)
+		}
+	}
+	return nil
+}
+
+func (db *Database) applyMigration(ctx context.Context, m migration) error {
+	return db.withTx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, m.sql); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, db.rebind(insertMigrationSQL), m.version, FormatTime(time.Now())); err != nil {
+			return fmt.Errorf("failed to record migration: %w", err)
+		}
+		return nil
+	})
+}
+
+// SchemaVersion returns the version of the latest applied migration, or 0 if none was applied
+func (db *Database) SchemaVersion(ctx context.Context) (int, error) {
+	var version int
+	err := db.DB.QueryRowContext(ctx, db.rebind(schemaVersionSQL)).Scan(&version)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, fmt.Errorf("failed to read schema version: %w", err)
+	}
+	return version, nil
+}
+
+// ErrSchemaMismatch is returned by VerifySchema when tables or columns the queries rely on are missing
+var ErrSchemaMismatch = errors.New("database schema does not match")
+
+// expectedSchema lists the tables and columns the queries rely on
+var expectedSchema = []struct {
+	table   string
+	columns []string
+}{
+	{table: "subscriptions", columns: []string{"id", "subscription_status", "duration", "start_subscription", "end_subscription", "auto_renew"}},
+	{table: "users", columns: []string{"username", "subscription_id", "traffic_bytes", "chat_id", "deleted_at", "last_active", "created_at"}},
+	{table: "idempotency_keys", columns: []string{"key", "status_code", "response", "created_at"}},
+	{table: "subscription_history", columns: []string{"id", "username", "old_status", "new_status", "changed_at", "source"}},
+}
+
+// VerifySchema checks that the tables and columns the queries rely on exist.
+// It catches schemas changed by hand after the migrations ran, naming everything that is missing.
+func (db *Database) VerifySchema(ctx context.Context) error {
+	rows, err := db.DB.QueryContext(ctx, db.dialect.tableColumnsSQL)
+	if err != nil {
+		return fmt.Errorf("failed to list schema columns: %w", err)
+	}
+	defer rows.Close()
+
+	columns := map[string]map[string]bool{}
+	for rows.Next() {
+		var table, column string
+		if err := rows.Scan(&table, &column); err != nil {
+			return fmt.Errorf("failed to scan schema column: %w", err)
+		}
+		if columns[table] == nil {
+			columns[table] = map[string]bool{}
+		}
+		columns[table][column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to iterate schema columns: %w", err)
+	}
+
+	var missing []string
+	for _, expected := range expectedSchema {
+		found, ok := columns[expected.table]
+		if !ok {
+			missing = append(missing, "table "+expected.table)
+			continue
+		}
+		for _, column := range expected.columns {
+			if !found[column] {
+				missing = append(missing, "column "+expected.table+"."+column)
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: missing %s", ErrSchemaMismatch, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+-- Initial schema. Every statement is idempotent so deployments created
+-- before schema_migrations existed can apply it on top of their tables.
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id SERIAL PRIMARY KEY,
+    subscription_status TEXT DEFAULT 'inactive',
+    duration TEXT NOT NULL DEFAULT 'month',
+    start_subscription TIMESTAMP NOT NULL,
+    end_subscription TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users (
+    username TEXT PRIMARY KEY,
+    subscription_id SERIAL NOT NULL,
+    traffic REAL DEFAULT 0,
+    chat_id BIGINT,
+    deleted_at TIMESTAMP NULL,
+    FOREIGN KEY (subscription_id) REFERENCES subscriptions(id) ON DELETE CASCADE
+);
+
+-- Soft-delete column for tables created by older versions
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP NULL;
+
+-- The status check is added here rather than inline so new and older tables
+-- end up with the same named constraint; NOT VALID keeps startup working if
+-- older rows hold unexpected statuses
+DO $$
+BEGIN
+    ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_status_check
+        CHECK (subscription_status IN ('active', 'inactive')) NOT VALID;
+EXCEPTION
+    WHEN duplicate_object THEN NULL;
+END $$;
+
+-- Columns used by expiry sweeps and chat ID lookups
+CREATE INDEX IF NOT EXISTS idx_subscriptions_end ON subscriptions(end_subscription);
+CREATE INDEX IF NOT EXISTS idx_users_chat_id ON users(chat_id);
@@ -0,0 +1,6 @@
+-- users.subscription_id was declared SERIAL, which gave it a sequence and default of its own
+-- unrelated to subscriptions.id. The ID is always inserted explicitly, so make it a plain
+-- foreign key column and drop the sequence.
+ALTER TABLE users ALTER COLUMN subscription_id DROP DEFAULT;
+ALTER TABLE users ALTER COLUMN subscription_id TYPE BIGINT;
+DROP SEQUENCE IF EXISTS users_subscription_id_seq;
@@ -0,0 +1,8 @@
+-- Traffic is kept in whole bytes so reports from the nodes add up exactly,
+-- MB values are derived from it with 1 MB = 1048576 bytes
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS traffic_bytes BIGINT NOT NULL DEFAULT 0;
+
+UPDATE users SET traffic_bytes = CAST(ROUND(CAST(COALESCE(traffic, 0) AS NUMERIC) * 1048576) AS BIGINT);
+
+ALTER TABLE users DROP COLUMN traffic;
@@ -0,0 +1,22 @@
+-- Initial schema
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    subscription_status TEXT DEFAULT 'inactive' CHECK (subscription_status IN ('active', 'inactive')),
+    duration TEXT NOT NULL DEFAULT 'month',
+    start_subscription TIMESTAMP NOT NULL,
+    end_subscription TIMESTAMP NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS users (
+    username TEXT PRIMARY KEY,
+    subscription_id INTEGER NOT NULL,
+    traffic REAL DEFAULT 0,
+    chat_id BIGINT,
+    deleted_at TIMESTAMP NULL,
+    FOREIGN KEY (subscription_id) REFERENCES subscriptions(id) ON DELETE CASCADE
+);
+
+-- Columns used by expiry sweeps and chat ID lookups
+CREATE INDEX IF NOT EXISTS idx_subscriptions_end ON subscriptions(end_subscription);
+CREATE INDEX IF NOT EXISTS idx_users_chat_id ON users(chat_id);
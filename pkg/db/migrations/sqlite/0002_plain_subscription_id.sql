@@ -0,0 +1,3 @@
+-- users.subscription_id is already a plain INTEGER foreign key in SQLite.
+-- Kept so both drivers share the same schema versions.
+SELECT 1;
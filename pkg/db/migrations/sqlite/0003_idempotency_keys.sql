@@ -0,0 +1,11 @@
+-- Responses of requests sent with an Idempotency-Key header, replayed when the request is retried
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    key TEXT PRIMARY KEY,
+    status_code INTEGER NOT NULL,
+    response TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+
+-- Expired keys are found by age
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_created_at ON idempotency_keys(created_at);
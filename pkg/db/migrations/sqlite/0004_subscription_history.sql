@@ -0,0 +1,12 @@
+-- Changes of subscription status, written together with the change itself
+
+CREATE TABLE IF NOT EXISTS subscription_history (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    username TEXT NOT NULL,
+    old_status TEXT NOT NULL,
+    new_status TEXT NOT NULL,
+    changed_at TIMESTAMP NOT NULL,
+    source TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscription_history_username ON subscription_history(username, changed_at);
@@ -0,0 +1,6 @@
+-- When a user last reported traffic or had their subscription changed, NULL if never since this column was added
+
+ALTER TABLE users ADD COLUMN last_active TIMESTAMP NULL;
+
+-- Dormant users are found by age
+CREATE INDEX IF NOT EXISTS idx_users_last_active ON users(last_active);
@@ -0,0 +1,7 @@
+-- When a user was registered, set on insert. Users created before this column
+-- was added keep NULL rather than the time of the migration, so cohorts are not skewed
+
+ALTER TABLE users ADD COLUMN created_at TIMESTAMP NULL;
+
+-- Cohorts are found by registration time
+CREATE INDEX IF NOT EXISTS idx_users_created_at ON users(created_at);
@@ -0,0 +1,4 @@
+-- Subscriptions with auto_renew are rolled forward by their duration when they
+-- expire instead of being marked inactive. Existing subscriptions do not renew
+
+ALTER TABLE subscriptions ADD COLUMN auto_renew BOOLEAN NOT NULL DEFAULT FALSE;
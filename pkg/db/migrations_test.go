@@ -0,0 +1,152 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	var versions [][]int
+	for _, driver := range []string{DriverPostgres, DriverSQLite} {
+		migrations, err := loadMigrations(driver)
+		if err != nil {
+			t.Fatalf("Failed to load %s migrations: %v", driver, err)
+		}
+		if len(migrations) == 0 || migrations[0].version != 1 {
+			t.Fatalf("Expected %s migrations to start at version 1, got: %v", driver, migrations)
+		}
+		var driverVersions []int
+		for i, m := range migrations {
+			if i > 0 && m.version <= migrations[i-1].version {
+				t.Fatalf("Expected %s migrations ordered by version, got %d after %d", driver, m.version, migrations[i-1].version)
+			}
+			driverVersions = append(driverVersions, m.version)
+		}
+		versions = append(versions, driverVersions)
+	}
+
+	// Both drivers must define the same schema versions
+	if fmt.Sprint(versions[0]) != fmt.Sprint(versions[1]) {
+		t.Fatalf("Expected the same migration versions for every driver, got: %v", versions)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	migrations, err := loadMigrations(db.driver)
+	if err != nil {
+		t.Fatalf("Failed to load migrations: %v", err)
+	}
+	latest := migrations[len(migrations)-1].version
+
+	version, err := db.SchemaVersion(ctx)
+	if err != nil {
+		t.Fatalf("Failed to read schema version: %v", err)
+	}
+	if version != latest {
+		t.Fatalf("Expected schema version: %d, got: %d", latest, version)
+	}
+
+	// Running the migrations again must be a no-op
+	if err := db.migrate(ctx); err != nil {
+		t.Fatalf("Failed to re-run migrations: %v", err)
+	}
+
+	var applied int
+	if err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM schema_migrations").Scan(&applied); err != nil {
+		t.Fatalf("Failed to count applied migrations: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Fatalf("Expected %d applied migrations, got: %d", len(migrations), applied)
+	}
+}
+
+func TestSubscriptionIDReferencesSubscription(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			// Create a stray subscription first so the IDs of users and subscriptions would drift apart
+			// if subscription_id still had its own sequence
+			if _, err := db.DB.ExecContext(ctx, db.rebind(addSubscription), StatusInactive, "month", FormatTime(time.Now()), FormatTime(time.Time{}), false); err != nil {
+				t.Fatalf("Failed to add subscription: %v", err)
+			}
+
+			for _, username := range []string{"fkuser1_" + driver, "fkuser2_" + driver} {
+				if err := db.CreateUser(ctx, &User{Username: username, ChatID: 12345}); err != nil {
+					t.Fatalf("Failed to create user: %v", err)
+				}
+
+				var subscriptionID, latestID int64
+				if err := db.DB.QueryRowContext(ctx, db.rebind(subscriptionId), username).Scan(&subscriptionID); err != nil {
+					t.Fatalf("Failed to read subscription_id: %v", err)
+				}
+				if err := db.DB.QueryRowContext(ctx, "SELECT MAX(id) FROM subscriptions").Scan(&latestID); err != nil {
+					t.Fatalf("Failed to read latest subscription id: %v", err)
+				}
+				if subscriptionID != latestID {
+					t.Fatalf("Expected subscription_id: %d, got: %d", latestID, subscriptionID)
+				}
+			}
+
+			if driver != DriverPostgres {
+				return
+			}
+			var columnDefault sql.NullString
+			err = db.DB.QueryRowContext(ctx, `
+				SELECT column_default FROM information_schema.columns
+				WHERE table_name = 'users' AND column_name = 'subscription_id'`).Scan(&columnDefault)
+			if err != nil {
+				t.Fatalf("Failed to read column default: %v", err)
+			}
+			if columnDefault.Valid {
+				t.Fatalf("Expected subscription_id without a default, got: %s", columnDefault.String)
+			}
+		})
+	}
+}
+
+func TestVerifySchema(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	if err := db.VerifySchema(ctx); err != nil {
+		t.Fatalf("Expected the migrated schema to verify: %v", err)
+	}
+
+	if _, err := db.DB.ExecContext(ctx, "ALTER TABLE users DROP COLUMN traffic_bytes"); err != nil {
+		t.Fatalf("Failed to drop column: %v", err)
+	}
+	if _, err := db.DB.ExecContext(ctx, "DROP TABLE idempotency_keys"); err != nil {
+		t.Fatalf("Failed to drop table: %v", err)
+	}
+
+	err = db.VerifySchema(ctx)
+	if !errors.Is(err, ErrSchemaMismatch) {
+		t.Fatalf("Expected ErrSchemaMismatch, got: %v", err)
+	}
+	for _, name := range []string{"column users.traffic_bytes", "table idempotency_keys"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Fatalf("Expected the error to name %s, got: %v", name, err)
+		}
+	}
+	if strings.Contains(err.Error(), "users.chat_id") {
+		t.Fatalf("Expected only missing columns to be named, got: %v", err)
+	}
+}
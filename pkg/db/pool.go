@@ -0,0 +1,100 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Default connection pool settings, overridable through the environment
+const (
+	defaultMaxOpenConns    = 25
+	defaultMaxIdleConns    = 25
+	defaultConnMaxLifetime = time.Hour
+)
+
+// poolConfig holds the connection pool settings applied to *sql.DB
+type poolConfig struct {
+	maxOpenConns    int
+	maxIdleConns    int
+	connMaxLifetime time.Duration
+}
+
+// poolConfigFromEnv reads DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS and DB_CONN_MAX_LIFETIME,
+// falling back to the defaults for unset variables.
+func poolConfigFromEnv() (poolConfig, error) {
+	cfg := poolConfig{
+		maxOpenConns:    defaultMaxOpenConns,
+		maxIdleConns:    defaultMaxIdleConns,
+		connMaxLifetime: defaultConnMaxLifetime,
+	}
+
+	if value := os.Getenv("DB_MAX_OPEN_CONNS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid DB_MAX_OPEN_CONNS %q: must be a positive integer", value)
+		}
+		cfg.maxOpenConns = n
+	}
+
+	if value := os.Getenv("DB_MAX_IDLE_CONNS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid DB_MAX_IDLE_CONNS %q: must be a non-negative integer", value)
+		}
+		cfg.maxIdleConns = n
+	}
+
+	if value := os.Getenv("DB_CONN_MAX_LIFETIME"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return cfg, fmt.Errorf("invalid DB_CONN_MAX_LIFETIME %q: must be a non-negative duration", value)
+		}
+		cfg.connMaxLifetime = d
+	}
+
+	if cfg.maxIdleConns > cfg.maxOpenConns {
+		return cfg, fmt.Errorf("DB_MAX_IDLE_CONNS (%d) must not exceed DB_MAX_OPEN_CONNS (%d)", cfg.maxIdleConns, cfg.maxOpenConns)
+	}
+
+	return cfg, nil
+}
+
+// configurePool applies the pool settings from the environment to db
+func configurePool(db *sql.DB) error {
+	cfg, err := poolConfigFromEnv()
+	if err != nil {
+		return err
+	}
+
+	db.SetMaxOpenConns(cfg.maxOpenConns)
+	db.SetMaxIdleConns(cfg.maxIdleConns)
+	db.SetConnMaxLifetime(cfg.connMaxLifetime)
+	return nil
+}
+
+// Stats returns the statistics of the connection pool
+func (db *Database) Stats() sql.DBStats {
+	return db.DB.Stats()
+}
+
+// Close closes the connection pool and the read replica, if any.
+// It is safe to call more than once; later calls return the result of the first.
+// Queries made after Close fail with an error.
+func (db *Database) Close() error {
+	db.closeOnce.Do(func() {
+		db.log.Info("Closing database connection...")
+		err := db.DB.Close()
+		if db.replica != nil {
+			err = errors.Join(err, db.replica.Close())
+		}
+		db.existsCache.clear()
+		if err != nil {
+			db.closeErr = fmt.Errorf("failed to close database: %w", err)
+		}
+	})
+	return db.closeErr
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestConfigurePool(t *testing.T) {
+	t.Setenv("DB_MAX_OPEN_CONNS", "7")
+	t.Setenv("DB_MAX_IDLE_CONNS", "3")
+	t.Setenv("DB_CONN_MAX_LIFETIME", "10m")
+
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	if err := configurePool(db); err != nil {
+		t.Fatalf("Failed to configure pool: %v", err)
+	}
+
+	if got := db.Stats().MaxOpenConnections; got != 7 {
+		t.Fatalf("Expected max open connections: 7, got: %d", got)
+	}
+
+	cfg, _ := poolConfigFromEnv()
+	if cfg.maxIdleConns != 3 || cfg.connMaxLifetime != 10*time.Minute {
+		t.Fatalf("Expected idle 3 and lifetime 10m, got: %+v", cfg)
+	}
+}
+
+func TestPoolConfigFromEnv(t *testing.T) {
+	type testCase struct {
+		name     string
+		maxOpen  string
+		maxIdle  string
+		lifetime string
+		want     poolConfig
+		wantErr  bool
+	}
+
+	testCases := []testCase{
+		{
+			name: "Defaults",
+			want: poolConfig{maxOpenConns: 25, maxIdleConns: 25, connMaxLifetime: time.Hour},
+		},
+		{
+			name:    "OpenOnly",
+			maxOpen: "50",
+			want:    poolConfig{maxOpenConns: 50, maxIdleConns: 25, connMaxLifetime: time.Hour},
+		},
+		{name: "InvalidOpen", maxOpen: "many", wantErr: true},
+		{name: "ZeroOpen", maxOpen: "0", wantErr: true},
+		{name: "NegativeIdle", maxIdle: "-1", wantErr: true},
+		{name: "InvalidLifetime", lifetime: "forever", wantErr: true},
+		{name: "IdleAboveOpen", maxOpen: "5", maxIdle: "10", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("DB_MAX_OPEN_CONNS", tc.maxOpen)
+			t.Setenv("DB_MAX_IDLE_CONNS", tc.maxIdle)
+			t.Setenv("DB_CONN_MAX_LIFETIME", tc.lifetime)
+
+			got, err := poolConfigFromEnv()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if !tc.wantErr && got != tc.want {
+				t.Fatalf("Expected config: %+v, got: %+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestClose(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+
+	if err := db.CreateUser(ctx, &User{Username: "closed_user"}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatalf("Failed to close database: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("Expected closing twice to succeed, got: %v", err)
+	}
+
+	if _, err := db.User(ctx, "closed_user"); err == nil {
+		t.Fatalf("Expected lookup on a closed database to fail")
+	}
+	if _, err := db.IsUserExists(ctx, "closed_user"); err == nil {
+		t.Fatalf("Expected existence check on a closed database to fail")
+	}
+	if err := db.CreateUser(ctx, &User{Username: "closed_user2"}); err == nil {
+		t.Fatalf("Expected insert on a closed database to fail")
+	}
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"regexp"
+	"strings"
+)
+
+const redactedValue = "*****"
+
+// passwordPattern matches the password field of a key/value connection string,
+// including single-quoted values that may contain spaces.
+var passwordPattern = regexp.MustCompile(`password=('(?:[^'\\]|\\.)*'|\S*)`)
+
+// redactConnStr returns a copy of the connection string that is safe to log.
+func redactConnStr(connStr string) string {
+	return passwordPattern.ReplaceAllString(connStr, "password="+redactedValue)
+}
+
+// redactedError hides a secret in the message of the wrapped error while keeping it unwrappable.
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// redactError removes secret from the error message.
+func redactError(err error, secret string) error {
+	if err == nil || secret == "" || !strings.Contains(err.Error(), secret) {
+		return err
+	}
+	return &redactedError{
+		msg: strings.ReplaceAll(err.Error(), secret, redactedValue),
+		err: err,
+	}
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const setAutoRenewSQL = `
+    		UPDATE subscriptions
+        	SET auto_renew = $1
+        	WHERE id = (SELECT subscription_id FROM users WHERE username = $2 AND deleted_at IS NULL)`
+
+// SetAutoRenew turns the automatic renewal of the user's subscription on or off.
+// A missing or deleted user is reported as ErrUserNotFound.
+func (db *Database) SetAutoRenew(ctx context.Context, username string, enabled bool) error {
+	ctx, span := db.startSpan(ctx, "SetAutoRenew", "UPDATE")
+	defer span.End()
+
+	db.log.DebugContext(ctx, "Setting subscription auto-renew", "username", username, "auto_renew", enabled)
+
+	result, err := db.DB.ExecContext(ctx, db.rebind(setAutoRenewSQL), enabled, username)
+	if err != nil {
+		return fmt.Errorf("failed to execute auto-renew statement: %w", err)
+	}
+	if err := checkUserAffected(result, username); err != nil {
+		return err
+	}
+
+	db.log.DebugContext(ctx, "Subscription auto-renew set successfully", "username", username, "auto_renew", enabled)
+	return nil
+}
+
+// Renewed returns the subscription rolled forward by its duration, period after period, until it ends after now.
+// Each new period starts where the previous one ended, so a renewal checked late does not shift the billing dates.
+func (s Subscription) Renewed(now time.Time) (Subscription, error) {
+	d, forever, err := ParseDuration(s.Duration)
+	if err != nil {
+		return s, err
+	}
+	if forever {
+		return s, fmt.Errorf("forever subscriptions are not renewed")
+	}
+	if d < day {
+		return s, fmt.Errorf("subscriptions shorter than a day are not renewed: %q", s.Duration)
+	}
+	if s.EndSubscription.After(now) {
+		return s, nil
+	}
+
+	// The number of periods needed to end after now, counted directly so a long overdue renewal takes no longer
+	periods := now.Sub(s.EndSubscription)/d + 1
+	s.StartSubscription = s.EndSubscription.Add((periods - 1) * d)
+	s.EndSubscription = s.EndSubscription.Add(periods * d)
+	return s, nil
+}
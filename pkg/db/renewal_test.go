@@ -0,0 +1,109 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSetAutoRenew(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			username := "renewuser_" + driver
+			start := time.Now().Truncate(time.Second)
+			user := &User{Username: username, Subscription: Subscription{
+				SubscriptionStatus: StatusActive, Duration: "month", StartSubscription: start, EndSubscription: start.AddDate(0, 1, 0),
+			}}
+			if err := db.CreateUser(ctx, user); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+			autoRenew := func() bool {
+				sub, err := db.GetSubscription(ctx, username)
+				if err != nil {
+					t.Fatalf("Failed to get subscription: %v", err)
+				}
+				return sub.AutoRenew
+			}
+			if autoRenew() {
+				t.Fatalf("Expected new subscriptions not to renew")
+			}
+
+			if err := db.SetAutoRenew(ctx, username, true); err != nil {
+				t.Fatalf("Failed to turn auto-renew on: %v", err)
+			}
+			if !autoRenew() {
+				t.Fatalf("Expected auto-renew to be on")
+			}
+
+			// Updating the subscription, as the scheduler does when renewing, keeps the setting
+			renewed := user.Subscription
+			renewed.StartSubscription, renewed.EndSubscription = renewed.EndSubscription, renewed.EndSubscription.AddDate(0, 1, 0)
+			if err := db.UpdateUserSubscription(ctx, username, renewed); err != nil {
+				t.Fatalf("Failed to update subscription: %v", err)
+			}
+			stored, err := db.User(ctx, username)
+			if err != nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+			if !stored.Subscription.AutoRenew {
+				t.Fatalf("Expected auto-renew to be kept, got: %+v", stored.Subscription)
+			}
+
+			if err := db.SetAutoRenew(ctx, username, false); err != nil {
+				t.Fatalf("Failed to turn auto-renew off: %v", err)
+			}
+			if autoRenew() {
+				t.Fatalf("Expected auto-renew to be off")
+			}
+
+			if err := db.SetAutoRenew(ctx, "nosuchuser", true); !errors.Is(err, ErrUserNotFound) {
+				t.Fatalf("Expected ErrUserNotFound, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestSubscriptionRenewed(t *testing.T) {
+	end := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		name      string
+		duration  string
+		now       time.Time
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   bool
+	}{
+		{name: "OnePeriod", duration: "1 month", now: end.Add(time.Hour), wantStart: end, wantEnd: end.AddDate(0, 0, 30)},
+		{name: "SeveralPeriods", duration: "7d", now: end.AddDate(0, 0, 15), wantStart: end.AddDate(0, 0, 14), wantEnd: end.AddDate(0, 0, 21)},
+		{name: "AtTheEnd", duration: "week", now: end, wantStart: end, wantEnd: end.AddDate(0, 0, 7)},
+		{name: "Forever", duration: "forever", now: end.Add(time.Hour), wantErr: true},
+		{name: "Invalid", duration: "soon", now: end.Add(time.Hour), wantErr: true},
+		{name: "ShorterThanADay", duration: "1ns", now: end.AddDate(10, 0, 0), wantErr: true},
+		{name: "LongOverdue", duration: "1d", now: end.AddDate(100, 0, 0).Add(time.Hour), wantStart: end.AddDate(100, 0, 0), wantEnd: end.AddDate(100, 0, 1)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			sub := Subscription{SubscriptionStatus: StatusActive, Duration: tc.duration, StartSubscription: end.AddDate(0, -1, 0), EndSubscription: end, AutoRenew: true}
+			renewed, err := sub.Renewed(tc.now)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if tc.wantErr {
+				return
+			}
+			if !renewed.StartSubscription.Equal(tc.wantStart) || !renewed.EndSubscription.Equal(tc.wantEnd) {
+				t.Fatalf("Expected %v to %v, got: %v to %v", tc.wantStart, tc.wantEnd, renewed.StartSubscription, renewed.EndSubscription)
+			}
+			if renewed.SubscriptionStatus != StatusActive || !renewed.AutoRenew {
+				t.Fatalf("Expected an active subscription that keeps renewing, got: %+v", renewed)
+			}
+		})
+	}
+}
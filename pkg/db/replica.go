@@ -0,0 +1,57 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const replicaURLVariable = "DB_REPLICA_URL"
+
+// openReplica connects to the Postgres read replica at DB_REPLICA_URL.
+// It returns nil when the variable is unset, reads then go to the primary.
+func openReplica(driver string) (*sql.DB, error) {
+	url := os.Getenv(replicaURLVariable)
+	if url == "" {
+		return nil, nil
+	}
+	if driver != DriverPostgres {
+		return nil, fmt.Errorf("%s is only supported with the %s driver", replicaURLVariable, DriverPostgres)
+	}
+
+	replica, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open read replica: %w", err)
+	}
+	if err := configurePool(replica); err != nil {
+		replica.Close()
+		return nil, err
+	}
+	return replica, nil
+}
+
+type primaryKey struct{}
+
+// WithPrimary returns a copy of ctx whose reads go to the primary even if there is a replica,
+// for reading back a change that may not have been replicated yet
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// read runs fn against the read replica, falling back to the primary when there is no replica,
+// ctx asks for the primary or the replica fails. Missing rows are not a failure.
+func (db *Database) read(ctx context.Context, fn func(q queryer) error) error {
+	if db.replica == nil || ctx.Value(primaryKey{}) != nil {
+		return fn(db.DB)
+	}
+
+	err := fn(db.replica)
+	if err == nil || errors.Is(err, sql.ErrNoRows) || ctx.Err() != nil {
+		return err
+	}
+
+	db.log.WarnContext(ctx, "Read replica failed, reading from primary", "error", err)
+	return fn(db.DB)
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReadReplica(t *testing.T) {
+	primary, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(primary)
+
+	replica, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup replica database: %v", err)
+	}
+	defer teardownTestDB(replica)
+
+	// Each in-memory database is separate, so a user only found in one of them tells which was read
+	if err := primary.CreateUser(ctx, &User{Username: "onprimary", ChatID: 1}); err != nil {
+		t.Fatalf("Failed to create user on primary: %v", err)
+	}
+	if err := replica.CreateUser(ctx, &User{Username: "onreplica", ChatID: 2}); err != nil {
+		t.Fatalf("Failed to create user on replica: %v", err)
+	}
+	primary.replica = replica.DB
+
+	user, err := primary.User(ctx, "onreplica")
+	if err != nil || user.ChatID != 2 {
+		t.Fatalf("Expected user from replica: %v, got: %v", err, user)
+	}
+	if _, err := primary.User(ctx, "onprimary"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected error: %v, got: %v", ErrUserNotFound, err)
+	}
+
+	exists, err := primary.IsUserExists(ctx, "onreplica")
+	if err != nil || !exists {
+		t.Fatalf("Expected user to exist on replica: %v, got: %v", err, exists)
+	}
+
+	status, err := primary.SubscriptionStatus(ctx, "onreplica")
+	if err != nil || status != string(StatusInactive) {
+		t.Fatalf("Expected status from replica: %v, got: %v", err, status)
+	}
+
+	usernames, err := primary.AllUsername(ctx)
+	if err != nil || len(usernames) != 1 || usernames[0] != "onreplica" {
+		t.Fatalf("Expected usernames from replica: [onreplica]: %v, got: %v", err, usernames)
+	}
+
+	// Reading back a change goes to the primary
+	user, err = primary.User(WithPrimary(ctx), "onprimary")
+	if err != nil || user.ChatID != 1 {
+		t.Fatalf("Expected user from primary: %v, got: %v", err, user)
+	}
+
+	// Writes always go to the primary
+	if err := primary.UpdateUserTraffic(ctx, "onreplica", 10); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected error: %v, got: %v", ErrUserNotFound, err)
+	}
+
+	// A failing replica falls back to the primary
+	replica.DB.Close()
+	user, err = primary.User(ctx, "onprimary")
+	if err != nil || user.ChatID != 1 {
+		t.Fatalf("Expected user from primary after replica failure: %v, got: %v", err, user)
+	}
+	usernames, err = primary.AllUsername(ctx)
+	if err != nil || len(usernames) != 1 || usernames[0] != "onprimary" {
+		t.Fatalf("Expected usernames from primary: [onprimary]: %v, got: %v", err, usernames)
+	}
+}
+
+func TestOpenReplica(t *testing.T) {
+	t.Setenv(replicaURLVariable, "")
+	replica, err := openReplica(DriverPostgres)
+	if err != nil || replica != nil {
+		t.Fatalf("Expected no replica when %s is unset: %v, got: %v", replicaURLVariable, err, replica)
+	}
+
+	t.Setenv(replicaURLVariable, "postgres://reader@replica:5432/users")
+	if _, err := openReplica(DriverSQLite); err == nil {
+		t.Fatalf("Expected error for a replica with the %s driver", DriverSQLite)
+	}
+
+	replica, err = openReplica(DriverPostgres)
+	if err != nil || replica == nil {
+		t.Fatalf("Expected replica handle: %v, got: %v", err, replica)
+	}
+	replica.Close()
+}
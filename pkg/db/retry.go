@@ -0,0 +1,82 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Default connection retry settings used by NewDatabase
+const (
+	defaultConnectAttempts = 5
+	defaultConnectBackoff  = time.Second
+)
+
+// retryPolicy controls how many times connecting is attempted and how long to wait in between.
+// The wait doubles after every failed attempt.
+type retryPolicy struct {
+	attempts int
+	backoff  time.Duration
+}
+
+var defaultRetryPolicy = retryPolicy{attempts: defaultConnectAttempts, backoff: defaultConnectBackoff}
+
+// pingWithRetry pings db until it answers, retrying transient connection failures with exponential backoff.
+// Other errors, such as authentication failures, are returned immediately.
+func pingWithRetry(ctx context.Context, db *sql.DB, policy retryPolicy, logger *slog.Logger) error {
+	attempts := policy.attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := policy.backoff
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		err = db.PingContext(ctx)
+		if err == nil {
+			return nil
+		}
+		if !isTransientConnError(err) {
+			return err
+		}
+		if attempt == attempts {
+			break
+		}
+
+		logger.Warn("Database is not reachable yet, retrying",
+			"attempt", attempt, "attempts", attempts, "backoff", backoff, "error", err)
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+
+	return fmt.Errorf("database is not reachable after %d attempts: %w", attempts, err)
+}
+
+// isTransientConnError reports whether err means the server is not accepting connections yet
+func isTransientConnError(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+
+	// The server is up but still starting: cannot_connect_now
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "57P03"
+	}
+
+	// The host may not be resolvable yet while the database container starts
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
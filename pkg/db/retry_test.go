@@ -0,0 +1,73 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// closedPort returns a local port nothing is listening on
+func closedPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to reserve a port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port
+}
+
+func TestPingWithRetryClosedPort(t *testing.T) {
+	dsn := fmt.Sprintf("host=127.0.0.1 port=%d user=test dbname=test sslmode=disable", closedPort(t))
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	defer db.Close()
+
+	policy := retryPolicy{attempts: 3, backoff: 20 * time.Millisecond}
+	start := time.Now()
+	err = pingWithRetry(ctx, db, policy, slog.Default())
+	elapsed := time.Since(start)
+
+	if err == nil {
+		t.Fatalf("Expected an error for a closed port")
+	}
+	if !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Fatalf("Expected error to report 3 attempts, got: %v", err)
+	}
+	// Waits of 20ms and 40ms happen between the three attempts
+	if elapsed < 60*time.Millisecond {
+		t.Fatalf("Expected retries to back off for at least 60ms, took: %v", elapsed)
+	}
+}
+
+func TestIsTransientConnError(t *testing.T) {
+	type testCase struct {
+		name string
+		err  error
+		want bool
+	}
+
+	testCases := []testCase{
+		{name: "ConnectionRefused", err: &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "Starting", err: &pq.Error{Code: "57P03"}, want: true},
+		{name: "AuthFailed", err: &pq.Error{Code: "28P01"}, want: false},
+		{name: "Other", err: fmt.Errorf("syntax error"), want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isTransientConnError(tc.err); got != tc.want {
+				t.Fatalf("Expected transient: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
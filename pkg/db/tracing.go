@@ -0,0 +1,22 @@
+package db
+
+import (
+	"context"
+
+	"github.com/YuarenArt/tg-users-database/pkg/tracing"
+)
+
+// dbSystems names the drivers as the db.system span attribute does
+var dbSystems = map[string]string{
+	DriverPostgres: "postgresql",
+	DriverSQLite:   "sqlite",
+}
+
+// startSpan starts a span around a call of the Database method with the SQL operation it runs,
+// e.g. SELECT or INSERT, as the db.operation attribute
+func (db *Database) startSpan(ctx context.Context, method, operation string) (context.Context, *tracing.Span) {
+	ctx, span := tracing.Start(ctx, "db."+method, tracing.SpanKindClient)
+	span.SetAttribute("db.system", dbSystems[db.driver])
+	span.SetAttribute("db.operation", operation)
+	return ctx, span
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"time"
+)
+
+const chargeTrafficSQL = `
+            UPDATE users SET traffic_bytes = traffic_bytes + $1, last_active = $3
+            WHERE username = $2 AND deleted_at IS NULL
+            RETURNING traffic_bytes`
+
+// defaultMaxTrafficMB is the traffic cap used when MAX_TRAFFIC_MB is not set, one petabyte
+const defaultMaxTrafficMB = 1e9
+
+// BytesPerMB is the number of bytes in a MB of traffic.
+// Being a power of two, every byte count converts to MB and back without loss.
+const BytesPerMB = 1 << 20
+
+// ErrInvalidTraffic is returned when a traffic value is negative or above the configured cap.
+var ErrInvalidTraffic = errors.New("invalid traffic")
+
+// maxTrafficFromEnv returns the largest traffic value accepted, read from MAX_TRAFFIC_MB
+func maxTrafficFromEnv() (float64, error) {
+	value := os.Getenv("MAX_TRAFFIC_MB")
+	if value == "" {
+		return defaultMaxTrafficMB, nil
+	}
+
+	max, err := strconv.ParseFloat(value, 64)
+	if err != nil || max <= 0 {
+		return 0, fmt.Errorf("invalid MAX_TRAFFIC_MB %q: must be a positive number", value)
+	}
+	return max, nil
+}
+
+// trafficQuotaFromEnv returns the traffic quota in MB read from TRAFFIC_QUOTA_MB, 0 when it is not set
+func trafficQuotaFromEnv() (float64, error) {
+	value := os.Getenv("TRAFFIC_QUOTA_MB")
+	if value == "" {
+		return 0, nil
+	}
+
+	quota, err := strconv.ParseFloat(value, 64)
+	if err != nil || quota < 0 || math.IsInf(quota, 0) {
+		return 0, fmt.Errorf("invalid TRAFFIC_QUOTA_MB %q: must be a non-negative number", value)
+	}
+	return quota, nil
+}
+
+// quota returns the traffic quota in MB users are charged against, the traffic cap when TRAFFIC_QUOTA_MB is not set
+func (db *Database) quota() float64 {
+	if db.trafficQuota > 0 {
+		return db.trafficQuota
+	}
+	return db.maxTraffic
+}
+
+// ChargeTraffic adds mb to the user's traffic and reports how much of the traffic quota is left, in MB and at least 0,
+// and whether this charge used it up. Charges past the quota still count, but only the one reaching it reports exhausted,
+// so concurrent charges report exhaustion once. Charges above the traffic cap are rejected with ErrInvalidTraffic.
+func (db *Database) ChargeTraffic(ctx context.Context, username string, mb float64) (float64, bool, error) {
+	ctx, span := db.startSpan(ctx, "ChargeTraffic", "UPDATE")
+	defer span.End()
+
+	if math.IsNaN(mb) || mb < 0 || mb > db.maxTraffic {
+		return 0, false, fmt.Errorf("%w %v: charge must be between 0 and %v MB", ErrInvalidTraffic, mb, db.maxTraffic)
+	}
+	charge := BytesFromMB(mb)
+	quota := BytesFromMB(db.quota())
+
+	db.log.DebugContext(ctx, "Charging traffic", "username", username, "traffic", mb)
+
+	var traffic int64
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		// The increment and the read happen in one statement, so concurrent charges see each other
+		err := tx.QueryRowContext(ctx, db.rebind(chargeTrafficSQL), charge, username, FormatTime(time.Now())).Scan(&traffic)
+		if errors.Is(err, sql.ErrNoRows) {
+			return &userNotFoundError{username: username}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to charge traffic: %w", err)
+		}
+		return db.validateTrafficBytes(traffic)
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	remaining := max(quota-traffic, 0)
+	exhausted := charge > 0 && traffic >= quota && traffic-charge < quota
+
+	db.log.DebugContext(ctx, "Traffic charged successfully", "username", username, "remaining", MBFromBytes(remaining), "exhausted", exhausted)
+	return MBFromBytes(remaining), exhausted, nil
+}
+
+// validateTraffic reports an error wrapping ErrInvalidTraffic unless traffic is between 0 and the cap.
+// Zero is valid so traffic can be reset.
+func (db *Database) validateTraffic(traffic float64) error {
+	if traffic < 0 || traffic > db.maxTraffic {
+		return fmt.Errorf("%w %v: must be between 0 and %v MB", ErrInvalidTraffic, traffic, db.maxTraffic)
+	}
+	return nil
+}
+
+// validateTrafficBytes is validateTraffic for traffic in bytes
+func (db *Database) validateTrafficBytes(traffic int64) error {
+	if traffic < 0 || traffic > BytesFromMB(db.maxTraffic) {
+		return fmt.Errorf("%w %d bytes: must be between 0 and %v MB", ErrInvalidTraffic, traffic, db.maxTraffic)
+	}
+	return nil
+}
+
+// userTrafficBytes returns the validated traffic of user in bytes, taken from TrafficBytes when set and from Traffic otherwise
+func (db *Database) userTrafficBytes(user *User) (int64, error) {
+	if user.TrafficBytes != 0 {
+		return user.TrafficBytes, db.validateTrafficBytes(user.TrafficBytes)
+	}
+	if err := db.validateTraffic(user.Traffic); err != nil {
+		return 0, err
+	}
+	return BytesFromMB(user.Traffic), nil
+}
+
+// MBFromBytes converts traffic in bytes to MB
+func MBFromBytes(bytes int64) float64 {
+	return float64(bytes) / BytesPerMB
+}
+
+// BytesFromMB converts traffic in MB to bytes, rounded to the nearest byte.
+// Values beyond the int64 range are clamped to it.
+func BytesFromMB(mb float64) int64 {
+	bytes := math.Round(mb * BytesPerMB)
+	switch {
+	case bytes >= math.MaxInt64:
+		return math.MaxInt64
+	case bytes <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(bytes)
+}
@@ -0,0 +1,326 @@
+package db
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMaxTrafficFromEnv(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{value: "", want: defaultMaxTrafficMB},
+		{value: "1024.5", want: 1024.5},
+		{value: "0", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "lots", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv("MAX_TRAFFIC_MB", tc.value)
+			got, err := maxTrafficFromEnv()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if !tc.wantErr && got != tc.want {
+				t.Fatalf("Expected max traffic: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestTrafficLimits(t *testing.T) {
+	t.Setenv("MAX_TRAFFIC_MB", "1000")
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	if err := db.CreateUser(ctx, &User{Username: "trafficlimits"}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	testCases := []struct {
+		name    string
+		traffic float64
+		wantErr bool
+	}{
+		{name: "Normal", traffic: 512.25},
+		{name: "Zero", traffic: 0},
+		{name: "AtCap", traffic: 1000},
+		{name: "Negative", traffic: -1, wantErr: true},
+		{name: "OverCap", traffic: 1e18, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := db.UpdateUserTraffic(ctx, "trafficlimits", 42); err != nil {
+				t.Fatalf("Failed to set traffic: %v", err)
+			}
+
+			err := db.UpdateUserTraffic(ctx, "trafficlimits", tc.traffic)
+			if tc.wantErr != errors.Is(err, ErrInvalidTraffic) {
+				t.Fatalf("Expected ErrInvalidTraffic: %v, got: %v", tc.wantErr, err)
+			}
+			if !tc.wantErr && err != nil {
+				t.Fatalf("Failed to update traffic: %v", err)
+			}
+
+			want := tc.traffic
+			if tc.wantErr {
+				want = 42
+			}
+			user, err := db.User(ctx, "trafficlimits")
+			if err != nil {
+				t.Fatalf("Failed to retrieve user: %v", err)
+			}
+			if user.Traffic != want {
+				t.Fatalf("Expected traffic: %v, got: %v", want, user.Traffic)
+			}
+
+			// Patches and new users are held to the same limits
+			err = db.UpdateUser(ctx, "trafficlimits", UserPatch{Traffic: &tc.traffic})
+			if tc.wantErr != errors.Is(err, ErrInvalidTraffic) {
+				t.Fatalf("Expected ErrInvalidTraffic from UpdateUser: %v, got: %v", tc.wantErr, err)
+			}
+			err = db.CreateUser(ctx, &User{Username: "trafficlimits_" + tc.name, Traffic: tc.traffic})
+			if tc.wantErr != errors.Is(err, ErrInvalidTraffic) {
+				t.Fatalf("Expected ErrInvalidTraffic from CreateUser: %v, got: %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestBytesFromMB(t *testing.T) {
+	testCases := []struct {
+		mb   float64
+		want int64
+	}{
+		{mb: 0, want: 0},
+		{mb: 1, want: BytesPerMB},
+		{mb: 0.1, want: 104858},
+		{mb: 1.5, want: 1572864},
+		{mb: 1e300, want: math.MaxInt64},
+		{mb: -1e300, want: math.MinInt64},
+	}
+
+	for _, tc := range testCases {
+		if got := BytesFromMB(tc.mb); got != tc.want {
+			t.Fatalf("Expected %v MB to be %d bytes, got: %d", tc.mb, tc.want, got)
+		}
+	}
+
+	// Bytes survive the trip through MB
+	for _, bytes := range []int64{1, 999, 123456789, 1<<53 - 1} {
+		if got := BytesFromMB(MBFromBytes(bytes)); got != bytes {
+			t.Fatalf("Expected %d bytes back, got: %d", bytes, got)
+		}
+	}
+}
+
+func TestTrafficBytesAccumulation(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	usernames := []string{"counter_one", "counter_two"}
+	for _, username := range usernames {
+		if err := db.CreateUser(ctx, &User{Username: username}); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	// A node reports each user's running byte counter, growing by odd amounts
+	// that add up to drift when kept as floating point MB
+	var want int64
+	for i := 1; i <= 1000; i++ {
+		want += int64(i*7919) % 1500
+		for _, username := range usernames {
+			if err := db.UpdateUserTrafficBytes(ctx, username, want); err != nil {
+				t.Fatalf("Failed to update traffic: %v", err)
+			}
+		}
+	}
+
+	for _, username := range usernames {
+		user, err := db.User(ctx, username)
+		if err != nil {
+			t.Fatalf("Failed to retrieve user: %v", err)
+		}
+		if user.TrafficBytes != want || user.Traffic != MBFromBytes(want) {
+			t.Fatalf("Expected traffic: %d bytes, got: %d bytes (%v MB)", want, user.TrafficBytes, user.Traffic)
+		}
+	}
+
+	total, err := db.TotalTraffic(ctx)
+	if err != nil {
+		t.Fatalf("Failed to sum traffic: %v", err)
+	}
+	if BytesFromMB(total) != 2*want {
+		t.Fatalf("Expected total traffic: %d bytes, got: %d bytes", 2*want, BytesFromMB(total))
+	}
+
+	if err := db.UpdateUserTrafficBytes(ctx, "counter_one", -1); !errors.Is(err, ErrInvalidTraffic) {
+		t.Fatalf("Expected ErrInvalidTraffic for negative bytes, got: %v", err)
+	}
+	if _, err := db.UpsertUserTrafficBytes(ctx, "counter_new", 12345); err != nil {
+		t.Fatalf("Failed to upsert traffic: %v", err)
+	}
+	if user, err := db.User(ctx, "counter_new"); err != nil || user.TrafficBytes != 12345 {
+		t.Fatalf("Expected upserted traffic: 12345 bytes, got: %+v, %v", user, err)
+	}
+}
+
+func TestTrafficQuotaFromEnv(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{value: "", want: 0},
+		{value: "0", want: 0},
+		{value: "2048.5", want: 2048.5},
+		{value: "-1", wantErr: true},
+		{value: "Inf", wantErr: true},
+		{value: "lots", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv("TRAFFIC_QUOTA_MB", tc.value)
+			got, err := trafficQuotaFromEnv()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if !tc.wantErr && got != tc.want {
+				t.Fatalf("Expected quota: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestChargeTraffic(t *testing.T) {
+	t.Setenv("TRAFFIC_QUOTA_MB", "100")
+	t.Setenv("MAX_TRAFFIC_MB", "1000")
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	if err := db.CreateUser(ctx, &User{Username: "charged_user", Traffic: 10}); err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+
+	testCases := []struct {
+		name          string
+		mb            float64
+		wantRemaining float64
+		wantExhausted bool
+		wantErr       error
+	}{
+		{name: "Partial", mb: 40.5, wantRemaining: 49.5},
+		{name: "Zero", mb: 0, wantRemaining: 49.5},
+		{name: "ReachesQuota", mb: 49.5, wantRemaining: 0, wantExhausted: true},
+		{name: "PastQuota", mb: 20, wantRemaining: 0},
+		{name: "Negative", mb: -1, wantErr: ErrInvalidTraffic},
+		{name: "NaN", mb: math.NaN(), wantErr: ErrInvalidTraffic},
+		{name: "OverCap", mb: 900, wantErr: ErrInvalidTraffic},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			before, err := db.User(ctx, "charged_user")
+			if err != nil {
+				t.Fatalf("Failed to retrieve user: %v", err)
+			}
+
+			remaining, exhausted, err := db.ChargeTraffic(ctx, "charged_user", tc.mb)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+				}
+				after, err := db.User(ctx, "charged_user")
+				if err != nil {
+					t.Fatalf("Failed to retrieve user: %v", err)
+				}
+				if after.TrafficBytes != before.TrafficBytes {
+					t.Fatalf("Expected traffic to stay %d bytes, got: %d", before.TrafficBytes, after.TrafficBytes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Failed to charge traffic: %v", err)
+			}
+			if remaining != tc.wantRemaining || exhausted != tc.wantExhausted {
+				t.Fatalf("Expected remaining: %v, exhausted: %v, got: %v, %v", tc.wantRemaining, tc.wantExhausted, remaining, exhausted)
+			}
+		})
+	}
+
+	if _, _, err := db.ChargeTraffic(ctx, "missing_user", 1); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("Expected ErrUserNotFound, got: %v", err)
+	}
+}
+
+func TestChargeTrafficConcurrent(t *testing.T) {
+	t.Setenv("TRAFFIC_QUOTA_MB", "100")
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			if err := db.CreateUser(ctx, &User{Username: "concurrent_charge"}); err != nil {
+				t.Fatalf("Failed to create user: %v", err)
+			}
+
+			// 60 charges of 3 MB cross the 100 MB quota on the 34th
+			const charges = 60
+			var wg sync.WaitGroup
+			var exhaustedCount atomic.Int32
+			errs := make(chan error, charges)
+			for i := 0; i < charges; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, exhausted, err := db.ChargeTraffic(ctx, "concurrent_charge", 3)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if exhausted {
+						exhaustedCount.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			for err := range errs {
+				t.Fatalf("Failed to charge traffic: %v", err)
+			}
+			if got := exhaustedCount.Load(); got != 1 {
+				t.Fatalf("Expected exhaustion to be reported once, got: %d", got)
+			}
+			user, err := db.User(ctx, "concurrent_charge")
+			if err != nil {
+				t.Fatalf("Failed to retrieve user: %v", err)
+			}
+			if user.Traffic != 3*charges {
+				t.Fatalf("Expected traffic: %v, got: %v", 3*charges, user.Traffic)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	transferSourceSQL = "SELECT subscription_id, chat_id, traffic_bytes FROM users WHERE username = $1 AND deleted_at IS NULL"
+	transferTargetSQL = "SELECT subscription_id, chat_id, traffic_bytes, deleted_at FROM users WHERE username = $1"
+)
+
+// ErrInvalidTransfer is returned when a user is transferred onto itself.
+var ErrInvalidTransfer = errors.New("invalid transfer")
+
+// TransferUser moves the subscription and traffic of fromUsername to toUsername and removes fromUsername, in one transaction.
+// An existing target keeps its chat ID, has its own subscription replaced and the traffic added to its own.
+// A missing target is created with the chat ID of the source, and a deleted one is restored like a new user.
+// A source that does not exist is reported as ErrUserNotFound.
+func (db *Database) TransferUser(ctx context.Context, fromUsername, toUsername string) error {
+	ctx, span := db.startSpan(ctx, "TransferUser", "UPDATE")
+	defer span.End()
+
+	if fromUsername == toUsername {
+		return fmt.Errorf("%w: %s cannot be transferred to itself", ErrInvalidTransfer, fromUsername)
+	}
+
+	db.log.DebugContext(ctx, "Preparing to transfer user", "from", fromUsername, "to", toUsername)
+
+	err := db.withTx(ctx, func(tx *sql.Tx) error {
+		var subscriptionID, chatID, traffic int64
+		err := tx.QueryRowContext(ctx, db.rebind(transferSourceSQL), fromUsername).Scan(&subscriptionID, &chatID, &traffic)
+		if errors.Is(err, sql.ErrNoRows) {
+			return &userNotFoundError{username: fromUsername}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get user %s: %w", fromUsername, err)
+		}
+		newStatus, err := db.currentStatus(ctx, tx, fromUsername)
+		if err != nil {
+			return err
+		}
+
+		var targetSubscriptionID, targetChatID, targetTraffic int64
+		var targetDeletedAt sql.NullString
+		err = tx.QueryRowContext(ctx, db.rebind(transferTargetSQL), toUsername).
+			Scan(&targetSubscriptionID, &targetChatID, &targetTraffic, &targetDeletedAt)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("failed to get user %s: %w", toUsername, err)
+		}
+		targetFound := err == nil
+		targetActive := targetFound && !targetDeletedAt.Valid
+
+		var oldStatus SubscriptionStatus
+		if targetActive {
+			if oldStatus, err = db.currentStatus(ctx, tx, toUsername); err != nil {
+				return err
+			}
+			chatID = targetChatID
+			traffic += targetTraffic
+		} else if err := validateUsername(toUsername); err != nil {
+			return err
+		}
+		if err := db.validateTrafficBytes(traffic); err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, db.rebind(hardDeleteUserSQL), fromUsername); err != nil {
+			return fmt.Errorf("failed to delete user %s: %w", fromUsername, err)
+		}
+
+		now := time.Now()
+		_, err = tx.ExecContext(ctx, db.rebind(upsertUserSQL), toUsername, subscriptionID, chatID, traffic, FormatTime(now))
+		if err != nil {
+			return fmt.Errorf("failed to write user %s: %w", toUsername, err)
+		}
+
+		if !targetFound {
+			return nil
+		}
+		// The target's own subscription is no longer referenced
+		if _, err := tx.ExecContext(ctx, db.rebind(deleteSubscriptionIfUnusedSQL), targetSubscriptionID); err != nil {
+			return fmt.Errorf("failed to delete replaced subscription: %w", err)
+		}
+		if !targetActive || oldStatus == newStatus {
+			return nil
+		}
+		return db.recordSubscriptionChange(ctx, tx, SubscriptionChange{
+			Username:  toUsername,
+			OldStatus: oldStatus,
+			NewStatus: newStatus,
+			ChangedAt: now,
+			Source:    changeSource(ctx, SourceTransfer),
+		})
+	})
+	db.existsCache.invalidate(fromUsername, toUsername)
+	if err != nil {
+		return err
+	}
+
+	db.log.DebugContext(ctx, "User transferred successfully", "from", fromUsername, "to", toUsername)
+	return nil
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTransferUser(t *testing.T) {
+	for _, driver := range testDrivers() {
+		t.Run(driver, func(t *testing.T) {
+			db, err := setupTestDBWithDriver(driver)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer teardownTestDB(db)
+
+			start := time.Now().Truncate(time.Second)
+			active := Subscription{
+				SubscriptionStatus: StatusActive,
+				Duration:           "month",
+				StartSubscription:  start,
+				EndSubscription:    start.AddDate(0, 1, 0),
+			}
+			createUser := func(user *User) *User {
+				if err := db.CreateUser(ctx, user); err != nil {
+					t.Fatalf("Failed to create user %s: %v", user.Username, err)
+				}
+				created, err := db.User(ctx, user.Username)
+				if err != nil {
+					t.Fatalf("Failed to retrieve user %s: %v", user.Username, err)
+				}
+				return created
+			}
+			countSubscriptions := func() int {
+				var count int
+				if err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM subscriptions").Scan(&count); err != nil {
+					t.Fatalf("Failed to count subscriptions: %v", err)
+				}
+				return count
+			}
+			assertGone := func(username string) {
+				exists, err := db.IsUserExists(ctx, username)
+				if err != nil || exists {
+					t.Fatalf("Expected user %s to be gone: %v, got exists: %v", username, err, exists)
+				}
+			}
+
+			t.Run("ExistingTarget", func(t *testing.T) {
+				source := createUser(&User{Username: "transfer_from", ChatID: 1, Traffic: 30, Subscription: active})
+				createUser(&User{Username: "transfer_to", ChatID: 2, Traffic: 12})
+				before := countSubscriptions()
+
+				if err := db.TransferUser(ctx, "transfer_from", "transfer_to"); err != nil {
+					t.Fatalf("Failed to transfer user: %v", err)
+				}
+
+				target, err := db.User(ctx, "transfer_to")
+				if err != nil {
+					t.Fatalf("Failed to retrieve target: %v", err)
+				}
+				if target.ChatID != 2 || target.Traffic != 42 {
+					t.Fatalf("Expected chat_id 2 and traffic 42, got: %+v", target)
+				}
+				if target.Subscription.ID != source.Subscription.ID || target.Subscription.SubscriptionStatus != StatusActive {
+					t.Fatalf("Expected the subscription %+v, got: %+v", source.Subscription, target.Subscription)
+				}
+				if after := countSubscriptions(); after != before-1 {
+					t.Fatalf("Expected the replaced subscription to be removed, subscriptions: %d, got: %d", before-1, after)
+				}
+				assertGone("transfer_from")
+
+				history, err := db.SubscriptionHistory(ctx, "transfer_to")
+				if err != nil {
+					t.Fatalf("Failed to get history: %v", err)
+				}
+				if len(history) != 1 || history[0].NewStatus != StatusActive || history[0].Source != SourceTransfer {
+					t.Fatalf("Expected one transfer to active in the history, got: %+v", history)
+				}
+			})
+
+			t.Run("NewTarget", func(t *testing.T) {
+				source := createUser(&User{Username: "transfer_old", ChatID: 3, Traffic: 7, Subscription: active})
+
+				// The cached answer for the target must not outlive the transfer
+				if exists, err := db.IsUserExists(ctx, "transfer_new"); err != nil || exists {
+					t.Fatalf("Expected the target not to exist: %v, got: %v", err, exists)
+				}
+				if err := db.TransferUser(ctx, "transfer_old", "transfer_new"); err != nil {
+					t.Fatalf("Failed to transfer user: %v", err)
+				}
+
+				target, err := db.User(ctx, "transfer_new")
+				if err != nil {
+					t.Fatalf("Failed to retrieve target: %v", err)
+				}
+				if target.ChatID != 3 || target.Traffic != 7 || target.Subscription.ID != source.Subscription.ID {
+					t.Fatalf("Expected the source's chat_id, traffic and subscription, got: %+v", target)
+				}
+				assertGone("transfer_old")
+			})
+
+			t.Run("DeletedTarget", func(t *testing.T) {
+				createUser(&User{Username: "transfer_src", ChatID: 4, Traffic: 5})
+				createUser(&User{Username: "transfer_gone", ChatID: 5, Traffic: 100})
+				if err := db.DeleteUser(ctx, "transfer_gone"); err != nil {
+					t.Fatalf("Failed to delete user: %v", err)
+				}
+
+				if err := db.TransferUser(ctx, "transfer_src", "transfer_gone"); err != nil {
+					t.Fatalf("Failed to transfer user: %v", err)
+				}
+				target, err := db.User(ctx, "transfer_gone")
+				if err != nil {
+					t.Fatalf("Failed to retrieve target: %v", err)
+				}
+				if target.ChatID != 4 || target.Traffic != 5 || target.DeletedAt != nil {
+					t.Fatalf("Expected the target restored with chat_id 4 and traffic 5, got: %+v", target)
+				}
+			})
+
+			t.Run("Errors", func(t *testing.T) {
+				createUser(&User{Username: "transfer_self", ChatID: 6})
+
+				testCases := []struct {
+					name    string
+					from    string
+					to      string
+					wantErr error
+				}{
+					{name: "SameUser", from: "transfer_self", to: "transfer_self", wantErr: ErrInvalidTransfer},
+					{name: "MissingSource", from: "transfer_missing", to: "transfer_self", wantErr: ErrUserNotFound},
+					{name: "InvalidTarget", from: "transfer_self", to: "no", wantErr: ErrInvalidUsername},
+				}
+				for _, tc := range testCases {
+					t.Run(tc.name, func(t *testing.T) {
+						if err := db.TransferUser(ctx, tc.from, tc.to); !errors.Is(err, tc.wantErr) {
+							t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+						}
+					})
+				}
+
+				// Failed transfers leave the source in place
+				if exists, err := db.IsUserExists(ctx, "transfer_self"); err != nil || !exists {
+					t.Fatalf("Expected the source to remain: %v, got: %v", err, exists)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWithTx(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	insert := func(tx *sql.Tx) error {
+		_, err := db.addSubscription(ctx, tx, defaultSubscription(time.Now()))
+		return err
+	}
+	countSubscriptions := func() int {
+		var count int
+		if err := db.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM subscriptions").Scan(&count); err != nil {
+			t.Fatalf("Failed to count subscriptions: %v", err)
+		}
+		return count
+	}
+
+	t.Run("Panic", func(t *testing.T) {
+		recovered := func() (p any) {
+			defer func() { p = recover() }()
+			db.withTx(ctx, func(tx *sql.Tx) error {
+				if err := insert(tx); err != nil {
+					t.Fatalf("Failed to insert subscription: %v", err)
+				}
+				panic("boom")
+			})
+			return nil
+		}()
+		if recovered != "boom" {
+			t.Fatalf("Expected the panic to be passed on: boom, got: %v", recovered)
+		}
+
+		// The SQLite test database has a single connection, so a lingering transaction would block these
+		if inUse := db.DB.Stats().InUse; inUse != 0 {
+			t.Fatalf("Expected no connection in use, got: %d", inUse)
+		}
+		if count := countSubscriptions(); count != 0 {
+			t.Fatalf("Expected the insert to be rolled back, got subscriptions: %d", count)
+		}
+		if err := db.withTx(ctx, insert); err != nil {
+			t.Fatalf("Failed to write after a panic: %v", err)
+		}
+		if count := countSubscriptions(); count != 1 {
+			t.Fatalf("Expected subscriptions: 1, got: %d", count)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		errFailed := errors.New("failed")
+		err := db.withTx(ctx, func(tx *sql.Tx) error {
+			if err := insert(tx); err != nil {
+				t.Fatalf("Failed to insert subscription: %v", err)
+			}
+			return errFailed
+		})
+		if !errors.Is(err, errFailed) {
+			t.Fatalf("Expected error: %v, got: %v", errFailed, err)
+		}
+		if inUse := db.DB.Stats().InUse; inUse != 0 {
+			t.Fatalf("Expected no connection in use, got: %d", inUse)
+		}
+		if count := countSubscriptions(); count != 1 {
+			t.Fatalf("Expected the insert to be rolled back, got subscriptions: %d", count)
+		}
+	})
+}
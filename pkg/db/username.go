@@ -0,0 +1,22 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// ErrInvalidUsername is returned when a new user's username does not follow Telegram's rules.
+var ErrInvalidUsername = errors.New("invalid username")
+
+// usernamePattern matches Telegram usernames: 5 to 32 letters, digits and underscores
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9_]{5,32}$`)
+
+// validateUsername reports an error wrapping ErrInvalidUsername unless username is a valid Telegram username.
+// Only new users are checked, so users stored before the check keep working.
+func validateUsername(username string) error {
+	if !usernamePattern.MatchString(username) {
+		return fmt.Errorf("%w %q: must be 5 to 32 letters, digits or underscores", ErrInvalidUsername, username)
+	}
+	return nil
+}
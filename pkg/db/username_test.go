@@ -0,0 +1,62 @@
+package db
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateUsername(t *testing.T) {
+	testCases := []struct {
+		username string
+		valid    bool
+	}{
+		{"alice", true},
+		{"john_doe", true},
+		{"User_2024", true},
+		{"_____", true},
+		{strings.Repeat("a", 32), true},
+		{"", false},
+		{"bob", false},
+		{"abcd", false},
+		{strings.Repeat("a", 33), false},
+		{"john doe", false},
+		{"john-doe", false},
+		{"@john_doe", false},
+		{"john.doe", false},
+		{"jöhn_doe", false},
+		{"alice\n", false},
+		{"x%_drop", false},
+	}
+
+	for _, tc := range testCases {
+		err := validateUsername(tc.username)
+		if tc.valid && err != nil {
+			t.Fatalf("Expected username %q to be valid, got: %v", tc.username, err)
+		}
+		if !tc.valid && !errors.Is(err, ErrInvalidUsername) {
+			t.Fatalf("Expected ErrInvalidUsername for %q, got: %v", tc.username, err)
+		}
+	}
+}
+
+func TestCreateUserInvalidUsername(t *testing.T) {
+	db, err := setupTestDB()
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer teardownTestDB(db)
+
+	if err := db.CreateUser(ctx, &User{Username: "bad-name"}); !errors.Is(err, ErrInvalidUsername) {
+		t.Fatalf("Expected ErrInvalidUsername, got: %v", err)
+	}
+	if _, err := db.UpsertUser(ctx, &User{Username: "bad-name"}); !errors.Is(err, ErrInvalidUsername) {
+		t.Fatalf("Expected ErrInvalidUsername, got: %v", err)
+	}
+	if _, err := db.UpsertUserTraffic(ctx, "bad-name", 10); !errors.Is(err, ErrInvalidUsername) {
+		t.Fatalf("Expected ErrInvalidUsername, got: %v", err)
+	}
+	if exists, err := db.IsUserExists(ctx, "bad-name"); err != nil || exists {
+		t.Fatalf("Expected no user to be stored: %v, got: %v", err, exists)
+	}
+}
@@ -0,0 +1,213 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// destructiveOpsVariable turns on the endpoints that wipe data, for test and development deployments
+const destructiveOpsVariable = "ALLOW_DESTRUCTIVE_OPS"
+
+// destructiveOpsEnabledFromEnv reports whether ALLOW_DESTRUCTIVE_OPS turns the destructive endpoints on
+func destructiveOpsEnabledFromEnv() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(destructiveOpsVariable))
+	return enabled
+}
+
+// healthSchedulerPath serves the scheduler health check without the bot token
+const healthSchedulerPath = "/health/scheduler"
+
+// DBStatsResponse represents the state of the database connection pool.
+type DBStatsResponse struct {
+	MaxOpenConnections int   `json:"max_open_connections" example:"25"`
+	OpenConnections    int   `json:"open_connections" example:"3"`
+	InUse              int   `json:"in_use" example:"1"`
+	Idle               int   `json:"idle" example:"2"`
+	WaitCount          int64 `json:"wait_count" example:"0"`
+	// WaitDuration is the total time spent waiting for a connection
+	WaitDuration string `json:"wait_duration" example:"1.5s"`
+}
+
+// CleanupSubscriptionsResponse represents the result of removing unused subscriptions.
+type CleanupSubscriptionsResponse struct {
+	Removed int `json:"removed" example:"3"`
+}
+
+// runResetTraffic handles resetting the traffic of all users on demand.
+// @Summary Reset the traffic of all users now
+// @Description Run the traffic reset task synchronously, regardless of when traffic was last reset. Answers 409 while a reset is already running.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} scheduler.TrafficResetSummary
+// @Failure 409 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Security Bearer
+// @Router /admin/tasks/reset-traffic [post]
+func (h *UserHandler) runResetTraffic(c *gin.Context) {
+	if h.Scheduler == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Scheduler is not available"})
+		return
+	}
+
+	h.log.InfoContext(c.Request.Context(), "Running traffic reset on demand")
+	summary, err := h.Scheduler.ResetTraffic()
+	if err != nil {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Traffic reset is already running"})
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// runCheckSubscriptions handles running the subscription sweep on demand.
+// @Summary Check all subscriptions now
+// @Description Run the subscription check task synchronously, activating paid and deactivating expired subscriptions. Answers 409 while a check is already running.
+// @Tags admin
+// @Produce json
+// @Success 200 {object} scheduler.SubscriptionSummary
+// @Failure 409 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Security Bearer
+// @Router /admin/tasks/check-subscriptions [post]
+func (h *UserHandler) runCheckSubscriptions(c *gin.Context) {
+	if h.Scheduler == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Scheduler is not available"})
+		return
+	}
+
+	h.log.InfoContext(c.Request.Context(), "Running subscription check on demand")
+	summary, err := h.Scheduler.CheckSubscriptions()
+	if err != nil {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Subscription check is already running"})
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// resetPreview handles reporting what the next traffic reset would do.
+// @Summary Preview the next traffic reset
+// @Description Get how many users the next scheduled traffic reset would reset, when traffic was last reset and when it will be reset next, without changing anything. last_reset is left out until a reset was recorded
+// @Tags admin
+// @Produce json
+// @Success 200 {object} scheduler.ResetPreview
+// @Failure 500 {object} ErrorResponse
+// @Failure 503 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /admin/reset-preview [get]
+func (h *UserHandler) resetPreview(c *gin.Context) {
+	if h.Scheduler == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Scheduler is not available"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	preview, err := h.Scheduler.PreviewReset(ctx)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, preview)
+}
+
+// schedulerHealth handles reporting whether the scheduled tasks still run.
+// @Summary Check the scheduler
+// @Description Report when every scheduled task last ran and when its next run is due at the latest (its schedule plus SCHEDULER_HEALTH_MARGIN and SCHEDULER_JITTER).
+// @Description Answers 503 when a task is past that deadline, e.g. because a run is stuck and the following runs are skipped. Served without the bot token for liveness probes
+// @Tags health
+// @Produce json
+// @Success 200 {object} scheduler.SchedulerHealth
+// @Failure 503 {object} scheduler.SchedulerHealth
+// @Router /health/scheduler [get]
+func (h *UserHandler) schedulerHealth(c *gin.Context) {
+	if h.Scheduler == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "Scheduler is not available"})
+		return
+	}
+
+	health := h.Scheduler.Health()
+	if !health.Healthy {
+		h.log.WarnContext(c.Request.Context(), "Scheduler is unhealthy", "tasks", health.Tasks)
+		c.JSON(http.StatusServiceUnavailable, health)
+		return
+	}
+	c.JSON(http.StatusOK, health)
+}
+
+// cleanupSubscriptions handles removing the subscriptions no User refers to.
+// @Summary Remove unused subscriptions
+// @Description Delete the subscriptions left without a User, which are otherwise only removed at startup and when deleted Users are purged
+// @Tags admin
+// @Produce json
+// @Success 200 {object} CleanupSubscriptionsResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /admin/cleanup/subscriptions [post]
+func (h *UserHandler) cleanupSubscriptions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Bulk)
+	defer cancel()
+
+	removed, err := h.Database.CleanupUnusedSubscriptions(ctx)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, CleanupSubscriptionsResponse{Removed: removed})
+}
+
+// truncateUsers handles removing every User and subscription.
+// @Summary Remove all users
+// @Description Permanently delete every User, including deleted ones, and every subscription in one transaction. Only enabled when ALLOW_DESTRUCTIVE_OPS is true, meant for resetting test and development databases
+// @Tags admin
+// @Produce json
+// @Success 200 {object} SuccessResponse
+// @Failure 403 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /admin/users/all [delete]
+func (h *UserHandler) truncateUsers(c *gin.Context) {
+	if !h.destructiveOpsEnabled {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Destructive operations are disabled, set " + destructiveOpsVariable + "=true to enable them"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Bulk)
+	defer cancel()
+
+	if err := h.Database.TruncateUsers(ctx); err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{Message: "All users deleted"})
+}
+
+// dbStats handles reporting the database connection pool statistics.
+// @Summary Get database connection pool statistics
+// @Description Get how many connections are open, in use and idle, and how often and long requests waited for one
+// @Tags admin
+// @Produce json
+// @Success 200 {object} DBStatsResponse
+// @Security Bearer
+// @Router /admin/db-stats [get]
+func (h *UserHandler) dbStats(c *gin.Context) {
+	stats := h.Database.Stats()
+	c.JSON(http.StatusOK, DBStatsResponse{
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDuration:       stats.WaitDuration.Round(time.Millisecond).String(),
+	})
+}
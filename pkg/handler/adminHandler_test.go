@@ -0,0 +1,186 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+	"github.com/YuarenArt/tg-users-database/pkg/scheduler"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDBStats(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/admin/db-stats", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var stats map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	for _, key := range []string{"max_open_connections", "open_connections", "in_use", "idle", "wait_count", "wait_duration"} {
+		assert.Contains(t, stats, key)
+	}
+	// The SQLite test database is limited to a single connection
+	assert.EqualValues(t, 1, stats["max_open_connections"])
+
+	// Like every other endpoint it needs the bot token
+	rec = httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/db-stats", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestCleanupSubscriptions(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, username := range []string{"kept_user", "orphan"} {
+		if err := database.CreateUser(ctx, &db.User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+	if _, err := database.DB.ExecContext(ctx, "DELETE FROM users WHERE username = 'orphan'"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodPost, "/admin/cleanup/subscriptions", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"removed":1}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodPost, "/admin/cleanup/subscriptions", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"removed":0}`, rec.Body.String())
+}
+
+func TestTruncateUsers(t *testing.T) {
+	t.Run("Enabled", func(t *testing.T) {
+		t.Setenv(destructiveOpsVariable, "true")
+		h, database := setupTestEnvironment()
+		defer database.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		for _, username := range []string{"first", "second"} {
+			if err := database.CreateUser(ctx, &db.User{Username: username, ChatID: 12345}); err != nil {
+				t.Fatalf("Failed to create initial user: %v", err)
+			}
+		}
+
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodDelete, "/admin/users/all", nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		for _, table := range []string{"users", "subscriptions"} {
+			var count int
+			if err := database.DB.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&count); err != nil {
+				t.Fatalf("Failed to count %s: %v", table, err)
+			}
+			assert.Equal(t, 0, count, table)
+		}
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Setenv(destructiveOpsVariable, "")
+		h, database := setupTestEnvironment()
+		defer database.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := database.CreateUser(ctx, &db.User{Username: "kept_user", ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodDelete, "/admin/users/all", nil))
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		exists, err := database.IsUserExists(ctx, "kept_user")
+		assert.NoError(t, err)
+		assert.True(t, exists)
+	})
+}
+
+func TestResetPreview(t *testing.T) {
+	t.Setenv("RESET_STATE_FILE", filepath.Join(t.TempDir(), "last_reset_time.txt"))
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, username := range []string{"preview_one", "preview_two", "preview_three"} {
+		if err := database.CreateUser(ctx, &db.User{Username: username, Traffic: 5}); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+	usernames, err := database.AllUsername(ctx)
+	if err != nil {
+		t.Fatalf("Failed to list users: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/admin/reset-preview", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var preview scheduler.ResetPreview
+	if err := json.Unmarshal(rec.Body.Bytes(), &preview); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	assert.Equal(t, len(usernames), preview.Users)
+	assert.True(t, preview.NextReset.After(time.Now()))
+
+	// Nothing was reset
+	for _, username := range usernames {
+		user, err := database.User(ctx, username)
+		if err != nil {
+			t.Fatalf("Failed to get user: %v", err)
+		}
+		assert.Equal(t, float64(5), user.Traffic)
+	}
+}
+
+func TestSchedulerHealth(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	// Served without the bot token
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/scheduler", nil))
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+	var health scheduler.SchedulerHealth
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	assert.True(t, health.Healthy)
+	assert.NotEmpty(t, health.Tasks)
+
+	// A task that did not run within its interval, as when a stuck run makes the following ones skip
+	h.Scheduler.HealthMargin = 0
+	h.Scheduler.RegisterTask("stuck", "@every 1s", func() {})
+	time.Sleep(1100 * time.Millisecond)
+
+	rec = httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/health/scheduler", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, rec.Body.String())
+
+	if err := json.Unmarshal(rec.Body.Bytes(), &health); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	assert.False(t, health.Healthy)
+	for _, task := range health.Tasks {
+		assert.Equal(t, task.Name != "stuck", task.Healthy, task.Name)
+	}
+}
@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	defaultMaxBodyBytes  = 1 << 20
+	maxBodyBytesVariable = "MAX_BODY_BYTES"
+)
+
+// maxBodyBytesFromEnv returns the largest request body accepted, read from MAX_BODY_BYTES
+func maxBodyBytesFromEnv() (int64, error) {
+	value := os.Getenv(maxBodyBytesVariable)
+	if value == "" {
+		return defaultMaxBodyBytes, nil
+	}
+
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive number of bytes", maxBodyBytesVariable, value)
+	}
+	return n, nil
+}
+
+// BodyLimitMiddleware rejects request bodies larger than MAX_BODY_BYTES with 413.
+// Bodies announcing their size are rejected up front, others fail once reading passes the limit.
+func (h *UserHandler) BodyLimitMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > h.maxBodyBytes {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: "Request body too large"})
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, h.maxBodyBytes)
+		c.Next()
+	}
+}
+
+// respondWithBodyError responds to a request body that could not be read or parsed,
+// with 413 if it was cut off by the body limit and 400 otherwise
+func respondWithBodyError(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: "Request body too large"})
+		return
+	}
+	var invalid validator.ValidationErrors
+	if errors.As(err, &invalid) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request body", Fields: validationFields(invalid)})
+		return
+	}
+	c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+}
+
+// bindJSON decodes the JSON request body into obj, responding with an error and returning false if it fails.
+// Bodies not sent as application/json are rejected with 415 before they are read.
+func bindJSON(c *gin.Context, obj any) bool {
+	if !requireJSONContentType(c) {
+		return false
+	}
+	if err := c.ShouldBindJSON(obj); err != nil {
+		respondWithBodyError(c, err)
+		return false
+	}
+	return true
+}
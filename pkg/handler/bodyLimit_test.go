@@ -0,0 +1,69 @@
+package handler
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyLimit(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+	h.maxBodyBytes = 64
+
+	oversized := `{"username":"` + strings.Repeat("a", 100) + `","chat_id":42}`
+	csvHeader := "username,chat_id,traffic,subscription_status,duration,start_subscription,end_subscription\n"
+	oversizedCSV := csvHeader + strings.Repeat("a", 100) + ",42,0,,,,\n"
+
+	testCases := []struct {
+		name               string
+		url                string
+		contentType        string
+		body               io.Reader
+		expectedStatusCode int
+	}{
+		{name: "WithinLimit", url: "/users/", contentType: "application/json", body: strings.NewReader(`{"username":"small","chat_id":42}`), expectedStatusCode: http.StatusCreated},
+		{name: "ContentLength", url: "/users/", contentType: "application/json", body: strings.NewReader(oversized), expectedStatusCode: http.StatusRequestEntityTooLarge},
+		// Without a Content-Length the limit is hit while reading
+		{name: "Chunked", url: "/users/", contentType: "application/json", body: io.MultiReader(strings.NewReader(oversized)), expectedStatusCode: http.StatusRequestEntityTooLarge},
+		{name: "ChunkedBulkDelete", url: "/users/bulk-delete", contentType: "application/json", body: io.MultiReader(strings.NewReader(`["` + strings.Repeat("a", 100) + `"]`)), expectedStatusCode: http.StatusRequestEntityTooLarge},
+		{name: "ChunkedCSV", url: "/users/import.csv", contentType: "text/csv", body: io.MultiReader(strings.NewReader(oversizedCSV)), expectedStatusCode: http.StatusRequestEntityTooLarge},
+		{name: "InvalidJSON", url: "/users/", contentType: "application/json", body: strings.NewReader(`{`), expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodPost, tc.url, tc.body)
+			req.Header.Set("Content-Type", tc.contentType)
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code)
+			if tc.expectedStatusCode == http.StatusRequestEntityTooLarge {
+				assert.JSONEq(t, `{"error":"Request body too large"}`, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestMaxBodyBytesFromEnv(t *testing.T) {
+	t.Setenv(maxBodyBytesVariable, "")
+	n, err := maxBodyBytesFromEnv()
+	assert.NoError(t, err)
+	assert.EqualValues(t, defaultMaxBodyBytes, n)
+
+	t.Setenv(maxBodyBytesVariable, "2048")
+	n, err = maxBodyBytesFromEnv()
+	assert.NoError(t, err)
+	assert.EqualValues(t, 2048, n)
+
+	for _, value := range []string{"0", "-1", "1MB"} {
+		t.Setenv(maxBodyBytesVariable, value)
+		_, err = maxBodyBytesFromEnv()
+		assert.Error(t, err, value)
+	}
+}
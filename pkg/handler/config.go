@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+const authDisabledVariable = "AUTH_DISABLED"
+
+// ErrBotTokenNotSet is returned when no bot token is configured and authentication is not disabled.
+var ErrBotTokenNotSet = errors.New("BOT_TOKEN is not set")
+
+// Config configures a UserHandler. Zero timeouts, TTL, body limit and gzip threshold take their defaults.
+type Config struct {
+	// BotToken is the bearer token every request must carry, required unless AuthDisabled is set
+	BotToken string
+	// AuthDisabled serves every endpoint without the bot token, for local development only
+	AuthDisabled bool
+	Timeouts     Timeouts
+	// IdempotencyTTL is how long responses to requests with an Idempotency-Key are replayed
+	IdempotencyTTL time.Duration
+	// MaxBodyBytes is the largest request body accepted
+	MaxBodyBytes int64
+	// GzipMinBytes is the smallest response body compressed for clients accepting gzip
+	GzipMinBytes int
+	// SwaggerHost and SwaggerSchemes replace the host and schemes of the served API docs when set
+	SwaggerHost    string
+	SwaggerSchemes []string
+	// PprofEnabled mounts the profiling endpoints
+	PprofEnabled bool
+	// DestructiveOpsEnabled allows removing all users
+	DestructiveOpsEnabled bool
+}
+
+// ConfigFromEnv reads the handler configuration from the environment, loading a .env file first if there is one.
+func ConfigFromEnv() (Config, error) {
+	if err := godotenv.Load(); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Config{}, fmt.Errorf("failed to load .env file: %w", err)
+	}
+
+	config := Config{
+		BotToken:              os.Getenv("BOT_TOKEN"),
+		SwaggerHost:           os.Getenv(swaggerHostVariable),
+		AuthDisabled:          authDisabledFromEnv(),
+		PprofEnabled:          pprofEnabledFromEnv(),
+		DestructiveOpsEnabled: destructiveOpsEnabledFromEnv(),
+	}
+
+	var err error
+	if config.Timeouts, err = TimeoutsFromEnv(); err != nil {
+		return Config{}, fmt.Errorf("invalid handler timeout: %w", err)
+	}
+	if config.IdempotencyTTL, err = idempotencyKeyTTLFromEnv(); err != nil {
+		return Config{}, fmt.Errorf("invalid idempotency key TTL: %w", err)
+	}
+	if config.MaxBodyBytes, err = maxBodyBytesFromEnv(); err != nil {
+		return Config{}, fmt.Errorf("invalid request body limit: %w", err)
+	}
+	if config.GzipMinBytes, err = gzipMinBytesFromEnv(); err != nil {
+		return Config{}, fmt.Errorf("invalid gzip threshold: %w", err)
+	}
+	if config.SwaggerSchemes, err = swaggerSchemesFromEnv(); err != nil {
+		return Config{}, fmt.Errorf("invalid swagger scheme: %w", err)
+	}
+	return config, nil
+}
+
+// authDisabledFromEnv reports whether AUTH_DISABLED turns off the bot token check
+func authDisabledFromEnv() bool {
+	disabled, _ := strconv.ParseBool(os.Getenv(authDisabledVariable))
+	return disabled
+}
+
+// withDefaults returns the config with its zero durations and limits replaced by the defaults
+func (c Config) withDefaults() Config {
+	if c.Timeouts.Read == 0 {
+		c.Timeouts.Read = defaultHandlerTimeout
+	}
+	if c.Timeouts.Write == 0 {
+		c.Timeouts.Write = defaultHandlerTimeout
+	}
+	if c.Timeouts.Bulk == 0 {
+		c.Timeouts.Bulk = defaultBulkTimeout
+	}
+	if c.IdempotencyTTL == 0 {
+		c.IdempotencyTTL = defaultIdempotencyKeyTTL
+	}
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = defaultMaxBodyBytes
+	}
+	if c.GzipMinBytes == 0 {
+		c.GzipMinBytes = defaultGzipMinBytes
+	}
+	return c
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+	"github.com/YuarenArt/tg-users-database/pkg/scheduler"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHandlerWithConfig(t *testing.T) {
+	newDatabase := func(t *testing.T) *db.Database {
+		database, err := db.NewDatabaseWithDriver(db.DriverSQLite, dataSourceName, nil)
+		if err != nil {
+			t.Fatalf("Failed to setup test database: %v", err)
+		}
+		t.Cleanup(func() { database.Close() })
+		return database
+	}
+	get := func(h *UserHandler, authorization string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/users/stats", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("MissingToken", func(t *testing.T) {
+		database := newDatabase(t)
+		h, err := NewHandlerWithConfig(database, scheduler.NewScheduler(database), nil, Config{})
+		if !errors.Is(err, ErrBotTokenNotSet) {
+			t.Fatalf("Expected ErrBotTokenNotSet, got: %v", err)
+		}
+		assert.Nil(t, h)
+	})
+
+	t.Run("MissingTokenFromEnv", func(t *testing.T) {
+		t.Setenv("BOT_TOKEN", "")
+		t.Setenv(authDisabledVariable, "")
+		config, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatalf("Failed to read config: %v", err)
+		}
+
+		database := newDatabase(t)
+		if _, err := NewHandlerWithConfig(database, scheduler.NewScheduler(database), nil, config); !errors.Is(err, ErrBotTokenNotSet) {
+			t.Fatalf("Expected ErrBotTokenNotSet, got: %v", err)
+		}
+	})
+
+	t.Run("AuthDisabled", func(t *testing.T) {
+		t.Setenv("BOT_TOKEN", "")
+		t.Setenv(authDisabledVariable, "true")
+		config, err := ConfigFromEnv()
+		if err != nil {
+			t.Fatalf("Failed to read config: %v", err)
+		}
+
+		database := newDatabase(t)
+		h, err := NewHandlerWithConfig(database, scheduler.NewScheduler(database), nil, config)
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+
+		// No token is needed, and a wrong one is not rejected either
+		assert.Equal(t, http.StatusOK, get(h, "").Code)
+		assert.Equal(t, http.StatusOK, get(h, "Bearer wrong").Code)
+	})
+
+	t.Run("AuthEnabled", func(t *testing.T) {
+		database := newDatabase(t)
+		h, err := NewHandlerWithConfig(database, scheduler.NewScheduler(database), nil, Config{BotToken: "secret"})
+		if err != nil {
+			t.Fatalf("Failed to create handler: %v", err)
+		}
+
+		assert.Equal(t, http.StatusUnauthorized, get(h, "").Code)
+		assert.Equal(t, http.StatusOK, get(h, "Bearer secret").Code)
+	})
+}
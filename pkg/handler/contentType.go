@@ -0,0 +1,19 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const jsonContentType = "application/json"
+
+// requireJSONContentType responds with 415 and returns false unless the request body is declared as JSON.
+// Parameters such as charset are ignored.
+func requireJSONContentType(c *gin.Context) bool {
+	if c.ContentType() != jsonContentType {
+		c.JSON(http.StatusUnsupportedMediaType, ErrorResponse{Error: "Content-Type must be " + jsonContentType})
+		return false
+	}
+	return true
+}
@@ -0,0 +1,50 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJSONContentType(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	testCases := []struct {
+		name               string
+		method             string
+		url                string
+		contentType        string
+		body               string
+		expectedStatusCode int
+	}{
+		{name: "JSON", method: http.MethodPost, url: "/users/", contentType: "application/json", body: `{"username":"json_user","chat_id":42}`, expectedStatusCode: http.StatusCreated},
+		{name: "JSONWithCharset", method: http.MethodPost, url: "/users/", contentType: "application/json; charset=utf-8", body: `{"username":"charset","chat_id":42}`, expectedStatusCode: http.StatusCreated},
+		{name: "PlainText", method: http.MethodPost, url: "/users/", contentType: "text/plain", body: `{"username":"plain","chat_id":42}`, expectedStatusCode: http.StatusUnsupportedMediaType},
+		{name: "Missing", method: http.MethodPost, url: "/users/", body: `{"username":"missing","chat_id":42}`, expectedStatusCode: http.StatusUnsupportedMediaType},
+		{name: "Put", method: http.MethodPut, url: "/users/json_user/traffic", contentType: "text/plain", body: `{"traffic":1}`, expectedStatusCode: http.StatusUnsupportedMediaType},
+		{name: "Patch", method: http.MethodPatch, url: "/users/json_user", contentType: "application/x-www-form-urlencoded", body: `chat_id=7`, expectedStatusCode: http.StatusUnsupportedMediaType},
+		// Endpoints without a JSON body are not checked
+		{name: "CSVImport", method: http.MethodPost, url: "/users/import.csv", contentType: "text/csv", body: "username,chat_id,traffic,subscription_status,duration,start,end\ncsv_user,42,0,,,,\n", expectedStatusCode: http.StatusCreated},
+		{name: "NoBody", method: http.MethodPost, url: "/users/json_user/traffic/reset", expectedStatusCode: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code, rec.Body.String())
+			if tc.expectedStatusCode == http.StatusUnsupportedMediaType {
+				assert.JSONEq(t, `{"error":"Content-Type must be application/json"}`, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package handler
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+	"github.com/gin-gonic/gin"
+)
+
+// csvHeader lists the columns of the users CSV in order
+var csvHeader = []string{"username", "chat_id", "traffic", "subscription_status", "duration", "start", "end"}
+
+// ImportUsersResponse represents the result of a CSV import.
+type ImportUsersResponse struct {
+	Imported int `json:"imported" example:"42"`
+}
+
+// exportUsersCSV handles streaming all users as CSV.
+// @Summary Export all Users as CSV
+// @Description Stream all Users as CSV with the columns username, chat_id, traffic, subscription_status, duration, start, end. Times are RFC3339, empty when unset.
+// @Tags users
+// @Produce text/csv
+// @Success 200 {string} string "CSV file"
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/export.csv [get]
+func (h *UserHandler) exportUsersCSV(c *gin.Context) {
+	users, err := h.listUsersPage(c, "")
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=users-export.csv")
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	writer := csv.NewWriter(c.Writer)
+	writer.Write(csvHeader)
+
+	exported := 0
+	for {
+		for _, user := range users {
+			if err := writer.Write(userToCSV(user)); err != nil {
+				h.log.ErrorContext(c.Request.Context(), "Failed to write exported user", "error", err)
+				return
+			}
+			exported++
+		}
+		writer.Flush()
+
+		if len(users) < exportPageSize {
+			break
+		}
+
+		users, err = h.listUsersPage(c, users[len(users)-1].Username)
+		if err != nil {
+			h.log.ErrorContext(c.Request.Context(), "Failed to export users", "exported", exported, "error", err)
+			return
+		}
+	}
+
+	if err := writer.Error(); err != nil {
+		h.log.ErrorContext(c.Request.Context(), "Failed to write CSV", "error", err)
+		return
+	}
+	h.log.InfoContext(c.Request.Context(), "Users exported as CSV", "count", exported)
+}
+
+// importUsersCSV handles creating users from an uploaded CSV.
+// @Summary Import Users from CSV
+// @Description Create Users from a CSV in the format of /users/export.csv, sent as the request body or as the "file" field of a multipart form. Either every User is created or none is.
+// @Tags users
+// @Accept text/csv
+// @Accept mpfd
+// @Produce json
+// @Param file formData file false "CSV file"
+// @Success 201 {object} ImportUsersResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/import.csv [post]
+func (h *UserHandler) importUsersCSV(c *gin.Context) {
+	var body io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		fileHeader, err := c.FormFile("file")
+		if errors.Is(err, http.ErrMissingFile) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Form field file is required"})
+			return
+		}
+		if err != nil {
+			respondWithBodyError(c, err)
+			return
+		}
+		file, err := fileHeader.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+
+	users, err := parseUsersCSV(body)
+	if err != nil {
+		respondWithBodyError(c, err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Bulk)
+	defer cancel()
+
+	if err := h.Database.CreateUsers(ctx, users); err != nil {
+		if errors.Is(err, db.ErrInvalidSubscriptionStatus) || errors.Is(err, db.ErrInvalidSubscriptionDates) ||
+			errors.Is(err, db.ErrInvalidTraffic) || errors.Is(err, db.ErrInvalidUsername) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if errors.Is(err, db.ErrUserExists) {
+			c.JSON(http.StatusConflict, ErrorResponse{Error: err.Error()})
+			return
+		}
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, ImportUsersResponse{Imported: len(users)})
+}
+
+// userToCSV converts the user into a CSV record in the order of csvHeader
+func userToCSV(user db.User) []string {
+	return []string{
+		user.Username,
+		strconv.FormatInt(user.ChatID, 10),
+		strconv.FormatFloat(user.Traffic, 'f', -1, 64),
+		string(user.Subscription.SubscriptionStatus),
+		user.Subscription.Duration,
+		formatCSVTime(user.Subscription.StartSubscription),
+		formatCSVTime(user.Subscription.EndSubscription),
+	}
+}
+
+// parseUsersCSV reads users from CSV with the columns of csvHeader.
+// Errors name the line of the first bad row.
+func parseUsersCSV(r io.Reader) ([]db.User, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = len(csvHeader)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("CSV is empty")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := validateCSVHeader(header); err != nil {
+		return nil, err
+	}
+
+	var users []db.User
+	seen := map[string]int{}
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			// csv.ParseError already names the line
+			return nil, err
+		}
+
+		line, _ := reader.FieldPos(0)
+		user, err := userFromCSV(record)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if previous, ok := seen[user.Username]; ok {
+			return nil, fmt.Errorf("line %d: username %s is already used on line %d", line, user.Username, previous)
+		}
+		seen[user.Username] = line
+		users = append(users, user)
+	}
+
+	if len(users) == 0 {
+		return nil, errors.New("CSV contains no users")
+	}
+	return users, nil
+}
+
+// validateCSVHeader checks that the header names the columns of csvHeader in order
+func validateCSVHeader(header []string) error {
+	// Spreadsheet programs may prepend a UTF-8 byte order mark
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+	for i, column := range csvHeader {
+		if !strings.EqualFold(strings.TrimSpace(header[i]), column) {
+			return fmt.Errorf("line 1: expected header %s, got %s", strings.Join(csvHeader, ","), strings.Join(header, ","))
+		}
+	}
+	return nil
+}
+
+// userFromCSV converts a CSV record in the order of csvHeader into a user.
+// Empty chat_id and traffic mean zero, empty times mean unset.
+func userFromCSV(record []string) (db.User, error) {
+	var user db.User
+	var err error
+
+	user.Username = strings.TrimSpace(record[0])
+	if user.Username == "" {
+		return user, errors.New("username is empty")
+	}
+
+	if value := strings.TrimSpace(record[1]); value != "" {
+		user.ChatID, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return user, fmt.Errorf("invalid chat_id %q", value)
+		}
+	}
+
+	if value := strings.TrimSpace(record[2]); value != "" {
+		user.Traffic, err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return user, fmt.Errorf("invalid traffic %q", value)
+		}
+	}
+
+	user.Subscription.SubscriptionStatus = db.SubscriptionStatus(strings.TrimSpace(record[3]))
+	if user.Subscription.SubscriptionStatus != "" {
+		if err := user.Subscription.SubscriptionStatus.Validate(); err != nil {
+			return user, err
+		}
+	}
+	user.Subscription.Duration = strings.TrimSpace(record[4])
+
+	user.Subscription.StartSubscription, err = parseCSVTime(record[5])
+	if err != nil {
+		return user, fmt.Errorf("invalid start: %w", err)
+	}
+	user.Subscription.EndSubscription, err = parseCSVTime(record[6])
+	if err != nil {
+		return user, fmt.Errorf("invalid end: %w", err)
+	}
+
+	return user, nil
+}
+
+// formatCSVTime formats t as RFC3339, leaving unset times empty
+func formatCSVTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// parseCSVTime parses an RFC3339 time, treating an empty value as unset
+func parseCSVTime(value string) (time.Time, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
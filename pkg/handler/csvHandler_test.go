@@ -0,0 +1,159 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCSVExportImportRoundTrip(t *testing.T) {
+	source, sourceDB := setupTestEnvironment()
+	defer sourceDB.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	users := []db.User{
+		{
+			Username: "activeuser",
+			ChatID:   12345,
+			Traffic:  12.5,
+			Subscription: db.Subscription{
+				SubscriptionStatus: db.StatusActive,
+				Duration:           "1 month",
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
+			},
+		},
+		{Username: "newuser", ChatID: 67890},
+	}
+	for i := range users {
+		if err := sourceDB.CreateUser(ctx, &users[i]); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	source.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/export.csv", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "attachment; filename=users-export.csv", rec.Header().Get("Content-Disposition"))
+	exported := rec.Body.String()
+	assert.True(t, strings.HasPrefix(exported, "username,chat_id,traffic,subscription_status,duration,start,end\n"), exported)
+
+	target, targetDB := setupTestEnvironment()
+	defer targetDB.Close()
+
+	req := newTestRequest(http.MethodPost, "/users/import.csv", strings.NewReader(exported))
+	req.Header.Set("Content-Type", "text/csv")
+	rec = httptest.NewRecorder()
+	target.Router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"imported":2}`, rec.Body.String())
+
+	for _, username := range []string{"activeuser", "newuser"} {
+		want, err := sourceDB.User(ctx, username)
+		if err != nil {
+			t.Fatalf("Failed to get source user: %v", err)
+		}
+		got, err := targetDB.User(ctx, username)
+		if err != nil {
+			t.Fatalf("Failed to get imported user: %v", err)
+		}
+		assert.Equal(t, want.ChatID, got.ChatID)
+		assert.Equal(t, want.Traffic, got.Traffic)
+		assert.Equal(t, want.Subscription.SubscriptionStatus, got.Subscription.SubscriptionStatus)
+		assert.Equal(t, want.Subscription.Duration, got.Subscription.Duration)
+		assert.True(t, want.Subscription.StartSubscription.Equal(got.Subscription.StartSubscription), username)
+		assert.True(t, want.Subscription.EndSubscription.Equal(got.Subscription.EndSubscription), username)
+	}
+
+	// Exporting the import again gives the same CSV
+	rec = httptest.NewRecorder()
+	target.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/export.csv", nil))
+	assert.Equal(t, exported, rec.Body.String())
+}
+
+func TestImportUsersCSVMultipart(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	file, err := form.CreateFormFile("file", "users.csv")
+	if err != nil {
+		t.Fatalf("Failed to create form file: %v", err)
+	}
+	file.Write([]byte("\ufeffusername,chat_id,traffic,subscription_status,duration,start,end\n\"alice\",1,\"2.5\",,,,\n"))
+	form.Close()
+
+	req := newTestRequest(http.MethodPost, "/users/import.csv", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	user, err := database.User(context.Background(), "alice")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2.5, user.Traffic)
+		assert.Equal(t, db.StatusInactive, user.Subscription.SubscriptionStatus)
+	}
+}
+
+func TestImportUsersCSVErrors(t *testing.T) {
+	const header = "username,chat_id,traffic,subscription_status,duration,start,end\n"
+
+	testCases := []struct {
+		name               string
+		body               string
+		expectedStatusCode int
+		expectedError      string
+	}{
+		{name: "Empty", body: "", expectedStatusCode: http.StatusBadRequest, expectedError: "CSV is empty"},
+		{name: "NoUsers", body: header, expectedStatusCode: http.StatusBadRequest, expectedError: "no users"},
+		{name: "WrongHeader", body: "name,chat_id,traffic,subscription_status,duration,start,end\n", expectedStatusCode: http.StatusBadRequest, expectedError: "line 1"},
+		{name: "BadChatID", body: header + "alice,1,0,,,,\nbob,abc,0,,,,\n", expectedStatusCode: http.StatusBadRequest, expectedError: "line 3: invalid chat_id"},
+		{name: "BadTime", body: header + "alice,1,0,active,1 month,2024-01-01,\n", expectedStatusCode: http.StatusBadRequest, expectedError: "line 2: invalid start"},
+		{name: "BadStatus", body: header + "alice,1,0,actve,,,\n", expectedStatusCode: http.StatusBadRequest, expectedError: "line 2"},
+		{name: "FieldCount", body: header + "alice,1,0,,,,\nbob,2\n", expectedStatusCode: http.StatusBadRequest, expectedError: "line 3"},
+		{name: "DuplicateRow", body: header + "alice,1,0,,,,\nalice,2,0,,,,\n", expectedStatusCode: http.StatusBadRequest, expectedError: "line 3"},
+		{name: "ExistingUser", body: header + "newuser,1,0,,,,\nexisting,2,0,,,,\n", expectedStatusCode: http.StatusConflict, expectedError: "existing"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, database := setupTestEnvironment()
+			defer database.Close()
+
+			if err := database.CreateUser(context.Background(), &db.User{Username: "existing"}); err != nil {
+				t.Fatalf("Failed to create initial user: %v", err)
+			}
+
+			req := newTestRequest(http.MethodPost, "/users/import.csv", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "text/csv")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code)
+			var response ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+			assert.Contains(t, response.Error, tc.expectedError)
+
+			// A failed import creates nobody
+			exists, err := database.IsUserExists(context.Background(), "newuser")
+			assert.NoError(t, err)
+			assert.False(t, exists)
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserETag(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "polled", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	get := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := newTestRequest(http.MethodGet, "/users/polled", nil)
+		if ifNoneMatch != "" {
+			req.Header.Set(ifNoneMatchHeader, ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := get("")
+	assert.Equal(t, http.StatusOK, first.Code)
+	etag := first.Header().Get(etagHeader)
+	assert.Regexp(t, `^W/"[0-9a-f]{32}"$`, etag)
+
+	notModified := get(etag)
+	assert.Equal(t, http.StatusNotModified, notModified.Code)
+	assert.Empty(t, notModified.Body.String())
+	assert.Equal(t, etag, notModified.Header().Get(etagHeader))
+
+	// Matches within a list of tags and as a strong tag
+	assert.Equal(t, http.StatusNotModified, get(`"other", `+etag).Code)
+	assert.Equal(t, http.StatusNotModified, get(etag[2:]).Code)
+	assert.Equal(t, http.StatusOK, get(`W/"other"`).Code)
+
+	// Any change to the user changes the tag
+	if err := database.UpdateUserTraffic(ctx, "polled", 10); err != nil {
+		t.Fatalf("Failed to set traffic: %v", err)
+	}
+	changed := get(etag)
+	assert.Equal(t, http.StatusOK, changed.Code)
+	assert.NotEqual(t, etag, changed.Header().Get(etagHeader))
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// exportPageSize is the number of users read from the database at a time while exporting
+	exportPageSize = 100
+
+	// exportIncompleteCode marks the error line ending an NDJSON export that failed part way
+	exportIncompleteCode = "export_incomplete"
+)
+
+// exportUsers handles streaming all users as a JSON array for backups.
+// @Summary Export all Users as JSON
+// @Description Stream all Users with their subscriptions as a JSON array attachment
+// @Tags users
+// @Produce json
+// @Success 200 {array} db.User
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/export [get]
+func (h *UserHandler) exportUsers(c *gin.Context) {
+	// Read the first page before writing anything so a failing database still gets a proper error response
+	users, err := h.listUsersPage(c, "")
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=users-export.json")
+	c.Header("Content-Type", "application/json; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	encoder := json.NewEncoder(c.Writer)
+	c.Writer.WriteString("[")
+
+	exported := 0
+	for {
+		for _, user := range users {
+			if exported > 0 {
+				c.Writer.WriteString(",")
+			}
+			if err := encoder.Encode(user); err != nil {
+				h.log.ErrorContext(c.Request.Context(), "Failed to write exported user", "error", err)
+				return
+			}
+			exported++
+		}
+		c.Writer.Flush()
+
+		if len(users) < exportPageSize {
+			break
+		}
+
+		// The status is already sent, so a failure can only end the stream early, leaving the array unterminated
+		users, err = h.listUsersPage(c, users[len(users)-1].Username)
+		if err != nil {
+			h.log.ErrorContext(c.Request.Context(), "Failed to export users", "exported", exported, "error", err)
+			return
+		}
+	}
+
+	c.Writer.WriteString("]")
+	h.log.InfoContext(c.Request.Context(), "Users exported", "count", exported)
+}
+
+// exportUsersNDJSON handles streaming all users as newline-delimited JSON, one User per line.
+// @Summary Export all Users as NDJSON
+// @Description Stream all Users with their subscriptions as newline-delimited JSON, one User per line ordered by username, so clients can process them as they arrive.
+// @Description If reading the Users fails part way, the stream ends with a line {"error": "...", "code": "export_incomplete"} instead of a User.
+// @Tags users
+// @Produce application/x-ndjson
+// @Success 200 {object} db.User "One per line"
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/export.ndjson [get]
+func (h *UserHandler) exportUsersNDJSON(c *gin.Context) {
+	// Read the first page before writing anything so a failing database still gets a proper error response
+	users, err := h.listUsersPage(c, "")
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", "attachment; filename=users-export.ndjson")
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+
+	// Encode writes every value on its own line
+	encoder := json.NewEncoder(c.Writer)
+	exported := 0
+	for {
+		for _, user := range users {
+			if err := encoder.Encode(user); err != nil {
+				h.log.ErrorContext(c.Request.Context(), "Failed to write exported user", "error", err)
+				return
+			}
+			exported++
+		}
+		// Every page goes out as soon as it is written
+		c.Writer.Flush()
+
+		if len(users) < exportPageSize {
+			break
+		}
+
+		users, err = h.listUsersPage(c, users[len(users)-1].Username)
+		if err != nil {
+			// The status is already sent, so the failure is reported in place of the next User
+			h.log.ErrorContext(c.Request.Context(), "Failed to export users", "exported", exported, "error", err)
+			encoder.Encode(ErrorResponse{Error: "export ended early: failed to read users", Code: exportIncompleteCode})
+			c.Writer.Flush()
+			return
+		}
+	}
+
+	h.log.InfoContext(c.Request.Context(), "Users exported", "count", exported)
+}
+
+// listUsersPage reads the page of users following the given username.
+// Keyset pages keep the export from skipping or repeating users created or deleted meanwhile.
+func (h *UserHandler) listUsersPage(c *gin.Context, afterUsername string) ([]db.User, error) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Bulk)
+	defer cancel()
+
+	return h.Database.ListUsersAfter(ctx, afterUsername, exportPageSize)
+}
@@ -0,0 +1,177 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportUsers(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// More than two pages so the export has to continue past the first page
+	const count = 2*exportPageSize + 5
+	want := make(map[string]db.User, count)
+	for i := 0; i < count; i++ {
+		user := db.User{
+			Username: fmt.Sprintf("user%03d", i),
+			ChatID:   int64(1000 + i),
+			Subscription: db.Subscription{
+				SubscriptionStatus: db.StatusActive,
+				Duration:           "1 month",
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
+			},
+		}
+		if err := database.CreateUser(ctx, &user); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+		if err := database.UpdateUserTraffic(ctx, user.Username, float64(i)); err != nil {
+			t.Fatalf("Failed to set traffic: %v", err)
+		}
+		user.Traffic = float64(i)
+		want[user.Username] = user
+	}
+
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/export", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "attachment; filename=users-export.json", rec.Header().Get("Content-Disposition"))
+
+	var users []db.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatalf("Failed to parse exported users: %v", err)
+	}
+	assert.Len(t, users, count)
+
+	seen := make(map[string]bool, count)
+	for _, user := range users {
+		assert.False(t, seen[user.Username], "user %s exported twice", user.Username)
+		seen[user.Username] = true
+
+		expected, ok := want[user.Username]
+		if !assert.True(t, ok, "unexpected user %s", user.Username) {
+			continue
+		}
+		assert.Equal(t, expected.ChatID, user.ChatID)
+		assert.Equal(t, expected.Traffic, user.Traffic)
+		assert.Equal(t, expected.Subscription.SubscriptionStatus, user.Subscription.SubscriptionStatus)
+		assert.True(t, expected.Subscription.EndSubscription.Equal(user.Subscription.EndSubscription))
+		assert.NotZero(t, user.Subscription.ID)
+	}
+}
+
+func TestExportUsersEmpty(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/export", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+}
+
+// flushHookRecorder runs onFlush the first time the response is flushed
+type flushHookRecorder struct {
+	*httptest.ResponseRecorder
+	onFlush func()
+}
+
+func (r *flushHookRecorder) Flush() {
+	if r.onFlush != nil {
+		r.onFlush()
+		r.onFlush = nil
+	}
+	r.ResponseRecorder.Flush()
+}
+
+func TestExportUsersNDJSON(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// More than two pages so the cursor has to move past the first page
+	const count = 2*exportPageSize + 5
+	for i := 0; i < count; i++ {
+		user := db.User{Username: fmt.Sprintf("user%03d", i), ChatID: int64(1000 + i)}
+		if err := database.CreateUser(ctx, &user); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/export.ndjson", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "attachment; filename=users-export.ndjson", rec.Header().Get("Content-Disposition"))
+
+	scanner := bufio.NewScanner(rec.Body)
+	lines := 0
+	for scanner.Scan() {
+		var user db.User
+		if err := json.Unmarshal(scanner.Bytes(), &user); err != nil {
+			t.Fatalf("Failed to parse line %d %q: %v", lines+1, scanner.Text(), err)
+		}
+		// Lines come in username order, each user once
+		assert.Equal(t, fmt.Sprintf("user%03d", lines), user.Username)
+		assert.Equal(t, int64(1000+lines), user.ChatID)
+		assert.NotZero(t, user.Subscription.ID)
+		lines++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Failed to read export: %v", err)
+	}
+	assert.Equal(t, count, lines)
+}
+
+func TestExportUsersNDJSONFailsMidStream(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < exportPageSize+1; i++ {
+		if err := database.CreateUser(ctx, &db.User{Username: fmt.Sprintf("user%03d", i)}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	// Break the database once the first page is out, so reading the second one fails
+	rec := &flushHookRecorder{ResponseRecorder: httptest.NewRecorder(), onFlush: func() {
+		if _, err := database.DB.ExecContext(ctx, "DROP TABLE users"); err != nil {
+			t.Errorf("Failed to drop users: %v", err)
+		}
+	}}
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/export.ndjson", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	lines := bytes.Split(bytes.TrimSuffix(rec.Body.Bytes(), []byte("\n")), []byte("\n"))
+	if !assert.Len(t, lines, exportPageSize+1) {
+		return
+	}
+	var last ErrorResponse
+	if err := json.Unmarshal(lines[len(lines)-1], &last); err != nil {
+		t.Fatalf("Failed to parse the last line: %v", err)
+	}
+	assert.Equal(t, exportIncompleteCode, last.Code)
+	assert.NotEmpty(t, last.Error)
+}
@@ -0,0 +1,175 @@
+package handler
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultGzipMinBytes  = 1024
+	gzipMinBytesVariable = "GZIP_MIN_BYTES"
+)
+
+// gzipExcludedPrefixes are the paths whose responses are never compressed:
+// metrics are scraped often and are small, and the pprof profiles are compressed already
+var gzipExcludedPrefixes = []string{"/metrics", pprofPrefix}
+
+// gzipMinBytesFromEnv returns the smallest response body compressed, read from GZIP_MIN_BYTES
+func gzipMinBytesFromEnv() (int, error) {
+	value := os.Getenv(gzipMinBytesVariable)
+	if value == "" {
+		return defaultGzipMinBytes, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive number of bytes", gzipMinBytesVariable, value)
+	}
+	return n, nil
+}
+
+// GzipMiddleware compresses response bodies of at least GZIP_MIN_BYTES for clients accepting gzip.
+// The body is held back until it reaches the threshold, so smaller responses go out as they are.
+func (h *UserHandler) GzipMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Method == http.MethodHead || !acceptsGzip(c.Request) || gzipExcluded(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+
+		c.Header("Vary", "Accept-Encoding")
+		w := &gzipWriter{ResponseWriter: c.Writer, minBytes: h.gzipMinBytes}
+		c.Writer = w
+		defer func() {
+			c.Writer = w.ResponseWriter
+			if recovered := recover(); recovered != nil {
+				// Let the recovery middleware answer in place of a body that was never sent
+				w.discard()
+				panic(recovered)
+			}
+			w.finish()
+		}()
+		c.Next()
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows gzip
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(encoding, ";")
+		if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+			continue
+		}
+		// gzip;q=0 refuses it
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			weight, err := strconv.ParseFloat(q, 64)
+			return err == nil && weight > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipExcluded reports whether responses for path are never compressed
+func gzipExcluded(path string) bool {
+	for _, prefix := range gzipExcludedPrefixes {
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter buffers the body until it reaches minBytes and then compresses it and everything after it
+type gzipWriter struct {
+	gin.ResponseWriter
+	minBytes int
+	buf      []byte
+	gz       *gzip.Writer
+	// passthrough is set once the body is known to go out uncompressed
+	passthrough bool
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	if w.gz != nil {
+		return w.gz.Write(data)
+	}
+	if w.passthrough {
+		return w.ResponseWriter.Write(data)
+	}
+
+	w.buf = append(w.buf, data...)
+	if len(w.buf) < w.minBytes {
+		return len(data), nil
+	}
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// Flush sends what was compressed so far; a body still below the threshold is held back
+func (w *gzipWriter) Flush() {
+	if w.gz == nil && !w.passthrough {
+		return
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+// start sends the buffered body, compressed unless the handler chose an encoding itself
+func (w *gzipWriter) start() error {
+	buf := w.buf
+	w.buf = nil
+
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" || !bodyAllowed(w.Status()) {
+		w.passthrough = true
+		_, err := w.ResponseWriter.Write(buf)
+		return err
+	}
+
+	header.Set("Content-Encoding", "gzip")
+	header.Del("Content-Length")
+	w.gz = gzip.NewWriter(w.ResponseWriter)
+	_, err := w.gz.Write(buf)
+	return err
+}
+
+// finish sends a body that stayed below the threshold as it is and ends the compressed stream
+func (w *gzipWriter) finish() {
+	if w.gz != nil {
+		w.gz.Close()
+		return
+	}
+	if len(w.buf) > 0 {
+		w.passthrough = true
+		w.ResponseWriter.Write(w.buf)
+		w.buf = nil
+	}
+}
+
+// discard drops a body held back and ends a compressed stream that already started
+func (w *gzipWriter) discard() {
+	w.buf = nil
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// bodyAllowed reports whether a response with the status can have a body
+func bodyAllowed(status int) bool {
+	return status >= http.StatusOK && status != http.StatusNoContent && status != http.StatusNotModified
+}
@@ -0,0 +1,111 @@
+package handler
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGzipMiddleware(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	const count = 50
+	for i := 0; i < count; i++ {
+		if err := database.CreateUser(ctx, &db.User{Username: fmt.Sprintf("gzip_user%03d", i)}); err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+	}
+
+	get := func(url, acceptEncoding string) *httptest.ResponseRecorder {
+		req := newTestRequest(http.MethodGet, url, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The export is well above the threshold and comes back compressed
+	rec := get("/users/export", "gzip, deflate")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+
+	reader, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("Failed to open compressed body: %v", err)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("Failed to decompress body: %v", err)
+	}
+	var users []db.User
+	if err := json.Unmarshal(body, &users); err != nil {
+		t.Fatalf("Failed to parse exported users: %v", err)
+	}
+	assert.Len(t, users, count)
+
+	// Without gzip in Accept-Encoding, or with it refused, the body is sent as it is
+	for _, acceptEncoding := range []string{"", "deflate", "gzip;q=0"} {
+		rec := get("/users/export", acceptEncoding)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Header().Get("Content-Encoding"), acceptEncoding)
+		if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+			t.Fatalf("Failed to parse exported users for %q: %v", acceptEncoding, err)
+		}
+	}
+
+	// Small responses are not worth compressing
+	rec = get("/users/stats", "gzip")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get("Content-Encoding"))
+	assert.JSONEq(t, `{"active": 0, "inactive": 50, "total": 50}`, rec.Body.String())
+}
+
+func TestGzipExcluded(t *testing.T) {
+	assert.True(t, gzipExcluded("/metrics"))
+	assert.True(t, gzipExcluded("/debug/pprof/heap"))
+	assert.False(t, gzipExcluded("/metricsfoo"))
+	assert.False(t, gzipExcluded("/users/export"))
+}
+
+func TestGzipMinBytesFromEnv(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "", want: defaultGzipMinBytes},
+		{value: "4096", want: 4096},
+		{value: "0", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "big", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv(gzipMinBytesVariable, tc.value)
+			got, err := gzipMinBytesFromEnv()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if !tc.wantErr && got != tc.want {
+				t.Fatalf("Expected threshold: %d, got: %d", tc.want, got)
+			}
+		})
+	}
+}
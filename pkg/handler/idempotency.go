@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	idempotencyKeyHeader      = "Idempotency-Key"
+	idempotentReplayedHeader  = "Idempotent-Replayed"
+	maxIdempotencyKeyLength   = 255
+	defaultIdempotencyKeyTTL  = 24 * time.Hour
+	idempotencyKeyTTLVariable = "IDEMPOTENCY_KEY_TTL"
+)
+
+// idempotencyKeyTTLFromEnv returns how long responses are replayed for, read from IDEMPOTENCY_KEY_TTL
+func idempotencyKeyTTLFromEnv() (time.Duration, error) {
+	return durationFromEnv(idempotencyKeyTTLVariable, defaultIdempotencyKeyTTL)
+}
+
+// idempotencyKey returns the Idempotency-Key of the request, responding 400 and returning false if it is too long
+func idempotencyKey(c *gin.Context) (string, bool) {
+	key := c.GetHeader(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLength {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Idempotency-Key must be at most 255 characters"})
+		return "", false
+	}
+	return key, true
+}
+
+// replayIdempotentResponse writes the response stored under key and reports whether the request was answered,
+// either by the replay or by an error.
+func (h *UserHandler) replayIdempotentResponse(ctx context.Context, c *gin.Context, key string) bool {
+	if key == "" {
+		return false
+	}
+
+	response, err := h.Database.IdempotentResponse(ctx, key, h.idempotencyTTL)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return true
+	}
+	if response == nil {
+		return false
+	}
+
+	c.Header(idempotentReplayedHeader, "true")
+	c.Data(response.StatusCode, "application/json; charset=utf-8", response.Body)
+	return true
+}
+
+// respondIdempotent writes the response and stores it under key so retries get the same answer.
+// Failing to store it is only logged since the request itself has succeeded.
+func (h *UserHandler) respondIdempotent(ctx context.Context, c *gin.Context, key string, status int, obj any) {
+	if key == "" {
+		c.JSON(status, obj)
+		return
+	}
+
+	body, err := json.Marshal(obj)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	response := db.IdempotentResponse{StatusCode: status, Body: body}
+	if err := h.Database.SaveIdempotentResponse(ctx, key, response, h.idempotencyTTL); err != nil {
+		h.log.WarnContext(ctx, "Failed to save idempotent response", "key", key, "error", err)
+	}
+	c.Data(status, "application/json; charset=utf-8", body)
+}
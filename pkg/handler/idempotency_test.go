@@ -0,0 +1,65 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCreateUserIdempotencyKey(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	create := func(key string) *httptest.ResponseRecorder {
+		req := newTestRequest(http.MethodPost, "/users/", strings.NewReader(`{"username":"retried","chat_id":42}`))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	first := create("create-retried")
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Empty(t, first.Header().Get(idempotentReplayedHeader))
+
+	// The retry is answered from the stored response instead of failing with 409
+	second := create("create-retried")
+	assert.Equal(t, http.StatusCreated, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, "true", second.Header().Get(idempotentReplayedHeader))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	usernames, err := database.AllUsername(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"retried"}, usernames)
+
+	// Without the key, or with another one, the request runs again
+	assert.Equal(t, http.StatusConflict, create("").Code)
+	assert.Equal(t, http.StatusConflict, create("another-key").Code)
+
+	// Failures are not stored, so a retry of a failed request runs again
+	rec := create("another-key")
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Empty(t, rec.Header().Get(idempotentReplayedHeader))
+}
+
+func TestIdempotencyKeyTooLong(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	req := newTestRequest(http.MethodPost, "/users/", strings.NewReader(`{"username":"longkey"}`))
+	req.Header.Set(idempotencyKeyHeader, strings.Repeat("k", maxIdempotencyKeyLength+1))
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,52 @@
+package handler
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	pprofPrefix   = "/debug/pprof"
+	pprofVariable = "ENABLE_PPROF"
+)
+
+// pprofEnabledFromEnv reports whether ENABLE_PPROF turns the profiling endpoints on
+func pprofEnabledFromEnv() bool {
+	enabled, _ := strconv.ParseBool(os.Getenv(pprofVariable))
+	return enabled
+}
+
+// LocalOnlyMiddleware rejects requests that do not come from the loopback interface with 403.
+// The peer address is checked rather than forwarding headers, which clients can set freely.
+// Requests over a Unix socket carry no IP and are let through, the socket permissions guard them.
+func LocalOnlyMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := net.ParseIP(c.RemoteIP())
+		if ip != nil && !ip.IsLoopback() {
+			c.AbortWithStatusJSON(http.StatusForbidden, ErrorResponse{Error: "Forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// registerPprof mounts the net/http/pprof handlers under /debug/pprof for local clients.
+// They are exempt from the bot token, see BotAuthMiddleware.
+func (h *UserHandler) registerPprof() {
+	pprofRoutes := h.Router.Group(pprofPrefix, LocalOnlyMiddleware())
+	{
+		pprofRoutes.GET("/", gin.WrapF(pprof.Index))
+		pprofRoutes.GET("/cmdline", gin.WrapF(pprof.Cmdline))
+		pprofRoutes.GET("/profile", gin.WrapF(pprof.Profile))
+		pprofRoutes.GET("/symbol", gin.WrapF(pprof.Symbol))
+		pprofRoutes.POST("/symbol", gin.WrapF(pprof.Symbol))
+		pprofRoutes.GET("/trace", gin.WrapF(pprof.Trace))
+		// heap, goroutine, allocs and the other named profiles
+		pprofRoutes.GET("/:name", gin.WrapF(pprof.Index))
+	}
+}
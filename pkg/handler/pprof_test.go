@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPprof(t *testing.T) {
+	get := func(h *UserHandler, url, remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("Enabled", func(t *testing.T) {
+		t.Setenv(pprofVariable, "true")
+		h, database := setupTestEnvironment()
+		defer database.Close()
+
+		// No bot token is needed
+		rec := get(h, "/debug/pprof/", "127.0.0.1:40000")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "goroutine")
+
+		rec = get(h, "/debug/pprof/goroutine?debug=1", "[::1]:40000")
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		rec = get(h, "/debug/pprof/", "192.0.2.1:40000")
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+
+		// Forwarding headers do not make a remote client local
+		req := httptest.NewRequest(http.MethodGet, "/debug/pprof/", nil)
+		req.RemoteAddr = "192.0.2.1:40000"
+		req.Header.Set("X-Forwarded-For", "127.0.0.1")
+		rec = httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		t.Setenv(pprofVariable, "")
+		h, database := setupTestEnvironment()
+		defer database.Close()
+
+		rec := get(h, "/debug/pprof/", "127.0.0.1:40000")
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		rec = httptest.NewRecorder()
+		req := newTestRequest(http.MethodGet, "/debug/pprof/", nil)
+		req.RemoteAddr = "127.0.0.1:40000"
+		h.Router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+}
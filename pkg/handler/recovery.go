@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// panicErrorCode is the ErrorResponse code of requests answered after a panic
+const panicErrorCode = "panic"
+
+// RecoveryMiddleware turns a panic in a later handler into a 500 with a JSON ErrorResponse and logs it with its stack.
+// It goes first in the chain so panics in the other middleware are recovered too.
+func (h *UserHandler) RecoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+
+			h.log.ErrorContext(c.Request.Context(), "Recovered from panic",
+				"panic", recovered,
+				"method", c.Request.Method,
+				"path", c.Request.URL.Path,
+				"stack", string(debug.Stack()),
+			)
+
+			// A response already on its way cannot be replaced
+			if c.Writer.Written() {
+				c.Abort()
+				return
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "internal server error", Code: panicErrorCode})
+		}()
+		c.Next()
+	}
+}
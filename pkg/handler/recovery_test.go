@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	h.Router.GET("/panic", func(c *gin.Context) {
+		panic("boom")
+	})
+
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/panic", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Contains(t, rec.Header().Get("Content-Type"), "application/json")
+	assert.JSONEq(t, `{"error":"internal server error","code":"panic"}`, rec.Body.String())
+
+	// The router keeps serving after a panic
+	rec = httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/nobody_here", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,68 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// shutdownTimeout is how long in-flight requests may take to finish once the server stops
+const shutdownTimeout = 10 * time.Second
+
+// ServeUnix serves the API over plain HTTP on a Unix domain socket at path until ctx is done.
+// A socket file left behind by an earlier run is removed first, and the socket is removed again on return.
+func (h *UserHandler) ServeUnix(ctx context.Context, path string) error {
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", path, err)
+	}
+	defer os.Remove(path)
+
+	server := &http.Server{Handler: h.Router}
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+
+	h.log.Info("Listening on Unix socket", "path", path)
+
+	select {
+	case err := <-served:
+		return fmt.Errorf("failed to serve on %s: %w", path, err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down server: %w", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// removeStaleSocket removes the socket at path, refusing to remove anything that is not a socket
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check socket path %s: %w", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket %s: %w", path, err)
+	}
+	return nil
+}
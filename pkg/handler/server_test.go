@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServeUnix(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	// Socket paths are limited to about 100 bytes, which a test's TempDir may exceed
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "api.sock")
+
+	// Leave a stale socket behind like a crashed server would
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to create stale socket: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- h.ServeUnix(ctx, path) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}
+
+	var resp *http.Response
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		req := newTestRequest(http.MethodGet, "http://unix/users/", nil)
+		req.RequestURI = ""
+		if resp, err = client.Do(req); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("Failed to request over the socket: %v", err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	cancel()
+	select {
+	case err := <-served:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server did not shut down")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the socket to be removed, got: %v", err)
+	}
+}
+
+func TestServeUnixKeepsOtherFiles(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	path := filepath.Join(t.TempDir(), "api.sock")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatalf("Failed to write file: %v", err)
+	}
+
+	assert.Error(t, h.ServeUnix(context.Background(), path))
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected the regular file to be kept, got: %v", err)
+	}
+}
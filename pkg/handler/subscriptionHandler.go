@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxBulkExtendUsernames is the most Users one bulk extension may name
+	maxBulkExtendUsernames = 1000
+	// maxBatchStatusUsernames is the most Users one batch status lookup may name
+	maxBatchStatusUsernames = 1000
+
+	// statusNotFound is reported in a batch status lookup for Users that do not exist
+	statusNotFound = "not_found"
+)
+
+// DaysRemainingResponse represents the days left on a subscription.
+// DaysRemaining is -1 for forever subscriptions and 0 once the subscription has expired.
+type DaysRemainingResponse struct {
+	DaysRemaining int  `json:"days_remaining" example:"12"`
+	Expired       bool `json:"expired" example:"false"`
+}
+
+// UserFullResponse represents a User with the days left on their subscription, for status screens.
+type UserFullResponse struct {
+	Username     string          `json:"username" example:"john_doe"`
+	ChatID       int64           `json:"chat_id" example:"12345"`
+	Traffic      float64         `json:"traffic" example:"512.5"`
+	TrafficBytes int64           `json:"traffic_bytes" example:"537395200"`
+	Subscription db.Subscription `json:"subscription"`
+	DaysRemainingResponse
+}
+
+// ExtendSubscriptionsBulkRequest represents a request to extend several subscriptions.
+// Without usernames every active subscription is extended.
+type ExtendSubscriptionsBulkRequest struct {
+	Usernames []string `json:"usernames" example:"john_doe,jane_doe"`
+	Duration  string   `json:"duration" binding:"required,subscription_duration" example:"7d"`
+}
+
+// ExtendSubscriptionsBulkResponse represents the result of a bulk extension.
+type ExtendSubscriptionsBulkResponse struct {
+	Extended int `json:"extended" example:"2"`
+}
+
+// activeSubscriptions handles listing the active subscriptions with the days left on them.
+// @Summary List active subscriptions
+// @Description List every User with an active subscription that has not ended yet, with the days remaining computed by the server.
+// @Description remaining_days counts a started day as a whole one and is -1 for forever subscriptions.
+// @Tags subscriptions
+// @Produce json
+// @Success 200 {array} db.SubscriptionInfo
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /subscriptions/active [get]
+func (h *UserHandler) activeSubscriptions(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	subscriptions, err := h.Database.ActiveSubscriptions(ctx)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, subscriptions)
+}
+
+// extendSubscriptionsBulk handles extending the subscriptions of several Users at once.
+// @Summary Extend subscriptions in bulk
+// @Description Activate and extend the subscriptions of the given Users by the duration in one transaction, e.g. for a promotion.
+// @Description Without usernames every active subscription is extended. Unknown usernames are ignored; the response tells how many subscriptions were extended.
+// @Tags subscriptions
+// @Accept json
+// @Produce json
+// @Param request body ExtendSubscriptionsBulkRequest true "Users and extension duration"
+// @Success 200 {object} ExtendSubscriptionsBulkResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /subscriptions/extend-bulk [post]
+func (h *UserHandler) extendSubscriptionsBulk(c *gin.Context) {
+	var request ExtendSubscriptionsBulkRequest
+	if !bindJSON(c, &request) {
+		return
+	}
+	if len(request.Usernames) > maxBulkExtendUsernames {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("at most %d usernames can be extended at once", maxBulkExtendUsernames)})
+		return
+	}
+
+	duration, err := parseExtendDuration(request.Duration)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Bulk)
+	defer cancel()
+
+	extended, err := h.Database.ExtendSubscriptionsBulk(ctx, request.Usernames, duration)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, ExtendSubscriptionsBulkResponse{Extended: extended})
+}
+
+// subscriptionStatuses handles retrieving the subscription statuses of several Users at once.
+// @Summary Get subscription statuses of several Users
+// @Description Get the subscription status of each of the given Users, read in a single query.
+// @Description Users that do not exist are reported as "not_found".
+// @Tags subscriptions
+// @Accept json
+// @Produce json
+// @Param usernames body []string true "Usernames to look up (at most 1000)"
+// @Success 200 {object} map[string]string "Subscription status by username"
+// @Failure 400 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/subscription/batch [post]
+func (h *UserHandler) subscriptionStatuses(c *gin.Context) {
+	var usernames []string
+	if !bindJSON(c, &usernames) {
+		return
+	}
+	if len(usernames) > maxBatchStatusUsernames {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("at most %d usernames can be looked up at once", maxBatchStatusUsernames)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	found, err := h.Database.SubscriptionStatuses(ctx, usernames)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	statuses := make(map[string]string, len(usernames))
+	for _, username := range usernames {
+		status, ok := found[username]
+		if !ok {
+			statuses[username] = statusNotFound
+			continue
+		}
+		statuses[username] = string(status)
+	}
+
+	c.JSON(http.StatusOK, statuses)
+}
+
+// daysRemaining handles reporting how many days are left on a User's subscription.
+// @Summary Get the days left on a User's subscription
+// @Description Get the days left until the subscription ends, computed by the server in UTC and counting a started day as a whole one.
+// @Description days_remaining is -1 for forever subscriptions. Ended and inactive subscriptions report 0 and expired true.
+// @Tags users
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} DaysRemainingResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/days-remaining [get]
+func (h *UserHandler) daysRemaining(c *gin.Context) {
+	subscription, ok := h.fetchSubscription(c, c.Param("username"))
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, daysRemainingAt(subscription, time.Now().UTC()))
+}
+
+// userFull handles reporting a User together with the days left on their subscription.
+// @Summary Get a User with the days left on their subscription
+// @Description Get the chat ID, traffic and subscription of a User with days_remaining and expired as /days-remaining computes them, read in one query.
+// @Tags users
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} UserFullResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/full [get]
+func (h *UserHandler) userFull(c *gin.Context) {
+	username, ok := usernameParam(c)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	user, err := h.Database.User(ctx, username)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, UserFullResponse{
+		Username:              user.Username,
+		ChatID:                user.ChatID,
+		Traffic:               user.Traffic,
+		TrafficBytes:          user.TrafficBytes,
+		Subscription:          user.Subscription,
+		DaysRemainingResponse: daysRemainingAt(&user.Subscription, time.Now().UTC()),
+	})
+}
+
+// daysRemainingAt computes the days left on the subscription at now.
+// A cancelled forever subscription is inactive and so expired, although it keeps its duration.
+func daysRemainingAt(subscription *db.Subscription, now time.Time) DaysRemainingResponse {
+	if subscription.SubscriptionStatus != db.StatusActive {
+		return DaysRemainingResponse{DaysRemaining: 0, Expired: true}
+	}
+	days := subscription.RemainingDays(now)
+	return DaysRemainingResponse{DaysRemaining: days, Expired: days == 0}
+}
@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActiveSubscriptions(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/subscriptions/active", nil))
+		return rec
+	}
+
+	// No active users is an empty list, not null
+	rec := get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	now := time.Now().Truncate(time.Second)
+	users := []db.User{
+		{Username: "paying", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: now, EndSubscription: now.AddDate(0, 0, 30)}},
+		{Username: "free_user", Subscription: db.Subscription{SubscriptionStatus: db.StatusInactive, Duration: "1 month", StartSubscription: now}},
+		{Username: "lapsed", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: now.AddDate(0, -2, 0), EndSubscription: now.AddDate(0, 0, -1)}},
+	}
+	for i := range users {
+		if err := database.CreateUser(ctx, &users[i]); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	rec = get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var subscriptions []db.SubscriptionInfo
+	if err := json.Unmarshal(rec.Body.Bytes(), &subscriptions); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if assert.Len(t, subscriptions, 1) {
+		assert.Equal(t, "paying", subscriptions[0].Username)
+		assert.Equal(t, 30, subscriptions[0].RemainingDays)
+	}
+}
+
+func TestExtendSubscriptionsBulk(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	now := time.Now().Truncate(time.Second)
+	end := now.AddDate(0, 0, 3)
+	for _, user := range []db.User{
+		{Username: "promo1", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: now, EndSubscription: end}},
+		{Username: "promo2", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: now, EndSubscription: end}},
+		{Username: "nopromo"},
+	} {
+		if err := database.CreateUser(ctx, &user); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name               string
+		body               string
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{name: "List", body: `{"usernames":["promo1","missing"],"duration":"7d"}`, expectedStatusCode: http.StatusOK, expectedResponse: `{"extended":1}`},
+		{name: "AllActive", body: `{"duration":"7d"}`, expectedStatusCode: http.StatusOK, expectedResponse: `{"extended":2}`},
+		{name: "MissingDuration", body: `{"usernames":["promo1"]}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "Forever", body: `{"duration":"forever"}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "TooMany", body: `{"usernames":[` + strings.TrimSuffix(strings.Repeat(`"u",`, maxBulkExtendUsernames+1), ",") + `],"duration":"7d"}`, expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodPost, "/subscriptions/extend-bulk", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code)
+			if tc.expectedResponse != "" {
+				assert.JSONEq(t, tc.expectedResponse, rec.Body.String())
+			}
+		})
+	}
+
+	user, err := database.User(ctx, "promo1")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	assert.True(t, user.Subscription.EndSubscription.Equal(end.AddDate(0, 0, 14)), "end: %v", user.Subscription.EndSubscription)
+	user, err = database.User(ctx, "nopromo")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	assert.Equal(t, db.StatusInactive, user.Subscription.SubscriptionStatus)
+}
+
+func TestSubscriptionStatuses(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	now := time.Now()
+	for _, user := range []db.User{
+		{Username: "paid_user", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: now, EndSubscription: now.AddDate(0, 1, 0)}},
+		{Username: "free_user"},
+	} {
+		if err := database.CreateUser(ctx, &user); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name               string
+		body               string
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{name: "Mixed", body: `["paid_user","missing","free_user"]`, expectedStatusCode: http.StatusOK, expectedResponse: `{"paid_user":"active","missing":"not_found","free_user":"inactive"}`},
+		{name: "Empty", body: `[]`, expectedStatusCode: http.StatusOK, expectedResponse: `{}`},
+		{name: "NotAList", body: `{"usernames":["paid_user"]}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "TooMany", body: `[` + strings.TrimSuffix(strings.Repeat(`"u",`, maxBatchStatusUsernames+1), ",") + `]`, expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodPost, "/users/subscription/batch", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code)
+			if tc.expectedResponse != "" {
+				assert.JSONEq(t, tc.expectedResponse, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestDaysRemaining(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, user := range []db.User{
+		{Username: "paying", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: now, EndSubscription: now.AddDate(0, 0, 30)}},
+		{Username: "lapsed", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: now.AddDate(0, -2, 0), EndSubscription: now.AddDate(0, 0, -1)}},
+		{Username: "lifetime", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "forever", StartSubscription: now}},
+		{Username: "free_user", Subscription: db.Subscription{SubscriptionStatus: db.StatusInactive, Duration: "forever", StartSubscription: now}},
+	} {
+		if err := database.CreateUser(ctx, &user); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name               string
+		username           string
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{"Active", "paying", http.StatusOK, `{"days_remaining":30,"expired":false}`},
+		{"Expired", "lapsed", http.StatusOK, `{"days_remaining":0,"expired":true}`},
+		{"Forever", "lifetime", http.StatusOK, `{"days_remaining":-1,"expired":false}`},
+		{"Inactive", "free_user", http.StatusOK, `{"days_remaining":0,"expired":true}`},
+		{"NotFound", "nobody", http.StatusNotFound, `{"error":"User not found"}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/"+tc.username+"/days-remaining", nil))
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code)
+			assert.JSONEq(t, tc.expectedResponse, rec.Body.String())
+		})
+	}
+}
+
+func TestUserFull(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	now := time.Now().UTC().Truncate(time.Second)
+	for _, user := range []db.User{
+		{Username: "paying", ChatID: 111, Traffic: 12.5, Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: now, EndSubscription: now.AddDate(0, 0, 30)}},
+		{Username: "lapsed", ChatID: 222, Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: now.AddDate(0, -2, 0), EndSubscription: now.AddDate(0, 0, -1)}},
+	} {
+		if err := database.CreateUser(ctx, &user); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	for _, username := range []string{"paying", "lapsed"} {
+		t.Run(username, func(t *testing.T) {
+			rec := get("/users/" + username + "/full")
+			assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+			var fields map[string]any
+			if err := json.Unmarshal(rec.Body.Bytes(), &fields); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+			for _, key := range []string{"username", "chat_id", "traffic", "traffic_bytes", "subscription", "days_remaining", "expired"} {
+				assert.Contains(t, fields, key)
+			}
+
+			var full UserFullResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &full); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+
+			// The same values as the three separate calls
+			var user db.User
+			if err := json.Unmarshal(get("/users/"+username).Body.Bytes(), &user); err != nil {
+				t.Fatalf("Failed to parse user: %v", err)
+			}
+			assert.Equal(t, user.Username, full.Username)
+			assert.Equal(t, user.ChatID, full.ChatID)
+			assert.Equal(t, user.Traffic, full.Traffic)
+			assert.Equal(t, user.TrafficBytes, full.TrafficBytes)
+			assert.Equal(t, user.Subscription, full.Subscription)
+
+			var days DaysRemainingResponse
+			if err := json.Unmarshal(get("/users/"+username+"/days-remaining").Body.Bytes(), &days); err != nil {
+				t.Fatalf("Failed to parse days remaining: %v", err)
+			}
+			assert.Equal(t, days, full.DaysRemainingResponse)
+		})
+	}
+
+	assert.Equal(t, http.StatusNotFound, get("/users/nobody/full").Code)
+}
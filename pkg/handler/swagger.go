@@ -0,0 +1,43 @@
+package handler
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/YuarenArt/tg-users-database/docs"
+)
+
+const (
+	swaggerHostVariable   = "SWAGGER_HOST"
+	swaggerSchemeVariable = "SWAGGER_SCHEME"
+)
+
+// swaggerSchemesFromEnv returns the schemes listed in SWAGGER_SCHEME, separated by commas, or nil when it is unset
+func swaggerSchemesFromEnv() ([]string, error) {
+	value := os.Getenv(swaggerSchemeVariable)
+	if value == "" {
+		return nil, nil
+	}
+
+	var schemes []string
+	for _, scheme := range strings.Split(value, ",") {
+		scheme = strings.ToLower(strings.TrimSpace(scheme))
+		if scheme != "http" && scheme != "https" {
+			return nil, fmt.Errorf("invalid %s %q: must be http, https or both separated by a comma", swaggerSchemeVariable, value)
+		}
+		schemes = append(schemes, scheme)
+	}
+	return schemes, nil
+}
+
+// configureSwagger points the served API docs at host and schemes, so "Try it out" reaches the deployment.
+// Empty values keep the ones from the annotations in main.go.
+func configureSwagger(host string, schemes []string) {
+	if host != "" {
+		docs.SwaggerInfo.Host = host
+	}
+	if len(schemes) > 0 {
+		docs.SwaggerInfo.Schemes = schemes
+	}
+}
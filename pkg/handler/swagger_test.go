@@ -0,0 +1,76 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/YuarenArt/tg-users-database/docs"
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+	"github.com/YuarenArt/tg-users-database/pkg/scheduler"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSwaggerOverrides(t *testing.T) {
+	host, schemes := docs.SwaggerInfo.Host, docs.SwaggerInfo.Schemes
+	t.Cleanup(func() { docs.SwaggerInfo.Host, docs.SwaggerInfo.Schemes = host, schemes })
+
+	t.Setenv("BOT_TOKEN", "secret")
+	t.Setenv(swaggerHostVariable, "api.example.com")
+	t.Setenv(swaggerSchemeVariable, "HTTP, https")
+	config, err := ConfigFromEnv()
+	if err != nil {
+		t.Fatalf("Failed to read config: %v", err)
+	}
+
+	database, err := db.NewDatabaseWithDriver(db.DriverSQLite, dataSourceName, nil)
+	if err != nil {
+		t.Fatalf("Failed to setup test database: %v", err)
+	}
+	defer database.Close()
+	h, err := NewHandlerWithConfig(database, scheduler.NewScheduler(database), nil, config)
+	if err != nil {
+		t.Fatalf("Failed to create handler: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/swagger/doc.json", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var spec struct {
+		Host    string   `json:"host"`
+		Schemes []string `json:"schemes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("Failed to parse spec: %v", err)
+	}
+	assert.Equal(t, "api.example.com", spec.Host)
+	assert.Equal(t, []string{"http", "https"}, spec.Schemes)
+}
+
+func TestSwaggerSchemesFromEnv(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: ""},
+		{value: "http", want: []string{"http"}},
+		{value: "https,http", want: []string{"https", "http"}},
+		{value: "ftp", wantErr: true},
+		{value: "https,", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			t.Setenv(swaggerSchemeVariable, tc.value)
+			got, err := swaggerSchemesFromEnv()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+	"github.com/gin-gonic/gin"
+)
+
+// Default handler timeouts
+const (
+	defaultHandlerTimeout = 10 * time.Second
+	defaultBulkTimeout    = 60 * time.Second
+)
+
+// Timeouts bounds how long a handler waits for the database.
+type Timeouts struct {
+	// Read applies to lookups such as getting a User or listing usernames
+	Read time.Duration
+	// Write applies to changes of a single User
+	Write time.Duration
+	// Bulk applies to exports and imports that touch every User
+	Bulk time.Duration
+}
+
+// TimeoutsFromEnv reads HANDLER_TIMEOUT as the default for reads and writes.
+// HANDLER_READ_TIMEOUT, HANDLER_WRITE_TIMEOUT and HANDLER_BULK_TIMEOUT override single operations.
+// Values are Go durations like "5s".
+func TimeoutsFromEnv() (Timeouts, error) {
+	base, err := durationFromEnv("HANDLER_TIMEOUT", defaultHandlerTimeout)
+	if err != nil {
+		return Timeouts{}, err
+	}
+
+	var timeouts Timeouts
+	if timeouts.Read, err = durationFromEnv("HANDLER_READ_TIMEOUT", base); err != nil {
+		return Timeouts{}, err
+	}
+	if timeouts.Write, err = durationFromEnv("HANDLER_WRITE_TIMEOUT", base); err != nil {
+		return Timeouts{}, err
+	}
+	if timeouts.Bulk, err = durationFromEnv("HANDLER_BULK_TIMEOUT", defaultBulkTimeout); err != nil {
+		return Timeouts{}, err
+	}
+	return timeouts, nil
+}
+
+// durationFromEnv parses the positive duration in the environment variable, returning fallback if it is unset
+func durationFromEnv(name string, fallback time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid %s %q: must be a positive duration", name, value)
+	}
+	return d, nil
+}
+
+// statusClientClosedRequest is the non-standard status for requests the client abandoned, as used by nginx
+const statusClientClosedRequest = 499
+
+// respondWithDBError responds to a failed database call.
+// Running out of time is reported as 504 so slow responses are not mistaken for server faults,
+// and a call cut short by the client going away as 499. A missing or deleted user is reported as 404.
+func (h *UserHandler) respondWithDBError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		h.log.WarnContext(c.Request.Context(), "Database call timed out", "path", c.Request.URL.Path, "error", err)
+		c.JSON(http.StatusGatewayTimeout, ErrorResponse{Error: "Request timed out"})
+	case errors.Is(err, context.Canceled):
+		h.log.InfoContext(c.Request.Context(), "Request canceled by the client", "route", c.FullPath())
+		c.JSON(statusClientClosedRequest, ErrorResponse{Error: "Request canceled"})
+	case errors.Is(err, db.ErrUserNotFound):
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "User not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+	}
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeoutsFromEnv(t *testing.T) {
+	testCases := []struct {
+		name     string
+		env      map[string]string
+		expected Timeouts
+		wantErr  bool
+	}{
+		{
+			name:     "Defaults",
+			expected: Timeouts{Read: 10 * time.Second, Write: 10 * time.Second, Bulk: 60 * time.Second},
+		},
+		{
+			name:     "Base",
+			env:      map[string]string{"HANDLER_TIMEOUT": "3s"},
+			expected: Timeouts{Read: 3 * time.Second, Write: 3 * time.Second, Bulk: 60 * time.Second},
+		},
+		{
+			name:     "Overrides",
+			env:      map[string]string{"HANDLER_TIMEOUT": "3s", "HANDLER_READ_TIMEOUT": "1s", "HANDLER_BULK_TIMEOUT": "5m"},
+			expected: Timeouts{Read: time.Second, Write: 3 * time.Second, Bulk: 5 * time.Minute},
+		},
+		{name: "Invalid", env: map[string]string{"HANDLER_TIMEOUT": "soon"}, wantErr: true},
+		{name: "NotPositive", env: map[string]string{"HANDLER_WRITE_TIMEOUT": "0s"}, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, name := range []string{"HANDLER_TIMEOUT", "HANDLER_READ_TIMEOUT", "HANDLER_WRITE_TIMEOUT", "HANDLER_BULK_TIMEOUT"} {
+				t.Setenv(name, tc.env[name])
+			}
+
+			timeouts, err := TimeoutsFromEnv()
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, timeouts)
+		})
+	}
+}
+
+func TestSlowDatabaseCallTimesOut(t *testing.T) {
+	testCases := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+	}{
+		{name: "ListUsernames", method: http.MethodGet, url: "/users/"},
+		{name: "GetUser", method: http.MethodGet, url: "/users/testuser"},
+		{name: "SubscriptionStatus", method: http.MethodGet, url: "/users/testuser/subscription"},
+		{name: "CreateUser", method: http.MethodPost, url: "/users/", body: `{"username":"newuser"}`},
+		{name: "PatchUser", method: http.MethodPatch, url: "/users/testuser", body: `{"chat_id":1}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, database := setupTestEnvironment()
+			defer database.Close()
+			if err := database.CreateUser(context.Background(), &db.User{Username: "testuser"}); err != nil {
+				t.Fatalf("Failed to create initial user: %v", err)
+			}
+			h.timeouts = Timeouts{Read: 50 * time.Millisecond, Write: 50 * time.Millisecond, Bulk: 50 * time.Millisecond}
+
+			// SQLite has a single connection, so holding it in a transaction stalls every other query
+			tx, err := database.DB.BeginTx(context.Background(), nil)
+			if err != nil {
+				t.Fatalf("Failed to begin transaction: %v", err)
+			}
+			defer tx.Rollback()
+
+			start := time.Now()
+			req := newTestRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, http.StatusGatewayTimeout, rec.Code)
+			assert.JSONEq(t, `{"error":"Request timed out"}`, rec.Body.String())
+			assert.Less(t, time.Since(start), 5*time.Second)
+		})
+	}
+}
+
+func TestCanceledRequest(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	// The client has already gone away when the handler runs
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req := newTestRequest(http.MethodGet, "/users/", nil).WithContext(ctx)
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, req)
+
+	assert.Equal(t, statusClientClosedRequest, rec.Code)
+}
@@ -0,0 +1,132 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+	"github.com/YuarenArt/tg-users-database/pkg/tracing"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTracingMiddleware(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	recorder := &tracing.Recorder{}
+	tracing.SetExporter(recorder)
+	t.Cleanup(func() { tracing.SetExporter(nil) })
+
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+	req := newTestRequest(http.MethodPost, "/users/", strings.NewReader(`{"username":"traced","chat_id":42}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(tracing.TraceparentHeader, "00-"+traceID+"-"+parentSpanID+"-01")
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, req)
+	if !assert.Equal(t, http.StatusCreated, rec.Code) {
+		t.FailNow()
+	}
+
+	var server, create *tracing.Span
+	for _, span := range recorder.Spans() {
+		if span.TraceID.String() != traceID {
+			continue
+		}
+		switch span.Name {
+		case "POST /users/":
+			server = span
+		case "db.CreateUser":
+			create = span
+		}
+	}
+	if server == nil || create == nil {
+		t.Fatalf("Expected the server and db.CreateUser spans of the trace, got: %v", recorder.Spans())
+	}
+
+	// The server span continues the incoming trace and the database span is its child
+	assert.Equal(t, tracing.SpanKindServer, server.Kind)
+	assert.Equal(t, parentSpanID, server.ParentSpanID.String())
+	assert.Equal(t, "/users/", server.Attributes["http.route"])
+	assert.Equal(t, http.StatusCreated, server.Attributes["http.response.status_code"])
+	assert.Empty(t, server.Error)
+
+	assert.Equal(t, tracing.SpanKindClient, create.Kind)
+	assert.Equal(t, server.SpanID, create.ParentSpanID)
+	assert.Equal(t, "INSERT", create.Attributes["db.operation"])
+	assert.Equal(t, "sqlite", create.Attributes["db.system"])
+}
+
+func TestUserDatabaseCalls(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, username := range []string{"updated", "deleted", "checked", "metered"} {
+		if err := database.CreateUser(ctx, &db.User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	recorder := &tracing.Recorder{}
+	tracing.SetExporter(recorder)
+	t.Cleanup(func() { tracing.SetExporter(nil) })
+
+	// Each request makes only the calls listed, a missing user is reported by the operation itself.
+	// The handlers use *db.Database directly, so the calls are counted by their spans instead of a mock:
+	// each Database method these handlers call opens exactly one "db.<Method>" span through startSpan.
+	testCases := []struct {
+		name               string
+		method             string
+		url                string
+		body               string
+		expectedStatusCode int
+		expectedCalls      []string
+	}{
+		{name: "UpdateUserSubscription", method: http.MethodPut, url: "/users/updated", body: `{"subscription":{"subscription_status":"inactive"}}`, expectedStatusCode: http.StatusOK, expectedCalls: []string{"db.UpdateUserSubscription", "db.User"}},
+		{name: "UpdateUserSubscriptionNotFound", method: http.MethodPut, url: "/users/nosuchuser", body: `{"subscription":{"subscription_status":"inactive"}}`, expectedStatusCode: http.StatusNotFound, expectedCalls: []string{"db.UpdateUserSubscription"}},
+		{name: "DeleteUser", method: http.MethodDelete, url: "/users/deleted", expectedStatusCode: http.StatusNoContent, expectedCalls: []string{"db.DeleteUser"}},
+		{name: "DeleteUserNotFound", method: http.MethodDelete, url: "/users/nosuchuser", expectedStatusCode: http.StatusNotFound, expectedCalls: []string{"db.DeleteUser"}},
+		{name: "SubscriptionStatus", method: http.MethodGet, url: "/users/checked/subscription", expectedStatusCode: http.StatusOK, expectedCalls: []string{"db.SubscriptionStatus"}},
+		{name: "SubscriptionStatusNotFound", method: http.MethodGet, url: "/users/nosuchuser/subscription", expectedStatusCode: http.StatusNotFound, expectedCalls: []string{"db.SubscriptionStatus"}},
+		{name: "UpdateUserTraffic", method: http.MethodPut, url: "/users/metered/traffic", body: `1`, expectedStatusCode: http.StatusOK, expectedCalls: []string{"db.UpdateUserTraffic"}},
+		{name: "SubscriptionHistory", method: http.MethodGet, url: "/users/checked/history", expectedStatusCode: http.StatusOK, expectedCalls: []string{"db.SubscriptionHistory"}},
+		{name: "SubscriptionHistoryNotFound", method: http.MethodGet, url: "/users/nosuchuser/history", expectedStatusCode: http.StatusNotFound, expectedCalls: []string{"db.SubscriptionHistory"}},
+		{name: "UpdateUserTrafficNotFound", method: http.MethodPut, url: "/users/nosuchuser/traffic", body: `1`, expectedStatusCode: http.StatusNotFound, expectedCalls: []string{"db.UpdateUserTraffic"}},
+	}
+
+	for i, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var body io.Reader
+			if tc.body != "" {
+				body = strings.NewReader(tc.body)
+			}
+			req := newTestRequest(tc.method, tc.url, body)
+			if tc.body != "" {
+				req.Header.Set("Content-Type", "application/json")
+			}
+			traceID := fmt.Sprintf("4bf92f3577b34da6a3ce929d0e0e47%02d", i)
+			req.Header.Set(tracing.TraceparentHeader, "00-"+traceID+"-00f067aa0ba902b7-01")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedStatusCode, rec.Code)
+
+			var calls []string
+			for _, span := range recorder.Spans() {
+				if span.TraceID.String() == traceID && strings.HasPrefix(span.Name, "db.") {
+					calls = append(calls, span.Name)
+				}
+			}
+			assert.ElementsMatch(t, tc.expectedCalls, calls)
+		})
+	}
+}
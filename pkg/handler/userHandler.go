@@ -2,17 +2,24 @@ package handler
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
-	"github.com/joho/godotenv"
+	"github.com/google/uuid"
 
-	_ "github.com/YuarenArt/tg-users-database/docs"
 	"github.com/YuarenArt/tg-users-database/pkg/db"
+	"github.com/YuarenArt/tg-users-database/pkg/logger"
+	"github.com/YuarenArt/tg-users-database/pkg/scheduler"
+	"github.com/YuarenArt/tg-users-database/pkg/tracing"
 
 	"github.com/gin-gonic/gin"
 	swaggerFiles "github.com/swaggo/files"
@@ -20,19 +27,51 @@ import (
 )
 
 const (
-	timeoutToContext = 60 * time.Second
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+
+	defaultTopTrafficUsers = 10
+	maxTopTrafficUsers     = 100
+
+	defaultInactiveDays = 30
+
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+
+	maxBulkDeleteUsernames = 1000
+
+	requestIDHeader = "X-Request-ID"
 )
 
 // UserHandler contains the dependencies for the HTTPS handlers and the router.
 type UserHandler struct {
-	Database *db.Database
-	Router   *gin.Engine
-	botToken string
+	Database  *db.Database
+	Scheduler *scheduler.Scheduler
+	Router    *gin.Engine
+	botToken  string
+	// authDisabled skips the bot token check, set by AUTH_DISABLED
+	authDisabled bool
+	timeouts     Timeouts
+	// idempotencyTTL is how long responses to requests with an Idempotency-Key are replayed
+	idempotencyTTL time.Duration
+	// maxBodyBytes is the largest request body accepted
+	maxBodyBytes int64
+	// gzipMinBytes is the smallest response body compressed, set by GZIP_MIN_BYTES
+	gzipMinBytes int
+	// pprofEnabled mounts the profiling endpoints, set by ENABLE_PPROF
+	pprofEnabled bool
+	// destructiveOpsEnabled allows removing all users, set by ALLOW_DESTRUCTIVE_OPS
+	destructiveOpsEnabled bool
+	log                   *slog.Logger
 }
 
 // ErrorResponse represents an error response.
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// Code identifies errors clients handle specially, such as "panic"
+	Code string `json:"code,omitempty"`
+	// Fields maps the request body fields that failed validation to what is wrong with them
+	Fields map[string]string `json:"fields,omitempty"`
 }
 
 // SuccessResponse represents a success response.
@@ -40,25 +79,151 @@ type SuccessResponse struct {
 	Message string `json:"message"`
 }
 
-// NewHandler creates a new UserHandler with an initialized router.
-func NewHandler(database *db.Database) *UserHandler {
-	err := godotenv.Load()
+// UsersPage represents a page of Users. Next is the username to pass as after for the following page
+// and is empty on the last page.
+type UsersPage struct {
+	Users []db.User `json:"users"`
+	Next  string    `json:"next,omitempty" example:"john_doe"`
+}
+
+// SubscriptionResponse represents the subscription of a User without its ID.
+type SubscriptionResponse struct {
+	Status            db.SubscriptionStatus `json:"status" example:"active"`
+	Duration          string                `json:"duration" example:"1 month"`
+	StartSubscription time.Time             `json:"start_subscription"`
+	EndSubscription   time.Time             `json:"end_subscription"`
+}
+
+// TotalTrafficResponse represents the traffic summed over all users.
+type TotalTrafficResponse struct {
+	Total float64 `json:"total" example:"1024.5"`
+}
+
+// UserStatsResponse represents the number of users by subscription status.
+type UserStatsResponse struct {
+	Active   int `json:"active" example:"120"`
+	Inactive int `json:"inactive" example:"30"`
+	Total    int `json:"total" example:"150"`
+}
+
+// DeleteUsersResponse represents the result of a bulk delete.
+type DeleteUsersResponse struct {
+	Deleted int `json:"deleted" example:"2"`
+}
+
+// ExtendSubscriptionRequest represents a request to extend a subscription.
+type ExtendSubscriptionRequest struct {
+	Duration string `json:"duration" binding:"required,subscription_duration" example:"30d"`
+}
+
+// ActivateSubscriptionRequest represents a request to activate a subscription for a plan.
+type ActivateSubscriptionRequest struct {
+	Duration string `json:"duration" binding:"required,subscription_duration" example:"1 month"`
+}
+
+// AutoRenewRequest represents a request to turn the automatic renewal of a subscription on or off.
+type AutoRenewRequest struct {
+	AutoRenew *bool `json:"auto_renew" binding:"required" example:"true"`
+}
+
+// Units traffic can be sent in with the unit query parameter
+const (
+	trafficUnitMB    = "mb"
+	trafficUnitBytes = "bytes"
+)
+
+// trafficBody is traffic sent as a JSON number or as a numeric string such as "100.0".
+// The number is kept as sent, so byte counts are not rounded through a float.
+type trafficBody json.Number
+
+// UnmarshalJSON accepts a JSON number or a string holding one and rejects anything else
+func (t *trafficBody) UnmarshalJSON(data []byte) error {
+	// json.Number only takes strings that are valid JSON numbers, so "abc", "" and "NaN" are rejected
+	var number json.Number
+	if err := json.Unmarshal(data, &number); err != nil {
+		return fmt.Errorf("traffic must be a number: %w", err)
+	}
+	value, err := number.Float64()
+	if err != nil {
+		return fmt.Errorf("traffic must be a number: %w", err)
+	}
+	// Some encoders emit NaN and Infinity, which must never reach the database
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("traffic must be a finite number")
+	}
+	*t = trafficBody(number)
+	return nil
+}
+
+// mb returns the traffic in MB
+func (t trafficBody) mb() float64 {
+	value, _ := json.Number(t).Float64()
+	return value
+}
+
+// bytes returns the traffic as a whole number of bytes
+func (t trafficBody) bytes() (int64, error) {
+	value, err := json.Number(t).Int64()
+	if err != nil {
+		return 0, fmt.Errorf("traffic in bytes must be a whole number")
+	}
+	return value, nil
+}
+
+// NewHandler creates a new UserHandler with an initialized router, configured from the environment.
+// The scheduler backs the admin task endpoints. If log is nil, slog.Default() is used.
+// It exits the process if the configuration is invalid, see NewHandlerWithConfig for a handler returning the error.
+func NewHandler(database *db.Database, scheduler *scheduler.Scheduler, log *slog.Logger) *UserHandler {
+	if log == nil {
+		log = slog.Default()
+	}
+
+	config, err := ConfigFromEnv()
+	if err != nil {
+		log.Error("Invalid handler configuration", "error", err)
+		os.Exit(1)
+	}
+
+	handler, err := NewHandlerWithConfig(database, scheduler, log, config)
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		log.Error("Failed to create handler", "error", err)
+		os.Exit(1)
+	}
+	return handler
+}
+
+// NewHandlerWithConfig creates a new UserHandler with an initialized router.
+// It returns ErrBotTokenNotSet if config has no bot token and authentication is not disabled.
+// If log is nil, slog.Default() is used.
+func NewHandlerWithConfig(database *db.Database, scheduler *scheduler.Scheduler, log *slog.Logger, config Config) (*UserHandler, error) {
+	if log == nil {
+		log = slog.Default()
 	}
 
-	botToken := os.Getenv("BOT_TOKEN")
-	if botToken == "" {
-		log.Fatal("BOT_TOKEN is not set")
+	if config.AuthDisabled {
+		log.Warn("AUTH_DISABLED is set, every endpoint is served without the bot token; use it for local development only")
+	} else if config.BotToken == "" {
+		return nil, ErrBotTokenNotSet
 	}
 
+	config = config.withDefaults()
+	configureSwagger(config.SwaggerHost, config.SwaggerSchemes)
 	handler := &UserHandler{
-		Database: database,
-		Router:   gin.Default(),
-		botToken: botToken,
+		Database:              database,
+		Scheduler:             scheduler,
+		Router:                gin.New(),
+		botToken:              config.BotToken,
+		authDisabled:          config.AuthDisabled,
+		timeouts:              config.Timeouts,
+		idempotencyTTL:        config.IdempotencyTTL,
+		maxBodyBytes:          config.MaxBodyBytes,
+		gzipMinBytes:          config.GzipMinBytes,
+		pprofEnabled:          config.PprofEnabled,
+		destructiveOpsEnabled: config.DestructiveOpsEnabled,
+		log:                   log,
 	}
 	handler.setupRouter()
-	return handler
+	return handler, nil
 }
 
 func (h *UserHandler) BotAuthMiddleware() gin.HandlerFunc {
@@ -67,10 +232,19 @@ func (h *UserHandler) BotAuthMiddleware() gin.HandlerFunc {
 			c.Next()
 			return
 		}
+		if c.Request.URL.Path == healthSchedulerPath {
+			c.Next()
+			return
+		}
+		// Only reachable locally, see LocalOnlyMiddleware
+		if h.pprofEnabled && strings.HasPrefix(c.Request.URL.Path, pprofPrefix+"/") {
+			c.Next()
+			return
+		}
 
 		token := c.GetHeader("Authorization")
 		if token != "Bearer "+h.botToken {
-			logRequestDetails(c, "incorrect bot token")
+			h.logRequestDetails(c, "incorrect bot token")
 			c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Unauthorized"})
 			c.Abort()
 			return
@@ -79,29 +253,99 @@ func (h *UserHandler) BotAuthMiddleware() gin.HandlerFunc {
 	}
 }
 
+// RequestIDMiddleware attaches a request ID to the request context and the response headers.
+// An incoming X-Request-ID header is reused, otherwise a new UUID is generated.
+func (h *UserHandler) RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(requestIDHeader)
+		if requestID == "" {
+			requestID = uuid.NewString()
+		}
+
+		c.Request = c.Request.WithContext(logger.WithRequestID(c.Request.Context(), requestID))
+		c.Header(requestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// TracingMiddleware starts the server span of every request, continuing the trace of an incoming traceparent header.
+// The span is named after the route once it is known and handlers pass it on through the request context.
+func (h *UserHandler) TracingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := tracing.Extract(c.Request.Context(), c.GetHeader(tracing.TraceparentHeader))
+		ctx, span := tracing.Start(ctx, c.Request.Method, tracing.SpanKindServer)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		c.Next()
+
+		route := c.FullPath()
+		if route != "" {
+			span.SetName(c.Request.Method + " " + route)
+			span.SetAttribute("http.route", route)
+		}
+		span.SetAttribute("http.request.method", c.Request.Method)
+		span.SetAttribute("url.path", c.Request.URL.Path)
+		span.SetAttribute("http.response.status_code", c.Writer.Status())
+		if requestID := logger.RequestID(ctx); requestID != "" {
+			span.SetAttribute("request.id", requestID)
+		}
+		if c.Writer.Status() >= http.StatusInternalServerError {
+			span.RecordError(fmt.Errorf("%d %s", c.Writer.Status(), http.StatusText(c.Writer.Status())))
+		}
+	}
+}
+
+// LoggerMiddleware logs every request once it has been handled.
+// The route is logged instead of the path, which carries the username; the path is added at debug level.
+func (h *UserHandler) LoggerMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		ctx := c.Request.Context()
+		attrs := []any{
+			"method", c.Request.Method,
+			"route", c.FullPath(),
+			"status", c.Writer.Status(),
+			"latency", time.Since(start),
+			"client_ip", c.ClientIP(),
+		}
+		if h.log.Enabled(ctx, slog.LevelDebug) {
+			attrs = append(attrs, "path", c.Request.URL.Path)
+		}
+		h.log.InfoContext(ctx, "Request handled", attrs...)
+	}
+}
+
 // logRequestDetails logs the details of the request.
-func logRequestDetails(c *gin.Context, message string) {
-	log.Printf("%s: Method=%s, URL=%s, Headers=%v, Params=%v",
-		message,
-		c.Request.Method,
-		c.Request.URL.String(),
-		c.Request.Header,
-		c.Request.URL.Query(),
+func (h *UserHandler) logRequestDetails(c *gin.Context, message string) {
+	h.log.WarnContext(c.Request.Context(), message,
+		"method", c.Request.Method,
+		"url", c.Request.URL.String(),
+		"headers", c.Request.Header,
+		"params", c.Request.URL.Query(),
 	)
 }
 
 // setupRouter registers the routes.
 func (h *UserHandler) setupRouter() {
-	h.Router.Use(gin.Logger())
-	h.Router.Use(gin.Recovery())
-	h.Router.Use(h.BotAuthMiddleware())
+	h.Router.Use(h.RecoveryMiddleware())
+	h.Router.Use(h.RequestIDMiddleware())
+	h.Router.Use(h.TracingMiddleware())
+	h.Router.Use(h.LoggerMiddleware())
+	if !h.authDisabled {
+		h.Router.Use(h.BotAuthMiddleware())
+	}
+	h.Router.Use(h.BodyLimitMiddleware())
+	h.Router.Use(h.GzipMiddleware())
 
 	// CORS configuration
 	h.Router.Use(cors.New(cors.Config{
 		AllowOrigins:     []string{"http://example.com"},
-		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE"},
-		AllowHeaders:     []string{"Origin", "Authorization", "Content-Type"},
-		ExposeHeaders:    []string{"Content-Length"},
+		AllowMethods:     []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowHeaders:     []string{"Origin", "Authorization", "Content-Type", idempotencyKeyHeader, ifNoneMatchHeader, tracing.TraceparentHeader},
+		ExposeHeaders:    []string{"Content-Length", idempotentReplayedHeader, etagHeader},
 		AllowCredentials: true,
 		MaxAge:           12 * time.Hour,
 	}))
@@ -109,279 +353,1286 @@ func (h *UserHandler) setupRouter() {
 	userRoutes := h.Router.Group("/users")
 	{
 		userRoutes.POST("/", h.createUser)
+		userRoutes.GET("/", h.listUsernames)
+		userRoutes.GET("/search", h.searchUsernames)
+		userRoutes.GET("/traffic/total", h.totalTraffic)
+		userRoutes.GET("/stats", h.userStats)
+		userRoutes.GET("/traffic/top", h.topTrafficUsers)
+		userRoutes.GET("/over-traffic", h.usersOverTraffic)
+		userRoutes.GET("/inactive", h.inactiveUsers)
+		userRoutes.GET("/export", h.exportUsers)
+		userRoutes.GET("/export.csv", h.exportUsersCSV)
+		userRoutes.GET("/export.ndjson", h.exportUsersNDJSON)
+		userRoutes.POST("/import.csv", h.importUsersCSV)
+		userRoutes.POST("/bulk-delete", h.deleteUsers)
+		userRoutes.POST("/subscription/batch", h.subscriptionStatuses)
 		userRoutes.GET("/:username", h.user)
 		userRoutes.PUT("/:username", h.updateUserSubscription)
+		userRoutes.PATCH("/:username", h.patchUser)
 		userRoutes.DELETE("/:username", h.deleteUser)
 		userRoutes.GET("/:username/subscription", h.subscriptionStatus)
+		userRoutes.GET("/:username/subscription/details", h.subscriptionDetails)
+		userRoutes.GET("/:username/days-remaining", h.daysRemaining)
+		userRoutes.GET("/:username/full", h.userFull)
+		userRoutes.POST("/:username/subscription/extend", h.extendSubscription)
+		userRoutes.POST("/:username/subscription/activate", h.activateSubscription)
+		userRoutes.POST("/:username/subscription/cancel", h.cancelSubscription)
+		userRoutes.PUT("/:username/subscription/auto-renew", h.setAutoRenew)
+		userRoutes.GET("/:username/history", h.subscriptionHistory)
 		userRoutes.GET("/:username/exists", h.isUserExists)
 		userRoutes.PUT("/:username/traffic", h.updateUserTraffic)
+		userRoutes.POST("/:username/traffic/reset", h.resetUserTraffic)
+		userRoutes.POST("/:username/traffic/charge", h.chargeUserTraffic)
+		userRoutes.POST("/:username/transfer/:to", h.transferUser)
+	}
+
+	subscriptionRoutes := h.Router.Group("/subscriptions")
+	{
+		subscriptionRoutes.GET("/active", h.activeSubscriptions)
+		subscriptionRoutes.POST("/extend-bulk", h.extendSubscriptionsBulk)
+	}
+
+	adminRoutes := h.Router.Group("/admin")
+	{
+		adminRoutes.POST("/tasks/reset-traffic", h.runResetTraffic)
+		adminRoutes.POST("/tasks/check-subscriptions", h.runCheckSubscriptions)
+		adminRoutes.GET("/reset-preview", h.resetPreview)
+		adminRoutes.POST("/cleanup/subscriptions", h.cleanupSubscriptions)
+		adminRoutes.GET("/db-stats", h.dbStats)
+		adminRoutes.DELETE("/users/all", h.truncateUsers)
 	}
 
+	// Health endpoint without BotAuthMiddleware, for liveness probes
+	h.Router.GET(healthSchedulerPath, h.schedulerHealth)
+
 	// Swagger endpoint without BotAuthMiddleware
 	h.Router.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
-}
-
-// checkUserExists checks if a user exists and handles errors.
-func (h *UserHandler) checkUserExists(c *gin.Context, username string) (bool, error) {
-	ctx, cancel := context.WithTimeout(c.Request.Context(), timeoutToContext)
-	defer cancel()
 
-	exists, err := h.Database.IsUserExists(ctx, username)
-	if err != nil {
-		return false, err
+	if h.pprofEnabled {
+		h.log.Warn("Profiling endpoints enabled", "path", pprofPrefix+"/")
+		h.registerPprof()
 	}
-	if !exists {
-		c.JSON(http.StatusNotFound, ErrorResponse{Error: "User not found"})
-		return false, nil
-	}
-	return true, nil
 }
 
 // createUser handles the creation of a new db.User.
 // @Summary Create a new User
-// @Description Create a new User with the provided details
+// @Description Create a new User with the provided details and return the stored User, including its subscription ID.
+// @Description The username must follow Telegram's rules: 5 to 32 letters, digits or underscores.
+// @Description A retry sent with the same Idempotency-Key gets the first successful response again instead of creating the User twice.
+// @Description With upsert=true an existing User with the username is replaced instead: its chat_id, traffic and subscription are overwritten,
+// @Description a deleted User is restored, and 200 is returned instead of 201.
 // @Tags users
 // @Accept json
 // @Produce json
 // @Param User body db.User true "User details"
+// @Param upsert query bool false "Replace the User if the username is taken"
+// @Param Idempotency-Key header string false "Key identifying retries of the same request"
+// @Success 200 {object} db.User
 // @Success 201 {object} db.User
 // @Failure 400 {object} ErrorResponse
+// @Failure 409 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Security Bearer
 // @Router /users [post]
 func (h *UserHandler) createUser(c *gin.Context) {
-	var newUser db.User
-	if err := c.BindJSON(&newUser); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+	key, ok := idempotencyKey(c)
+	if !ok {
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(c.Request.Context(), timeoutToContext)
+	upsert := false
+	if value := c.Query("upsert"); value != "" {
+		var err error
+		if upsert, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "upsert must be true or false"})
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
 	defer cancel()
 
-	if err := h.Database.CreateUser(ctx, &newUser); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+	if h.replayIdempotentResponse(ctx, c, key) {
 		return
 	}
 
-	c.JSON(http.StatusCreated, newUser)
-}
-
-// user handles retrieving a User by username.
-// @Summary Get a User by username
-// @Description Get User details by username
-// @Tags users
-// @Accept json
-// @Produce json
-// @Param username path string true "Username"
-// @Success 200 {object} db.User
-// @Failure 400 {object} ErrorResponse
-// @Failure 404 {object} ErrorResponse
-// @Failure 500 {object} ErrorResponse
-// @Security Bearer
-// @Router /users/{username} [get]
-func (h *UserHandler) user(c *gin.Context) {
-	username := c.Param("username")
-
-	ctx, cancel := context.WithTimeout(c.Request.Context(), timeoutToContext)
-	defer cancel()
+	var newUser db.User
+	if !bindJSON(c, &newUser) {
+		return
+	}
 
-	user, err := h.Database.User(ctx, username)
-	if user == nil {
-		c.JSON(http.StatusNotFound, ErrorResponse{Error: "User not found"})
+	status := http.StatusCreated
+	var err error
+	if upsert {
+		var created bool
+		created, err = h.Database.UpsertUser(ctx, &newUser)
+		if !created {
+			status = http.StatusOK
+		}
+	} else {
+		err = h.Database.CreateUser(ctx, &newUser)
+	}
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidSubscriptionStatus) || errors.Is(err, db.ErrInvalidSubscriptionDates) ||
+			errors.Is(err, db.ErrInvalidTraffic) || errors.Is(err, db.ErrInvalidUsername) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		if errors.Is(err, db.ErrUserExists) {
+			c.JSON(http.StatusConflict, ErrorResponse{Error: "User already exists"})
+			return
+		}
+		h.respondWithDBError(c, err)
 		return
 	}
+
+	// Return the stored record rather than the request so the client sees the generated subscription
+	user, err := h.Database.User(db.WithPrimary(ctx), newUser.Username)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		h.respondWithDBError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, user)
+	h.respondIdempotent(ctx, c, key, status, user)
 }
 
-// updateUserSubscription handles updating a User's subscription.
-// @Summary Update a User's subscription status
-// @Description Update the subscription status of a User by username
+// listUsernames handles listing usernames, optionally filtered by subscription status.
+// With after or limit it returns a page of Users instead, see listUsersPage,
+// with created_from or created_to the Users registered in that window, see listUsersCreated,
+// and with duration the Users on that plan, see listUsersByDuration.
+// @Summary List usernames
+// @Description List the usernames of all Users, or only of those whose subscription has the given status.
+// @Description When after or limit is given, a UsersPage of Users ordered by username is returned instead; pass its next as after to get the following page.
+// @Description When created_from or created_to is given, the Users registered in that window are returned instead, oldest first. Users registered before registration times were recorded are left out.
+// @Description When duration is given, the Users whose subscription is on that plan are returned instead, ordered by username. The duration is matched ignoring case, and "year" and "1 year" are the same plan.
 // @Tags users
-// @Accept json
 // @Produce json
-// @Param username path string true "Username"
-// @Param User body db.User true "Updated User details"
-// @Success 200 {object} db.User
+// @Param status query string false "Subscription status" Enums(active, inactive)
+// @Param after query string false "Return Users whose username sorts after this one"
+// @Param limit query int false "Page size (1-500)" default(50)
+// @Param created_from query string false "Return Users registered at or after this RFC3339 time or date (YYYY-MM-DD)"
+// @Param created_to query string false "Return Users registered at or before this RFC3339 time or date (YYYY-MM-DD, the whole day), now by default"
+// @Param duration query string false "Return Users on this subscription plan, e.g. month or 1 year"
+// @Success 200 {array} string
 // @Failure 400 {object} ErrorResponse
-// @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Security Bearer
-// @Router /users/{username} [put]
-func (h *UserHandler) updateUserSubscription(c *gin.Context) {
-	username := c.Param("username")
-	var updateUser db.User
-	if err := c.BindJSON(&updateUser); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+// @Router /users [get]
+func (h *UserHandler) listUsernames(c *gin.Context) {
+	if _, ok := c.GetQuery("duration"); ok {
+		h.listUsersByDuration(c)
+		return
+	}
+
+	_, fromSet := c.GetQuery("created_from")
+	_, toSet := c.GetQuery("created_to")
+	if fromSet || toSet {
+		h.listUsersCreated(c)
+		return
+	}
+
+	_, paged := c.GetQuery("after")
+	if _, ok := c.GetQuery("limit"); ok {
+		paged = true
+	}
+	if paged {
+		h.listUsersPaged(c)
 		return
 	}
 
-	exists, err := h.checkUserExists(c, username)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	var usernames []string
+	var err error
+	if status := c.Query("status"); status != "" {
+		usernames, err = h.Database.UsernamesByStatus(ctx, db.SubscriptionStatus(status))
+	} else {
+		usernames, err = h.Database.AllUsername(ctx)
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		if errors.Is(err, db.ErrInvalidSubscriptionStatus) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		h.respondWithDBError(c, err)
 		return
 	}
-	if !exists {
+
+	c.JSON(http.StatusOK, usernames)
+}
+
+// listUsersPaged responds with the page of Users following the after query parameter
+func (h *UserHandler) listUsersPaged(c *gin.Context) {
+	if c.Query("status") != "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "status cannot be combined with after or limit"})
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(c.Request.Context(), timeoutToContext)
+	limit := defaultPageLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageLimit {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("limit must be between 1 and %d", maxPageLimit)})
+			return
+		}
+		limit = n
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
 	defer cancel()
 
-	err = h.Database.UpdateUserSubscription(ctx, username, updateUser.Subscription)
+	users, err := h.Database.ListUsersAfter(ctx, c.Query("after"), limit)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		h.respondWithDBError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, updateUser)
+	page := UsersPage{Users: users}
+	if len(users) == limit {
+		page.Next = users[len(users)-1].Username
+	}
+	c.JSON(http.StatusOK, page)
 }
 
-// deleteUser handles deleting a User by username.
-// @Summary Delete a User by username
-// @Description Delete a User by their username
-// @Tags users
-// @Produce json
-// @Param username path string true "Username"
-// @Success 204 {object} nil
-// @Failure 400 {object} ErrorResponse
-// @Failure 500 {object} ErrorResponse
-// @Security Bearer
-// @Router /users/{username} [delete]
-func (h *UserHandler) deleteUser(c *gin.Context) {
-	username := c.Param("username")
+// listUsersCreated responds with the Users registered between the created_from and created_to query parameters
+func (h *UserHandler) listUsersCreated(c *gin.Context) {
+	for _, name := range []string{"status", "after", "limit"} {
+		if _, ok := c.GetQuery(name); ok {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "created_from and created_to cannot be combined with status, after or limit"})
+			return
+		}
+	}
+
+	var from time.Time
+	to := time.Now()
+	if value := c.Query("created_from"); value != "" {
+		t, _, err := parseQueryTime(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "created_from must be an RFC3339 time or a YYYY-MM-DD date"})
+			return
+		}
+		from = t
+	}
+	if value := c.Query("created_to"); value != "" {
+		t, dateOnly, err := parseQueryTime(value)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "created_to must be an RFC3339 time or a YYYY-MM-DD date"})
+			return
+		}
+		// A date covers the whole day, up to its last second
+		if dateOnly {
+			t = t.AddDate(0, 0, 1).Add(-time.Second)
+		}
+		to = t
+	}
 
-	exists, err := h.checkUserExists(c, username)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	users, err := h.Database.UsersCreatedBetween(ctx, from, to)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		if errors.Is(err, db.ErrInvalidTimeRange) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "created_from must not be after created_to"})
+			return
+		}
+		h.respondWithDBError(c, err)
 		return
 	}
-	if !exists {
+
+	c.JSON(http.StatusOK, users)
+}
+
+// listUsersByDuration responds with the Users on the plan in the duration query parameter
+func (h *UserHandler) listUsersByDuration(c *gin.Context) {
+	for _, name := range []string{"status", "after", "limit", "created_from", "created_to"} {
+		if _, ok := c.GetQuery(name); ok {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "duration cannot be combined with status, after, limit, created_from or created_to"})
+			return
+		}
+	}
+
+	duration := c.Query("duration")
+	if _, _, err := db.ParseDuration(duration); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(c.Request.Context(), timeoutToContext)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
 	defer cancel()
 
-	if err := h.Database.DeleteUser(ctx, username); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+	users, err := h.Database.UsersByDuration(ctx, duration)
+	if err != nil {
+		h.respondWithDBError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusNoContent, nil)
+	c.JSON(http.StatusOK, users)
 }
 
-// subscriptionStatus handles retrieving the subscription status of a User by username.
-// @Summary Get subscription status of a User by username
-// @Description Get the subscription status of a User by their username
+// parseQueryTime parses a query parameter holding an RFC3339 time or a YYYY-MM-DD date in UTC
+// and reports whether it was a date
+func parseQueryTime(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	return t, false, err
+}
+
+// searchUsernames handles searching usernames by prefix.
+// @Summary Search usernames
+// @Description Find usernames starting with the given prefix, ignoring case, in alphabetical order
 // @Tags users
 // @Produce json
-// @Param username path string true "Username"
-// @Success 200 {string} string "Subscription status"
+// @Param q query string true "Username prefix"
+// @Param limit query int false "Maximum number of usernames (1-100)" default(20)
+// @Success 200 {array} string
 // @Failure 400 {object} ErrorResponse
-// @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Security Bearer
-// @Router /users/{username}/subscription [get]
-func (h *UserHandler) subscriptionStatus(c *gin.Context) {
-	username := c.Param("username")
-
-	exists, err := h.checkUserExists(c, username)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+// @Router /users/search [get]
+func (h *UserHandler) searchUsernames(c *gin.Context) {
+	prefix := strings.TrimSpace(c.Query("q"))
+	if prefix == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Query parameter q is required"})
 		return
 	}
-	if !exists {
-		return
+
+	limit := defaultSearchLimit
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxSearchLimit {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit)})
+			return
+		}
+		limit = n
 	}
 
-	ctx, cancel := context.WithTimeout(c.Request.Context(), timeoutToContext)
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
 	defer cancel()
 
-	status, err := h.Database.SubscriptionStatus(ctx, username)
+	usernames, err := h.Database.SearchUsernames(ctx, prefix, limit)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		h.respondWithDBError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, status)
+	c.JSON(http.StatusOK, usernames)
 }
 
-// isUserExists handles checking if a User exists by username.
-// @Summary Check if a User exists by username
-// @Description Check if a User exists by their username
+// totalTraffic handles summing the traffic of all Users.
+// @Summary Get total traffic
+// @Description Get the sum of the traffic of all Users
 // @Tags users
 // @Produce json
-// @Param username path string true "Username"
-// @Success 200 {bool} boolean "User exists or not"
-// @Failure 400 {object} ErrorResponse
+// @Success 200 {object} TotalTrafficResponse
 // @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Security Bearer
-// @Router /users/{username}/exists [get]
-func (h *UserHandler) isUserExists(c *gin.Context) {
-	username := c.Param("username")
-
-	ctx, cancel := context.WithTimeout(c.Request.Context(), timeoutToContext)
+// @Router /users/traffic/total [get]
+func (h *UserHandler) totalTraffic(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
 	defer cancel()
 
-	exist, err := h.Database.IsUserExists(ctx, username)
+	total, err := h.Database.TotalTraffic(ctx)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		h.respondWithDBError(c, err)
 		return
 	}
 
-	if !exist {
-		c.JSON(http.StatusNotFound, exist)
+	c.JSON(http.StatusOK, TotalTrafficResponse{Total: total})
+}
+
+// userStats handles counting Users by subscription status.
+// @Summary Count Users by subscription status
+// @Description Get the number of Users with an active and with an inactive subscription and their total
+// @Tags users
+// @Produce json
+// @Success 200 {object} UserStatsResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/stats [get]
+func (h *UserHandler) userStats(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	counts, err := h.Database.SubscriptionStatusCounts(ctx)
+	if err != nil {
+		h.respondWithDBError(c, err)
 		return
 	}
 
-	c.JSON(http.StatusOK, exist)
+	stats := UserStatsResponse{
+		Active:   counts[string(db.StatusActive)],
+		Inactive: counts[string(db.StatusInactive)],
+	}
+	stats.Total = stats.Active + stats.Inactive
+	c.JSON(http.StatusOK, stats)
 }
 
-// updateUserTraffic handles updating the amount of traffic used by a User
-// @Summary Update the amount of traffic used by a User
-// @Description Update the traffic used by a User identified by username
+// topTrafficUsers handles listing the Users with the most traffic.
+// @Summary Get top traffic Users
+// @Description Get the Users with the most traffic, highest first
 // @Tags users
-// @Accept json
 // @Produce json
-// @Param username path string true "Username"
-// @Param traffic body float64 true "Traffic used in MB"
-// @Success 200 {object} SuccessResponse
+// @Param n query int false "Number of Users (1-100)" default(10)
+// @Success 200 {array} db.User
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/traffic/top [get]
+func (h *UserHandler) topTrafficUsers(c *gin.Context) {
+	n := defaultTopTrafficUsers
+	if value := c.Query("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxTopTrafficUsers {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("n must be between 1 and %d", maxTopTrafficUsers)})
+			return
+		}
+		n = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	users, err := h.Database.TopTrafficUsers(ctx, n)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// usersOverTraffic handles listing the Users whose traffic exceeds a threshold.
+// @Summary Get Users over a traffic threshold
+// @Description Get the Users whose traffic is above the given number of MB, highest first
+// @Tags users
+// @Produce json
+// @Param mb query number true "Traffic threshold in MB, at least 0"
+// @Success 200 {array} db.User
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/over-traffic [get]
+func (h *UserHandler) usersOverTraffic(c *gin.Context) {
+	threshold, err := strconv.ParseFloat(c.Query("mb"), 64)
+	if err != nil || threshold < 0 || math.IsNaN(threshold) || math.IsInf(threshold, 0) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "mb must be a non-negative number"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	users, err := h.Database.UsersOverTraffic(ctx, threshold)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// inactiveUsers handles listing the Users not active for a number of days.
+// @Summary Get inactive Users
+// @Description Get the Users whose traffic was not reported and subscription not changed in the last days, including those never active, ordered by username
+// @Tags users
+// @Produce json
+// @Param days query int false "Days without activity, at least 1" default(30)
+// @Success 200 {array} db.User
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/inactive [get]
+func (h *UserHandler) inactiveUsers(c *gin.Context) {
+	days := defaultInactiveDays
+	if value := c.Query("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "days must be a positive integer"})
+			return
+		}
+		days = parsed
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	users, err := h.Database.InactiveUsers(ctx, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+// user handles retrieving a User by username.
+// @Summary Get a User by username
+// @Description Get User details by username. The response carries an ETag; sending it back in If-None-Match returns 304 while the User is unchanged.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param includeDeleted query bool false "Include soft-deleted users"
+// @Param If-None-Match header string false "ETag of a previous response"
+// @Success 200 {object} db.User
+// @Success 304 "Not Modified"
 // @Failure 400 {object} ErrorResponse
 // @Failure 404 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
 // @Security Bearer
-// @Router /users/{username}/traffic [put]
-func (h *UserHandler) updateUserTraffic(c *gin.Context) {
+// @Router /users/{username} [get]
+func (h *UserHandler) user(c *gin.Context) {
 	username := c.Param("username")
-	var traffic float64
-	if err := c.BindJSON(&traffic); err != nil {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	var user *db.User
+	var err error
+	if c.Query("includeDeleted") == "true" {
+		user, err = h.Database.UserIncludingDeleted(ctx, username)
+	} else {
+		user, err = h.Database.User(ctx, username)
+	}
+	if err != nil {
+		h.respondWithDBError(c, err)
 		return
 	}
 
-	exists, err := h.checkUserExists(c, username)
+	etag, err := userETag(user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
 		return
 	}
-	if !exists {
+	c.Header(etagHeader, etag)
+	if match := c.GetHeader(ifNoneMatchHeader); match != "" && etagMatches(match, etag) {
+		c.Status(http.StatusNotModified)
 		return
 	}
 
-	ctx, cancel := context.WithTimeout(c.Request.Context(), timeoutToContext)
+	c.JSON(http.StatusOK, user)
+}
+
+// updateUserSubscription handles updating a User's subscription.
+// @Summary Update a User's subscription status
+// @Description Update the subscription of a User by username and return the stored User
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param User body db.User true "Updated User details"
+// @Success 200 {object} db.User
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username} [put]
+func (h *UserHandler) updateUserSubscription(c *gin.Context) {
+	username := c.Param("username")
+	var updateUser db.User
+	if !bindJSON(c, &updateUser) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
 	defer cancel()
 
-	err = h.Database.UpdateUserTraffic(ctx, username, traffic)
+	err := h.Database.UpdateUserSubscription(ctx, username, updateUser.Subscription)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		if errors.Is(err, db.ErrInvalidSubscriptionStatus) || errors.Is(err, db.ErrInvalidSubscriptionDates) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		h.respondWithDBError(c, err)
 		return
 	}
 
+	h.respondWithUser(ctx, c, username)
+}
+
+// patchUser handles changing several fields of a User at once.
+// @Summary Update fields of a User
+// @Description Change the chat ID, traffic and subscription of a User in one transaction. Omitted fields are left as they are.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param patch body db.UserPatch true "Fields to change"
+// @Success 200 {object} db.User
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username} [patch]
+func (h *UserHandler) patchUser(c *gin.Context) {
+	username := c.Param("username")
+	var patch db.UserPatch
+	if !bindJSON(c, &patch) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
+	defer cancel()
+
+	if err := h.Database.UpdateUser(ctx, username, patch); err != nil {
+		if errors.Is(err, db.ErrEmptyPatch) || errors.Is(err, db.ErrInvalidSubscriptionStatus) ||
+			errors.Is(err, db.ErrInvalidSubscriptionDates) || errors.Is(err, db.ErrInvalidTraffic) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	h.respondWithUser(ctx, c, username)
+}
+
+// respondWithUser responds with the stored User so the client sees what was actually persisted
+func (h *UserHandler) respondWithUser(ctx context.Context, c *gin.Context, username string) {
+	user, err := h.Database.User(db.WithPrimary(ctx), username)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// deleteUser handles deleting a User by username.
+// @Summary Delete a User by username
+// @Description Delete a User by their username
+// @Tags users
+// @Produce json
+// @Param username path string true "Username"
+// @Success 204 {object} nil
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username} [delete]
+func (h *UserHandler) deleteUser(c *gin.Context) {
+	username := c.Param("username")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
+	defer cancel()
+
+	if err := h.Database.DeleteUser(ctx, username); err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// deleteUsers handles permanently deleting several Users at once.
+// @Summary Delete several Users
+// @Description Permanently delete the Users with the given usernames and their subscriptions in one transaction.
+// @Description Unknown usernames are ignored; the response tells how many Users were deleted.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param usernames body []string true "Usernames to delete (at most 1000)"
+// @Success 200 {object} DeleteUsersResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/bulk-delete [post]
+func (h *UserHandler) deleteUsers(c *gin.Context) {
+	var usernames []string
+	if !bindJSON(c, &usernames) {
+		return
+	}
+	if len(usernames) > maxBulkDeleteUsernames {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("at most %d usernames can be deleted at once", maxBulkDeleteUsernames)})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Bulk)
+	defer cancel()
+
+	deleted, err := h.Database.DeleteUsers(ctx, usernames)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, DeleteUsersResponse{Deleted: deleted})
+}
+
+// subscriptionStatus handles retrieving the subscription status of a User by username.
+// @Summary Get subscription status of a User by username
+// @Description Get the subscription status of a User by their username.
+// @Description With full=true a SubscriptionResponse with the duration and dates is returned instead of the bare status.
+// @Tags users
+// @Produce json
+// @Param username path string true "Username"
+// @Param full query bool false "Return the whole subscription"
+// @Success 200 {string} string "Subscription status"
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/subscription [get]
+func (h *UserHandler) subscriptionStatus(c *gin.Context) {
+	username := c.Param("username")
+
+	if c.Query("full") == "true" {
+		h.fullSubscription(c, username)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	status, err := h.Database.SubscriptionStatus(ctx, username)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// fullSubscription responds with the whole subscription of the User, read in a single query
+func (h *UserHandler) fullSubscription(c *gin.Context, username string) {
+	subscription, ok := h.fetchSubscription(c, username)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, SubscriptionResponse{
+		Status:            subscription.SubscriptionStatus,
+		Duration:          subscription.Duration,
+		StartSubscription: subscription.StartSubscription,
+		EndSubscription:   subscription.EndSubscription,
+	})
+}
+
+// subscriptionDetails handles retrieving the subscription of a User by username.
+// @Summary Get the subscription of a User by username
+// @Description Get the subscription of a User, including its ID, without the rest of the User
+// @Tags users
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} db.Subscription
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/subscription/details [get]
+func (h *UserHandler) subscriptionDetails(c *gin.Context) {
+	subscription, ok := h.fetchSubscription(c, c.Param("username"))
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, subscription)
+}
+
+// fetchSubscription reads the subscription of the User, responding with an error and reporting false if it cannot
+func (h *UserHandler) fetchSubscription(c *gin.Context, username string) (*db.Subscription, bool) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	subscription, err := h.Database.GetSubscription(ctx, username)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return nil, false
+	}
+	return subscription, true
+}
+
+// extendSubscription handles extending a User's subscription by a duration.
+// @Summary Extend a User's subscription
+// @Description Activate the subscription of a User and extend it by the given duration, e.g. "30d" or "1 month"
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param request body ExtendSubscriptionRequest true "Extension duration"
+// @Success 200 {object} db.User
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/subscription/extend [post]
+func (h *UserHandler) extendSubscription(c *gin.Context) {
+	username := c.Param("username")
+	var request ExtendSubscriptionRequest
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	duration, err := parseExtendDuration(request.Duration)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
+	defer cancel()
+
+	if err := h.Database.ExtendSubscription(ctx, username, duration); err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	user, err := h.Database.User(db.WithPrimary(ctx), username)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// parseExtendDuration parses a finite extension duration such as "30d" or "1 month", already checked by the subscription_duration validation.
+func parseExtendDuration(s string) (time.Duration, error) {
+	duration, forever, err := db.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	if forever {
+		return 0, fmt.Errorf("cannot extend a subscription by %q", s)
+	}
+	return duration, nil
+}
+
+// activateSubscription handles activating a User's subscription for a duration.
+// @Summary Activate a User's subscription
+// @Description Mark the subscription of a User active from now for the given duration, e.g. "1 month", "1 year" or "forever".
+// @Description Start and end are computed by the server; forever subscriptions have no end.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param request body ActivateSubscriptionRequest true "Subscription duration"
+// @Success 200 {object} db.User
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/subscription/activate [post]
+func (h *UserHandler) activateSubscription(c *gin.Context) {
+	username := c.Param("username")
+	var request ActivateSubscriptionRequest
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
+	defer cancel()
+
+	if err := h.Database.ActivateSubscription(ctx, username, request.Duration); err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	user, err := h.Database.User(db.WithPrimary(ctx), username)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// cancelSubscription handles cancelling a User's subscription immediately.
+// @Summary Cancel a User's subscription
+// @Description Mark the subscription of a User inactive and end it now. Cancelling an inactive subscription changes nothing.
+// @Tags users
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} db.User
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/subscription/cancel [post]
+func (h *UserHandler) cancelSubscription(c *gin.Context) {
+	username := c.Param("username")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
+	defer cancel()
+
+	if err := h.Database.CancelSubscription(ctx, username); err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	user, err := h.Database.User(db.WithPrimary(ctx), username)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// setAutoRenew handles turning the automatic renewal of a User's subscription on or off.
+// @Summary Set the auto-renewal of a User's subscription
+// @Description Turn automatic renewal on or off. When a subscription with auto_renew expires, the daily subscription check rolls it forward by its duration instead of marking it inactive.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param request body AutoRenewRequest true "Whether the subscription renews"
+// @Success 200 {object} db.User
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/subscription/auto-renew [put]
+func (h *UserHandler) setAutoRenew(c *gin.Context) {
+	username := c.Param("username")
+
+	var request AutoRenewRequest
+	if !bindJSON(c, &request) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
+	defer cancel()
+
+	if err := h.Database.SetAutoRenew(ctx, username, *request.AutoRenew); err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	user, err := h.Database.User(db.WithPrimary(ctx), username)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// subscriptionHistory handles listing the changes of a User's subscription.
+// @Summary Get a User's subscription history
+// @Description Get the status changes of a User's subscription, the most recent first
+// @Tags users
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {array} db.SubscriptionChange
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/history [get]
+func (h *UserHandler) subscriptionHistory(c *gin.Context) {
+	username := c.Param("username")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	history, err := h.Database.SubscriptionHistory(ctx, username)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, history)
+}
+
+// isUserExists handles checking if a User exists by username.
+// @Summary Check if a User exists by username
+// @Description Check if a User exists by their username
+// @Tags users
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {bool} boolean "User exists or not"
+// @Failure 400 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/exists [get]
+func (h *UserHandler) isUserExists(c *gin.Context) {
+	username := c.Param("username")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Read)
+	defer cancel()
+
+	exist, err := h.Database.IsUserExists(ctx, username)
+	if err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	if !exist {
+		c.JSON(http.StatusNotFound, exist)
+		return
+	}
+
+	c.JSON(http.StatusOK, exist)
+}
+
+// updateUserTraffic handles updating the amount of traffic used by a User
+// @Summary Update the amount of traffic used by a User
+// @Description Update the traffic used by a User identified by username.
+// @Description With upsert=true a missing User is created with a default inactive subscription and 201 is returned, so reports racing with the registration are not lost.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param traffic body float64 true "Traffic used in the given unit, from 0 up to MAX_TRAFFIC_MB, as a JSON number or a numeric string"
+// @Param unit query string false "Unit of the traffic, mb (default) or bytes; bytes must be a whole number and are stored exactly" Enums(mb, bytes)
+// @Param upsert query bool false "Create the User if it does not exist"
+// @Success 200 {object} SuccessResponse
+// @Success 201 {object} SuccessResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/traffic [put]
+func (h *UserHandler) updateUserTraffic(c *gin.Context) {
+	username, ok := usernameParam(c)
+	if !ok {
+		return
+	}
+
+	upsert := false
+	if value := c.Query("upsert"); value != "" {
+		var err error
+		if upsert, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "upsert must be true or false"})
+			return
+		}
+	}
+
+	unit := strings.ToLower(c.DefaultQuery("unit", trafficUnitMB))
+	if unit != trafficUnitMB && unit != trafficUnitBytes {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "unit must be mb or bytes"})
+		return
+	}
+
+	var body trafficBody
+	if !bindJSON(c, &body) {
+		return
+	}
+	var traffic int64
+	if unit == trafficUnitBytes {
+		var err error
+		if traffic, err = body.bytes(); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	if upsert {
+		h.upsertUserTraffic(c, username, unit, body.mb(), traffic)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
+	defer cancel()
+
+	var err error
+	if unit == trafficUnitBytes {
+		err = h.Database.UpdateUserTrafficBytes(ctx, username, traffic)
+	} else {
+		err = h.Database.UpdateUserTraffic(ctx, username, body.mb())
+	}
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidTraffic) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{Message: "Traffic updated successfully"})
+}
+
+// usernameParam returns the username path parameter, responding with 400 and returning false when it is blank
+func usernameParam(c *gin.Context) (string, bool) {
+	username := c.Param("username")
+	if strings.TrimSpace(username) == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "username is required"})
+		return "", false
+	}
+	return username, true
+}
+
+// upsertUserTraffic sets the traffic of a User, creating the User if it does not exist.
+// The traffic is trafficMB or, for the bytes unit, trafficBytes.
+func (h *UserHandler) upsertUserTraffic(c *gin.Context, username, unit string, trafficMB float64, trafficBytes int64) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
+	defer cancel()
+
+	var created bool
+	var err error
+	if unit == trafficUnitBytes {
+		created, err = h.Database.UpsertUserTrafficBytes(ctx, username, trafficBytes)
+	} else {
+		created, err = h.Database.UpsertUserTraffic(ctx, username, trafficMB)
+	}
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidTraffic) || errors.Is(err, db.ErrInvalidUsername) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	if created {
+		c.JSON(http.StatusCreated, SuccessResponse{Message: "User created with traffic"})
+		return
+	}
 	c.JSON(http.StatusOK, SuccessResponse{Message: "Traffic updated successfully"})
 }
+
+// resetUserTraffic handles resetting the traffic used by a User to zero
+// @Summary Reset the traffic used by a User
+// @Description Set the traffic used by a User identified by username to zero, e.g. after a manual top-up
+// @Tags users
+// @Produce json
+// @Param username path string true "Username"
+// @Success 200 {object} SuccessResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/traffic/reset [post]
+func (h *UserHandler) resetUserTraffic(c *gin.Context) {
+	username := c.Param("username")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
+	defer cancel()
+
+	if err := h.Database.ResetUserTraffic(ctx, username); err != nil {
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{Message: "Traffic reset successfully"})
+}
+
+// ChargeTrafficResponse represents the traffic quota left after a charge.
+type ChargeTrafficResponse struct {
+	// Remaining is the traffic left in MB before the quota is used up, never below 0
+	Remaining float64 `json:"remaining" example:"412.5"`
+	// Exhausted is true only for the charge that used up the quota
+	Exhausted bool `json:"exhausted"`
+}
+
+// chargeUserTraffic handles adding traffic to a User and reporting the quota left
+// @Summary Charge traffic to a User
+// @Description Add the traffic in MB to the traffic used by a User and return how much of the traffic quota (TRAFFIC_QUOTA_MB, or MAX_TRAFFIC_MB when unset) is left.
+// @Description exhausted is true for the one charge that uses up the quota, so concurrent charges report it once. Charges past the quota are still counted.
+// @Tags users
+// @Accept json
+// @Produce json
+// @Param username path string true "Username"
+// @Param traffic body float64 true "Traffic to add in MB, as a JSON number or a numeric string"
+// @Success 200 {object} ChargeTrafficResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 413 {object} ErrorResponse
+// @Failure 415 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/traffic/charge [post]
+func (h *UserHandler) chargeUserTraffic(c *gin.Context) {
+	username, ok := usernameParam(c)
+	if !ok {
+		return
+	}
+
+	var body trafficBody
+	if !bindJSON(c, &body) {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
+	defer cancel()
+
+	remaining, exhausted, err := h.Database.ChargeTraffic(ctx, username, body.mb())
+	if err != nil {
+		if errors.Is(err, db.ErrInvalidTraffic) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, ChargeTrafficResponse{Remaining: remaining, Exhausted: exhausted})
+}
+
+// transferUser handles moving the subscription and traffic of a User to another one
+// @Summary Transfer a User to another username
+// @Description Move the subscription and traffic of a User to another username in one transaction and delete the User.
+// @Description An existing target keeps its chat ID, gets the subscription in place of its own and the traffic added to its own; a missing or deleted target is created with the chat ID of the User.
+// @Tags users
+// @Produce json
+// @Param username path string true "Username to transfer from"
+// @Param to path string true "Username to transfer to"
+// @Success 200 {object} SuccessResponse
+// @Failure 400 {object} ErrorResponse
+// @Failure 404 {object} ErrorResponse
+// @Failure 500 {object} ErrorResponse
+// @Failure 504 {object} ErrorResponse
+// @Security Bearer
+// @Router /users/{username}/transfer/{to} [post]
+func (h *UserHandler) transferUser(c *gin.Context) {
+	username, ok := usernameParam(c)
+	if !ok {
+		return
+	}
+	to := c.Param("to")
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), h.timeouts.Write)
+	defer cancel()
+
+	if err := h.Database.TransferUser(ctx, username, to); err != nil {
+		if errors.Is(err, db.ErrInvalidTransfer) || errors.Is(err, db.ErrInvalidUsername) || errors.Is(err, db.ErrInvalidTraffic) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+		h.respondWithDBError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, SuccessResponse{Message: "User transferred successfully"})
+}
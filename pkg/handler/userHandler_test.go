@@ -4,12 +4,18 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/YuarenArt/tg-users-database/pkg/db"
+	"github.com/YuarenArt/tg-users-database/pkg/logger"
+	"github.com/YuarenArt/tg-users-database/pkg/scheduler"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -18,6 +24,9 @@ import (
 
 var dataSourceName = ":memory:"
 
+// testStart is truncated to the second precision subscriptions are stored with
+var testStart = time.Now().Truncate(time.Second)
+
 var testCases = []struct {
 	name               string
 	initialUser        db.User
@@ -31,27 +40,47 @@ var testCases = []struct {
 	{
 		name:   "CreateUser",
 		method: http.MethodPost,
-		url:    "/users",
+		url:    "/users/",
 		body: db.User{
 			Username: "testuser",
 			ChatID:   12345,
 			Subscription: db.Subscription{
 				SubscriptionStatus: "active",
 				Duration:           "1 month",
-				StartSubscription:  time.Now(),
-				EndSubscription:    time.Now().AddDate(0, 1, 0),
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
 			},
 		},
 		expectedStatusCode: http.StatusCreated,
-		expectedResponse: db.User{
+	},
+	{
+		name:   "CreateUserInvalidUsername",
+		method: http.MethodPost,
+		url:    "/users/",
+		body: db.User{
+			Username: "bad-name",
+			ChatID:   12345,
+		},
+		expectedStatusCode: http.StatusBadRequest,
+		expectedResponse: map[string]string{
+			"error": `invalid username "bad-name": must be 5 to 32 letters, digits or underscores`,
+		},
+	},
+	{
+		name: "CreateDuplicateUser",
+		initialUser: db.User{
 			Username: "testuser",
 			ChatID:   12345,
-			Subscription: db.Subscription{
-				SubscriptionStatus: "active",
-				Duration:           "1 month",
-				StartSubscription:  time.Now(),
-				EndSubscription:    time.Now().AddDate(0, 1, 0),
-			},
+		},
+		method: http.MethodPost,
+		url:    "/users/",
+		body: db.User{
+			Username: "testuser",
+			ChatID:   67890,
+		},
+		expectedStatusCode: http.StatusConflict,
+		expectedResponse: map[string]string{
+			"error": "User already exists",
 		},
 	},
 	{
@@ -62,8 +91,8 @@ var testCases = []struct {
 			Subscription: db.Subscription{
 				SubscriptionStatus: "active",
 				Duration:           "1 month",
-				StartSubscription:  time.Now(),
-				EndSubscription:    time.Now().AddDate(0, 1, 0),
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
 			},
 		},
 		method:             http.MethodGet,
@@ -73,10 +102,11 @@ var testCases = []struct {
 			Username: "testuser",
 			ChatID:   12345,
 			Subscription: db.Subscription{
+				ID:                 1,
 				SubscriptionStatus: "active",
 				Duration:           "1 month",
-				StartSubscription:  time.Now(),
-				EndSubscription:    time.Now().AddDate(0, 1, 0),
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
 			},
 		},
 	},
@@ -88,8 +118,8 @@ var testCases = []struct {
 			Subscription: db.Subscription{
 				SubscriptionStatus: "active",
 				Duration:           "1 month",
-				StartSubscription:  time.Now(),
-				EndSubscription:    time.Now().AddDate(0, 1, 0),
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
 			},
 		},
 		method: http.MethodPut,
@@ -98,8 +128,8 @@ var testCases = []struct {
 			Subscription: db.Subscription{
 				SubscriptionStatus: "inactive",
 				Duration:           "2 months",
-				StartSubscription:  time.Now(),
-				EndSubscription:    time.Now().AddDate(0, 2, 0),
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 2, 0),
 			},
 		},
 		expectedStatusCode: http.StatusOK,
@@ -107,13 +137,64 @@ var testCases = []struct {
 			Username: "testuser",
 			ChatID:   12345,
 			Subscription: db.Subscription{
+				ID:                 1,
 				SubscriptionStatus: "inactive",
 				Duration:           "2 months",
-				StartSubscription:  time.Now(),
-				EndSubscription:    time.Now().AddDate(0, 2, 0),
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 2, 0),
 			},
 		},
 	},
+	{
+		name: "UpdateUserSubscriptionInvalidStatus",
+		initialUser: db.User{
+			Username: "testuser",
+			ChatID:   12345,
+		},
+		method: http.MethodPut,
+		url:    "/users/testuser",
+		body: db.User{
+			Subscription: db.Subscription{
+				SubscriptionStatus: "actve",
+				Duration:           "1 month",
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
+			},
+		},
+		expectedStatusCode: http.StatusBadRequest,
+	},
+	{
+		name: "UpdateUserSubscriptionReversedDates",
+		initialUser: db.User{
+			Username: "testuser",
+			ChatID:   12345,
+		},
+		method: http.MethodPut,
+		url:    "/users/testuser",
+		body: db.User{
+			Subscription: db.Subscription{
+				SubscriptionStatus: "active",
+				Duration:           "1 month",
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, -1, 0),
+			},
+		},
+		expectedStatusCode: http.StatusBadRequest,
+	},
+	{
+		name:   "CreateUserActiveWithoutEnd",
+		method: http.MethodPost,
+		url:    "/users/",
+		body: db.User{
+			Username: "testuser",
+			ChatID:   12345,
+			Subscription: db.Subscription{
+				SubscriptionStatus: "active",
+				StartSubscription:  testStart,
+			},
+		},
+		expectedStatusCode: http.StatusBadRequest,
+	},
 	{
 		name: "DeleteUser",
 		initialUser: db.User{
@@ -122,8 +203,8 @@ var testCases = []struct {
 			Subscription: db.Subscription{
 				SubscriptionStatus: "active",
 				Duration:           "1 month",
-				StartSubscription:  time.Now(),
-				EndSubscription:    time.Now().AddDate(0, 1, 0),
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
 			},
 		},
 		method:             http.MethodDelete,
@@ -138,8 +219,8 @@ var testCases = []struct {
 			Subscription: db.Subscription{
 				SubscriptionStatus: "active",
 				Duration:           "1 month",
-				StartSubscription:  time.Now(),
-				EndSubscription:    time.Now().AddDate(0, 1, 0),
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
 			},
 		},
 		method:             http.MethodGet,
@@ -147,6 +228,65 @@ var testCases = []struct {
 		expectedStatusCode: http.StatusOK,
 		expectedResponse:   "active",
 	},
+	{
+		name: "SubscriptionStatusFull",
+		initialUser: db.User{
+			Username: "testuser",
+			ChatID:   12345,
+			Subscription: db.Subscription{
+				SubscriptionStatus: "active",
+				Duration:           "1 month",
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
+			},
+		},
+		method:             http.MethodGet,
+		url:                "/users/testuser/subscription?full=true",
+		expectedStatusCode: http.StatusOK,
+		expectedResponse: SubscriptionResponse{
+			Status:            "active",
+			Duration:          "1 month",
+			StartSubscription: testStart,
+			EndSubscription:   testStart.AddDate(0, 1, 0),
+		},
+	},
+	{
+		name:               "SubscriptionStatusFullNotFound",
+		method:             http.MethodGet,
+		url:                "/users/nonexistentuser/subscription?full=true",
+		expectedStatusCode: http.StatusNotFound,
+		expectedResponse:   ErrorResponse{Error: "User not found"},
+	},
+	{
+		name: "SubscriptionDetails",
+		initialUser: db.User{
+			Username: "testuser",
+			ChatID:   12345,
+			Subscription: db.Subscription{
+				SubscriptionStatus: "active",
+				Duration:           "1 month",
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
+			},
+		},
+		method:             http.MethodGet,
+		url:                "/users/testuser/subscription/details",
+		expectedStatusCode: http.StatusOK,
+		expectedResponse: db.Subscription{
+			ID:                 1,
+			SubscriptionStatus: "active",
+			Duration:           "1 month",
+			StartSubscription:  testStart,
+			EndSubscription:    testStart.AddDate(0, 1, 0),
+		},
+	},
+	{
+		name:               "SubscriptionDetailsNotFound",
+		method:             http.MethodGet,
+		url:                "/users/nonexistentuser/subscription/details",
+		expectedStatusCode: http.StatusNotFound,
+		expectedResponse:   ErrorResponse{Error: "User not found"},
+	},
 	{
 		name: "IsUserExists",
 		initialUser: db.User{
@@ -155,8 +295,8 @@ var testCases = []struct {
 			Subscription: db.Subscription{
 				SubscriptionStatus: "active",
 				Duration:           "1 month",
-				StartSubscription:  time.Now(),
-				EndSubscription:    time.Now().AddDate(0, 1, 0),
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
 			},
 		},
 		method:             http.MethodGet,
@@ -172,8 +312,8 @@ var testCases = []struct {
 			Subscription: db.Subscription{
 				SubscriptionStatus: "active",
 				Duration:           "1 month",
-				StartSubscription:  time.Now(),
-				EndSubscription:    time.Now().AddDate(0, 1, 0),
+				StartSubscription:  testStart,
+				EndSubscription:    testStart.AddDate(0, 1, 0),
 			},
 		},
 		method:             http.MethodPut,
@@ -184,19 +324,76 @@ var testCases = []struct {
 			"message": "Traffic updated successfully",
 		},
 	},
+	{
+		name: "ExtendSubscription",
+		initialUser: db.User{
+			Username: "testuser",
+			ChatID:   12345,
+		},
+		method:             http.MethodPost,
+		url:                "/users/testuser/subscription/extend",
+		body:               map[string]string{"duration": "30d"},
+		expectedStatusCode: http.StatusOK,
+	},
+	{
+		name:               "ExtendSubscriptionInvalidDuration",
+		method:             http.MethodPost,
+		url:                "/users/testuser/subscription/extend",
+		body:               map[string]string{"duration": "soon"},
+		expectedStatusCode: http.StatusBadRequest,
+	},
+	{
+		name: "RunResetTraffic",
+		initialUser: db.User{
+			Username: "testuser",
+			ChatID:   12345,
+		},
+		method:             http.MethodPost,
+		url:                "/admin/tasks/reset-traffic",
+		expectedStatusCode: http.StatusOK,
+		expectedResponse: map[string]interface{}{
+			"dry_run": false,
+			"reset":   []string{"testuser"},
+		},
+	},
+	{
+		name: "RunCheckSubscriptions",
+		initialUser: db.User{
+			Username: "testuser",
+			ChatID:   12345,
+		},
+		method:             http.MethodPost,
+		url:                "/admin/tasks/check-subscriptions",
+		expectedStatusCode: http.StatusOK,
+		expectedResponse: map[string]interface{}{
+			"dry_run":     false,
+			"activated":   []string{},
+			"deactivated": []string{},
+			"renewed":     []string{},
+			"skipped":     1,
+			"errored":     []string{},
+		},
+	},
 }
 
 // Setup test environment
 func setupTestEnvironment() (*UserHandler, *db.Database) {
-	db, err := db.NewDatabase(dataSourceName)
+	db, err := db.NewDatabaseWithDriver(db.DriverSQLite, dataSourceName, nil)
 	if err != nil {
 		panic(err)
 	}
 
-	handler := NewHandler(db)
+	handler := NewHandler(db, scheduler.NewScheduler(db), nil)
 	return handler, db
 }
 
+// newTestRequest creates a request authorized with the configured bot token
+func newTestRequest(method, url string, body io.Reader) *http.Request {
+	req := httptest.NewRequest(method, url, body)
+	req.Header.Set("Authorization", "Bearer "+os.Getenv("BOT_TOKEN"))
+	return req
+}
+
 func TestHandlers(t *testing.T) {
 	for _, tc := range testCases {
 		tc := tc // capture the range variable
@@ -205,7 +402,7 @@ func TestHandlers(t *testing.T) {
 
 			// Setup test environment
 			h, db := setupTestEnvironment()
-			defer db.DB.Close()
+			defer db.Close()
 
 			// Setup initial state
 			if tc.initialUser.Username != "" {
@@ -224,7 +421,7 @@ func TestHandlers(t *testing.T) {
 				body = bytes.NewBuffer(nil)
 			}
 
-			req := httptest.NewRequest(tc.method, tc.url, body)
+			req := newTestRequest(tc.method, tc.url, body)
 			if tc.method == http.MethodPost || tc.method == http.MethodPut {
 				req.Header.Set("Content-Type", "application/json")
 			}
@@ -234,11 +431,16 @@ func TestHandlers(t *testing.T) {
 			assert.Equal(t, tc.expectedStatusCode, rec.Code)
 
 			if tc.expectedResponse != nil {
-				var actualResponse map[string]interface{}
+				var actualResponse interface{}
 				err := json.Unmarshal(rec.Body.Bytes(), &actualResponse)
 				if err != nil {
 					t.Fatalf("Failed to parse response body: %v", err)
 				}
+				// last_active and created_at are set by the database at the time of the request
+				if user, ok := actualResponse.(map[string]interface{}); ok {
+					delete(user, "last_active")
+					delete(user, "created_at")
+				}
 
 				expectedBytes, _ := json.Marshal(tc.expectedResponse)
 				actualBytes, _ := json.Marshal(actualResponse)
@@ -247,3 +449,1211 @@ func TestHandlers(t *testing.T) {
 		})
 	}
 }
+
+func TestRequestLogPath(t *testing.T) {
+	testCases := []struct {
+		name     string
+		level    slog.Level
+		wantPath bool
+	}{
+		{name: "Info", level: slog.LevelInfo, wantPath: false},
+		{name: "Debug", level: slog.LevelDebug, wantPath: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			database, err := db.NewDatabaseWithDriver(db.DriverSQLite, dataSourceName, nil)
+			if err != nil {
+				t.Fatalf("Failed to setup test database: %v", err)
+			}
+			defer database.Close()
+
+			var logs bytes.Buffer
+			h := NewHandler(database, scheduler.NewScheduler(database), logger.New("text", tc.level, &logs))
+
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/loggeduser", nil))
+			assert.Equal(t, http.StatusNotFound, rec.Code)
+
+			out := logs.String()
+			assert.Contains(t, out, "route=/users/:username")
+			assert.Equal(t, tc.wantPath, strings.Contains(out, "loggeduser"), out)
+		})
+	}
+}
+
+func TestCreateUserReturnsPersistedUser(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	body, _ := json.Marshal(db.User{Username: "testuser", ChatID: 12345})
+	req := newTestRequest(http.MethodPost, "/users/", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	var created db.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	assert.Equal(t, "testuser", created.Username)
+	assert.Equal(t, int64(12345), created.ChatID)
+	assert.NotZero(t, created.Subscription.ID)
+	assert.Equal(t, db.StatusInactive, created.Subscription.SubscriptionStatus)
+}
+
+func TestListUsernamesByStatus(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, username := range []string{"activeuser", "inactiveuser"} {
+		if err := database.CreateUser(ctx, &db.User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+	err := database.UpdateUserSubscription(ctx, "activeuser", db.Subscription{
+		SubscriptionStatus: db.StatusActive,
+		Duration:           "1 month",
+	})
+	if err != nil {
+		t.Fatalf("Failed to activate user: %v", err)
+	}
+
+	testCases := []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+		expectedUsernames  []string
+	}{
+		{name: "All", url: "/users/", expectedStatusCode: http.StatusOK, expectedUsernames: []string{"activeuser", "inactiveuser"}},
+		{name: "Active", url: "/users/?status=active", expectedStatusCode: http.StatusOK, expectedUsernames: []string{"activeuser"}},
+		{name: "Inactive", url: "/users/?status=inactive", expectedStatusCode: http.StatusOK, expectedUsernames: []string{"inactiveuser"}},
+		{name: "InvalidStatus", url: "/users/?status=actve", expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodGet, tc.url, nil)
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code)
+			if tc.expectedUsernames == nil {
+				return
+			}
+
+			var usernames []string
+			if err := json.Unmarshal(rec.Body.Bytes(), &usernames); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+			assert.ElementsMatch(t, tc.expectedUsernames, usernames)
+		})
+	}
+}
+
+func TestSearchUsernames(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, username := range []string{"alice", "alfred", "bobby", "al_xyz", "alpha"} {
+		if err := database.CreateUser(ctx, &db.User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+		expectedUsernames  []string
+	}{
+		{name: "Prefix", url: "/users/search?q=alf", expectedStatusCode: http.StatusOK, expectedUsernames: []string{"alfred"}},
+		{name: "Limit", url: "/users/search?q=al&limit=2", expectedStatusCode: http.StatusOK, expectedUsernames: []string{"al_xyz", "alfred"}},
+		{name: "WildcardEscaped", url: "/users/search?q=al_", expectedStatusCode: http.StatusOK, expectedUsernames: []string{"al_xyz"}},
+		{name: "EmptyQuery", url: "/users/search?q=", expectedStatusCode: http.StatusBadRequest},
+		{name: "MissingQuery", url: "/users/search", expectedStatusCode: http.StatusBadRequest},
+		{name: "InvalidLimit", url: "/users/search?q=al&limit=0", expectedStatusCode: http.StatusBadRequest},
+		{name: "LimitTooLarge", url: "/users/search?q=al&limit=1000", expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodGet, tc.url, nil)
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code)
+			if tc.expectedUsernames == nil {
+				return
+			}
+
+			var usernames []string
+			if err := json.Unmarshal(rec.Body.Bytes(), &usernames); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+			assert.Equal(t, tc.expectedUsernames, usernames)
+		})
+	}
+}
+
+func TestTrafficAggregation(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	// Empty table
+	rec := get("/users/traffic/total")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"total":0}`, rec.Body.String())
+	rec = get("/users/traffic/top")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for username, traffic := range map[string]float64{"light": 5, "medium": 50, "heavy": 500} {
+		if err := database.CreateUser(ctx, &db.User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+		if err := database.UpdateUserTraffic(ctx, username, traffic); err != nil {
+			t.Fatalf("Failed to set traffic: %v", err)
+		}
+	}
+
+	rec = get("/users/traffic/total")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"total":555}`, rec.Body.String())
+
+	rec = get("/users/traffic/top?n=2")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var users []db.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if assert.Len(t, users, 2) {
+		assert.Equal(t, "heavy", users[0].Username)
+		assert.Equal(t, "medium", users[1].Username)
+	}
+
+	for _, n := range []string{"0", "-1", "101", "ten"} {
+		rec = get("/users/traffic/top?n=" + n)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, "n=%s", n)
+	}
+}
+
+func TestUserStats(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	get := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/stats", nil))
+		return rec
+	}
+
+	rec := get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"active":0,"inactive":0,"total":0}`, rec.Body.String())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	now := time.Now()
+	active := db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: now, EndSubscription: now.AddDate(0, 1, 0)}
+	for username, subscription := range map[string]db.Subscription{
+		"paying_one": active,
+		"paying_two": active,
+		"free_user":  {},
+	} {
+		if err := database.CreateUser(ctx, &db.User{Username: username, ChatID: 12345, Subscription: subscription}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	rec = get()
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"active":2,"inactive":1,"total":3}`, rec.Body.String())
+}
+
+func TestUsersOverTraffic(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for username, traffic := range map[string]float64{"light": 5, "medium": 50, "heavy": 500} {
+		if err := database.CreateUser(ctx, &db.User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+		if err := database.UpdateUserTraffic(ctx, username, traffic); err != nil {
+			t.Fatalf("Failed to set traffic: %v", err)
+		}
+	}
+
+	rec := get("/users/over-traffic?mb=10")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var users []db.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if assert.Len(t, users, 2) {
+		assert.Equal(t, "heavy", users[0].Username)
+		assert.Equal(t, "medium", users[1].Username)
+	}
+
+	// Nobody is over the threshold
+	rec = get("/users/over-traffic?mb=500")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+
+	for _, mb := range []string{"", "-1", "NaN", "Inf", "ten"} {
+		rec = get("/users/over-traffic?mb=" + mb)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, "mb=%s", mb)
+	}
+}
+
+func TestInactiveUsers(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	get := func(url string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, url, nil))
+		return rec
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for username, daysAgo := range map[string]int{"active": 1, "dormant": 40} {
+		if err := database.CreateUser(ctx, &db.User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+		lastActive := db.FormatTime(time.Now().AddDate(0, 0, -daysAgo))
+		if _, err := database.DB.ExecContext(ctx, "UPDATE users SET last_active = ? WHERE username = ?", lastActive, username); err != nil {
+			t.Fatalf("Failed to set last_active: %v", err)
+		}
+	}
+
+	rec := get("/users/inactive")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var users []db.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	if assert.Len(t, users, 1) {
+		assert.Equal(t, "dormant", users[0].Username)
+		assert.NotNil(t, users[0].LastActive)
+	}
+
+	rec = get("/users/inactive?days=60")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `[]`, rec.Body.String())
+
+	for _, days := range []string{"0", "-1", "1.5", "month"} {
+		rec = get("/users/inactive?days=" + days)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, "days=%s", days)
+	}
+}
+
+func TestUsersCreatedBetween(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for username, createdAt := range map[string]string{
+		"early_user":  "2024-02-29T23:59:59Z",
+		"cohort_one":  "2024-03-01T00:00:00Z",
+		"cohort_two":  "2024-03-31T12:00:00Z",
+		"late_user":   "2024-04-01T00:00:00Z",
+		"legacy_user": "",
+	} {
+		if err := database.CreateUser(ctx, &db.User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+		var value any
+		if createdAt != "" {
+			value = createdAt
+		}
+		if _, err := database.DB.ExecContext(ctx, "UPDATE users SET created_at = ? WHERE username = ?", value, username); err != nil {
+			t.Fatalf("Failed to set created_at: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name               string
+		query              string
+		expectedStatusCode int
+		expectedUsers      []string
+	}{
+		{name: "Dates", query: "created_from=2024-03-01&created_to=2024-03-31", expectedStatusCode: http.StatusOK, expectedUsers: []string{"cohort_one", "cohort_two"}},
+		{name: "Times", query: "created_from=2024-03-01T00:00:00Z&created_to=2024-03-31T11:59:59Z", expectedStatusCode: http.StatusOK, expectedUsers: []string{"cohort_one"}},
+		{name: "FromOnly", query: "created_from=2024-03-31", expectedStatusCode: http.StatusOK, expectedUsers: []string{"cohort_two", "late_user"}},
+		{name: "ToOnly", query: "created_to=2024-02-29", expectedStatusCode: http.StatusOK, expectedUsers: []string{"early_user"}},
+		{name: "Empty", query: "created_from=2023-01-01&created_to=2023-12-31", expectedStatusCode: http.StatusOK, expectedUsers: []string{}},
+		{name: "FromAfterTo", query: "created_from=2024-04-01&created_to=2024-03-01", expectedStatusCode: http.StatusBadRequest},
+		{name: "InvalidFrom", query: "created_from=yesterday", expectedStatusCode: http.StatusBadRequest},
+		{name: "InvalidTo", query: "created_to=2024-13-01", expectedStatusCode: http.StatusBadRequest},
+		{name: "WithStatus", query: "created_from=2024-03-01&status=active", expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/?"+tc.query, nil))
+			assert.Equal(t, tc.expectedStatusCode, rec.Code, rec.Body.String())
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var users []db.User
+			if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+			usernames := []string{}
+			for _, user := range users {
+				usernames = append(usernames, user.Username)
+			}
+			assert.Equal(t, tc.expectedUsers, usernames)
+		})
+	}
+}
+
+func TestListUsersByDuration(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for username, duration := range map[string]string{
+		"monthly_user": "month",
+		"yearly_one":   "1 year",
+		"yearly_two":   "year",
+		"forever_user": "forever",
+	} {
+		user := &db.User{Username: username, ChatID: 12345, Subscription: db.Subscription{SubscriptionStatus: db.StatusInactive, Duration: duration}}
+		if err := database.CreateUser(ctx, user); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name               string
+		query              string
+		expectedStatusCode int
+		expectedUsers      []string
+	}{
+		{name: "Year", query: "duration=year", expectedStatusCode: http.StatusOK, expectedUsers: []string{"yearly_one", "yearly_two"}},
+		{name: "OneMonth", query: "duration=1+month", expectedStatusCode: http.StatusOK, expectedUsers: []string{"monthly_user"}},
+		{name: "Empty", query: "duration=2+weeks", expectedStatusCode: http.StatusOK, expectedUsers: []string{}},
+		{name: "Invalid", query: "duration=someday", expectedStatusCode: http.StatusBadRequest},
+		{name: "WithStatus", query: "duration=year&status=active", expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/?"+tc.query, nil))
+			assert.Equal(t, tc.expectedStatusCode, rec.Code, rec.Body.String())
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var users []db.User
+			if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+			usernames := []string{}
+			for _, user := range users {
+				usernames = append(usernames, user.Username)
+			}
+			assert.Equal(t, tc.expectedUsers, usernames)
+		})
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	testCases := []struct {
+		name               string
+		url                string
+		body               string
+		expectedStatusCode int
+		expectedChatID     int64
+		expectedTraffic    float64
+		expectedStatus     db.SubscriptionStatus
+	}{
+		{name: "ChatID", url: "/users/testuser", body: `{"chat_id":67890}`, expectedStatusCode: http.StatusOK, expectedChatID: 67890, expectedTraffic: 5, expectedStatus: db.StatusInactive},
+		{name: "TrafficAndSubscription", url: "/users/testuser", body: `{"traffic":7.5,"subscription":{"subscription_status":"active","duration":"1 month"}}`, expectedStatusCode: http.StatusOK, expectedChatID: 12345, expectedTraffic: 7.5, expectedStatus: db.StatusActive},
+		{name: "Empty", url: "/users/testuser", body: `{}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "InvalidStatus", url: "/users/testuser", body: `{"subscription":{"subscription_status":"actve"}}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "NotFound", url: "/users/nonexistentuser", body: `{"chat_id":1}`, expectedStatusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h, database := setupTestEnvironment()
+			defer database.Close()
+
+			if err := database.CreateUser(context.Background(), &db.User{Username: "testuser", ChatID: 12345, Traffic: 5}); err != nil {
+				t.Fatalf("Failed to create initial user: %v", err)
+			}
+
+			req := newTestRequest(http.MethodPatch, tc.url, bytes.NewBufferString(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code, rec.Body.String())
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var user db.User
+			if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+			assert.Equal(t, "testuser", user.Username)
+			assert.Equal(t, tc.expectedChatID, user.ChatID)
+			assert.Equal(t, tc.expectedTraffic, user.Traffic)
+			assert.Equal(t, tc.expectedStatus, user.Subscription.SubscriptionStatus)
+			assert.NotZero(t, user.Subscription.ID)
+		})
+	}
+}
+
+func TestListUsersPaged(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, username := range []string{"alice", "bobby", "carol", "david", "erina"} {
+		if err := database.CreateUser(ctx, &db.User{Username: username, ChatID: 12345}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	var usernames []string
+	url := "/users/?limit=2"
+	for pages := 0; ; pages++ {
+		if pages > 5 {
+			t.Fatalf("Expected pagination to end, got usernames: %v", usernames)
+		}
+
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, url, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		var page UsersPage
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("Failed to parse response body: %v", err)
+		}
+		for _, user := range page.Users {
+			usernames = append(usernames, user.Username)
+		}
+		if page.Next == "" {
+			break
+		}
+		url = "/users/?limit=2&after=" + page.Next
+	}
+	assert.Equal(t, []string{"alice", "bobby", "carol", "david", "erina"}, usernames)
+
+	for _, url := range []string{"/users/?limit=0", "/users/?limit=1000", "/users/?limit=abc", "/users/?after=bobby&status=active"} {
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, url, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, url)
+	}
+}
+
+func TestSubscriptionHistory(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "historyuser", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	send := func(method, url, body string) *httptest.ResponseRecorder {
+		req := newTestRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	history := func() []db.SubscriptionChange {
+		rec := send(http.MethodGet, "/users/historyuser/history", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var changes []db.SubscriptionChange
+		if err := json.Unmarshal(rec.Body.Bytes(), &changes); err != nil {
+			t.Fatalf("Failed to parse response body: %v", err)
+		}
+		return changes
+	}
+
+	assert.Empty(t, history())
+
+	rec := send(http.MethodPost, "/users/historyuser/subscription/extend", `{"duration":"30d"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = send(http.MethodPut, "/users/historyuser", `{"subscription":{"subscription_status":"inactive","duration":"month"}}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	changes := history()
+	if assert.Len(t, changes, 2) {
+		assert.Equal(t, db.StatusActive, changes[0].OldStatus)
+		assert.Equal(t, db.StatusInactive, changes[0].NewStatus)
+		assert.Equal(t, db.SourceUpdate, changes[0].Source)
+		assert.Equal(t, db.StatusInactive, changes[1].OldStatus)
+		assert.Equal(t, db.StatusActive, changes[1].NewStatus)
+		assert.Equal(t, db.SourceExtend, changes[1].Source)
+	}
+
+	rec = send(http.MethodGet, "/users/nosuchuser/history", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestNullSubscriptionStatus(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "legacy", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+	_, err := database.DB.ExecContext(ctx, `
+		UPDATE subscriptions SET subscription_status = NULL
+		WHERE id = (SELECT subscription_id FROM users WHERE username = 'legacy')`)
+	if err != nil {
+		t.Fatalf("Failed to clear subscription status: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/legacy/subscription", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `"inactive"`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/legacy", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var user db.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	assert.Equal(t, db.StatusInactive, user.Subscription.SubscriptionStatus)
+}
+
+func TestActivateSubscription(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "subscriber", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	testCases := []struct {
+		name               string
+		username           string
+		body               string
+		expectedStatusCode int
+		// expectedLength is the time from start to end, zero for forever
+		expectedLength time.Duration
+	}{
+		{name: "Month", username: "subscriber", body: `{"duration":"1 month"}`, expectedStatusCode: http.StatusOK, expectedLength: 30 * 24 * time.Hour},
+		{name: "Year", username: "subscriber", body: `{"duration":"1 year"}`, expectedStatusCode: http.StatusOK, expectedLength: 365 * 24 * time.Hour},
+		{name: "Forever", username: "subscriber", body: `{"duration":"forever"}`, expectedStatusCode: http.StatusOK},
+		{name: "InvalidDuration", username: "subscriber", body: `{"duration":"soon"}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "MissingDuration", username: "subscriber", body: `{}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "NotFound", username: "nosuchuser", body: `{"duration":"1 month"}`, expectedStatusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodPost, "/users/"+tc.username+"/subscription/activate", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code, rec.Body.String())
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var user db.User
+			if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+			subscription := user.Subscription
+			assert.Equal(t, db.StatusActive, subscription.SubscriptionStatus)
+			assert.WithinDuration(t, time.Now(), subscription.StartSubscription, 2*time.Second)
+			if tc.expectedLength == 0 {
+				assert.True(t, subscription.EndSubscription.IsZero(), "end: %v", subscription.EndSubscription)
+				return
+			}
+			assert.Equal(t, tc.expectedLength, subscription.EndSubscription.Sub(subscription.StartSubscription))
+		})
+	}
+}
+
+func TestCancelSubscription(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	active := db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "month", StartSubscription: time.Now(), EndSubscription: time.Now().AddDate(0, 1, 0)}
+	if err := database.CreateUser(ctx, &db.User{Username: "canceller", ChatID: 12345, Subscription: active}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	cancelSubscription := func(username string) (*httptest.ResponseRecorder, db.User) {
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodPost, "/users/"+username+"/subscription/cancel", nil))
+		var user db.User
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+		}
+		return rec, user
+	}
+
+	rec, cancelled := cancelSubscription("canceller")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, db.StatusInactive, cancelled.Subscription.SubscriptionStatus)
+	assert.WithinDuration(t, time.Now(), cancelled.Subscription.EndSubscription, 2*time.Second)
+
+	// Already cancelled
+	rec, again := cancelSubscription("canceller")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, cancelled.Subscription, again.Subscription)
+
+	rec, _ = cancelSubscription("nosuchuser")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestDeleteUser(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "deleteme", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	deleteUser := func(username string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, newTestRequest(http.MethodDelete, "/users/"+username, nil))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusNoContent, deleteUser("deleteme").Code)
+
+	// Already deleted
+	rec := deleteUser("deleteme")
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.JSONEq(t, `{"error":"User not found"}`, rec.Body.String())
+
+	assert.Equal(t, http.StatusNotFound, deleteUser("nosuchuser").Code)
+}
+
+func TestSetAutoRenew(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "renewer", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	testCases := []struct {
+		name               string
+		url                string
+		body               string
+		expectedStatusCode int
+		expectedAutoRenew  bool
+	}{
+		{name: "On", url: "/users/renewer/subscription/auto-renew", body: `{"auto_renew":true}`, expectedStatusCode: http.StatusOK, expectedAutoRenew: true},
+		{name: "Off", url: "/users/renewer/subscription/auto-renew", body: `{"auto_renew":false}`, expectedStatusCode: http.StatusOK},
+		{name: "Missing", url: "/users/renewer/subscription/auto-renew", body: `{}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "NotABool", url: "/users/renewer/subscription/auto-renew", body: `{"auto_renew":"yes"}`, expectedStatusCode: http.StatusBadRequest},
+		{name: "NotFound", url: "/users/nosuchuser/subscription/auto-renew", body: `{"auto_renew":true}`, expectedStatusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodPut, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedStatusCode, rec.Code, rec.Body.String())
+			if tc.expectedStatusCode != http.StatusOK {
+				return
+			}
+
+			var user db.User
+			if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+			assert.Equal(t, tc.expectedAutoRenew, user.Subscription.AutoRenew)
+		})
+	}
+}
+
+func TestDeleteUsers(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, username := range []string{"trial1", "trial2", "keeper"} {
+		if err := database.CreateUser(ctx, &db.User{Username: username}); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name               string
+		body               string
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{name: "Mixed", body: `["trial1","missing","trial2"]`, expectedStatusCode: http.StatusOK, expectedResponse: `{"deleted":2}`},
+		{name: "AlreadyDeleted", body: `["trial1"]`, expectedStatusCode: http.StatusOK, expectedResponse: `{"deleted":0}`},
+		{name: "Empty", body: `[]`, expectedStatusCode: http.StatusOK, expectedResponse: `{"deleted":0}`},
+		{name: "NotAnArray", body: `{"username":"keeper"}`, expectedStatusCode: http.StatusBadRequest},
+		{
+			name:               "TooMany",
+			body:               `[` + strings.TrimSuffix(strings.Repeat(`"x",`, maxBulkDeleteUsernames+1), ",") + `]`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodPost, "/users/bulk-delete", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code)
+			if tc.expectedResponse != "" {
+				assert.JSONEq(t, tc.expectedResponse, rec.Body.String())
+			}
+		})
+	}
+
+	usernames, err := database.AllUsername(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"keeper"}, usernames)
+}
+
+func TestResetUserTraffic(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "topup", ChatID: 12345, Traffic: 512.5}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodPost, "/users/topup/traffic/reset", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"message":"Traffic reset successfully"}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, "/users/topup", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var user db.User
+	if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+		t.Fatalf("Failed to parse response body: %v", err)
+	}
+	assert.Zero(t, user.Traffic)
+
+	rec = httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, newTestRequest(http.MethodPost, "/users/nosuchuser/traffic/reset", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func TestCreateUserUpsert(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	create := func(url, body string) (*httptest.ResponseRecorder, db.User) {
+		req := newTestRequest(http.MethodPost, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, req)
+
+		var user db.User
+		if rec.Code < http.StatusBadRequest {
+			if err := json.Unmarshal(rec.Body.Bytes(), &user); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+		}
+		return rec, user
+	}
+
+	rec, user := create("/users/?upsert=true", `{"username":"reused","chat_id":111}`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Equal(t, int64(111), user.ChatID)
+
+	// Without upsert the taken username is still a conflict
+	rec, _ = create("/users/", `{"username":"reused","chat_id":222}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	rec, user = create("/users/?upsert=true", `{"username":"reused","chat_id":222}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, int64(222), user.ChatID)
+
+	rec, _ = create("/users/?upsert=maybe", `{"username":"reused","chat_id":333}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestUpdateUserTrafficLimits(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "vpnuser"}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	testCases := []struct {
+		name               string
+		body               string
+		expectedStatusCode int
+	}{
+		{name: "Normal", body: `2048.5`, expectedStatusCode: http.StatusOK},
+		{name: "Zero", body: `0`, expectedStatusCode: http.StatusOK},
+		{name: "Negative", body: `-1`, expectedStatusCode: http.StatusBadRequest},
+		{name: "OverCap", body: `1e18`, expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodPut, "/users/vpnuser/traffic", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+
+			assert.Equal(t, tc.expectedStatusCode, rec.Code)
+		})
+	}
+}
+
+func TestUpdateUserTrafficNumericString(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "vpnuser"}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	testCases := []struct {
+		name               string
+		body               string
+		expectedStatusCode int
+		expectedTraffic    float64
+	}{
+		{name: "Number", body: `100.5`, expectedStatusCode: http.StatusOK, expectedTraffic: 100.5},
+		{name: "String", body: `"100.0"`, expectedStatusCode: http.StatusOK, expectedTraffic: 100},
+		{name: "StringExponent", body: `"2.5e2"`, expectedStatusCode: http.StatusOK, expectedTraffic: 250},
+		{name: "StringNegative", body: `"-1"`, expectedStatusCode: http.StatusBadRequest},
+		{name: "Garbage", body: `"abc"`, expectedStatusCode: http.StatusBadRequest},
+		{name: "EmptyString", body: `""`, expectedStatusCode: http.StatusBadRequest},
+		{name: "PaddedString", body: `" 100"`, expectedStatusCode: http.StatusBadRequest},
+		{name: "NaN", body: `"NaN"`, expectedStatusCode: http.StatusBadRequest},
+		{name: "OutOfRange", body: `"1e400"`, expectedStatusCode: http.StatusBadRequest},
+		{name: "Boolean", body: `true`, expectedStatusCode: http.StatusBadRequest},
+		{name: "Object", body: `{"traffic":100}`, expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Start from a traffic no case sets, so a rejected body is seen to leave it unchanged
+			if err := database.UpdateUserTraffic(ctx, "vpnuser", 1); err != nil {
+				t.Fatalf("Failed to set traffic: %v", err)
+			}
+
+			req := newTestRequest(http.MethodPut, "/users/vpnuser/traffic", strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedStatusCode, rec.Code, rec.Body.String())
+
+			user, err := database.User(ctx, "vpnuser")
+			if err != nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+			if tc.expectedStatusCode == http.StatusOK {
+				assert.Equal(t, tc.expectedTraffic, user.Traffic)
+			} else {
+				assert.Equal(t, 1.0, user.Traffic)
+			}
+		})
+	}
+}
+
+func TestUpdateUserTrafficUnit(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "vpnuser"}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	testCases := []struct {
+		name               string
+		url                string
+		body               string
+		expectedStatusCode int
+		expectedBytes      int64
+	}{
+		{name: "DefaultMB", url: "/users/vpnuser/traffic", body: `1.5`, expectedStatusCode: http.StatusOK, expectedBytes: 1572864},
+		{name: "MB", url: "/users/vpnuser/traffic?unit=mb", body: `2`, expectedStatusCode: http.StatusOK, expectedBytes: 2097152},
+		{name: "Bytes", url: "/users/vpnuser/traffic?unit=bytes", body: `123456789012345`, expectedStatusCode: http.StatusOK, expectedBytes: 123456789012345},
+		{name: "BytesString", url: "/users/vpnuser/traffic?unit=BYTES", body: `"1234567"`, expectedStatusCode: http.StatusOK, expectedBytes: 1234567},
+		{name: "FractionalBytes", url: "/users/vpnuser/traffic?unit=bytes", body: `1.5`, expectedStatusCode: http.StatusBadRequest},
+		{name: "NegativeBytes", url: "/users/vpnuser/traffic?unit=bytes", body: `-1`, expectedStatusCode: http.StatusBadRequest},
+		{name: "UnknownUnit", url: "/users/vpnuser/traffic?unit=gb", body: `1`, expectedStatusCode: http.StatusBadRequest},
+		{name: "NaN", url: "/users/vpnuser/traffic", body: `NaN`, expectedStatusCode: http.StatusBadRequest},
+		{name: "NaNString", url: "/users/vpnuser/traffic", body: `"NaN"`, expectedStatusCode: http.StatusBadRequest},
+		{name: "InfinityString", url: "/users/vpnuser/traffic", body: `"Infinity"`, expectedStatusCode: http.StatusBadRequest},
+		{name: "NegativeInfinityString", url: "/users/vpnuser/traffic", body: `"-Inf"`, expectedStatusCode: http.StatusBadRequest},
+		{name: "Overflow", url: "/users/vpnuser/traffic", body: `1e400`, expectedStatusCode: http.StatusBadRequest},
+		{name: "OverflowString", url: "/users/vpnuser/traffic?upsert=true", body: `"1e400"`, expectedStatusCode: http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := database.UpdateUserTrafficBytes(ctx, "vpnuser", 1); err != nil {
+				t.Fatalf("Failed to set traffic: %v", err)
+			}
+
+			req := newTestRequest(http.MethodPut, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedStatusCode, rec.Code, rec.Body.String())
+
+			user, err := database.User(ctx, "vpnuser")
+			if err != nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+			if tc.expectedStatusCode == http.StatusOK {
+				assert.Equal(t, tc.expectedBytes, user.TrafficBytes)
+			} else {
+				assert.Equal(t, int64(1), user.TrafficBytes)
+			}
+		})
+	}
+
+	// A missing user is created with the exact bytes
+	req := newTestRequest(http.MethodPut, "/users/new_vpnuser/traffic?unit=bytes&upsert=true", strings.NewReader(`4097`))
+	req.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	h.Router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusCreated, rec.Code, rec.Body.String())
+	user, err := database.User(ctx, "new_vpnuser")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(4097), user.TrafficBytes)
+	}
+
+	// A blank username is rejected before the database is queried
+	for _, url := range []string{"/users/%20/traffic", "/users/%20/traffic?upsert=true"} {
+		req := newTestRequest(http.MethodPut, url, strings.NewReader(`1`))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, rec.Body.String())
+		assert.Contains(t, rec.Body.String(), "username is required")
+	}
+}
+
+func TestUpsertUserTraffic(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	put := func(url, body string) *httptest.ResponseRecorder {
+		req := newTestRequest(http.MethodPut, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		rec := httptest.NewRecorder()
+		h.Router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Strict by default
+	rec := put("/users/latecomer/traffic", `10`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	rec = put("/users/latecomer/traffic?upsert=true", `10`)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	user, err := database.User(ctx, "latecomer")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+	assert.Equal(t, 10.0, user.Traffic)
+	assert.Equal(t, db.StatusInactive, user.Subscription.SubscriptionStatus)
+
+	rec = put("/users/latecomer/traffic?upsert=true", `20`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = put("/users/latecomer/traffic", `30`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = put("/users/latecomer/traffic?upsert=true", `-1`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = put("/users/latecomer/traffic?upsert=maybe", `10`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestEmptyLists(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	// Clients expect empty arrays, never null
+	testCases := []struct {
+		url              string
+		expectedResponse string
+	}{
+		{url: "/users/", expectedResponse: `[]`},
+		{url: "/users/?status=active", expectedResponse: `[]`},
+		{url: "/users/?limit=10", expectedResponse: `{"users":[]}`},
+		{url: "/users/search?q=nobody", expectedResponse: `[]`},
+		{url: "/users/traffic/top", expectedResponse: `[]`},
+		{url: "/users/over-traffic?mb=0", expectedResponse: `[]`},
+		{url: "/users/export", expectedResponse: `[]`},
+		{url: "/subscriptions/active", expectedResponse: `[]`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, newTestRequest(http.MethodGet, tc.url, nil))
+
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.JSONEq(t, tc.expectedResponse, rec.Body.String())
+		})
+	}
+}
+
+func TestChargeUserTraffic(t *testing.T) {
+	t.Setenv("TRAFFIC_QUOTA_MB", "10")
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "chargeuser"}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	testCases := []struct {
+		name               string
+		url                string
+		body               string
+		expectedStatusCode int
+		expectedResponse   string
+	}{
+		{name: "Partial", url: "/users/chargeuser/traffic/charge", body: `4`, expectedStatusCode: http.StatusOK, expectedResponse: `{"remaining": 6, "exhausted": false}`},
+		{name: "String", url: "/users/chargeuser/traffic/charge", body: `"2.5"`, expectedStatusCode: http.StatusOK, expectedResponse: `{"remaining": 3.5, "exhausted": false}`},
+		{name: "Exhausts", url: "/users/chargeuser/traffic/charge", body: `5`, expectedStatusCode: http.StatusOK, expectedResponse: `{"remaining": 0, "exhausted": true}`},
+		{name: "AlreadyExhausted", url: "/users/chargeuser/traffic/charge", body: `1`, expectedStatusCode: http.StatusOK, expectedResponse: `{"remaining": 0, "exhausted": false}`},
+		{name: "Negative", url: "/users/chargeuser/traffic/charge", body: `-1`, expectedStatusCode: http.StatusBadRequest},
+		{name: "NotANumber", url: "/users/chargeuser/traffic/charge", body: `"NaN"`, expectedStatusCode: http.StatusBadRequest},
+		{name: "NotFound", url: "/users/missinguser/traffic/charge", body: `1`, expectedStatusCode: http.StatusNotFound},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodPost, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedStatusCode, rec.Code, rec.Body.String())
+			if tc.expectedResponse != "" {
+				assert.JSONEq(t, tc.expectedResponse, rec.Body.String())
+			}
+		})
+	}
+
+	user, err := database.User(ctx, "chargeuser")
+	if assert.NoError(t, err) {
+		assert.Equal(t, 12.5, user.Traffic)
+	}
+}
+
+func TestTransferUser(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, user := range []*db.User{
+		{Username: "transfersource", ChatID: 1, Traffic: 3},
+		{Username: "transfertarget", ChatID: 2, Traffic: 4},
+	} {
+		if err := database.CreateUser(ctx, user); err != nil {
+			t.Fatalf("Failed to create initial user: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+	}{
+		{name: "SameUser", url: "/users/transfersource/transfer/transfersource", expectedStatusCode: http.StatusBadRequest},
+		{name: "InvalidTarget", url: "/users/transfersource/transfer/x", expectedStatusCode: http.StatusBadRequest},
+		{name: "ExistingTarget", url: "/users/transfersource/transfer/transfertarget", expectedStatusCode: http.StatusOK},
+		{name: "NotFound", url: "/users/transfersource/transfer/transfertarget", expectedStatusCode: http.StatusNotFound},
+		{name: "NewTarget", url: "/users/transfertarget/transfer/transfernew", expectedStatusCode: http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(http.MethodPost, tc.url, nil)
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedStatusCode, rec.Code, rec.Body.String())
+		})
+	}
+
+	user, err := database.User(ctx, "transfernew")
+	if assert.NoError(t, err) {
+		assert.Equal(t, int64(2), user.ChatID)
+		assert.Equal(t, 7.0, user.Traffic)
+	}
+}
@@ -0,0 +1,63 @@
+package handler
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// subscriptionDurationTag validates a subscription duration written the way the API documents it
+const subscriptionDurationTag = "subscription_duration"
+
+// subscriptionDurationPattern matches "forever", a unit ("month"), a count and unit ("3 months") and the short "7d" and "2w".
+// db.ParseDuration is more lenient, but durations such as "1month" or "Month" are stored as sent and read back by clients.
+var subscriptionDurationPattern = regexp.MustCompile(`^(forever|(day|week|month|year)s?|[1-9][0-9]* (day|week|month|year)s?|[1-9][0-9]*[dw])$`)
+
+func init() {
+	engine, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	// Report fields by their JSON names
+	engine.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+	engine.RegisterValidation(subscriptionDurationTag, func(fl validator.FieldLevel) bool {
+		return subscriptionDurationPattern.MatchString(fl.Field().String())
+	})
+}
+
+// validationFields maps every field that failed validation, by its JSON path such as "subscription.duration", to what is wrong with it
+func validationFields(errs validator.ValidationErrors) map[string]string {
+	fields := make(map[string]string, len(errs))
+	for _, fieldErr := range errs {
+		// The namespace starts with the name of the bound type, e.g. "User.subscription.duration"
+		path := fieldErr.Namespace()
+		if _, rest, ok := strings.Cut(path, "."); ok {
+			path = rest
+		}
+		fields[path] = validationMessage(fieldErr)
+	}
+	return fields
+}
+
+// validationMessage describes the rule a field broke
+func validationMessage(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "oneof":
+		return "must be one of: " + strings.ReplaceAll(fieldErr.Param(), " ", ", ")
+	case subscriptionDurationTag:
+		return `must be "forever", a unit such as "month", or a count and unit such as "3 months" or "7d"`
+	default:
+		return "failed the " + fieldErr.Tag() + " check"
+	}
+}
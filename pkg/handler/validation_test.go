@@ -0,0 +1,154 @@
+package handler
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionValidation(t *testing.T) {
+	h, database := setupTestEnvironment()
+	defer database.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := database.CreateUser(ctx, &db.User{Username: "validuser", ChatID: 12345}); err != nil {
+		t.Fatalf("Failed to create initial user: %v", err)
+	}
+
+	testCases := []struct {
+		name               string
+		method             string
+		url                string
+		body               string
+		expectedStatusCode int
+		expectedFields     map[string]string
+	}{
+		{
+			name: "CapitalizedStatus", method: http.MethodPost, url: "/users/",
+			body:               `{"username":"newuser1","subscription":{"subscription_status":"Active","duration":"1 month"}}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFields:     map[string]string{"subscription.subscription_status": "must be one of: active, inactive"},
+		},
+		{
+			name: "DurationWithoutSpace", method: http.MethodPost, url: "/users/",
+			body:               `{"username":"newuser2","subscription":{"subscription_status":"active","duration":"1month"}}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFields:     map[string]string{"subscription.duration": `must be "forever", a unit such as "month", or a count and unit such as "3 months" or "7d"`},
+		},
+		{
+			name: "BothInvalid", method: http.MethodPut, url: "/users/validuser",
+			body:               `{"subscription":{"subscription_status":"paid","duration":"Month"}}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFields: map[string]string{
+				"subscription.subscription_status": "must be one of: active, inactive",
+				"subscription.duration":            `must be "forever", a unit such as "month", or a count and unit such as "3 months" or "7d"`,
+			},
+		},
+		{
+			name: "ZeroCount", method: http.MethodPut, url: "/users/validuser",
+			body:               `{"subscription":{"subscription_status":"inactive","duration":"0 days"}}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "UnknownUnit", method: http.MethodPut, url: "/users/validuser",
+			body:               `{"subscription":{"subscription_status":"inactive","duration":"monthly"}}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "PatchedSubscription", method: http.MethodPatch, url: "/users/validuser",
+			body:               `{"subscription":{"subscription_status":"ACTIVE"}}`,
+			expectedStatusCode: http.StatusBadRequest,
+		},
+		{
+			name: "ShortDuration", method: http.MethodPut, url: "/users/validuser",
+			body:               `{"subscription":{"subscription_status":"inactive","duration":"7d"}}`,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name: "Forever", method: http.MethodPut, url: "/users/validuser",
+			body:               `{"subscription":{"subscription_status":"inactive","duration":"forever"}}`,
+			expectedStatusCode: http.StatusOK,
+		},
+		{
+			name: "ActivateHours", method: http.MethodPost, url: "/users/validuser/subscription/activate",
+			body:               `{"duration":"12h"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFields:     map[string]string{"duration": `must be "forever", a unit such as "month", or a count and unit such as "3 months" or "7d"`},
+		},
+		{
+			name: "ActivateNanosecond", method: http.MethodPost, url: "/users/validuser/subscription/activate",
+			body:               `{"duration":"1ns"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFields:     map[string]string{"duration": `must be "forever", a unit such as "month", or a count and unit such as "3 months" or "7d"`},
+		},
+		{
+			name: "ActivateWithoutSpace", method: http.MethodPost, url: "/users/validuser/subscription/activate",
+			body:               `{"duration":"1month"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFields:     map[string]string{"duration": `must be "forever", a unit such as "month", or a count and unit such as "3 months" or "7d"`},
+		},
+		{
+			name: "ActivateWithoutDuration", method: http.MethodPost, url: "/users/validuser/subscription/activate",
+			body:               `{}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFields:     map[string]string{"duration": "is required"},
+		},
+		{
+			name: "ExtendHours", method: http.MethodPost, url: "/users/validuser/subscription/extend",
+			body:               `{"duration":"12h"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFields:     map[string]string{"duration": `must be "forever", a unit such as "month", or a count and unit such as "3 months" or "7d"`},
+		},
+		{
+			name: "ExtendWithoutSpace", method: http.MethodPost, url: "/users/validuser/subscription/extend",
+			body:               `{"duration":"1month"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFields:     map[string]string{"duration": `must be "forever", a unit such as "month", or a count and unit such as "3 months" or "7d"`},
+		},
+		{
+			name: "ExtendBulkNanosecond", method: http.MethodPost, url: "/subscriptions/extend-bulk",
+			body:               `{"usernames":["validuser"],"duration":"1ns"}`,
+			expectedStatusCode: http.StatusBadRequest,
+			expectedFields:     map[string]string{"duration": `must be "forever", a unit such as "month", or a count and unit such as "3 months" or "7d"`},
+		},
+		{
+			name: "NoSubscription", method: http.MethodPost, url: "/users/",
+			body:               `{"username":"newuser3"}`,
+			expectedStatusCode: http.StatusCreated,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := newTestRequest(tc.method, tc.url, strings.NewReader(tc.body))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			h.Router.ServeHTTP(rec, req)
+			assert.Equal(t, tc.expectedStatusCode, rec.Code, rec.Body.String())
+			if tc.expectedFields == nil {
+				return
+			}
+
+			var response ErrorResponse
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("Failed to parse response body: %v", err)
+			}
+			assert.Equal(t, tc.expectedFields, response.Fields)
+		})
+	}
+
+	// Rejected updates leave the subscription as it was
+	user, err := database.User(ctx, "validuser")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "forever", user.Subscription.Duration)
+	}
+}
@@ -0,0 +1,97 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRequestIDIsLogged(t *testing.T) {
+	var buf bytes.Buffer
+	log := New("json", slog.LevelInfo, &buf)
+
+	ctx := WithRequestID(context.Background(), "req-123")
+	log.InfoContext(ctx, "hello", "username", "testuser")
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Failed to parse log line %q: %v", buf.String(), err)
+	}
+	if line["request_id"] != "req-123" {
+		t.Fatalf("Expected request_id: req-123, got: %v", line["request_id"])
+	}
+	if line["username"] != "testuser" {
+		t.Fatalf("Expected username: testuser, got: %v", line["username"])
+	}
+}
+
+func TestNoRequestID(t *testing.T) {
+	var buf bytes.Buffer
+	log := New("json", slog.LevelInfo, &buf)
+
+	log.InfoContext(context.Background(), "hello")
+
+	if strings.Contains(buf.String(), "request_id") {
+		t.Fatalf("Expected no request_id, got: %s", buf.String())
+	}
+}
+
+func TestTextFormat(t *testing.T) {
+	var buf bytes.Buffer
+	log := New("text", slog.LevelInfo, &buf).With("component", "db")
+
+	ctx := WithRequestID(context.Background(), "req-456")
+	log.InfoContext(ctx, "hello")
+
+	out := buf.String()
+	if json.Valid(buf.Bytes()) {
+		t.Fatalf("Expected plain-text output, got JSON: %s", out)
+	}
+	if !strings.Contains(out, "request_id=req-456") || !strings.Contains(out, "component=db") {
+		t.Fatalf("Expected request_id and component attributes, got: %s", out)
+	}
+}
+
+func TestLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log := New("json", slog.LevelInfo, &buf)
+
+	log.DebugContext(context.Background(), "hidden")
+	log.InfoContext(context.Background(), "shown")
+
+	out := buf.String()
+	if strings.Contains(out, "hidden") || !strings.Contains(out, "shown") {
+		t.Fatalf("Expected only the info line, got: %s", out)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	testCases := []struct {
+		value   string
+		want    slog.Level
+		wantErr bool
+	}{
+		{value: "", want: slog.LevelInfo},
+		{value: "debug", want: slog.LevelDebug},
+		{value: "INFO", want: slog.LevelInfo},
+		{value: " warn ", want: slog.LevelWarn},
+		{value: "warning", want: slog.LevelWarn},
+		{value: "error", want: slog.LevelError},
+		{value: "verbose", want: slog.LevelInfo, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.value, func(t *testing.T) {
+			got, err := ParseLevel(tc.value)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Expected error: %v, got: %v", tc.wantErr, err)
+			}
+			if got != tc.want {
+				t.Fatalf("Expected level: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -4,38 +4,152 @@ import (
 	"context"
 	"log"
 	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
 )
 
-func (s *Scheduler) checkAndUpdateSubscriptions() {
+// SubscriptionSummary lists the users whose subscriptions a run changed, or would change in dry-run mode.
+// Renewed lists the expired subscriptions with auto-renew that were rolled forward instead of deactivated.
+// Skipped counts the users left unchanged and Errored lists those that could not be read or updated.
+type SubscriptionSummary struct {
+	DryRun      bool     `json:"dry_run"`
+	Activated   []string `json:"activated"`
+	Deactivated []string `json:"deactivated"`
+	Renewed     []string `json:"renewed"`
+	Skipped     int      `json:"skipped"`
+	Errored     []string `json:"errored"`
+}
+
+// CheckSubscriptions runs the subscription sweep now and returns what it changed.
+// It returns ErrTaskRunning instead while a scheduled or on-demand sweep is in progress.
+func (s *Scheduler) CheckSubscriptions() (SubscriptionSummary, error) {
+	var summary SubscriptionSummary
+	if !s.exclusive(checkSubscriptions, func() { summary = s.checkAndUpdateSubscriptions() }) {
+		return SubscriptionSummary{}, ErrTaskRunning
+	}
+	return summary, nil
+}
+
+func (s *Scheduler) checkAndUpdateSubscriptions() SubscriptionSummary {
+	summary := SubscriptionSummary{DryRun: s.DryRun, Activated: []string{}, Deactivated: []string{}, Renewed: []string{}, Errored: []string{}}
+	defer func() {
+		log.Printf("Subscription check finished: activated=%d deactivated=%d renewed=%d skipped=%d errored=%d dry_run=%t",
+			len(summary.Activated), len(summary.Deactivated), len(summary.Renewed), summary.Skipped, len(summary.Errored), summary.DryRun)
+	}()
+
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
-	usernames, err := s.db.AllUsername(ctx)
+	ctx = db.WithChangeSource(ctx, db.SourceScheduler)
+
+	var usernames []string
+	var err error
+	if s.ActiveOnly {
+		usernames, err = s.db.UsernamesByStatus(ctx, db.StatusActive)
+	} else {
+		usernames, err = s.db.AllUsername(ctx)
+	}
 	if err != nil {
 		log.Printf("Failed to fetch usernames: %v", err)
-		return
+		return summary
 	}
 
 	for _, username := range usernames {
 		user, err := s.db.User(ctx, username)
 		if err != nil {
 			log.Printf("Failed to get user %s: %v", username, err)
+			summary.Errored = append(summary.Errored, username)
+			continue
 		}
 
-		if user.Subscription.SubscriptionStatus == "inactive" && user.Subscription.EndSubscription.After(time.Now()) {
-			user.Subscription.SubscriptionStatus = "active"
+		now := time.Now()
+		changed := false
+		// A cancelled forever subscription keeps its duration and never expires, so it is left inactive
+		if user.Subscription.SubscriptionStatus == db.StatusInactive && !user.Subscription.IsForever() && !user.Subscription.IsExpired(now) {
+			if s.DryRun {
+				log.Printf("Dry run: would activate subscription for user %s", user.Username)
+				summary.Activated = append(summary.Activated, username)
+				continue
+			}
+			user.Subscription.SubscriptionStatus = db.StatusActive
 			if err := s.db.UpdateUserSubscription(ctx, username, user.Subscription); err != nil {
 				log.Printf("Failed to update subscription for user %s: %v", user.Username, err)
+				summary.Errored = append(summary.Errored, username)
+				continue
 			}
+			summary.Activated = append(summary.Activated, username)
+			changed = true
 		}
 
-		if user.Subscription.SubscriptionStatus == "active" && user.Subscription.EndSubscription.Before(time.Now()) {
-			log.Printf("Subscription expired for user %s, updating status to inactive.", user.Username)
-			user.Subscription.SubscriptionStatus = "inactive"
-			user.Subscription.EndSubscription = time.Time{}
-			if err := s.db.UpdateUserSubscription(ctx, username, user.Subscription); err != nil {
-				log.Printf("Failed to update subscription for user %s: %v", user.Username, err)
+		if user.Subscription.SubscriptionStatus == db.StatusActive && s.pastGracePeriod(user.Subscription, now) {
+			if user.Subscription.AutoRenew {
+				if !s.renewSubscription(ctx, user, &summary) {
+					continue
+				}
+				changed = true
+			} else {
+				if s.DryRun {
+					log.Printf("Dry run: would mark subscription of user %s as inactive", user.Username)
+					summary.Deactivated = append(summary.Deactivated, username)
+					continue
+				}
+				log.Printf("Subscription expired for user %s, updating status to inactive.", user.Username)
+				user.Subscription.SubscriptionStatus = db.StatusInactive
+				user.Subscription.EndSubscription = time.Time{}
+				if err := s.db.UpdateUserSubscription(ctx, username, user.Subscription); err != nil {
+					log.Printf("Failed to update subscription for user %s: %v", user.Username, err)
+					summary.Errored = append(summary.Errored, username)
+					continue
+				}
+				summary.Deactivated = append(summary.Deactivated, username)
+				changed = true
+				s.notify(Event{Username: user.Username, ChatID: user.ChatID, Event: EventExpired})
 			}
 		}
+		if !changed {
+			summary.Skipped++
+		}
+
+		if s.TrafficQuotaMB > 0 && user.Subscription.IsActive(now) && user.Traffic > s.TrafficQuotaMB {
+			if s.DryRun {
+				log.Printf("Dry run: would report user %s over the traffic quota", user.Username)
+				continue
+			}
+			s.notify(Event{Username: user.Username, ChatID: user.ChatID, Event: EventQuotaExceeded, Traffic: user.Traffic})
+		}
+	}
+
+	return summary
+}
+
+// pastGracePeriod reports whether the subscription ended more than GracePeriod before now.
+// Expired subscriptions are kept active until then, and forever subscriptions have no end, so they never expire.
+func (s *Scheduler) pastGracePeriod(subscription db.Subscription, now time.Time) bool {
+	return !subscription.IsForever() && subscription.EndSubscription.Add(s.GracePeriod).Before(now)
+}
+
+// renewSubscription rolls the expired subscription of the user forward by its duration, keeping it active,
+// and reports whether it was renewed. Subscriptions whose duration cannot be renewed are counted as errored.
+func (s *Scheduler) renewSubscription(ctx context.Context, user *db.User, summary *SubscriptionSummary) bool {
+	renewed, err := user.Subscription.Renewed(time.Now())
+	if err != nil {
+		log.Printf("Failed to renew subscription for user %s: %v", user.Username, err)
+		summary.Errored = append(summary.Errored, user.Username)
+		return false
+	}
+	if s.DryRun {
+		log.Printf("Dry run: would renew subscription of user %s until %s", user.Username, renewed.EndSubscription.Format(time.RFC3339))
+		summary.Renewed = append(summary.Renewed, user.Username)
+		return false
+	}
 
+	if err := s.db.UpdateUserSubscription(ctx, user.Username, renewed); err != nil {
+		log.Printf("Failed to update subscription for user %s: %v", user.Username, err)
+		summary.Errored = append(summary.Errored, user.Username)
+		return false
 	}
+	user.Subscription = renewed
+	log.Printf("Subscription renewed for user %s until %s", user.Username, renewed.EndSubscription.Format(time.RFC3339))
+	summary.Renewed = append(summary.Renewed, user.Username)
+	s.notify(Event{Username: user.Username, ChatID: user.ChatID, Event: EventRenewed})
+	return true
 }
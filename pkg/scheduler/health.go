@@ -0,0 +1,73 @@
+package scheduler
+
+import (
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+const defaultHealthMargin = time.Hour
+
+// taskRuns holds when a task was registered and when its last run finished
+type taskRuns struct {
+	registered time.Time
+	lastRun    time.Time
+}
+
+// TaskHealth reports whether a task ran as often as its schedule says
+type TaskHealth struct {
+	Name     string `json:"name" example:"resetTraffic"`
+	Schedule string `json:"schedule" example:"@daily"`
+	// LastRun is when the last scheduled run finished, null before the first one
+	LastRun *time.Time `json:"last_run"`
+	// Deadline is when the next run is due, plus the margin
+	Deadline time.Time `json:"deadline"`
+	Healthy  bool      `json:"healthy"`
+}
+
+// SchedulerHealth reports the scheduled tasks, healthy when none of them is past its deadline
+type SchedulerHealth struct {
+	Healthy bool         `json:"healthy"`
+	Tasks   []TaskHealth `json:"tasks"`
+}
+
+// recordRun stores when a scheduled run of the task finished
+func (s *Scheduler) recordRun(name string, at time.Time) {
+	s.runsMu.Lock()
+	defer s.runsMu.Unlock()
+	s.runs[name].lastRun = at
+}
+
+// Health reports the tasks whose next scheduled run is overdue by more than HealthMargin and Jitter,
+// e.g. because a run is stuck and the following ones are skipped.
+// A task that has not run yet is measured from its registration.
+func (s *Scheduler) Health() SchedulerHealth {
+	now := time.Now()
+	margin := s.HealthMargin + s.Jitter
+
+	health := SchedulerHealth{Healthy: true, Tasks: make([]TaskHealth, 0, len(s.tasks))}
+	for _, task := range s.tasks {
+		schedule, err := cron.Parse(task.Schedule)
+		if err != nil {
+			// Never added to cron, see RegisterTask
+			continue
+		}
+
+		s.runsMu.Lock()
+		runs := *s.runs[task.Name]
+		s.runsMu.Unlock()
+
+		taskHealth := TaskHealth{Name: task.Name, Schedule: task.Schedule}
+		since := runs.registered
+		if !runs.lastRun.IsZero() {
+			since = runs.lastRun
+			taskHealth.LastRun = &runs.lastRun
+		}
+		taskHealth.Deadline = schedule.Next(since).Add(margin)
+		taskHealth.Healthy = now.Before(taskHealth.Deadline)
+
+		health.Healthy = health.Healthy && taskHealth.Healthy
+		health.Tasks = append(health.Tasks, taskHealth)
+	}
+	return health
+}
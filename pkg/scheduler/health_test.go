@@ -0,0 +1,44 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+func TestHealth(t *testing.T) {
+	s := &Scheduler{cron: cron.New(), HealthMargin: time.Minute}
+	s.RegisterTask("fresh", "@daily", func() {})
+	s.RegisterTask("stale", "@hourly", func() {})
+
+	health := s.Health()
+	if !health.Healthy || len(health.Tasks) != 2 {
+		t.Fatalf("Expected 2 healthy tasks after registration, got: %+v", health)
+	}
+	if health.Tasks[0].LastRun != nil {
+		t.Fatalf("Expected no last run before the first run, got: %v", health.Tasks[0].LastRun)
+	}
+
+	s.tasks[0].Run()
+	// The stale task last ran two hours ago and missed its hourly run
+	s.recordRun("stale", time.Now().Add(-2*time.Hour))
+
+	health = s.Health()
+	if health.Healthy {
+		t.Fatalf("Expected the scheduler to be unhealthy, got: %+v", health)
+	}
+	fresh, stale := health.Tasks[0], health.Tasks[1]
+	if !fresh.Healthy || fresh.LastRun == nil || time.Since(*fresh.LastRun) > time.Minute {
+		t.Fatalf("Expected the fresh task to be healthy with a recent run, got: %+v", fresh)
+	}
+	if stale.Healthy || !stale.Deadline.Before(time.Now()) {
+		t.Fatalf("Expected the stale task to be past its deadline, got: %+v", stale)
+	}
+
+	// Jitter delays runs, so it extends the deadline
+	s.Jitter = 2 * time.Hour
+	if health := s.Health(); !health.Healthy {
+		t.Fatalf("Expected the jitter to cover the late run, got: %+v", health)
+	}
+}
@@ -0,0 +1,75 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+const (
+	// EventExpired is sent when a subscription is marked inactive
+	EventExpired = "expired"
+	// EventRenewed is sent when an expired subscription with auto-renew is rolled forward
+	EventRenewed = "renewed"
+	// EventQuotaExceeded is sent when an active user has used more traffic than TRAFFIC_QUOTA_MB
+	EventQuotaExceeded = "quota_exceeded"
+	// EventTrafficReset is sent once after traffic was reset, listing every reset user in Users
+	EventTrafficReset = "traffic_reset"
+
+	notifyTimeout = webhookAttempts * webhookTimeout
+)
+
+// Event is a notification about a user raised by the scheduler tasks.
+// Events about many users at once leave Username and ChatID empty and list the users in Users instead.
+type Event struct {
+	Username string      `json:"username"`
+	ChatID   int64       `json:"chat_id"`
+	Event    string      `json:"event"`
+	Traffic  float64     `json:"traffic,omitempty"`
+	Users    []EventUser `json:"users,omitempty"`
+}
+
+// EventUser is one of the users an event is about
+type EventUser struct {
+	Username string `json:"username"`
+	ChatID   int64  `json:"chat_id"`
+}
+
+// subject describes who the event is about for log messages
+func (e Event) subject() string {
+	if e.Users != nil {
+		return fmt.Sprintf("%d users", len(e.Users))
+	}
+	return fmt.Sprintf("user %s (chat %d)", e.Username, e.ChatID)
+}
+
+// Notifier delivers events to a notification sink such as a log, a webhook or a chat bot
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// LogNotifier writes events to the standard logger
+type LogNotifier struct{}
+
+// Notify logs the event
+func (LogNotifier) Notify(ctx context.Context, event Event) error {
+	log.Printf("Notification %s for %s", event.Event, event.subject())
+	return nil
+}
+
+// AddNotifier registers a notifier receiving the events of all later task runs
+func (s *Scheduler) AddNotifier(notifier Notifier) {
+	s.notifiers = append(s.notifiers, notifier)
+}
+
+// notify delivers the event to every notifier, each with its own timeout.
+// Delivery is best-effort: failures are logged and never stop the task.
+func (s *Scheduler) notify(event Event) {
+	for _, notifier := range s.notifiers {
+		ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+		if err := notifier.Notify(ctx, event); err != nil {
+			log.Printf("Failed to deliver %s notification for %s: %v", event.Event, event.subject(), err)
+		}
+		cancel()
+	}
+}
@@ -0,0 +1,151 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+)
+
+// recordingNotifier keeps the events it is notified about
+type recordingNotifier struct {
+	events []Event
+	err    error
+}
+
+func (r *recordingNotifier) Notify(ctx context.Context, event Event) error {
+	r.events = append(r.events, event)
+	return r.err
+}
+
+func TestNotifiers(t *testing.T) {
+	overQuota := db.User{
+		Username: "heavy",
+		ChatID:   777,
+		Traffic:  150,
+		Subscription: db.Subscription{
+			SubscriptionStatus: db.StatusActive,
+			EndSubscription:    time.Now().Add(time.Hour),
+		},
+	}
+	// Expired users are deactivated first, so they are not reported over quota
+	expiredOverQuota := db.User{
+		Username: "expired-heavy",
+		ChatID:   888,
+		Traffic:  150,
+		Subscription: db.Subscription{
+			SubscriptionStatus: db.StatusActive,
+			EndSubscription:    time.Now().Add(-time.Hour),
+		},
+	}
+
+	type testCase struct {
+		name       string
+		dryRun     bool
+		quota      float64
+		wantEvents []Event
+	}
+
+	testCases := []testCase{
+		{
+			name: "ExpiredOnly",
+			wantEvents: []Event{
+				{Username: "expired", Event: EventExpired},
+				{Username: "expired-heavy", ChatID: 888, Event: EventExpired},
+			},
+		},
+		{
+			name:  "QuotaExceeded",
+			quota: 100,
+			wantEvents: []Event{
+				{Username: "expired", Event: EventExpired},
+				{Username: "expired-heavy", ChatID: 888, Event: EventExpired},
+				{Username: "heavy", ChatID: 777, Event: EventQuotaExceeded, Traffic: 150},
+			},
+		},
+		{name: "DryRun", dryRun: true, quota: 100},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			failing := &recordingNotifier{err: errors.New("unavailable")}
+			recorder := &recordingNotifier{}
+			store := newFakeStore(append(testUsers(), overQuota, expiredOverQuota)...)
+			s := &Scheduler{db: store, DryRun: tc.dryRun, TrafficQuotaMB: tc.quota}
+			s.AddNotifier(failing)
+			s.AddNotifier(recorder)
+
+			s.checkAndUpdateSubscriptions()
+
+			// A failing notifier does not keep the event from the others
+			if len(failing.events) != len(tc.wantEvents) || len(recorder.events) != len(tc.wantEvents) {
+				t.Fatalf("Expected events: %+v, got: %+v and %+v", tc.wantEvents, failing.events, recorder.events)
+			}
+			for i, want := range tc.wantEvents {
+				if !reflect.DeepEqual(recorder.events[i], want) {
+					t.Fatalf("Expected event %d: %+v, got: %+v", i, want, recorder.events[i])
+				}
+			}
+		})
+	}
+}
+
+func TestLogNotifier(t *testing.T) {
+	if err := (LogNotifier{}).Notify(context.Background(), Event{Username: "user", Event: EventExpired}); err != nil {
+		t.Fatalf("Expected no error: %v", err)
+	}
+}
+
+func TestTrafficResetNotification(t *testing.T) {
+	t.Setenv("RESET_STATE_FILE", filepath.Join(t.TempDir(), "last_reset_time.txt"))
+
+	users := []db.User{
+		{Username: "alice", ChatID: 111, Traffic: 10},
+		{Username: "bobby", ChatID: 222, Traffic: 20},
+		{Username: "carol", ChatID: 333},
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DryRun=%v", dryRun), func(t *testing.T) {
+			recorder := &recordingNotifier{}
+			s := &Scheduler{db: newFakeStore(users...), DryRun: dryRun}
+			s.AddNotifier(recorder)
+
+			s.ResetTraffic()
+
+			if dryRun {
+				if len(recorder.events) != 0 {
+					t.Fatalf("Expected no events in dry run, got: %+v", recorder.events)
+				}
+				return
+			}
+
+			// All reset users arrive in one event
+			want := []Event{{
+				Event: EventTrafficReset,
+				Users: []EventUser{
+					{Username: "alice", ChatID: 111},
+					{Username: "bobby", ChatID: 222},
+					{Username: "carol", ChatID: 333},
+				},
+			}}
+			if !reflect.DeepEqual(recorder.events, want) {
+				t.Fatalf("Expected events: %+v, got: %+v", want, recorder.events)
+			}
+		})
+	}
+
+	// Nothing to reset sends nothing
+	recorder := &recordingNotifier{}
+	s := &Scheduler{db: newFakeStore()}
+	s.AddNotifier(recorder)
+	s.ResetTraffic()
+	if len(recorder.events) != 0 {
+		t.Fatalf("Expected no events without users, got: %+v", recorder.events)
+	}
+}
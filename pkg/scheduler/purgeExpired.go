@@ -0,0 +1,98 @@
+package scheduler
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+)
+
+// PurgeSummary lists the users a purge deleted, or would delete in dry-run mode,
+// and those that could not be read or deleted
+type PurgeSummary struct {
+	DryRun  bool     `json:"dry_run"`
+	Purged  []string `json:"purged"`
+	Errored []string `json:"errored"`
+}
+
+func (s *Scheduler) purgeExpiredUsers() PurgeSummary {
+	summary := PurgeSummary{DryRun: s.DryRun, Purged: []string{}, Errored: []string{}}
+	if s.PurgeRetention <= 0 {
+		log.Println("Skipping purge of expired users, PURGE_EXPIRED_RETENTION is not set")
+		return summary
+	}
+	defer func() {
+		log.Printf("Purge of expired users finished: purged=%d errored=%d dry_run=%t",
+			len(summary.Purged), len(summary.Errored), summary.DryRun)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+
+	usernames, err := s.db.UsernamesByStatus(ctx, db.StatusInactive)
+	if err != nil {
+		log.Printf("Failed to fetch inactive usernames: %v", err)
+		return summary
+	}
+
+	cutoff := time.Now().Add(-s.PurgeRetention)
+	for _, username := range usernames {
+		user, err := s.db.User(ctx, username)
+		if err != nil {
+			log.Printf("Failed to get user %s: %v", username, err)
+			summary.Errored = append(summary.Errored, username)
+			continue
+		}
+		history, err := s.db.SubscriptionHistory(ctx, username)
+		if err != nil {
+			log.Printf("Failed to get subscription history of user %s: %v", username, err)
+			summary.Errored = append(summary.Errored, username)
+			continue
+		}
+
+		// Users whose subscription left no trace of when it ended are kept
+		since := inactiveSince(user, history)
+		if since.IsZero() || !since.Before(cutoff) {
+			continue
+		}
+
+		if s.DryRun {
+			log.Printf("Dry run: would purge user %s, inactive since %s", username, since.Format(time.RFC3339))
+			summary.Purged = append(summary.Purged, username)
+			continue
+		}
+		if err := s.db.DeleteUser(ctx, username); err != nil {
+			log.Printf("Failed to purge user %s: %v", username, err)
+			summary.Errored = append(summary.Errored, username)
+			continue
+		}
+		log.Printf("Purged user %s, inactive since %s", username, since.Format(time.RFC3339))
+		summary.Purged = append(summary.Purged, username)
+	}
+
+	return summary
+}
+
+// inactiveSince returns the last time the inactive user's subscription was known to be in use:
+// the latest of its last status change, its end, its start and the user's registration.
+// It is zero when none of them is known.
+func inactiveSince(user *db.User, history []db.SubscriptionChange) time.Time {
+	var since time.Time
+	latest := func(t time.Time) {
+		if t.After(since) {
+			since = t
+		}
+	}
+
+	// History is ordered newest first
+	if len(history) > 0 {
+		latest(history[0].ChangedAt)
+	}
+	latest(user.Subscription.EndSubscription)
+	latest(user.Subscription.StartSubscription)
+	if user.CreatedAt != nil {
+		latest(*user.CreatedAt)
+	}
+	return since
+}
@@ -0,0 +1,126 @@
+package scheduler
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+)
+
+func TestPurgeExpiredUsers(t *testing.T) {
+	now := time.Now()
+	retention := 30 * 24 * time.Hour
+	longAgo := now.Add(-2 * retention)
+	recently := now.Add(-retention / 2)
+
+	purgeUsers := func() []db.User {
+		return []db.User{
+			{
+				// Ended long ago
+				Username: "expired_long_ago",
+				Subscription: db.Subscription{
+					SubscriptionStatus: db.StatusInactive,
+					StartSubscription:  longAgo.AddDate(0, -1, 0),
+					EndSubscription:    longAgo,
+				},
+			},
+			{
+				// Ended within the retention period
+				Username: "expired_recently",
+				Subscription: db.Subscription{
+					SubscriptionStatus: db.StatusInactive,
+					StartSubscription:  longAgo,
+					EndSubscription:    recently,
+				},
+			},
+			{
+				// Deactivated recently, which cleared its end
+				Username: "deactivated_recently",
+				Subscription: db.Subscription{
+					SubscriptionStatus: db.StatusInactive,
+					StartSubscription:  longAgo,
+				},
+			},
+			{
+				// Never subscribed, registered long ago
+				Username: "never_subscribed",
+				Subscription: db.Subscription{
+					SubscriptionStatus: db.StatusInactive,
+					StartSubscription:  longAgo,
+				},
+			},
+			{
+				// Nothing tells when it ended
+				Username: "unknown",
+				Subscription: db.Subscription{
+					SubscriptionStatus: db.StatusInactive,
+				},
+			},
+			{
+				Username: "active",
+				Subscription: db.Subscription{
+					SubscriptionStatus: db.StatusActive,
+					StartSubscription:  longAgo,
+					EndSubscription:    longAgo,
+				},
+			},
+		}
+	}
+	history := map[string][]db.SubscriptionChange{
+		"deactivated_recently": {
+			{Username: "deactivated_recently", OldStatus: db.StatusActive, NewStatus: db.StatusInactive, ChangedAt: recently},
+			{Username: "deactivated_recently", OldStatus: db.StatusInactive, NewStatus: db.StatusActive, ChangedAt: longAgo},
+		},
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DryRun=%v", dryRun), func(t *testing.T) {
+			store := newFakeStore(purgeUsers()...)
+			store.history = history
+			s := &Scheduler{db: store, DryRun: dryRun, PurgeRetention: retention}
+
+			summary := s.purgeExpiredUsers()
+
+			want := []string{"expired_long_ago", "never_subscribed"}
+			if fmt.Sprint(summary.Purged) != fmt.Sprint(want) {
+				t.Fatalf("Expected purged: %v, got: %v", want, summary.Purged)
+			}
+			if len(summary.Errored) != 0 {
+				t.Fatalf("Expected no errors, got: %v", summary.Errored)
+			}
+
+			wantWrites, wantRemaining := 2, 4
+			if dryRun {
+				wantWrites, wantRemaining = 0, 6
+			}
+			if store.writes != wantWrites {
+				t.Fatalf("Expected writes: %d, got: %d", wantWrites, store.writes)
+			}
+			if len(store.users) != wantRemaining {
+				t.Fatalf("Expected %d users left, got: %d", wantRemaining, len(store.users))
+			}
+		})
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		store := newFakeStore(purgeUsers()...)
+		s := &Scheduler{db: store}
+
+		if summary := s.purgeExpiredUsers(); len(summary.Purged) != 0 || store.writes != 0 {
+			t.Fatalf("Expected nothing purged without a retention period, got: %v", summary.Purged)
+		}
+	})
+
+	t.Run("Errored", func(t *testing.T) {
+		store := newFakeStore(purgeUsers()...)
+		store.history = history
+		store.failUpdates = map[string]bool{"never_subscribed": true}
+		s := &Scheduler{db: store, PurgeRetention: retention}
+
+		summary := s.purgeExpiredUsers()
+		if len(summary.Purged) != 1 || len(summary.Errored) != 1 || summary.Errored[0] != "never_subscribed" {
+			t.Fatalf("Expected purged: [expired_long_ago] and errored: [never_subscribed], got: %v and %v", summary.Purged, summary.Errored)
+		}
+	})
+}
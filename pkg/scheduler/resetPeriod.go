@@ -0,0 +1,57 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+)
+
+// Names of the reset periods accepted in TRAFFIC_RESET_PERIOD
+const (
+	resetPeriodDaily   = "daily"
+	resetPeriodWeekly  = "weekly"
+	resetPeriodMonthly = "monthly"
+)
+
+// ResetPeriod decides how often traffic is reset.
+// Traffic is reset once the last reset lies before the start of the current period.
+type ResetPeriod interface {
+	// Start returns the start of the period containing t, in the location of t
+	Start(t time.Time) time.Time
+}
+
+// DailyReset resets traffic at midnight
+type DailyReset struct{}
+
+func (DailyReset) Start(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
+
+// WeeklyReset resets traffic at midnight between Sunday and Monday
+type WeeklyReset struct{}
+
+func (WeeklyReset) Start(t time.Time) time.Time {
+	// Days since Monday, with Sunday as the last day of the week
+	sinceMonday := (int(t.Weekday()) + 6) % 7
+	return DailyReset{}.Start(t).AddDate(0, 0, -sinceMonday)
+}
+
+// MonthlyReset resets traffic at midnight on the first day of the month
+type MonthlyReset struct{}
+
+func (MonthlyReset) Start(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, t.Location())
+}
+
+// resetPeriodFromName returns the reset period named by TRAFFIC_RESET_PERIOD, monthly when the name is empty
+func resetPeriodFromName(name string) (ResetPeriod, error) {
+	switch name {
+	case resetPeriodDaily:
+		return DailyReset{}, nil
+	case resetPeriodWeekly:
+		return WeeklyReset{}, nil
+	case resetPeriodMonthly, "":
+		return MonthlyReset{}, nil
+	default:
+		return nil, fmt.Errorf("unknown reset period %q: must be %s, %s or %s", name, resetPeriodDaily, resetPeriodWeekly, resetPeriodMonthly)
+	}
+}
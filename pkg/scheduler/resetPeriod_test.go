@@ -0,0 +1,62 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResetDue(t *testing.T) {
+	// A Friday, so the week started on Monday the 9th
+	now := time.Date(2024, time.September, 13, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		period    ResetPeriod
+		lastReset time.Time
+		now       time.Time
+		want      bool
+	}{
+		{"daily same day", DailyReset{}, time.Date(2024, time.September, 13, 0, 0, 0, 0, time.UTC), now, false},
+		{"daily just before midnight", DailyReset{}, time.Date(2024, time.September, 12, 23, 59, 0, 0, time.UTC), now, true},
+		{"daily at midnight", DailyReset{}, time.Date(2024, time.September, 13, 23, 59, 0, 0, time.UTC), time.Date(2024, time.September, 14, 0, 0, 0, 0, time.UTC), true},
+		{"weekly same week", WeeklyReset{}, time.Date(2024, time.September, 9, 0, 0, 0, 0, time.UTC), now, false},
+		{"weekly previous Sunday", WeeklyReset{}, time.Date(2024, time.September, 8, 23, 59, 0, 0, time.UTC), now, true},
+		{"weekly on Sunday", WeeklyReset{}, time.Date(2024, time.September, 9, 0, 0, 0, 0, time.UTC), time.Date(2024, time.September, 15, 23, 59, 0, 0, time.UTC), false},
+		{"weekly at Monday midnight", WeeklyReset{}, time.Date(2024, time.September, 15, 23, 59, 0, 0, time.UTC), time.Date(2024, time.September, 16, 0, 0, 0, 0, time.UTC), true},
+		{"monthly same month", MonthlyReset{}, time.Date(2024, time.September, 1, 0, 0, 0, 0, time.UTC), now, false},
+		{"monthly previous month", MonthlyReset{}, time.Date(2024, time.August, 31, 23, 59, 0, 0, time.UTC), now, true},
+		{"monthly at the first", MonthlyReset{}, time.Date(2024, time.September, 30, 23, 59, 0, 0, time.UTC), time.Date(2024, time.October, 1, 0, 0, 0, 0, time.UTC), true},
+		{"monthly across years", MonthlyReset{}, time.Date(2023, time.December, 31, 12, 0, 0, 0, time.UTC), time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC), true},
+		{"monthly when unset", nil, time.Date(2024, time.August, 31, 23, 59, 0, 0, time.UTC), now, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Scheduler{ResetPeriod: tt.period}
+			if got := s.resetDue(tt.lastReset, tt.now); got != tt.want {
+				t.Fatalf("Expected reset due: %v, got: %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestResetPeriodFromName(t *testing.T) {
+	tests := map[string]ResetPeriod{
+		"":        MonthlyReset{},
+		"monthly": MonthlyReset{},
+		"weekly":  WeeklyReset{},
+		"daily":   DailyReset{},
+	}
+	for name, want := range tests {
+		period, err := resetPeriodFromName(name)
+		if err != nil {
+			t.Fatalf("Failed to parse reset period %q: %v", name, err)
+		}
+		if period != want {
+			t.Fatalf("Expected reset period: %T, got: %T", want, period)
+		}
+	}
+
+	if _, err := resetPeriodFromName("hourly"); err == nil {
+		t.Fatalf("Expected an error for an unknown reset period")
+	}
+}
@@ -2,58 +2,219 @@ package scheduler
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
 	"time"
 )
 
-const resetTrafficFilePath = "docs/last_reset_time.txt" // file path to store the last reset time
+// defaultResetStateFile stores the last reset time when RESET_STATE_FILE is not set
+const defaultResetStateFile = "data/last_reset_time.txt"
 
-func (s *Scheduler) checkAndResetTraffic() {
+// resetStateFile returns the path of the file storing the last reset time, set by RESET_STATE_FILE
+func resetStateFile() string {
+	if path := os.Getenv("RESET_STATE_FILE"); path != "" {
+		return path
+	}
+	return defaultResetStateFile
+}
+
+// TrafficResetSummary lists the users whose traffic a run reset, or would reset in dry-run mode
+type TrafficResetSummary struct {
+	DryRun bool     `json:"dry_run"`
+	Reset  []string `json:"reset"`
+}
+
+func (s *Scheduler) checkAndResetTraffic() TrafficResetSummary {
 	now := time.Now()
 	lastResetTime, err := LastResetTimeFromFile()
 	if err != nil {
-		log.Printf("Failed to read last reset time: %v", err)
-		return
+		// Keep resetting traffic on schedule even when the state file cannot be used
+		log.Printf("Failed to read last reset time, using the one kept in memory: %v", err)
+		lastResetTime = s.lastResetInMemory(now)
 	}
 
-	// Check if the month has changed
-	if lastResetTime.Year() != now.Year() || lastResetTime.Month() != now.Month() {
+	if s.resetDue(lastResetTime, now) {
 		log.Println("Starts reset user's traffic")
-		// Reset traffic for all users
-		s.resetAllUserTraffic()
+		return s.resetTrafficNow()
+	}
+
+	return TrafficResetSummary{DryRun: s.DryRun, Reset: []string{}}
+}
+
+// ResetPreview describes the next traffic reset.
+// LastReset is missing when no reset was recorded yet, in which case the period is counted from the first check.
+type ResetPreview struct {
+	Users     int        `json:"users" example:"150"`
+	Due       bool       `json:"due"`
+	LastReset *time.Time `json:"last_reset,omitempty"`
+	NextReset time.Time  `json:"next_reset"`
+}
 
-		// Update last reset time to the first day of the current month
-		newResetTime := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, time.Local)
-		if err := UpdateLastResetTimeInFile(newResetTime); err != nil {
-			log.Printf("Failed to update last reset time: %v", err)
+// PreviewReset reports how many users the next scheduled traffic reset would reset and when it runs,
+// without resetting anything or creating the state file
+func (s *Scheduler) PreviewReset(ctx context.Context) (ResetPreview, error) {
+	now := time.Now()
+	preview := ResetPreview{}
+
+	lastReset, err := readLastResetTime(resetStateFile())
+	switch {
+	case err == nil:
+		preview.LastReset = &lastReset
+	case errors.Is(err, os.ErrNotExist):
+		// The first check starts counting from then, as if traffic had just been reset
+		lastReset = now
+	default:
+		log.Printf("Failed to read last reset time, using the one kept in memory: %v", err)
+		s.resetMu.Lock()
+		lastReset = s.lastReset
+		s.resetMu.Unlock()
+		if lastReset.IsZero() {
+			lastReset = now
 		} else {
-			log.Println("Successful update last reset time")
+			preview.LastReset = &lastReset
 		}
 	}
+
+	// The check runs daily at midnight, so a due reset happens at the next one
+	preview.Due = s.resetDue(lastReset, now)
+	if preview.Due {
+		preview.NextReset = DailyReset{}.Start(now).AddDate(0, 0, 1)
+	} else {
+		preview.NextReset = nextPeriodStart(s.resetPeriod(), now)
+	}
+
+	usernames, err := s.db.AllUsername(ctx)
+	if err != nil {
+		return ResetPreview{}, fmt.Errorf("failed to get all users: %w", err)
+	}
+	preview.Users = len(usernames)
+	return preview, nil
+}
+
+// nextPeriodStart returns the start of the reset period following the one containing now
+func nextPeriodStart(period ResetPeriod, now time.Time) time.Time {
+	current := period.Start(now)
+	day := DailyReset{}.Start(now).AddDate(0, 0, 1)
+	for !period.Start(day).After(current) {
+		day = day.AddDate(0, 0, 1)
+	}
+	return period.Start(day)
 }
 
-func (s *Scheduler) resetAllUserTraffic() {
+// resetPeriod returns the configured reset period, monthly when none is set
+func (s *Scheduler) resetPeriod() ResetPeriod {
+	if s.ResetPeriod == nil {
+		return MonthlyReset{}
+	}
+	return s.ResetPeriod
+}
+
+// resetDue reports whether the last reset was before the start of the current reset period
+func (s *Scheduler) resetDue(lastReset, now time.Time) bool {
+	return lastReset.Before(s.resetPeriod().Start(now))
+}
+
+// ResetTraffic resets the traffic of all users now, regardless of when it was last reset,
+// and records the reset time. It returns ErrTaskRunning instead while a scheduled or on-demand reset is in progress.
+func (s *Scheduler) ResetTraffic() (TrafficResetSummary, error) {
+	var summary TrafficResetSummary
+	if !s.exclusive(resetTraffic, func() { summary = s.resetTrafficNow() }) {
+		return TrafficResetSummary{}, ErrTaskRunning
+	}
+	return summary, nil
+}
+
+// resetTrafficNow resets the traffic of all users and records the reset time
+func (s *Scheduler) resetTrafficNow() TrafficResetSummary {
+	// Reset traffic for all users
+	summary := TrafficResetSummary{DryRun: s.DryRun, Reset: s.resetAllUserTraffic()}
+	if s.DryRun {
+		return summary
+	}
+
+	// Record the reset time, truncated to the minute
+	now := time.Now()
+	newResetTime := time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), now.Minute(), 0, 0, time.Local)
+	s.setLastResetInMemory(newResetTime)
+	if err := UpdateLastResetTimeInFile(newResetTime); err != nil {
+		log.Printf("Failed to update last reset time, keeping it in memory: %v", err)
+	} else {
+		log.Println("Successful update last reset time")
+	}
+
+	return summary
+}
+
+// resetAllUserTraffic resets the traffic of every user and returns the usernames it reset.
+// The reset users are then sent to the notifiers in a single traffic_reset event.
+// In dry-run mode it only returns the usernames that would be reset.
+func (s *Scheduler) resetAllUserTraffic() []string {
+	reset := []string{}
+	notified := []EventUser{}
+
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	usernames, err := s.db.AllUsername(ctx)
 	if err != nil {
 		log.Printf("Failed to get all users: %v", err)
-		return
+		return reset
 	}
 	for _, username := range usernames {
+		if s.DryRun {
+			log.Printf("Dry run: would reset traffic for user %s", username)
+			reset = append(reset, username)
+			continue
+		}
 		if err := s.db.ResetUserTraffic(ctx, username); err != nil {
 			log.Printf("Failed to reset traffic for user %s: %v", username, err)
+			continue
 		}
+		reset = append(reset, username)
+
+		// The chat ID is only needed for the notification, so the reset stands without it
+		user, err := s.db.User(ctx, username)
+		if err != nil {
+			log.Printf("Failed to get chat ID of user %s, leaving them out of the notification: %v", username, err)
+			continue
+		}
+		notified = append(notified, EventUser{Username: username, ChatID: user.ChatID})
 	}
+
+	if len(notified) > 0 {
+		s.notify(Event{Event: EventTrafficReset, Users: notified})
+	}
+	return reset
 }
 
-// LastResetTimeFromFile reads the last reset time from a single file.
-// It returns the last reset time stored in the file. If the file does not exist, it returns the zero-fold value.
+// lastResetInMemory returns the last reset time kept in memory.
+// The first call without one starts counting from now, like a missing state file does.
+func (s *Scheduler) lastResetInMemory(now time.Time) time.Time {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	if s.lastReset.IsZero() {
+		s.lastReset = now
+	}
+	return s.lastReset
+}
+
+// setLastResetInMemory keeps the last reset time in memory in case the state file cannot be written
+func (s *Scheduler) setLastResetInMemory(t time.Time) {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	s.lastReset = t
+}
+
+// LastResetTimeFromFile reads the last reset time from the file named by RESET_STATE_FILE.
+// If the file does not exist, it is created with the current time, which is returned.
 func LastResetTimeFromFile() (time.Time, error) {
+	resetTrafficFilePath := resetStateFile()
 	if _, err := os.Stat(resetTrafficFilePath); os.IsNotExist(err) {
-		file, err := os.Create(resetTrafficFilePath)
+		file, err := createResetStateFile(resetTrafficFilePath)
 		if err != nil {
 			return time.Time{}, fmt.Errorf("failed to create file: %w", err)
 		}
@@ -70,7 +231,12 @@ func LastResetTimeFromFile() (time.Time, error) {
 		return time.Time{}, fmt.Errorf("failed to check file existence: %w", err)
 	}
 
-	file, err := os.Open(resetTrafficFilePath)
+	return readLastResetTime(resetTrafficFilePath)
+}
+
+// readLastResetTime reads the last reset time from the state file at path, an error wrapping os.ErrNotExist when there is none
+func readLastResetTime(path string) (time.Time, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return time.Time{}, fmt.Errorf("failed to open file: %w", err)
 	}
@@ -90,10 +256,9 @@ func LastResetTimeFromFile() (time.Time, error) {
 	return lastResetTime, nil
 }
 
-// UpdateLastResetTimeInFile updates the last reset time in the single file.
-// It writes the new last reset time to the file.
+// UpdateLastResetTimeInFile writes the last reset time to the file named by RESET_STATE_FILE.
 func UpdateLastResetTimeInFile(lastResetTime time.Time) error {
-	file, err := os.Create(resetTrafficFilePath)
+	file, err := createResetStateFile(resetStateFile())
 	if err != nil {
 		return fmt.Errorf("failed to create file: %w", err)
 	}
@@ -106,3 +271,11 @@ func UpdateLastResetTimeInFile(lastResetTime time.Time) error {
 
 	return nil
 }
+
+// createResetStateFile creates or truncates the state file at path together with its parent directories
+func createResetStateFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
@@ -0,0 +1,132 @@
+package scheduler
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResetStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "nested", "last_reset_time.txt")
+	t.Setenv("RESET_STATE_FILE", path)
+
+	// A missing file is created together with its directories and starts from now
+	before := time.Now().Add(-time.Second)
+	lastReset, err := LastResetTimeFromFile()
+	if err != nil {
+		t.Fatalf("Failed to read last reset time: %v", err)
+	}
+	if lastReset.Before(before) {
+		t.Fatalf("Expected last reset time to be now, got: %v", lastReset)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("Expected state file to be created: %v", err)
+	}
+
+	want := time.Date(2024, time.March, 1, 12, 30, 0, 0, time.UTC)
+	if err := UpdateLastResetTimeInFile(want); err != nil {
+		t.Fatalf("Failed to update last reset time: %v", err)
+	}
+	lastReset, err = LastResetTimeFromFile()
+	if err != nil {
+		t.Fatalf("Failed to read last reset time: %v", err)
+	}
+	if !lastReset.Equal(want) {
+		t.Fatalf("Expected last reset time: %v, got: %v", want, lastReset)
+	}
+}
+
+func TestResetTrafficWithoutStateFile(t *testing.T) {
+	// A regular file in place of the parent directory makes the state file impossible to create
+	blocker := filepath.Join(t.TempDir(), "readonly")
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatalf("Failed to create file: %v", err)
+	}
+	t.Setenv("RESET_STATE_FILE", filepath.Join(blocker, "last_reset_time.txt"))
+
+	store := newFakeStore(testUsers()...)
+	s := &Scheduler{db: store}
+
+	// The first run counts from now, like a new state file would
+	if reset := s.checkAndResetTraffic().Reset; len(reset) != 0 {
+		t.Fatalf("Expected no reset on the first run, got: %v", reset)
+	}
+
+	// A reset from an earlier month is still noticed through the time kept in memory
+	s.setLastResetInMemory(time.Now().AddDate(0, -1, 0))
+	if reset := s.checkAndResetTraffic().Reset; len(reset) != 3 {
+		t.Fatalf("Expected 3 users to be reset, got: %v", reset)
+	}
+	writes := store.writes
+
+	if reset := s.checkAndResetTraffic().Reset; len(reset) != 0 {
+		t.Fatalf("Expected no second reset in the same month, got: %v", reset)
+	}
+	if store.writes != writes {
+		t.Fatalf("Expected writes: %d, got: %d", writes, store.writes)
+	}
+}
+
+func TestPreviewReset(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "last_reset_time.txt")
+	t.Setenv("RESET_STATE_FILE", path)
+
+	store := newFakeStore(testUsers()...)
+	s := &Scheduler{db: store, ResetPeriod: MonthlyReset{}}
+	now := time.Now()
+	nextMonth := MonthlyReset{}.Start(now).AddDate(0, 1, 0)
+
+	// Without a state file nothing is due and the file is not created
+	preview, err := s.PreviewReset(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to preview reset: %v", err)
+	}
+	if preview.Users != 3 || preview.Due || preview.LastReset != nil || !preview.NextReset.Equal(nextMonth) {
+		t.Fatalf("Expected 3 users, not due, no last reset and next reset at %v, got: %+v", nextMonth, preview)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Expected no state file to be created, got: %v", err)
+	}
+
+	// A reset from last month is due at the next daily check
+	lastMonth := MonthlyReset{}.Start(now).AddDate(0, -1, 0)
+	if err := UpdateLastResetTimeInFile(lastMonth); err != nil {
+		t.Fatalf("Failed to update last reset time: %v", err)
+	}
+	preview, err = s.PreviewReset(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to preview reset: %v", err)
+	}
+	tomorrow := DailyReset{}.Start(now).AddDate(0, 0, 1)
+	if !preview.Due || preview.LastReset == nil || !preview.LastReset.Equal(lastMonth) || !preview.NextReset.Equal(tomorrow) {
+		t.Fatalf("Expected due reset at %v after %v, got: %+v", tomorrow, lastMonth, preview)
+	}
+
+	if store.writes != 0 {
+		t.Fatalf("Expected no writes, got: %d", store.writes)
+	}
+	if store.users["expired"].Traffic != 10 {
+		t.Fatalf("Expected traffic to be kept, got: %v", store.users["expired"].Traffic)
+	}
+}
+
+func TestNextPeriodStart(t *testing.T) {
+	// Wednesday
+	now := time.Date(2024, time.January, 31, 15, 0, 0, 0, time.UTC)
+	testCases := []struct {
+		period ResetPeriod
+		want   time.Time
+	}{
+		{period: DailyReset{}, want: time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{period: WeeklyReset{}, want: time.Date(2024, time.February, 5, 0, 0, 0, 0, time.UTC)},
+		{period: MonthlyReset{}, want: time.Date(2024, time.February, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tc := range testCases {
+		if got := nextPeriodStart(tc.period, now); !got.Equal(tc.want) {
+			t.Fatalf("Expected next start of %T: %v, got: %v", tc.period, tc.want, got)
+		}
+	}
+}
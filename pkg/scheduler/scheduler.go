@@ -1,7 +1,15 @@
 package scheduler
 
 import (
+	"context"
+	"errors"
 	"log"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/YuarenArt/tg-users-database/pkg/db"
 
@@ -11,13 +19,20 @@ import (
 const (
 	resetTraffic       = "resetTraffic"
 	checkSubscriptions = "checkSubscriptions"
+	purgeExpired       = "purgeExpired"
 )
 
+// Traffic is checked daily so that a reset happens on the day its period starts, see ResetPeriod.
+// The purge schedule can be changed with PURGE_EXPIRED_SCHEDULE.
 var schedulerPlans = map[string]string{
-	resetTraffic:       "@weekly",
+	resetTraffic:       "@daily",
 	checkSubscriptions: "@daily",
+	purgeExpired:       "@daily",
 }
 
+// ErrTaskRunning is returned when a task is run on demand while a run of it is still in progress
+var ErrTaskRunning = errors.New("task is already running")
+
 // Task represents a task to be executed by the scheduler
 type Task struct {
 	Name     string
@@ -25,19 +40,137 @@ type Task struct {
 	Run      func()
 }
 
+// userStore is the part of the database used by the scheduler tasks
+type userStore interface {
+	AllUsername(ctx context.Context) ([]string, error)
+	UsernamesByStatus(ctx context.Context, status db.SubscriptionStatus) ([]string, error)
+	User(ctx context.Context, username string) (*db.User, error)
+	UpdateUserSubscription(ctx context.Context, username string, newSubscription db.Subscription) error
+	ResetUserTraffic(ctx context.Context, username string) error
+	SubscriptionHistory(ctx context.Context, username string) ([]db.SubscriptionChange, error)
+	DeleteUser(ctx context.Context, username string) error
+}
+
 // Scheduler is a struct that holds the cron scheduler and a list of tasks
 type Scheduler struct {
-	cron  *cron.Cron
-	tasks []Task
-	db    *db.Database
+	cron      *cron.Cron
+	tasks     []Task
+	db        userStore
+	notifiers []Notifier
+
+	// DryRun makes the tasks log the changes they would make without writing them
+	DryRun bool
+	// ActiveOnly limits the subscription check to active subscriptions, so it only deactivates expired ones
+	ActiveOnly bool
+	// GracePeriod is how long after its end a subscription stays active before it is marked inactive
+	GracePeriod time.Duration
+	// TrafficQuotaMB is the traffic above which active users are reported as over quota, 0 turns the check off
+	TrafficQuotaMB float64
+	// ResetPeriod is how often traffic is reset, monthly when nil
+	ResetPeriod ResetPeriod
+	// Jitter is the longest random delay before a scheduled task starts, so instances sharing a database do not start together
+	Jitter time.Duration
+	// PurgeRetention is how long a subscription stays inactive before its user is deleted, 0 turns the purge off
+	PurgeRetention time.Duration
+	// PurgeSchedule is the cron schedule of the purge, the one in schedulerPlans when empty
+	PurgeSchedule string
+	// HealthMargin is how late a scheduled run may be before Health reports its task as stuck
+	HealthMargin time.Duration
+
+	// runs tracks the scheduled runs of every registered task, see Health
+	runsMu sync.Mutex
+	runs   map[string]*taskRuns
+
+	// running marks the tasks with a run in progress, scheduled or on demand
+	runningMu sync.Mutex
+	running   map[string]*atomic.Bool
+
+	// lastReset is the last traffic reset, used when the reset state file cannot be read or written
+	resetMu   sync.Mutex
+	lastReset time.Time
 }
 
-// NewScheduler creates a new Scheduler instance
+// NewScheduler creates a new Scheduler instance.
+// Dry-run mode is enabled by SCHEDULER_DRY_RUN=true and
+// SCHEDULER_ACTIVE_ONLY=true limits the subscription check to active users.
+// Events are logged and, when SUBSCRIPTION_WEBHOOK_URL is set, posted to it.
+// Active users over TRAFFIC_QUOTA_MB are reported with a quota_exceeded event.
+// Subscriptions are only marked inactive once SUBSCRIPTION_GRACE_PERIOD has passed since their end.
+// Scheduled tasks start after a random delay of up to SCHEDULER_JITTER.
+// Traffic is reset every TRAFFIC_RESET_PERIOD, which is daily, weekly or monthly (the default).
+// Users inactive for longer than PURGE_EXPIRED_RETENTION are deleted on PURGE_EXPIRED_SCHEDULE.
+// Tasks running later than SCHEDULER_HEALTH_MARGIN (1h by default) past their schedule are reported by Health.
 func NewScheduler(db *db.Database) *Scheduler {
+	dryRun, _ := strconv.ParseBool(os.Getenv("SCHEDULER_DRY_RUN"))
+	activeOnly, _ := strconv.ParseBool(os.Getenv("SCHEDULER_ACTIVE_ONLY"))
+	quota, _ := strconv.ParseFloat(os.Getenv("TRAFFIC_QUOTA_MB"), 64)
+	if dryRun {
+		log.Println("Scheduler runs in dry-run mode, no changes will be written")
+	}
+
+	var grace time.Duration
+	if value := os.Getenv("SUBSCRIPTION_GRACE_PERIOD"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			log.Printf("Invalid SUBSCRIPTION_GRACE_PERIOD %q, expiring subscriptions without grace period", value)
+		} else {
+			grace = parsed
+		}
+	}
+
+	var jitter time.Duration
+	if value := os.Getenv("SCHEDULER_JITTER"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			log.Printf("Invalid SCHEDULER_JITTER %q, starting tasks without delay", value)
+		} else {
+			jitter = parsed
+		}
+	}
+
+	var retention time.Duration
+	if value := os.Getenv("PURGE_EXPIRED_RETENTION"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			log.Printf("Invalid PURGE_EXPIRED_RETENTION %q, not purging expired users", value)
+		} else {
+			retention = parsed
+		}
+	}
+
+	healthMargin := defaultHealthMargin
+	if value := os.Getenv("SCHEDULER_HEALTH_MARGIN"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			log.Printf("Invalid SCHEDULER_HEALTH_MARGIN %q, using %s", value, defaultHealthMargin)
+		} else {
+			healthMargin = parsed
+		}
+	}
+
+	resetPeriod, err := resetPeriodFromName(os.Getenv("TRAFFIC_RESET_PERIOD"))
+	if err != nil {
+		log.Printf("Invalid TRAFFIC_RESET_PERIOD, resetting traffic monthly: %v", err)
+		resetPeriod = MonthlyReset{}
+	}
+
 	s := &Scheduler{
-		cron:  cron.New(),
-		tasks: []Task{},
-		db:    db,
+		cron:           cron.New(),
+		tasks:          []Task{},
+		db:             db,
+		notifiers:      []Notifier{LogNotifier{}},
+		DryRun:         dryRun,
+		ActiveOnly:     activeOnly,
+		GracePeriod:    grace,
+		TrafficQuotaMB: quota,
+		ResetPeriod:    resetPeriod,
+		Jitter:         jitter,
+		PurgeRetention: retention,
+		PurgeSchedule:  os.Getenv("PURGE_EXPIRED_SCHEDULE"),
+		HealthMargin:   healthMargin,
+	}
+	if url := os.Getenv("SUBSCRIPTION_WEBHOOK_URL"); url != "" {
+		s.AddNotifier(NewWebhookNotifier(url))
 	}
 
 	// Initialize and register tasks
@@ -59,31 +192,83 @@ func (s *Scheduler) Stop() {
 // initializeTasks registers provided tasks using the schedulerPlans map
 func (s *Scheduler) initializeTasks() {
 	for name, schedule := range schedulerPlans {
+		if name == purgeExpired && s.PurgeSchedule != "" {
+			schedule = s.PurgeSchedule
+		}
 		s.RegisterTask(name, schedule, s.getTaskRunFunction(name))
 	}
 }
 
-// RegisterTask adds a task to the scheduler
+// RegisterTask adds a task to the scheduler.
+// A run is skipped while the previous run of the task is still in progress.
 func (s *Scheduler) RegisterTask(name, schedule string, run func()) {
+	s.runsMu.Lock()
+	if s.runs == nil {
+		s.runs = map[string]*taskRuns{}
+	}
+	s.runs[name] = &taskRuns{registered: time.Now()}
+	s.runsMu.Unlock()
+
 	task := Task{
 		Name:     name,
 		Schedule: schedule,
-		Run:      run,
+		Run:      s.guard(name, run),
 	}
 	s.tasks = append(s.tasks, task)
 
-	if err := s.cron.AddFunc(schedule, run); err != nil {
+	if err := s.cron.AddFunc(schedule, task.Run); err != nil {
 		log.Printf("Failed to add task %s to the scheduler: %v", name, err)
 	}
 }
 
+// guard wraps run so that it is skipped while another run of the task, scheduled or on demand, is in progress
+// and starts after a random delay of up to Jitter. Finished runs are recorded for Health.
+func (s *Scheduler) guard(name string, run func()) func() {
+	return func() {
+		ran := s.exclusive(name, func() {
+			if s.Jitter > 0 {
+				time.Sleep(time.Duration(rand.Int63n(int64(s.Jitter))))
+			}
+			run()
+			s.recordRun(name, time.Now())
+		})
+		if !ran {
+			log.Printf("Skipping task %s, its previous run is still in progress", name)
+		}
+	}
+}
+
+// exclusive calls run unless a run of the task is already in progress and reports whether it did
+func (s *Scheduler) exclusive(name string, run func()) bool {
+	s.runningMu.Lock()
+	if s.running == nil {
+		s.running = map[string]*atomic.Bool{}
+	}
+	running, ok := s.running[name]
+	if !ok {
+		running = &atomic.Bool{}
+		s.running[name] = running
+	}
+	s.runningMu.Unlock()
+
+	if !running.CompareAndSwap(false, true) {
+		return false
+	}
+	defer running.Store(false)
+
+	run()
+	return true
+}
+
 // getTaskRunFunction returns the appropriate function to run based on the task name
 func (s *Scheduler) getTaskRunFunction(name string) func() {
 	switch name {
 	case resetTraffic:
-		return s.checkAndResetTraffic
+		return func() { s.checkAndResetTraffic() }
 	case checkSubscriptions:
-		return s.checkAndUpdateSubscriptions
+		return func() { s.checkAndUpdateSubscriptions() }
+	case purgeExpired:
+		return func() { s.purgeExpiredUsers() }
 	default:
 		return func() {
 			log.Printf("No task function found for %s", name)
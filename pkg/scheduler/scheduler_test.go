@@ -0,0 +1,471 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+
+	"github.com/robfig/cron"
+)
+
+// fakeStore keeps users in memory and counts the writes made by the scheduler
+type fakeStore struct {
+	users       map[string]*db.User
+	writes      int
+	failUpdates map[string]bool // usernames whose subscription updates fail
+	history     map[string][]db.SubscriptionChange
+}
+
+func newFakeStore(users ...db.User) *fakeStore {
+	store := &fakeStore{users: map[string]*db.User{}}
+	for i := range users {
+		store.users[users[i].Username] = &users[i]
+	}
+	return store
+}
+
+func (f *fakeStore) AllUsername(ctx context.Context) ([]string, error) {
+	usernames := []string{}
+	for username := range f.users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+	return usernames, nil
+}
+
+func (f *fakeStore) UsernamesByStatus(ctx context.Context, status db.SubscriptionStatus) ([]string, error) {
+	usernames := []string{}
+	for username, user := range f.users {
+		if user.Subscription.SubscriptionStatus == status {
+			usernames = append(usernames, username)
+		}
+	}
+	sort.Strings(usernames)
+	return usernames, nil
+}
+
+func (f *fakeStore) User(ctx context.Context, username string) (*db.User, error) {
+	user, ok := f.users[username]
+	if !ok {
+		return nil, fmt.Errorf("user %s not found", username)
+	}
+	copied := *user
+	return &copied, nil
+}
+
+func (f *fakeStore) UpdateUserSubscription(ctx context.Context, username string, newSubscription db.Subscription) error {
+	if f.failUpdates[username] {
+		return fmt.Errorf("update of user %s failed", username)
+	}
+	f.writes++
+	f.users[username].Subscription = newSubscription
+	return nil
+}
+
+func (f *fakeStore) ResetUserTraffic(ctx context.Context, username string) error {
+	f.writes++
+	f.users[username].Traffic = 0
+	return nil
+}
+
+func (f *fakeStore) SubscriptionHistory(ctx context.Context, username string) ([]db.SubscriptionChange, error) {
+	return f.history[username], nil
+}
+
+func (f *fakeStore) DeleteUser(ctx context.Context, username string) error {
+	if f.failUpdates[username] {
+		return fmt.Errorf("delete of user %s failed", username)
+	}
+	f.writes++
+	delete(f.users, username)
+	return nil
+}
+
+func testUsers() []db.User {
+	now := time.Now()
+	return []db.User{
+		{
+			Username: "expired",
+			Traffic:  10,
+			Subscription: db.Subscription{
+				SubscriptionStatus: db.StatusActive,
+				EndSubscription:    now.Add(-time.Hour),
+			},
+		},
+		{
+			Username: "paid",
+			Traffic:  20,
+			Subscription: db.Subscription{
+				SubscriptionStatus: db.StatusInactive,
+				EndSubscription:    now.Add(time.Hour),
+			},
+		},
+		{
+			Username: "unchanged",
+			Subscription: db.Subscription{
+				SubscriptionStatus: db.StatusActive,
+				EndSubscription:    now.Add(time.Hour),
+			},
+		},
+	}
+}
+
+func TestCheckAndUpdateSubscriptions(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DryRun=%v", dryRun), func(t *testing.T) {
+			store := newFakeStore(testUsers()...)
+			s := &Scheduler{db: store, DryRun: dryRun}
+
+			summary := s.checkAndUpdateSubscriptions()
+
+			if summary.DryRun != dryRun {
+				t.Fatalf("Expected dry run: %v, got: %v", dryRun, summary.DryRun)
+			}
+			if len(summary.Activated) != 1 || summary.Activated[0] != "paid" {
+				t.Fatalf("Expected activated: [paid], got: %v", summary.Activated)
+			}
+			if len(summary.Deactivated) != 1 || summary.Deactivated[0] != "expired" {
+				t.Fatalf("Expected deactivated: [expired], got: %v", summary.Deactivated)
+			}
+
+			wantWrites, wantStatus := 2, db.StatusInactive
+			if dryRun {
+				wantWrites, wantStatus = 0, db.StatusActive
+			}
+			if store.writes != wantWrites {
+				t.Fatalf("Expected writes: %d, got: %d", wantWrites, store.writes)
+			}
+			if got := store.users["expired"].Subscription.SubscriptionStatus; got != wantStatus {
+				t.Fatalf("Expected status of expired user: %s, got: %s", wantStatus, got)
+			}
+		})
+	}
+}
+
+func TestCheckAndUpdateSubscriptionsSummaryCounts(t *testing.T) {
+	now := time.Now()
+	broken := db.User{
+		Username: "broken",
+		Subscription: db.Subscription{
+			SubscriptionStatus: db.StatusActive,
+			EndSubscription:    now.Add(-time.Hour),
+		},
+	}
+	store := newFakeStore(append(testUsers(), broken)...)
+	store.failUpdates = map[string]bool{"broken": true}
+	s := &Scheduler{db: store}
+
+	summary := s.checkAndUpdateSubscriptions()
+
+	if len(summary.Activated) != 1 || summary.Activated[0] != "paid" {
+		t.Fatalf("Expected activated: [paid], got: %v", summary.Activated)
+	}
+	if len(summary.Deactivated) != 1 || summary.Deactivated[0] != "expired" {
+		t.Fatalf("Expected deactivated: [expired], got: %v", summary.Deactivated)
+	}
+	if summary.Skipped != 1 {
+		t.Fatalf("Expected skipped: 1, got: %d", summary.Skipped)
+	}
+	if len(summary.Errored) != 1 || summary.Errored[0] != "broken" {
+		t.Fatalf("Expected errored: [broken], got: %v", summary.Errored)
+	}
+}
+
+func TestCheckAndUpdateSubscriptionsAutoRenew(t *testing.T) {
+	now := time.Now()
+	end := now.Add(-time.Hour)
+	// The fake store keeps pointers into the slice, so every run gets its own users
+	users := func() []db.User {
+		return []db.User{
+			{Username: "renewing", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: end.AddDate(0, 0, -30), EndSubscription: end, AutoRenew: true}},
+			{Username: "lapsing", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", StartSubscription: end.AddDate(0, 0, -30), EndSubscription: end}},
+			// Missed several weekly renewals, e.g. while the service was down
+			{Username: "behind", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "7d", EndSubscription: end.AddDate(0, 0, -20), AutoRenew: true}},
+			{Username: "unparsable", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "soon", EndSubscription: end, AutoRenew: true}},
+			// Not expired yet, so left alone
+			{Username: "current", Subscription: db.Subscription{SubscriptionStatus: db.StatusActive, Duration: "1 month", EndSubscription: now.Add(time.Hour), AutoRenew: true}},
+		}
+	}
+
+	for _, dryRun := range []bool{false, true} {
+		t.Run(fmt.Sprintf("DryRun=%v", dryRun), func(t *testing.T) {
+			store := newFakeStore(users()...)
+			notifier := &recordingNotifier{}
+			s := &Scheduler{db: store, DryRun: dryRun, notifiers: []Notifier{notifier}}
+
+			summary := s.checkAndUpdateSubscriptions()
+
+			sort.Strings(summary.Renewed)
+			if fmt.Sprint(summary.Renewed) != "[behind renewing]" {
+				t.Fatalf("Expected renewed: [behind renewing], got: %v", summary.Renewed)
+			}
+			if len(summary.Deactivated) != 1 || summary.Deactivated[0] != "lapsing" {
+				t.Fatalf("Expected deactivated: [lapsing], got: %v", summary.Deactivated)
+			}
+			if len(summary.Errored) != 1 || summary.Errored[0] != "unparsable" {
+				t.Fatalf("Expected errored: [unparsable], got: %v", summary.Errored)
+			}
+			if summary.Skipped != 1 {
+				t.Fatalf("Expected skipped: 1, got: %d", summary.Skipped)
+			}
+			if dryRun {
+				if store.writes != 0 {
+					t.Fatalf("Expected no writes in dry run, got: %d", store.writes)
+				}
+				return
+			}
+
+			renewing := store.users["renewing"].Subscription
+			if renewing.SubscriptionStatus != db.StatusActive || !renewing.StartSubscription.Equal(end) || !renewing.EndSubscription.Equal(end.AddDate(0, 0, 30)) {
+				t.Fatalf("Expected the subscription renewed from %v for 30 days, got: %+v", end, renewing)
+			}
+			behind := store.users["behind"].Subscription
+			if behind.SubscriptionStatus != db.StatusActive || !behind.EndSubscription.Equal(end.AddDate(0, 0, 1)) {
+				t.Fatalf("Expected the subscription renewed past now on its weekly dates, got: %+v", behind)
+			}
+			if got := store.users["lapsing"].Subscription.SubscriptionStatus; got != db.StatusInactive {
+				t.Fatalf("Expected the subscription without auto-renew to be inactive, got: %s", got)
+			}
+
+			renewedEvents := 0
+			for _, event := range notifier.events {
+				if event.Event == EventRenewed {
+					renewedEvents++
+				}
+			}
+			if renewedEvents != 2 {
+				t.Fatalf("Expected 2 renewed events, got: %v", notifier.events)
+			}
+		})
+	}
+}
+
+func TestCheckAndUpdateSubscriptionsForever(t *testing.T) {
+	forever := db.User{
+		Username: "forever",
+		Subscription: db.Subscription{
+			SubscriptionStatus: db.StatusActive,
+			Duration:           db.DurationForever,
+			StartSubscription:  time.Now().AddDate(-1, 0, 0),
+		},
+	}
+	store := newFakeStore(append(testUsers(), forever)...)
+	s := &Scheduler{db: store}
+
+	summary := s.checkAndUpdateSubscriptions()
+
+	for _, username := range summary.Deactivated {
+		if username == "forever" {
+			t.Fatalf("Expected forever user not to be deactivated, got: %v", summary.Deactivated)
+		}
+	}
+	if got := store.users["forever"].Subscription; got.SubscriptionStatus != db.StatusActive || !got.EndSubscription.IsZero() {
+		t.Fatalf("Expected forever subscription to be untouched, got: %+v", got)
+	}
+}
+
+func TestCheckAndUpdateSubscriptionsGracePeriod(t *testing.T) {
+	now := time.Now()
+	expiredFor := func(username string, d time.Duration) db.User {
+		return db.User{
+			Username: username,
+			Subscription: db.Subscription{
+				SubscriptionStatus: db.StatusActive,
+				EndSubscription:    now.Add(-d),
+			},
+		}
+	}
+	store := newFakeStore(expiredFor("withinGrace", time.Hour), expiredFor("pastGrace", 3*time.Hour))
+	s := &Scheduler{db: store, GracePeriod: 2 * time.Hour}
+
+	summary := s.checkAndUpdateSubscriptions()
+
+	if len(summary.Deactivated) != 1 || summary.Deactivated[0] != "pastGrace" {
+		t.Fatalf("Expected deactivated: [pastGrace], got: %v", summary.Deactivated)
+	}
+	if got := store.users["withinGrace"].Subscription.SubscriptionStatus; got != db.StatusActive {
+		t.Fatalf("Expected subscription within the grace period to stay active, got: %s", got)
+	}
+	if got := store.users["pastGrace"].Subscription.SubscriptionStatus; got != db.StatusInactive {
+		t.Fatalf("Expected subscription past the grace period to be inactive, got: %s", got)
+	}
+
+	// A subscription is deactivated only once the grace period is over, not when it ends
+	boundary := expiredFor("boundary", s.GracePeriod).Subscription
+	if s.pastGracePeriod(boundary, now) {
+		t.Fatalf("Expected subscription at the end of the grace period to stay active")
+	}
+	if !s.pastGracePeriod(boundary, now.Add(time.Nanosecond)) {
+		t.Fatalf("Expected subscription just past the grace period to expire")
+	}
+}
+
+// blockingStore holds AllUsername until release is closed, keeping a run of a task in progress
+type blockingStore struct {
+	*fakeStore
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingStore) AllUsername(ctx context.Context) ([]string, error) {
+	close(b.started)
+	<-b.release
+	return b.fakeStore.AllUsername(ctx)
+}
+
+func TestOnDemandRunsSkipOverlappingRuns(t *testing.T) {
+	t.Setenv("RESET_STATE_FILE", filepath.Join(t.TempDir(), "last_reset_time.txt"))
+
+	t.Run("ScheduledRunInProgress", func(t *testing.T) {
+		store := newFakeStore(testUsers()...)
+		s := &Scheduler{cron: cron.New(), db: store}
+
+		started := make(chan struct{})
+		release := make(chan struct{})
+		s.RegisterTask(checkSubscriptions, "@daily", func() {
+			close(started)
+			<-release
+		})
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.tasks[0].Run()
+		}()
+		<-started
+
+		if _, err := s.CheckSubscriptions(); !errors.Is(err, ErrTaskRunning) {
+			t.Fatalf("Expected error: %v, got: %v", ErrTaskRunning, err)
+		}
+		if store.writes != 0 {
+			t.Fatalf("Expected no writes while the scheduled run is in progress, got: %d", store.writes)
+		}
+		close(release)
+		wg.Wait()
+
+		summary, err := s.CheckSubscriptions()
+		if err != nil || len(summary.Deactivated) != 1 {
+			t.Fatalf("Expected the check to run once the scheduled run finished: %v, got: %+v", err, summary)
+		}
+	})
+
+	t.Run("OnDemandRunInProgress", func(t *testing.T) {
+		store := &blockingStore{fakeStore: newFakeStore(testUsers()...), started: make(chan struct{}), release: make(chan struct{})}
+		s := &Scheduler{cron: cron.New(), db: store}
+
+		var scheduledRuns atomic.Int32
+		s.RegisterTask(resetTraffic, "@daily", func() { scheduledRuns.Add(1) })
+
+		var wg sync.WaitGroup
+		wg.Add(1)
+		var summary TrafficResetSummary
+		var err error
+		go func() {
+			defer wg.Done()
+			summary, err = s.ResetTraffic()
+		}()
+		<-store.started
+
+		// Both the scheduled run and a second on-demand run are skipped
+		s.tasks[0].Run()
+		if _, err := s.ResetTraffic(); !errors.Is(err, ErrTaskRunning) {
+			t.Fatalf("Expected error: %v, got: %v", ErrTaskRunning, err)
+		}
+		close(store.release)
+		wg.Wait()
+
+		if err != nil || len(summary.Reset) != len(testUsers()) {
+			t.Fatalf("Expected every user reset once: %v, got: %+v", err, summary)
+		}
+		if scheduledRuns.Load() != 0 {
+			t.Fatalf("Expected the scheduled run to be skipped, got: %d runs", scheduledRuns.Load())
+		}
+	})
+}
+
+func TestCheckAndUpdateSubscriptionsActiveOnly(t *testing.T) {
+	store := newFakeStore(testUsers()...)
+	s := &Scheduler{db: store, ActiveOnly: true}
+
+	summary := s.checkAndUpdateSubscriptions()
+
+	if len(summary.Activated) != 0 {
+		t.Fatalf("Expected inactive users to be skipped, got activated: %v", summary.Activated)
+	}
+	if len(summary.Deactivated) != 1 || summary.Deactivated[0] != "expired" {
+		t.Fatalf("Expected deactivated: [expired], got: %v", summary.Deactivated)
+	}
+	if got := store.users["paid"].Subscription.SubscriptionStatus; got != db.StatusInactive {
+		t.Fatalf("Expected status of paid user to stay inactive, got: %s", got)
+	}
+}
+
+func TestResetAllUserTrafficDryRun(t *testing.T) {
+	store := newFakeStore(testUsers()...)
+	s := &Scheduler{db: store, DryRun: true}
+
+	reset := s.resetAllUserTraffic()
+
+	if len(reset) != 3 {
+		t.Fatalf("Expected 3 users to be reset, got: %v", reset)
+	}
+	if store.writes != 0 {
+		t.Fatalf("Expected no writes in dry run, got: %d", store.writes)
+	}
+	if store.users["paid"].Traffic != 20 {
+		t.Fatalf("Expected traffic to be kept, got: %f", store.users["paid"].Traffic)
+	}
+}
+
+func TestRegisterTaskSkipsOverlappingRuns(t *testing.T) {
+	s := &Scheduler{cron: cron.New(), Jitter: time.Millisecond}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var runs, running, maxRunning atomic.Int32
+	s.RegisterTask("slow", "@weekly", func() {
+		runs.Add(1)
+		if n := running.Add(1); n > maxRunning.Load() {
+			maxRunning.Store(n)
+		}
+		defer running.Add(-1)
+		close(started)
+		<-release
+	})
+	task := s.tasks[0]
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		task.Run()
+	}()
+	<-started
+
+	// The first run is still going, so this one is skipped
+	task.Run()
+	close(release)
+	wg.Wait()
+
+	if runs.Load() != 1 || maxRunning.Load() != 1 {
+		t.Fatalf("Expected a single run, got: %d runs, %d at once", runs.Load(), maxRunning.Load())
+	}
+
+	// Once the previous run is done the task runs again
+	started = make(chan struct{})
+	release = make(chan struct{})
+	close(release)
+	task.Run()
+	if runs.Load() != 2 {
+		t.Fatalf("Expected the task to run again after the first run finished, got: %d runs", runs.Load())
+	}
+}
@@ -0,0 +1,129 @@
+package scheduler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/YuarenArt/tg-users-database/pkg/db"
+)
+
+// webhookRecorder is an HTTP server capturing the events posted to it
+type webhookRecorder struct {
+	mu       sync.Mutex
+	events   []Event
+	requests int
+	failures int // number of requests answered with 500 before succeeding
+}
+
+func (r *webhookRecorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests++
+	if r.failures > 0 {
+		r.failures--
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	var event Event
+	if err := json.NewDecoder(req.Body).Decode(&event); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	r.events = append(r.events, event)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func TestExpiredWebhook(t *testing.T) {
+	type testCase struct {
+		name         string
+		failures     int
+		wantRequests int
+		wantEvents   int
+	}
+
+	testCases := []testCase{
+		{name: "Delivered", failures: 0, wantRequests: 1, wantEvents: 1},
+		{name: "RetriedOnce", failures: 1, wantRequests: 2, wantEvents: 1},
+		{name: "GivesUp", failures: 5, wantRequests: 2, wantEvents: 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			recorder := &webhookRecorder{failures: tc.failures}
+			server := httptest.NewServer(recorder)
+			defer server.Close()
+
+			store := newFakeStore(db.User{
+				Username: "expired",
+				ChatID:   12345,
+				Subscription: db.Subscription{
+					SubscriptionStatus: db.StatusActive,
+					EndSubscription:    time.Now().Add(-time.Hour),
+				},
+			})
+			s := &Scheduler{db: store, notifiers: []Notifier{NewWebhookNotifier(server.URL)}}
+
+			summary := s.checkAndUpdateSubscriptions()
+			if len(summary.Deactivated) != 1 {
+				t.Fatalf("Expected 1 deactivated user, got: %v", summary.Deactivated)
+			}
+
+			if recorder.requests != tc.wantRequests {
+				t.Fatalf("Expected requests: %d, got: %d", tc.wantRequests, recorder.requests)
+			}
+			if len(recorder.events) != tc.wantEvents {
+				t.Fatalf("Expected events: %d, got: %d", tc.wantEvents, len(recorder.events))
+			}
+			if tc.wantEvents == 0 {
+				return
+			}
+
+			want := Event{Username: "expired", ChatID: 12345, Event: EventExpired}
+			if !reflect.DeepEqual(recorder.events[0], want) {
+				t.Fatalf("Expected event: %+v, got: %+v", want, recorder.events[0])
+			}
+		})
+	}
+}
+
+func TestExpiredWebhookSkippedInDryRun(t *testing.T) {
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	store := newFakeStore(testUsers()...)
+	s := &Scheduler{db: store, notifiers: []Notifier{NewWebhookNotifier(server.URL)}, DryRun: true}
+	s.checkAndUpdateSubscriptions()
+
+	if recorder.requests != 0 {
+		t.Fatalf("Expected no webhook requests in dry run, got: %d", recorder.requests)
+	}
+}
+
+func TestTrafficResetWebhook(t *testing.T) {
+	t.Setenv("RESET_STATE_FILE", filepath.Join(t.TempDir(), "last_reset_time.txt"))
+
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	store := newFakeStore(testUsers()...)
+	s := &Scheduler{db: store, notifiers: []Notifier{NewWebhookNotifier(server.URL)}}
+	s.ResetTraffic()
+
+	// One request for all users rather than one per user
+	if recorder.requests != 1 || len(recorder.events) != 1 {
+		t.Fatalf("Expected a single webhook request, got requests: %d, events: %+v", recorder.requests, recorder.events)
+	}
+	if event := recorder.events[0]; event.Event != EventTrafficReset || len(event.Users) != 3 {
+		t.Fatalf("Expected a traffic_reset event for 3 users, got: %+v", event)
+	}
+}
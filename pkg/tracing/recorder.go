@@ -0,0 +1,34 @@
+package tracing
+
+import "sync"
+
+// Recorder is an Exporter keeping ended spans in memory, for tests
+type Recorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// ExportSpan stores the span
+func (r *Recorder) ExportSpan(span *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, span)
+}
+
+// Spans returns the spans recorded so far in the order they ended
+func (r *Recorder) Spans() []*Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*Span(nil), r.spans...)
+}
+
+// Trace returns the recorded spans of the trace in the order they ended
+func (r *Recorder) Trace(traceID TraceID) []*Span {
+	var spans []*Span
+	for _, span := range r.Spans() {
+		if span.TraceID == traceID {
+			spans = append(spans, span)
+		}
+	}
+	return spans
+}
@@ -0,0 +1,210 @@
+// Package tracing records OpenTelemetry-compatible spans for requests and database calls.
+// Trace context is propagated with the W3C traceparent header and finished spans are handed to the
+// Exporter set with SetExporter. Without one, Start returns a nil *Span and tracing costs nothing.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceparentHeader is the W3C header carrying the trace context
+const TraceparentHeader = "traceparent"
+
+// TraceID identifies a trace
+type TraceID [16]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is not all zeros
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// SpanID identifies a span within a trace
+type SpanID [8]byte
+
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is not all zeros
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// SpanKind is the role of a span, numbered as in OTLP
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Exporter receives spans once they have ended. ExportSpan must not block.
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+// exporterHolder lets atomic.Value store a nil Exporter
+type exporterHolder struct{ exporter Exporter }
+
+var globalExporter atomic.Value
+
+// SetExporter sets the exporter of all spans started afterwards. A nil exporter turns tracing off.
+func SetExporter(exporter Exporter) {
+	globalExporter.Store(exporterHolder{exporter: exporter})
+}
+
+func currentExporter() Exporter {
+	holder, _ := globalExporter.Load().(exporterHolder)
+	return holder.exporter
+}
+
+// Span is a timed operation within a trace. All methods are safe to call on a nil *Span.
+type Span struct {
+	mu sync.Mutex
+
+	Name         string
+	Kind         SpanKind
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]any
+	// Error is the message of the error recorded on the span, empty if it succeeded
+	Error string
+
+	exporter Exporter
+	ended    bool
+}
+
+// SetName renames the span, e.g. once the route of a request is known
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Name = name
+}
+
+// SetAttribute sets an attribute of the span. Values should be strings, bools, integers or floats.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// RecordError marks the span as failed with err. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Error = err.Error()
+}
+
+// End finishes the span and hands it to the exporter. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	s.exporter.ExportSpan(s)
+}
+
+// Traceparent returns the span's context formatted as a traceparent header value
+func (s *Span) Traceparent() string {
+	if s == nil {
+		return ""
+	}
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// spanContext is the parent of a new span, either a local span or one received in a traceparent header
+type spanContext struct {
+	traceID TraceID
+	spanID  SpanID
+}
+
+type spanKey struct{}
+type remoteKey struct{}
+
+// SpanFromContext returns the span stored in ctx by Start, or nil
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// Start starts a span as a child of the span in ctx or, failing that, of the remote parent set by Extract.
+// The returned context carries the new span. Without an exporter it returns ctx and a nil *Span.
+func Start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	exporter := currentExporter()
+	if exporter == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: map[string]any{},
+		exporter:   exporter,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID, span.ParentSpanID = parent.TraceID, parent.SpanID
+	} else if remote, ok := ctx.Value(remoteKey{}).(spanContext); ok {
+		span.TraceID, span.ParentSpanID = remote.traceID, remote.spanID
+	} else {
+		rand.Read(span.TraceID[:])
+	}
+	rand.Read(span.SpanID[:])
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// Extract returns ctx with the remote parent from a traceparent header value.
+// Invalid values are ignored, so the next span starts a new trace.
+func Extract(ctx context.Context, traceparent string) context.Context {
+	remote, ok := parseTraceparent(traceparent)
+	if !ok {
+		return ctx
+	}
+	return context.WithValue(ctx, remoteKey{}, remote)
+}
+
+// parseTraceparent parses "version-traceid-spanid-flags" as defined by W3C Trace Context
+func parseTraceparent(value string) (spanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return spanContext{}, false
+	}
+	// Version 00 has exactly four fields, later versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return spanContext{}, false
+	}
+
+	var sc spanContext
+	if _, err := hex.Decode(sc.traceID[:], []byte(parts[1])); err != nil || !sc.traceID.IsValid() {
+		return spanContext{}, false
+	}
+	if _, err := hex.Decode(sc.spanID[:], []byte(parts[2])); err != nil || !sc.spanID.IsValid() {
+		return spanContext{}, false
+	}
+	return sc, true
+}
@@ -0,0 +1,166 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStartWithoutExporter(t *testing.T) {
+	SetExporter(nil)
+
+	ctx, span := Start(context.Background(), "noop", SpanKindInternal)
+	if span != nil || SpanFromContext(ctx) != nil {
+		t.Fatalf("Expected no span without an exporter, got: %v", span)
+	}
+
+	// Every method is a no-op on the nil span
+	span.SetName("renamed")
+	span.SetAttribute("key", "value")
+	span.RecordError(errors.New("failed"))
+	span.End()
+}
+
+func TestSpanParents(t *testing.T) {
+	recorder := &Recorder{}
+	SetExporter(recorder)
+	t.Cleanup(func() { SetExporter(nil) })
+
+	ctx := Extract(context.Background(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, root := Start(ctx, "root", SpanKindServer)
+	_, child := Start(ctx, "child", SpanKindClient)
+	child.End()
+	root.End()
+	root.End()
+
+	spans := recorder.Spans()
+	if len(spans) != 2 || spans[0] != child || spans[1] != root {
+		t.Fatalf("Expected the child and the root span once each, got: %v", spans)
+	}
+	if got := root.TraceID.String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Fatalf("Expected the trace ID of the traceparent header, got: %s", got)
+	}
+	if got := root.ParentSpanID.String(); got != "00f067aa0ba902b7" {
+		t.Fatalf("Expected the span ID of the traceparent header as parent, got: %s", got)
+	}
+	if child.TraceID != root.TraceID || child.ParentSpanID != root.SpanID {
+		t.Fatalf("Expected child of %s, got trace %s parent %s", root.SpanID, child.TraceID, child.ParentSpanID)
+	}
+	if got := len(recorder.Trace(root.TraceID)); got != 2 {
+		t.Fatalf("Expected 2 spans in the trace, got: %d", got)
+	}
+
+	// Without a parent a new trace is started
+	_, other := Start(context.Background(), "other", SpanKindInternal)
+	if !other.TraceID.IsValid() || other.TraceID == root.TraceID || other.ParentSpanID.IsValid() {
+		t.Fatalf("Expected a new trace without parent, got: %s %s", other.TraceID, other.ParentSpanID)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	testCases := []struct {
+		value string
+		valid bool
+	}{
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", valid: true},
+		{value: "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", valid: true},
+		{value: ""},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"},
+		{value: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{value: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01"},
+		{value: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"},
+	}
+
+	for _, tc := range testCases {
+		if _, valid := parseTraceparent(tc.value); valid != tc.valid {
+			t.Fatalf("Expected %q valid: %v, got: %v", tc.value, tc.valid, valid)
+		}
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan otlpRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var request otlpRequest
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || json.Unmarshal(body, &request) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- request
+	}))
+	defer server.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", server.URL+"/")
+	t.Setenv("OTEL_SERVICE_NAME", "test-service")
+	exporter, err := ExporterFromEnv(nil)
+	if err != nil || exporter == nil {
+		t.Fatalf("Failed to create exporter: %v", err)
+	}
+
+	SetExporter(exporter)
+	t.Cleanup(func() { SetExporter(nil) })
+
+	ctx, span := Start(context.Background(), "db.User", SpanKindClient)
+	span.SetAttribute("db.operation", "SELECT")
+	span.SetAttribute("rows", 3)
+	span.RecordError(errors.New("connection reset"))
+	span.End()
+	_, sibling := Start(ctx, "db.AllUsername", SpanKindClient)
+	sibling.End()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := exporter.Shutdown(ctx); err != nil {
+		t.Fatalf("Failed to shut down exporter: %v", err)
+	}
+
+	request := <-received
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("Expected one resource and scope, got: %+v", request)
+	}
+	resource := request.ResourceSpans[0]
+	if attr := resource.Resource.Attributes; len(attr) != 1 || attr[0].Key != "service.name" || attr[0].Value["stringValue"] != "test-service" {
+		t.Fatalf("Expected service.name test-service, got: %+v", attr)
+	}
+	spans := resource.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got: %+v", spans)
+	}
+	first := spans[0]
+	if first.Name != "db.User" || first.Kind != SpanKindClient || first.TraceID != span.TraceID.String() || first.SpanID != span.SpanID.String() {
+		t.Fatalf("Expected span db.User, got: %+v", first)
+	}
+	if first.Status == nil || first.Status.Code != statusCodeError || first.Status.Message != "connection reset" {
+		t.Fatalf("Expected error status, got: %+v", first.Status)
+	}
+	if spans[1].ParentSpanID != first.SpanID {
+		t.Fatalf("Expected parent %s, got: %s", first.SpanID, spans[1].ParentSpanID)
+	}
+	attributes := map[string]map[string]any{}
+	for _, attr := range first.Attributes {
+		attributes[attr.Key] = attr.Value
+	}
+	if attributes["db.operation"]["stringValue"] != "SELECT" || attributes["rows"]["intValue"] != "3" {
+		t.Fatalf("Expected db.operation and rows attributes, got: %v", attributes)
+	}
+}
+
+func TestExporterFromEnv(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	if exporter, err := ExporterFromEnv(nil); exporter != nil || err != nil {
+		t.Fatalf("Expected no exporter without an endpoint: %v, got: %v", err, exporter)
+	}
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "collector:4318")
+	if _, err := ExporterFromEnv(nil); err == nil {
+		t.Fatalf("Expected an error for an endpoint without scheme")
+	}
+}